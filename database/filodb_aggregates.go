@@ -23,33 +23,61 @@ func RegisterAggregateCommands(commands map[string]Command) {
 	commands["scan"] = HandleTableScan   // New working scan command
 }
 
-// Helper function to get all records from a table using the same method as GET command
-func getAllRecords(db *DB, tableName string) ([]*Record, error) {
-	var kvReader KVReader
-	db.kv.BeginRead(&kvReader)
-	defer db.kv.EndRead(&kvReader)
+// Helper function to get all records from a table using the same method as GET command.
+// the rows are read with the caller's reader, the one its definition came from; a view
+// runs its query instead
+func getAllRecords(db *DB, tableName string, reader *KVReader) ([]*Record, error) {
+	return db.QueryRows(tableName, reader)
+}
 
-	tdef := GetTableDef(db, tableName, &kvReader.Tree)
-	if tdef == nil {
-		return nil, fmt.Errorf("table '%s' not found", tableName)
+// the records with a value in the column `colIndex`, the aggregates ignore NULLs
+func nonNullRecords(results []*Record, colIndex int) []*Record {
+	out := results[:0:0]
+	for _, record := range results {
+		if !record.Vals[colIndex].Null {
+			out = append(out, record)
+		}
 	}
-
-	// Use fullTableScan directly - this is the actual function that QueryWithFilter calls internally
-	// This avoids the empty filter issue since fullTableScan doesn't require any filter
-	results, err := fullTableScan(db, tableName, tdef)
-	return results, err
+	return out
 }
 
 // HandleCount - Count records in a table
 func HandleCount(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
+
+	fmt.Print("Enter column name for COUNT (leave empty to count rows): ")
+	columnInput, _ := scanner.ReadString('\n')
+	columnName := strings.TrimSpace(columnInput)
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	colIndex := -1
+	if columnName != "" {
+		if colIndex = ColIndex(tdef, columnName); colIndex < 0 {
+			fmt.Printf("Column '%s' not found.\n", columnName)
+			return
+		}
+	}
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
+	if colIndex >= 0 {
+		// COUNT(col) counts the values, not the NULLs
+		results = nonNullRecords(results, colIndex)
+	}
 
 	count := int64(len(results))
 
@@ -57,13 +85,18 @@ func HandleCount(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	fmt.Printf("COUNT RESULT\n")
 	fmt.Println(strings.Repeat("=", 50))
 	fmt.Printf("Table: %s\n", tableName)
-	fmt.Printf("Count: %d\n", count)
+	if columnName != "" {
+		fmt.Printf("COUNT(%s): %d\n", columnName, count)
+	} else {
+		fmt.Printf("Count: %d\n", count)
+	}
 	fmt.Println(strings.Repeat("=", 50))
 }
 
 // HandleSum - Sum numeric values in a column
 func HandleSum(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
 
 	fmt.Print("Enter column name for SUM: ")
 	columnInput, _ := scanner.ReadString('\n')
@@ -74,9 +107,9 @@ func HandleSum(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	db.kv.BeginRead(&reader)
 	defer db.kv.EndRead(&reader)
 
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -92,11 +125,12 @@ func HandleSum(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
+	results = nonNullRecords(results, colIndex)
 
 	var sum float64 = 0 // Use float64 to handle both INT64 and FLOAT64
 	count := int64(len(results))
@@ -126,6 +160,7 @@ func HandleSum(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 // HandleAvg - Calculate average of numeric values
 func HandleAvg(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
 
 	fmt.Print("Enter column name for AVG: ")
 	columnInput, _ := scanner.ReadString('\n')
@@ -135,9 +170,9 @@ func HandleAvg(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	db.kv.BeginRead(&reader)
 	defer db.kv.EndRead(&reader)
 
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -153,11 +188,12 @@ func HandleAvg(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
+	results = nonNullRecords(results, colIndex)
 
 	count := int64(len(results))
 	if count == 0 {
@@ -195,6 +231,7 @@ func HandleAvg(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 // HandleMin - Find minimum value in a column
 func HandleMin(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
 
 	fmt.Print("Enter column name for MIN: ")
 	columnInput, _ := scanner.ReadString('\n')
@@ -204,9 +241,9 @@ func HandleMin(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	db.kv.BeginRead(&reader)
 	defer db.kv.EndRead(&reader)
 
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -217,11 +254,12 @@ func HandleMin(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error scanning table: %v\n", err)
 		return
 	}
+	results = nonNullRecords(results, colIndex)
 
 	count := int64(len(results))
 	if count == 0 {
@@ -312,6 +350,7 @@ func HandleMin(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 // HandleMax - Find maximum value in a column
 func HandleMax(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
 
 	fmt.Print("Enter column name for MAX: ")
 	columnInput, _ := scanner.ReadString('\n')
@@ -321,9 +360,9 @@ func HandleMax(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	db.kv.BeginRead(&reader)
 	defer db.kv.EndRead(&reader)
 
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -334,11 +373,12 @@ func HandleMax(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	}
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error scanning table: %v\n", err)
 		return
 	}
+	results = nonNullRecords(results, colIndex)
 
 	count := int64(len(results))
 	if count == 0 {
@@ -429,9 +469,14 @@ func HandleMax(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 // HandleTableScan - Shows all records in a table (debugging/verification)
 func HandleTableScan(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
 
 	// Use the SAME table scanning approach as the working GET command
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -454,15 +499,16 @@ func HandleTableScan(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 // HandleDebugTable - Debug function to check table structure
 func HandleDebugTable(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	tableName := helper.GetTableName(scanner)
+	db, tableName = db.resolve(tableName)
 
 	// Get table definition first to show structure
 	var reader KVReader
 	db.kv.BeginRead(&reader)
 	defer db.kv.EndRead(&reader)
 
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	if tdef == nil {
-		fmt.Printf("Table '%s' not found.\n", tableName)
+	tdef, err := db.QueryDef(tableName, &reader.Tree)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -470,10 +516,14 @@ func HandleDebugTable(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	fmt.Printf("DEBUG TABLE INFO: %s\n", tableName)
 	fmt.Println(strings.Repeat("=", 50))
 	fmt.Printf("Columns: %v\n", tdef.Cols)
-	fmt.Printf("Types: %v (1=INT64, 2=BYTES)\n", tdef.Types)
+	types := make([]string, len(tdef.Types))
+	for i, typ := range tdef.Types {
+		types[i] = typeName(typ)
+	}
+	fmt.Printf("Types: %v\n", types)
 
 	// Now test the new scanning approach
-	results, err := getAllRecords(db, tableName)
+	results, err := getAllRecords(db, tableName, &reader)
 	if err != nil {
 		fmt.Printf("Error with table scan: %v\n", err)
 	} else {
@@ -0,0 +1,431 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrAliasExists   = errors.New("alias is already attached")
+	ErrAliasNotFound = errors.New("no database attached under alias")
+	ErrAttachedInUse = errors.New("attached database is used by an open transaction")
+)
+
+// Attach opens another FiloDB file under `alias`. Its tables are named
+// `alias.table`, and a transaction touching several files commits
+// atomically on all of them.
+func (db *DB) Attach(alias, path string) error {
+	if !isValidTableName(alias) {
+		return fmt.Errorf("invalid alias: %q", alias)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	schema := getSchema(db, alias, &reader.Tree)
+	db.kv.EndRead(&reader)
+	if schema != nil {
+		return fmt.Errorf("%w: %s is a schema", ErrAliasExists, alias)
+	}
+	db.attachMu.Lock()
+	defer db.attachMu.Unlock()
+	if _, ok := db.attached[alias]; ok {
+		return fmt.Errorf("%w: %s", ErrAliasExists, alias)
+	}
+	for _, other := range append(db.attachedList(), db) {
+		if same, _ := filepath.Abs(other.Path); same == abs {
+			return fmt.Errorf("%s is already open", path)
+		}
+	}
+
+	attached := &DB{
+		Path:   abs,
+		kv:     *newKV(abs),
+		tables: make(map[string]*TableDef),
+		pool:   db.pool,
+		limits: db.Limits(),
+	}
+	if err := attached.kv.Open(); err != nil {
+		return err
+	}
+	if err := initializeInternalTables(attached); err != nil {
+		attached.kv.Close()
+		return err
+	}
+	if db.attached == nil {
+		db.attached = map[string]*DB{}
+	}
+	db.attached[alias] = attached
+	return nil
+}
+
+// Detach closes an attached database, it must not be used by an open transaction.
+func (db *DB) Detach(alias string) error {
+	db.attachMu.Lock()
+	defer db.attachMu.Unlock()
+	attached, ok := db.attached[alias]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAliasNotFound, alias)
+	}
+	attached.txMu.Lock()
+	inUse := len(attached.txs) > 0
+	attached.txMu.Unlock()
+	if inUse {
+		return fmt.Errorf("%w: %s", ErrAttachedInUse, alias)
+	}
+	delete(db.attached, alias)
+	attached.kv.Close()
+	return nil
+}
+
+// close the attached databases on shutdown
+func (db *DB) closeAttached() {
+	db.attachMu.Lock()
+	defer db.attachMu.Unlock()
+	for alias, attached := range db.attached {
+		attached.kv.Close()
+		delete(db.attached, alias)
+	}
+}
+
+// Attached returns the paths of the attached databases by alias.
+func (db *DB) Attached() map[string]string {
+	db.attachMu.Lock()
+	defer db.attachMu.Unlock()
+	paths := map[string]string{}
+	for alias, attached := range db.attached {
+		paths[alias] = attached.Path
+	}
+	return paths
+}
+
+// the caller holds `db.attachMu`
+func (db *DB) attachedList() []*DB {
+	var out []*DB
+	for _, attached := range db.attached {
+		out = append(out, attached)
+	}
+	return out
+}
+
+// the database holding `table` and the table name within it
+func (db *DB) resolve(table string) (*DB, string) {
+	alias, name, ok := strings.Cut(table, ".")
+	if !ok {
+		return db, table
+	}
+	db.attachMu.Lock()
+	defer db.attachMu.Unlock()
+	if attached, ok := db.attached[alias]; ok {
+		return attached, name
+	}
+	return db, table
+}
+
+// the part of the transaction running on the database holding `table`,
+// started on first use. the caller holds `tx.mu`.
+func (tx *DBTX) route(table string) (*DBTX, string) {
+	target, name := tx.db.resolve(table)
+	if target == tx.db {
+		return tx, table
+	}
+	alias, _, _ := strings.Cut(table, ".")
+	part := tx.attached[alias]
+	if part == nil {
+		part = &DBTX{}
+		target.Begin(part)
+		// the reaper flags the statements of `tx`
+		part.kv.Tree.interrupt = tx.interrupted
+		// the age decides the deadlock victim
+		target.txMu.Lock()
+		part.started = tx.started
+		target.txMu.Unlock()
+		if tx.attached == nil {
+			tx.attached = map[string]*DBTX{}
+		}
+		tx.attached[alias] = part
+	}
+	return part, name
+}
+
+// commit a transaction and its parts on attached databases. with more
+// than one file changed, it is a two-phase commit: every file writes
+// its pages first, then the new master pages are recorded in the
+// coordinator log, which is the commit point, and written last. each
+// file names the log until then, so it is rolled forward when opened
+// on its own.
+func (db *DB) commitParts(tx *DBTX) error {
+	parts := []*DBTX{tx}
+	aliases := make([]string, 0, len(tx.attached))
+	for alias := range tx.attached {
+		aliases = append(aliases, alias)
+	}
+	// the writers are always locked in the same order
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		parts = append(parts, tx.attached[alias])
+	}
+
+	// phase 1: prepare
+	writers := make([]*KVTX, 0, len(parts))
+	for _, part := range parts {
+		if len(part.log) == 0 {
+			continue
+		}
+		writer := &KVTX{}
+		changed, err := part.db.replay(part, writer)
+		if err != nil {
+			for _, prepared := range writers {
+				rollbackTX(prepared)
+				prepared.kv.Abort(prepared)
+			}
+			return err
+		}
+		if changed {
+			writers = append(writers, writer)
+		}
+	}
+	if len(writers) > 1 {
+		if err := writeCommitLog(db.Path, writers); err != nil {
+			for _, prepared := range writers {
+				rollbackTX(prepared)
+				prepared.kv.Abort(prepared)
+			}
+			return err
+		}
+	}
+
+	// phase 2: the decision is durable, publish the master pages
+	var err error
+	for _, writer := range writers {
+		writer.kv.publish(writer)
+		if serr := writer.kv.storeMaster(); serr != nil && err == nil {
+			err = serr
+		}
+		writer.kv.Abort(writer) // unlocks the writer
+	}
+	if len(writers) > 1 && err == nil {
+		// every file has its master page, the log is no longer needed
+		err = os.Remove(commitLogPath(db.Path))
+		for _, writer := range writers {
+			if rerr := os.Remove(preparedPath(writer.kv.Path)); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+	return err
+}
+
+// The coordinator log format.
+// | sig | nfiles | files... | checksum |
+// | 8B  |   4B   |          |    4B    |
+// each file is | path len | path | old len | old master | master len | master |
+//              |    2B    |      |   2B    |            |     2B     |        |
+// the checksum covers everything before it. the old master page is the
+// one on disk before the commit, the logged one replaces only that.
+
+const COMMIT_LOG_SIG = "FILO2PC\x01"
+
+func commitLogPath(path string) string {
+	return path + "-2pc"
+}
+
+// a file taking part in a two-phase commit holds the path of the
+// coordinator log here until its master page is written
+func preparedPath(path string) string {
+	return path + "-2pc-prepared"
+}
+
+func writeCommitLog(path string, writers []*KVTX) error {
+	logPath, err := filepath.Abs(commitLogPath(path))
+	if err != nil {
+		return err
+	}
+	data := []byte(COMMIT_LOG_SIG)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(writers)))
+	for _, writer := range writers {
+		file, err := filepath.Abs(writer.kv.Path)
+		if err != nil {
+			return err
+		}
+		old, err := readMaster(writer.kv.fp)
+		if err != nil {
+			return fmt.Errorf("coordinator log: %w", err)
+		}
+		master := writer.master.encode()
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(file)))
+		data = append(data, file...)
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(old)))
+		data = append(data, old...)
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(master)))
+		data = append(data, master...)
+		// named before the commit point
+		if err := writeSynced(preparedPath(writer.kv.Path), []byte(logPath)); err != nil {
+			return fmt.Errorf("coordinator log: %w", err)
+		}
+	}
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	if err := writeSynced(commitLogPath(path), data); err != nil {
+		return fmt.Errorf("coordinator log: %w", err)
+	}
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err := fp.Write(data); err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// the master page on disk, empty for a new file
+func readMaster(fp *os.File) ([]byte, error) {
+	data := make([]byte, BTREE_PAGE_SIZE)
+	n, err := fp.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n < MASTER_HEADER {
+		return nil, nil
+	}
+	nhistory := min(int(binary.LittleEndian.Uint32(data[40:])), MAX_HISTORY)
+	return data[:min(MASTER_HEADER+nhistory*24, n)], nil
+}
+
+// finish a two-phase commit interrupted after its commit point by
+// writing the logged master pages that didn't make it to disk. an
+// incomplete log is from a commit that never reached that point.
+func recoverCommitLog(path string) error {
+	data, err := os.ReadFile(commitLogPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("coordinator log: %w", err)
+	}
+	files, ok := parseCommitLog(data)
+	if ok {
+		for file, masters := range files {
+			if err := recoverMaster(file, masters); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(commitLogPath(path))
+}
+
+// finish the two-phase commit a file took part in when it is opened
+// before the coordinator. its master page is written if the log
+// reached the commit point.
+func recoverPrepared(path string) error {
+	logPath, err := os.ReadFile(preparedPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("coordinator log: %w", err)
+	}
+	data, err := os.ReadFile(string(logPath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("coordinator log: %w", err)
+	}
+	// no log: the commit either never reached its commit point or was
+	// completed and the log removed
+	if files, ok := parseCommitLog(data); ok {
+		file, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if masters, ok := files[file]; ok {
+			if err := recoverMaster(file, masters); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(preparedPath(path))
+}
+
+// the master pages of a file before and after a logged commit
+type loggedMasters struct {
+	old    []byte
+	master []byte
+}
+
+func parseCommitLog(data []byte) (map[string]loggedMasters, bool) {
+	if len(data) < len(COMMIT_LOG_SIG)+8 || string(data[:len(COMMIT_LOG_SIG)]) != COMMIT_LOG_SIG {
+		return nil, false
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, false
+	}
+	n := binary.LittleEndian.Uint32(body[len(COMMIT_LOG_SIG):])
+	rest := body[len(COMMIT_LOG_SIG)+4:]
+	files := map[string]loggedMasters{}
+	next := func() []byte {
+		if len(rest) < 2 {
+			return nil
+		}
+		size := int(binary.LittleEndian.Uint16(rest))
+		if len(rest) < 2+size {
+			return nil
+		}
+		out := rest[2 : 2+size]
+		rest = rest[2+size:]
+		return out
+	}
+	for i := uint32(0); i < n; i++ {
+		file, old, master := next(), next(), next()
+		if len(file) == 0 || old == nil || len(master) < MASTER_HEADER {
+			return nil, false
+		}
+		files[string(file)] = loggedMasters{old: old, master: master}
+	}
+	return files, true
+}
+
+// write a logged master page over the one it replaces. the file may
+// have it already, or have committed on its own since.
+func recoverMaster(path string, masters loggedMasters) error {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("recover %s: %w", path, err)
+	}
+	defer fp.Close()
+	current, err := readMaster(fp)
+	if err != nil {
+		return fmt.Errorf("recover %s: %w", path, err)
+	}
+	switch {
+	case bytes.Equal(current, masters.master):
+		return nil // written before the interruption
+	case !bytes.Equal(current, masters.old):
+		// the logged page is stale
+		log.Printf("recover %s: the master page was replaced, not rolling forward", path)
+		return nil
+	}
+	if _, err := fp.WriteAt(masters.master, 0); err != nil {
+		return fmt.Errorf("recover %s: %w", path, err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
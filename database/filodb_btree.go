@@ -30,9 +30,19 @@ type BTree struct {
 	// a pointer (a non-zero page number)
 	root uint64
 	// callbacks for managing on-disk pages
-	get func(uint64) BNode // dereference the page number (pointer)
-	new func(BNode) uint64 // create a new page
-	del func(uint64)       // de-allocate the page
+	get  func(uint64) BNode // dereference the page number (pointer)
+	new  func(BNode) uint64 // create a new page
+	del  func(uint64)       // de-allocate the page
+	free func(uint64)       // de-allocate the subtree under the page
+	// why the statement reading the tree must stop, nil if it may go on
+	interrupt func() error
+}
+
+func (tree *BTree) interrupted() error {
+	if tree.interrupt == nil {
+		return nil
+	}
+	return tree.interrupt()
 }
 
 func (tree *BTree) Insert(key, val []byte) error {
@@ -79,12 +89,41 @@ func (tree *BTree) Delete(key []byte) bool {
 	if tree.root == 0 {
 		return false
 	}
+	if _, ok, _ := tree.Get(key); !ok {
+		return false
+	}
+	// pages are released top-down, a page shared with a snapshot
+	// must be released before its children (see `KVTX.pageDel`)
+	root := tree.get(tree.root)
+	tree.del(tree.root)
 	// Gives the new updated node after deleting the key
-	updated := treeDelete(tree, tree.get(tree.root), key)
-	if len(updated.data) == 0 {
+	updated := treeDelete(tree, root, key)
+	if updated.bNodeType() == BNODE_INODE && updated.nKeys() == 1 {
+		tree.root = updated.getPtr(0)
+	} else {
+		tree.root = tree.new(updated)
+	}
+	return true
+}
+
+// DeleteRange removes the keys in [start, end). the subtrees inside the
+// range are released whole, only the nodes at its edges are rewritten.
+func (tree *BTree) DeleteRange(start, end []byte) bool {
+	assert(len(start) != 0)
+	assert(bytes.Compare(start, end) < 0)
+	if tree.root == 0 {
+		return false
+	}
+	iter := tree.Seek(start, CMP_GE)
+	if !iter.Valid() {
+		return false
+	}
+	if key, _ := iter.Deref(); bytes.Compare(key, end) >= 0 {
 		return false
 	}
+	root := tree.get(tree.root)
 	tree.del(tree.root)
+	updated := treeDeleteRange(tree, root, nil, start, end)
 	if updated.bNodeType() == BNODE_INODE && updated.nKeys() == 1 {
 		tree.root = updated.getPtr(0)
 	} else {
@@ -283,19 +322,42 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	right := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(left, right, old)
 	if left.nbytes() <= BTREE_PAGE_SIZE {
+		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right}
 	}
 	leftLeft := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(leftLeft, middle, left)
 	assertWithSrc(leftLeft.nbytes() <= BTREE_PAGE_SIZE, "Failed in nodeSplit3")
-	return 3, [3]BNode{left, middle, right}
+	return 3, [3]BNode{leftLeft, middle, right}
 }
 
+// split an oversized node so that the right half fits on a page,
+// the left half may still be too big and is split again by the caller.
 func nodeSplit2(left, right, old BNode) {
-	midIndex := old.nKeys() / 2
-	nodeAppendRange(left, old, 0, 0, midIndex)
-	nodeAppendRange(right, old, 0, midIndex, old.nKeys()-1)
+	assertWithSrc(old.nKeys() >= 2, "Failed in nodeSplit2")
+	nleft := old.nKeys() / 2
+	leftBytes := func() uint16 {
+		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+	}
+	for leftBytes() > BTREE_PAGE_SIZE {
+		nleft--
+	}
+	assertWithSrc(nleft >= 1, "Failed in nodeSplit2")
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	for rightBytes() > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	assertWithSrc(nleft < old.nKeys(), "Failed in nodeSplit2")
+	nright := old.nKeys() - nleft
+
+	left.setHeader(old.bNodeType(), nleft)
+	right.setHeader(old.bNodeType(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	assertWithSrc(right.nbytes() <= BTREE_PAGE_SIZE, "Failed in nodeSplit2")
 }
 
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
@@ -381,9 +443,8 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 
 	switch node.bNodeType() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{}
-		}
+		// the caller checked that the key exists
+		assertWithSrc(bytes.Equal(key, node.getKey(idx)), "Failed in treeDelete")
 		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		leafDelete(new, node, idx)
 		return new
@@ -396,11 +457,10 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 
 func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kptr), key)
-	if len(updated.data) == 0 {
-		return BNode{}
-	}
+	knode := tree.get(kptr)
 	tree.del(kptr)
+	updated := treeDelete(tree, knode, key)
+	assertWithSrc(len(updated.data) != 0, "Failed in nodeDelete")
 
 	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
@@ -412,7 +472,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: // right
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
+		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0:
@@ -457,6 +517,86 @@ func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode
 	return 0, BNode{}
 }
 
+// B-Tree Range Deletion
+
+// a child of a node rewritten by a range delete, either the page it
+// had or a new node not allocated yet
+type rangeKid struct {
+	key  []byte
+	ptr  uint64
+	node BNode
+}
+
+// remove the keys in [start, end) from a node whose keys are below `hi`,
+// nil if unbounded. the result may be empty or underfull.
+func treeDeleteRange(tree *BTree, node BNode, hi, start, end []byte) BNode {
+	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	if node.bNodeType() == BNODE_LEAF {
+		// the keys in the range are a run, the dummy key is never in it
+		lo, up := node.nKeys(), node.nKeys()
+		for i := node.nKeys(); i > 0; i-- {
+			key := node.getKey(i - 1)
+			if bytes.Compare(key, end) >= 0 {
+				up = i - 1
+			}
+			if bytes.Compare(key, start) >= 0 {
+				lo = i - 1
+			}
+		}
+		new.setHeader(BNODE_LEAF, node.nKeys()-(up-lo))
+		nodeAppendRange(new, node, 0, 0, lo)
+		nodeAppendRange(new, node, lo, up, node.nKeys()-up)
+		return new
+	}
+
+	var kids []rangeKid
+	for i := uint16(0); i < node.nKeys(); i++ {
+		kid := rangeKid{key: node.getKey(i), ptr: node.getPtr(i)}
+		kidHi := hi
+		if i+1 < node.nKeys() {
+			kidHi = node.getKey(i + 1)
+		}
+		switch {
+		case kidHi != nil && bytes.Compare(kidHi, start) <= 0, bytes.Compare(kid.key, end) >= 0:
+			kids = append(kids, kid) // outside the range
+		case bytes.Compare(kid.key, start) >= 0 && kidHi != nil && bytes.Compare(kidHi, end) <= 0:
+			tree.free(kid.ptr) // inside the range
+		default:
+			knode := tree.get(kid.ptr)
+			tree.del(kid.ptr)
+			kid.ptr, kid.node = 0, treeDeleteRange(tree, knode, kidHi, start, end)
+			if kid.node.nKeys() == 0 {
+				continue
+			}
+			// the parent key stays a lower bound, and never grows the node
+			if n := len(kids); n > 0 && kid.node.nbytes() <= BTREE_PAGE_SIZE/4 {
+				left := kids[n-1].node
+				if left.data == nil {
+					left = tree.get(kids[n-1].ptr)
+				}
+				if left.nbytes()+kid.node.nbytes()-HEADER <= BTREE_PAGE_SIZE {
+					if kids[n-1].node.data == nil {
+						tree.del(kids[n-1].ptr)
+					}
+					merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+					nodeMerge(merged, left, kid.node)
+					kids[n-1] = rangeKid{key: kids[n-1].key, node: merged}
+					continue
+				}
+			}
+			kids = append(kids, kid)
+		}
+	}
+	new.setHeader(BNODE_INODE, uint16(len(kids)))
+	for i, kid := range kids {
+		if kid.node.data != nil {
+			kid.ptr = tree.new(kid.node)
+		}
+		nodeAppendKV(new, uint16(i), kid.ptr, kid.key, nil)
+	}
+	return new
+}
+
 func assert(condition bool) {
 	if !condition {
 		panic("assertion failed")
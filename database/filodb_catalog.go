@@ -0,0 +1,130 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// the size of the keys under a prefix: a table's rows, or an index
+type KeyStats struct {
+	Prefix uint32
+	Keys   int
+	Pages  int // the leaves the keys span, the shared ones included
+}
+
+// the sizes of a table and of its indexes, in the order of tdef.Indexes
+type TableStats struct {
+	Rows    KeyStats
+	Indexes []KeyStats
+}
+
+// the keys read from the leaves to estimate the keys of a prefix
+const STATS_SAMPLE = 16
+
+// estimated on a snapshot without walking the keys: the leaves the keys
+// span are listed by the nodes above them, and the keys per leaf are
+// counted on a sample of them, exact for a small prefix. the rows
+// expired or written by open transactions are counted as they are stored.
+func prefixStats(tree *BTree, prefix uint32) KeyStats {
+	stats := KeyStats{Prefix: prefix}
+	if tree.root == 0 {
+		return stats
+	}
+	start, end := prefixRange(prefix)
+	count := func(ptr uint64) int {
+		node, n := tree.get(ptr), 0
+		for i := uint16(0); i < node.nKeys(); i++ {
+			key := node.getKey(i)
+			if bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the leaves are at the same depth
+	height := 1
+	for node := tree.get(tree.root); node.bNodeType() == BNODE_INODE; node = tree.get(node.getPtr(0)) {
+		height++
+	}
+	var leaves []uint64
+	var walk func(node BNode, height int)
+	walk = func(node BNode, height int) {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			if i+1 < node.nKeys() && bytes.Compare(node.getKey(i+1), start) <= 0 {
+				continue // before the prefix
+			}
+			if bytes.Compare(node.getKey(i), end) >= 0 {
+				break
+			}
+			if height == 2 {
+				leaves = append(leaves, node.getPtr(i))
+			} else {
+				walk(tree.get(node.getPtr(i)), height-1)
+			}
+		}
+	}
+	if height == 1 {
+		leaves = []uint64{tree.root}
+	} else {
+		walk(tree.get(tree.root), height)
+	}
+	if len(leaves) == 0 {
+		return stats
+	}
+
+	// the first and the last leaf may hold other keys, or none of the
+	// prefix. the ones in between hold only keys of the prefix.
+	for _, ptr := range []uint64{leaves[0], leaves[len(leaves)-1]}[:min(len(leaves), 2)] {
+		if n := count(ptr); n > 0 {
+			stats.Keys += n
+			stats.Pages++
+		}
+	}
+	if len(leaves) <= 2 {
+		return stats
+	}
+	inner := leaves[1 : len(leaves)-1]
+	stats.Pages += len(inner)
+	if len(inner) <= STATS_SAMPLE {
+		for _, ptr := range inner {
+			stats.Keys += count(ptr)
+		}
+		return stats
+	}
+	sampled := 0
+	for i := 0; i < STATS_SAMPLE; i++ {
+		sampled += count(inner[i*len(inner)/STATS_SAMPLE])
+	}
+	stats.Keys += sampled * len(inner) / STATS_SAMPLE
+	return stats
+}
+
+// UserTables lists the tables in @table, the internal ones left out.
+func (db *DB) UserTables(tree *BTree) ([]string, error) {
+	names, err := db.TableNames(tree)
+	if err != nil {
+		return nil, err
+	}
+	tables := names[:0]
+	for _, name := range names {
+		if !strings.HasPrefix(name, "@") {
+			tables = append(tables, name)
+		}
+	}
+	return tables, nil
+}
+
+// TableStats returns the definition of a table with its sizes.
+func (db *DB) TableStats(name string, tree *BTree) (*TableDef, TableStats, error) {
+	tdef := GetTableDef(db, name, tree)
+	if tdef == nil {
+		return nil, TableStats{}, fmt.Errorf("table not found: %s", name)
+	}
+	stats := TableStats{Rows: prefixStats(tree, tdef.Prefix)}
+	for _, prefix := range tdef.IndexPrefix {
+		stats.Indexes = append(stats.Indexes, prefixStats(tree, prefix))
+	}
+	return tdef, stats, nil
+}
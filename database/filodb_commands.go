@@ -6,8 +6,11 @@ package database
 
 import (
 	"bufio"
+	"errors"
 	"filodb/database/helper"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,8 +30,14 @@ type QueryRequest struct {
 	cols      []string
 	startVals []string
 	endVals   []string
+	project   []string // the columns a range query returns, nil for all
 	queryType QueryType
-	response  chan GetResponse
+	asOf      string // version or datetime to read, empty for the latest
+	// a single record lookup in a transaction reads its view of the table
+	// and may lock the row, i.e. SELECT ... FOR SHARE / FOR UPDATE
+	tx       *DBTX
+	lock     LockMode
+	response chan GetResponse
 }
 
 type GetResponse struct {
@@ -40,6 +49,12 @@ type GetResponse struct {
 func RegisterCommands() map[string]Command {
 	return map[string]Command{
 		"create": HandleCreate,
+		"alter":  HandleAlter,
+		"drop":   HandleDrop,
+		"index":  HandleIndex,
+		"rename": HandleRename,
+		"alias":  HandleAlias,
+		"view":   HandleView,
 		"insert": HandleInsert,
 		"delete": HandleDelete,
 		"get":    HandleGet,
@@ -49,6 +64,26 @@ func RegisterCommands() map[string]Command {
 		"commit": func(scanner *bufio.Reader, db *DB, currentTX *DBTX) {},
 		"stats":  HandleStats,
 		"help":   HandleHelp,
+		// Triggers
+		"trigger": HandleTrigger,
+		// Row TTL
+		"ttl": HandleTTL,
+		// Catalog
+		"tables":   HandleTables,
+		"describe": HandleDescribe,
+		"indexes":  HandleIndexes,
+		// Transaction limits
+		"timeout": HandleTimeout,
+		// Time travel
+		"history":  HandleHistory,
+		"snapshot": HandleSnapshot,
+		"branch":   HandleBranch,
+		// Attached databases
+		"attach":    HandleAttach,
+		"detach":    HandleDetach,
+		"databases": HandleDatabases,
+		"sequence":  HandleSequence,
+		"schema":    HandleSchema,
 		// Aggregate functions
 		"count": HandleCount,
 		"sum":   HandleSum,
@@ -62,7 +97,6 @@ func RegisterCommands() map[string]Command {
 
 func HandleCreate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	td := helper.GetTableInput(scanner)
-	var writer KVTX
 	tdef := &TableDef{
 		Name:        td.Name,
 		Cols:        td.Cols,
@@ -71,22 +105,494 @@ func HandleCreate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 		PKeys:       1,
 		IndexPrefix: make([]uint32, 0),
 	}
-	if currentTX != nil {
-		if err := db.TableNew(tdef, &writer); err != nil {
+	if err := setPrimaryKey(tdef, td.PrimaryKey); err != nil {
+		fmt.Println("Error creating table: ", err)
+		return
+	}
+	if err := setNotNull(tdef, td.NotNull); err != nil {
+		fmt.Println("Error creating table: ", err)
+		return
+	}
+	if err := setDefaults(tdef, td.Defaults); err != nil {
+		fmt.Println("Error creating table: ", err)
+		return
+	}
+	tdef.Checks = td.Checks
+	tdef.AutoIncrement = td.AutoIncrement
+	for _, index := range td.Unique {
+		for len(tdef.Unique) < len(tdef.Indexes) {
+			tdef.Unique = append(tdef.Unique, 0)
+		}
+		tdef.Indexes = append(tdef.Indexes, index)
+		tdef.Unique = append(tdef.Unique, len(index))
+	}
+	for _, fk := range td.Foreign {
+		tdef.ForeignKeys = append(tdef.ForeignKeys, ForeignKey{Cols: fk.Cols, Table: fk.Table, OnDelete: fk.OnDelete})
+	}
+	if td.TTL != "" {
+		ttl, err := ParseTTL(td.TTL)
+		if err != nil {
 			fmt.Println("Error creating table: ", err)
+			return
+		}
+		tdef.TTL = ttl
+	}
+	var err error
+	if currentTX != nil {
+		err = currentTX.TableNew(tdef)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.TableNew(tdef)
+		})
+	}
+	if err != nil {
+		fmt.Println("Error creating table: ", err)
+	} else {
+		fmt.Printf("Table '%s' created successfully.\n", td.Name)
+	}
+}
+
+// HandleAlter adds, drops or renames a column
+func HandleAlter(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	tableName := helper.GetTableName(scanner)
+	fmt.Print("Enter change (add, drop, rename): ")
+	change, _ := scanner.ReadString('\n')
+	change = strings.ToLower(strings.TrimSpace(change))
+
+	var alter TableAlter
+	fmt.Print("Enter column name: ")
+	col, _ := scanner.ReadString('\n')
+	alter.Col = strings.TrimSpace(col)
+	switch change {
+	case "add":
+		alter.Op = ALTER_ADD_COLUMN
+		fmt.Print("Enter column type (as number): ")
+		typeStr, _ := scanner.ReadString('\n')
+		if _, err := fmt.Sscanf(strings.TrimSpace(typeStr), "%d", &alter.Type); err != nil {
+			fmt.Println("Invalid column type.")
+			return
+		}
+		fmt.Print("NOT NULL? (y/N): ")
+		notNull, _ := scanner.ReadString('\n')
+		notNull = strings.ToLower(strings.TrimSpace(notNull))
+		alter.NotNull = notNull == "y" || notNull == "yes"
+		fmt.Print("Enter default (expression, or leave empty): ")
+		def, _ := scanner.ReadString('\n')
+		alter.Default = strings.TrimSpace(def)
+	case "drop":
+		alter.Op = ALTER_DROP_COLUMN
+	case "rename":
+		alter.Op = ALTER_RENAME_COLUMN
+		fmt.Print("Enter new column name: ")
+		newName, _ := scanner.ReadString('\n')
+		alter.NewName = strings.TrimSpace(newName)
+	default:
+		fmt.Printf("Unknown change '%s'.\n", change)
+		return
+	}
+
+	var err error
+	if currentTX != nil {
+		err = currentTX.AlterTable(tableName, alter)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.AlterTable(tableName, alter)
+		})
+	}
+	if err != nil {
+		fmt.Println("Error altering table: ", err)
+		return
+	}
+	fmt.Printf("Table '%s' altered successfully.\n", tableName)
+}
+
+// HandleDrop removes a table with its rows and indexes
+func HandleDrop(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	tableName := helper.GetTableName(scanner)
+	fmt.Printf("Drop table '%s' and all its rows? (y/N): ", tableName)
+	confirm, _ := scanner.ReadString('\n')
+	confirm = strings.ToLower(strings.TrimSpace(confirm))
+	if confirm != "y" && confirm != "yes" {
+		fmt.Println("Drop cancelled.")
+		return
+	}
+
+	var err error
+	if currentTX != nil {
+		err = currentTX.TableDrop(tableName)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.TableDrop(tableName)
+		})
+	}
+	if err != nil {
+		fmt.Println("Error dropping table: ", err)
+		return
+	}
+	fmt.Printf("Table '%s' dropped successfully.\n", tableName)
+}
+
+// HandleRename gives a table a new name, optionally keeping the old one
+func HandleRename(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	tableName := helper.GetTableName(scanner)
+	fmt.Print("Enter new table name: ")
+	newName, _ := scanner.ReadString('\n')
+	newName = strings.TrimSpace(newName)
+	fmt.Print("Keep the old name as an alias? (y/N): ")
+	keep, _ := scanner.ReadString('\n')
+	keep = strings.ToLower(strings.TrimSpace(keep))
+	alias := keep == "y" || keep == "yes"
+
+	var err error
+	if currentTX != nil {
+		err = currentTX.TableRename(tableName, newName, alias)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.TableRename(tableName, newName, alias)
+		})
+	}
+	if err != nil {
+		fmt.Println("Error renaming table: ", err)
+		return
+	}
+	fmt.Printf("Table '%s' renamed to '%s'.\n", tableName, newName)
+}
+
+// HandleAlias lists or drops the old names kept by RENAME
+func HandleAlias(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (list, drop): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	switch action {
+	case "list":
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		aliases, err := db.TableAliases(&reader.Tree)
+		db.kv.EndRead(&reader)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if len(aliases) == 0 {
+			fmt.Println("No table aliases.")
+		}
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s -> %s\n", name, aliases[name])
+		}
+	case "drop":
+		fmt.Print("Enter alias: ")
+		name, _ := scanner.ReadString('\n')
+		name = strings.TrimSpace(name)
+		var err error
+		if currentTX != nil {
+			err = currentTX.TableAliasDrop(name)
+		} else {
+			_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+				return true, tx.TableAliasDrop(name)
+			})
+		}
+		if err != nil {
+			fmt.Println("Error dropping alias: ", err)
+			return
+		}
+		fmt.Printf("Alias '%s' dropped.\n", name)
+	default:
+		fmt.Printf("Unknown action '%s'.\n", action)
+	}
+}
+
+// HandleView creates, drops or lists the views, GET, SCAN and the
+// aggregates read a view like a table
+func HandleView(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	switch action {
+	case "list":
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		views, err := db.Views(&reader.Tree)
+		db.kv.EndRead(&reader)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if len(views) == 0 {
+			fmt.Println("No views.")
+		}
+		for _, view := range views {
+			fmt.Printf("%-20s AS %s\n", view.Name, view.Query())
+		}
+	case "create", "drop":
+		fmt.Print("Enter view name: ")
+		name, _ := scanner.ReadString('\n')
+		name = strings.TrimSpace(name)
+		var query string
+		if action == "create" {
+			fmt.Print("Enter query (SELECT <cols> FROM <table> [WHERE <expr>]): ")
+			query, _ = scanner.ReadString('\n')
+			query = strings.TrimSpace(query)
+		}
+		stmt := func(tx *DBTX) error {
+			if action == "create" {
+				return tx.ViewCreate(name, query)
+			}
+			return tx.ViewDrop(name)
+		}
+		var err error
+		if currentTX != nil {
+			err = stmt(currentTX)
+		} else {
+			_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+				return true, stmt(tx)
+			})
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if action == "create" {
+			fmt.Printf("View '%s' created.\n", name)
 		} else {
-			fmt.Printf("Table '%s' created successfully.\n", td.Name)
+			fmt.Printf("View '%s' dropped.\n", name)
+		}
+	default:
+		fmt.Printf("Unknown action '%s'.\n", action)
+	}
+}
+
+// HandleTrigger creates, drops or lists the triggers of a table
+func HandleTrigger(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+	if action != "create" && action != "drop" && action != "list" {
+		fmt.Printf("Unknown action '%s'.\n", action)
+		return
+	}
+	tableName := helper.GetTableName(scanner)
+
+	if action == "list" {
+		src, name := db.resolve(tableName)
+		var reader KVReader
+		src.kv.BeginRead(&reader)
+		tdef := GetTableDef(src, name, &reader.Tree)
+		src.kv.EndRead(&reader)
+		if tdef == nil {
+			fmt.Printf("Table '%s' not found.\n", tableName)
+			return
+		}
+		if len(tdef.Triggers) == 0 {
+			fmt.Println("No triggers.")
+		}
+		for _, trig := range tdef.Triggers {
+			fmt.Printf("%-20s %s\n", trig.Name, formatTrigger(trig))
 		}
+		return
+	}
+
+	fmt.Print("Enter trigger name: ")
+	name, _ := scanner.ReadString('\n')
+	name = strings.TrimSpace(name)
+	var stmt func(tx *DBTX) error
+	if action == "drop" {
+		stmt = func(tx *DBTX) error { return tx.TriggerDrop(tableName, name) }
 	} else {
-		db.kv.Begin(&writer)
-		if err := db.TableNew(tdef, &writer); err != nil {
-			db.kv.Abort(&writer)
-			fmt.Println("Error creating table: ", err)
+		trig := Trigger{Name: name}
+		fmt.Print("Run BEFORE or AFTER: ")
+		trig.Timing, _ = scanner.ReadString('\n')
+		fmt.Print("On INSERT, UPDATE or DELETE: ")
+		trig.Event, _ = scanner.ReadString('\n')
+		fmt.Print("WHEN condition (old.col and new.col, leave empty to always run): ")
+		trig.When, _ = scanner.ReadString('\n')
+		fmt.Print("Action (INSERT, UPSERT, REJECT, SET): ")
+		trig.Action, _ = scanner.ReadString('\n')
+		trig.Timing = strings.TrimSpace(trig.Timing)
+		trig.Event = strings.TrimSpace(trig.Event)
+		trig.When = strings.TrimSpace(trig.When)
+		trig.Action = strings.ToUpper(strings.TrimSpace(trig.Action))
+		switch trig.Action {
+		case ACTION_INSERT, ACTION_UPSERT:
+			trig.Table = helper.GetTableName(scanner)
+			fmt.Print("Enter values (format: col=expression; ...): ")
+			values, _ := scanner.ReadString('\n')
+			trig.Cols, trig.Exprs = helper.ParseAssignments(values)
+		case ACTION_SET:
+			fmt.Print("Enter columns to set (format: col=expression; ...): ")
+			values, _ := scanner.ReadString('\n')
+			trig.Cols, trig.Exprs = helper.ParseAssignments(values)
+		case ACTION_REJECT:
+			fmt.Print("Enter error message: ")
+			trig.Message, _ = scanner.ReadString('\n')
+			trig.Message = strings.TrimSpace(trig.Message)
+		}
+		stmt = func(tx *DBTX) error { return tx.TriggerCreate(tableName, trig) }
+	}
+
+	var err error
+	if currentTX != nil {
+		err = stmt(currentTX)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, stmt(tx)
+		})
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if action == "create" {
+		fmt.Printf("Trigger '%s' created on '%s'.\n", name, tableName)
+	} else {
+		fmt.Printf("Trigger '%s' dropped from '%s'.\n", name, tableName)
+	}
+}
+
+// HandleTTL sets or drops the TTL of a table, or purges the expired rows
+// of every table now
+func HandleTTL(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (set, drop, show, purge): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+	if action == "purge" {
+		n, err := db.PurgeExpired()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		fmt.Printf("%d expired rows deleted.\n", n)
+		return
+	}
+	if action != "set" && action != "drop" && action != "show" {
+		fmt.Printf("Unknown action '%s'.\n", action)
+		return
+	}
+	tableName := helper.GetTableName(scanner)
+
+	if action == "show" {
+		src, name := db.resolve(tableName)
+		var reader KVReader
+		src.kv.BeginRead(&reader)
+		tdef := GetTableDef(src, name, &reader.Tree)
+		src.kv.EndRead(&reader)
+		if tdef == nil {
+			fmt.Printf("Table '%s' not found.\n", tableName)
+		} else if tdef.TTL == nil {
+			fmt.Println("No TTL.")
 		} else {
-			db.kv.Commit(&writer)
-			fmt.Printf("Table '%s' created successfully.\n", td.Name)
+			fmt.Printf("TTL: %s\n", tdef.TTL)
+		}
+		return
+	}
+
+	var ttl *TTL
+	if action == "set" {
+		fmt.Print("Enter TTL (format: col or col+duration, e.g. created_at+24h): ")
+		input, _ := scanner.ReadString('\n')
+		var err error
+		if ttl, err = ParseTTL(strings.TrimSpace(input)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
 		}
 	}
+	stmt := func(tx *DBTX) error { return tx.TableSetTTL(tableName, ttl) }
+	var err error
+	if currentTX != nil {
+		err = stmt(currentTX)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, stmt(tx)
+		})
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if ttl != nil {
+		fmt.Printf("TTL of '%s' set to %s.\n", tableName, ttl)
+	} else {
+		fmt.Printf("TTL of '%s' dropped.\n", tableName)
+	}
+}
+
+// a trigger as `BEFORE UPDATE WHEN ... SET col = expr, ...`
+func formatTrigger(trig Trigger) string {
+	out := trig.Timing + " " + trig.Event
+	if trig.When != "" {
+		out += " WHEN " + trig.When
+	}
+	assignments := make([]string, len(trig.Cols))
+	for i, col := range trig.Cols {
+		assignments[i] = col + " = " + trig.Exprs[i]
+	}
+	switch trig.Action {
+	case ACTION_REJECT:
+		return out + " REJECT '" + trig.Message + "'"
+	case ACTION_SET:
+		return out + " SET " + strings.Join(assignments, ", ")
+	}
+	return out + " " + trig.Action + " INTO " + trig.Table + " SET " + strings.Join(assignments, ", ")
+}
+
+// HandleIndex creates or drops an index of an existing table
+func HandleIndex(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+	if action != "create" && action != "drop" {
+		fmt.Printf("Unknown action '%s'.\n", action)
+		return
+	}
+	tableName := helper.GetTableName(scanner)
+	fmt.Print("Enter index columns or expressions (comma-separated): ")
+	colsStr, _ := scanner.ReadString('\n')
+	cols := splitKeys(colsStr)
+	target, name := db.resolve(tableName)
+
+	if action == "create" {
+		if currentTX != nil {
+			fmt.Println("CREATE INDEX commits as it goes, run it outside a transaction.")
+			return
+		}
+		fmt.Print("UNIQUE? (y/N): ")
+		unique, _ := scanner.ReadString('\n')
+		unique = strings.ToLower(strings.TrimSpace(unique))
+		fmt.Print("WHERE condition for a partial index (leave empty to index every row): ")
+		where, _ := scanner.ReadString('\n')
+		fmt.Print("INCLUDE columns kept in the index (comma-separated, leave empty for none): ")
+		include, _ := scanner.ReadString('\n')
+		opts := IndexOptions{
+			Unique:  unique == "y" || unique == "yes",
+			Where:   strings.TrimSpace(where),
+			Include: splitKeys(include),
+		}
+		if err := target.IndexCreate(name, cols, opts); err != nil {
+			fmt.Println("Error creating index: ", err)
+			return
+		}
+		fmt.Printf("Index on %s(%s) created successfully.\n", tableName, strings.Join(cols, ", "))
+		return
+	}
+
+	var err error
+	if currentTX != nil {
+		err = currentTX.IndexDrop(tableName, cols)
+	} else {
+		_, err = db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.IndexDrop(tableName, cols)
+		})
+	}
+	if err != nil {
+		fmt.Println("Error dropping index: ", err)
+		return
+	}
+	fmt.Printf("Index on %s(%s) dropped successfully.\n", tableName, strings.Join(cols, ", "))
 }
 
 func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
@@ -97,11 +603,12 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 		Vals: []Value{},
 	}
 
-	var writer KVTX
+	// writes go through the transaction, which routes them by the alias
+	src, name := db.resolve(tableName)
 	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	src.kv.BeginRead(&reader)
+	tdef := GetTableDef(src, name, &reader.Tree)
+	src.kv.EndRead(&reader)
 	if tdef == nil {
 		fmt.Printf("Table '%s' not found.\n", tableName)
 		return
@@ -110,13 +617,28 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	for i, col := range tdef.Cols {
 		var val Value
 		isValidInput := false
+		useDefault := false
 
 		for !isValidInput {
-			fmt.Printf("Enter value for %s: ", col)
+			if tdef.AutoIncrement && i == 0 {
+				fmt.Printf("Enter value for %s (AUTO_INCREMENT): ", col)
+			} else if i < len(tdef.Defaults) && tdef.Defaults[i] != "" {
+				fmt.Printf("Enter value for %s (default %s): ", col, tdef.Defaults[i])
+			} else {
+				fmt.Printf("Enter value for %s: ", col)
+			}
 			valStr, _ := scanner.ReadString('\n')
 			valStr = strings.TrimSpace(valStr)
 
-			if tdef.Types[i] == TYPE_BYTES {
+			if isDefaultInput(tdef, i, valStr) {
+				useDefault = true
+				isValidInput = true
+			} else if isNullInput(tdef, i, valStr) {
+				val = Value{Type: tdef.Types[i], Null: true}
+				isValidInput = true
+			} else if valStr == "" && tdef.Types[i] != TYPE_BYTES {
+				fmt.Printf("%s is NOT NULL, please enter a value:\n", col)
+			} else if tdef.Types[i] == TYPE_BYTES {
 				val = Value{Type: TYPE_BYTES, Str: []byte(valStr)}
 				isValidInput = true
 			} else if tdef.Types[i] == TYPE_INT64 {
@@ -177,6 +699,9 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			}
 		}
 
+		if useDefault {
+			continue // left out, the table fills it in
+		}
 		rec.Cols = append(rec.Cols, col)
 		rec.Vals = append(rec.Vals, val)
 	}
@@ -190,15 +715,14 @@ func HandleInsert(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			fmt.Println("Failed to insert record.")
 		}
 	} else {
-		db.kv.Begin(&writer)
-		if inserted, err := db.Insert(tableName, rec, &writer); err != nil {
-			db.kv.Abort(&writer)
+		inserted, err := db.autocommit(func(tx *DBTX) (bool, error) {
+			return tx.Set(tableName, rec, MODE_INSERT_ONLY)
+		})
+		if err != nil {
 			fmt.Println("Failed to insert: ", err.Error())
 		} else if inserted {
-			db.kv.Commit(&writer)
 			fmt.Println("Record inserted successfully.")
 		} else {
-			db.kv.Abort(&writer)
 			fmt.Println("Failed to insert record.")
 		}
 	}
@@ -208,6 +732,10 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	responseChan := make(chan GetResponse, 1)
 	tableName := helper.GetTableName(scanner)
 
+	fmt.Print("As of (version, snapshot or datetime, leave empty for latest): ")
+	asOfStr, _ := scanner.ReadString('\n')
+	asOf := strings.TrimSpace(asOfStr)
+
 	fmt.Println("\nSelect query type:")
 	fmt.Println("1. Index lookup (primary/secondary index)")
 	fmt.Println("2. Range query")
@@ -234,28 +762,36 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 
 	switch queryType {
 	case RangeQuery:
-		fmt.Print("\nEnter column name for range lookup(index col): ")
+		fmt.Print("\nEnter column name(s) for range lookup (index col, comma-separated for leading key columns): ")
 		colStr, _ := scanner.ReadString('\n')
-		col := strings.TrimSpace(colStr)
-
-		startVals := make([]string, 0, 1)
-		endVals := make([]string, 0, 1)
+		cols := splitKeys(colStr)
 
-		fmt.Print("\nEnter start range value: ")
-		val, _ := scanner.ReadString('\n')
-		startVals = append(startVals, strings.TrimSpace(val))
+		startVals := make([]string, 0, len(cols))
+		endVals := make([]string, 0, len(cols))
 
-		fmt.Print("\nEnter end range value: ")
-		val, _ = scanner.ReadString('\n')
-		endVals = append(endVals, strings.TrimSpace(val))
+		for _, col := range cols {
+			fmt.Printf("\nEnter start range value for %s: ", col)
+			val, _ := scanner.ReadString('\n')
+			startVals = append(startVals, strings.TrimSpace(val))
+		}
+		for _, col := range cols {
+			fmt.Printf("\nEnter end range value for %s: ", col)
+			val, _ := scanner.ReadString('\n')
+			endVals = append(endVals, strings.TrimSpace(val))
+		}
+		fmt.Print("\nColumns to return (comma-separated, leave empty for all): ")
+		projectStr, _ := scanner.ReadString('\n')
+		project := splitKeys(projectStr)
 
 		db.pool.Submit(func() {
 			processQueryRequest(QueryRequest{
 				tableName: tableName,
-				cols:      []string{col},
+				cols:      cols,
 				startVals: startVals,
 				endVals:   endVals,
+				project:   project,
 				queryType: queryType,
+				asOf:      asOf,
 				response:  responseChan,
 			}, db)
 		})
@@ -274,14 +810,32 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			startVals = append(startVals, strings.TrimSpace(val))
 		}
 
+		var lock LockMode
+		if currentTX != nil && asOf == "" {
+			fmt.Print("Lock row (none, share, update): ")
+			mode, _ := scanner.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(mode)) {
+			case "share":
+				lock = LOCK_SHARED
+			case "update":
+				lock = LOCK_EXCLUSIVE
+			}
+		}
+
 		db.pool.Submit(func() {
-			processQueryRequest(QueryRequest{
+			req := QueryRequest{
 				tableName: tableName,
 				cols:      cols,
 				startVals: startVals,
 				queryType: queryType,
+				asOf:      asOf,
+				lock:      lock,
 				response:  responseChan,
-			}, db)
+			}
+			if asOf == "" {
+				req.tx = currentTX
+			}
+			processQueryRequest(req, db)
 		})
 	default:
 		fmt.Print("\nEnter column name for filter: ")
@@ -302,12 +856,23 @@ func HandleGet(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 				cols:      startCols,
 				startVals: startVals,
 				queryType: queryType,
+				asOf:      asOf,
 				response:  responseChan,
 			}, db)
 		})
 	}
 
-	response := <-responseChan
+	var response GetResponse
+	if limit := db.Limits().StatementTimeout; limit > 0 {
+		// the query stops in the pool too, its response is dropped
+		select {
+		case response = <-responseChan:
+		case <-time.After(limit):
+			response.err = fmt.Errorf("%w after %v", ErrStatementTimeout, limit)
+		}
+	} else {
+		response = <-responseChan
+	}
 	if response.err != nil {
 		fmt.Println("\nError:", response.err)
 		return
@@ -326,11 +891,12 @@ func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 		Vals: []Value{},
 	}
 
-	var writer KVTX
+	// writes go through the transaction, which routes them by the alias
+	src, name := db.resolve(tableName)
 	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	src.kv.BeginRead(&reader)
+	tdef := GetTableDef(src, name, &reader.Tree)
+	src.kv.EndRead(&reader)
 	if tdef == nil {
 		fmt.Printf("Table '%s' not found.\n", tableName)
 		return
@@ -345,7 +911,12 @@ func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			valStr, _ := scanner.ReadString('\n')
 			valStr = strings.TrimSpace(valStr)
 
-			if tdef.Types[i] == TYPE_BYTES {
+			if isNullInput(tdef, i, valStr) {
+				val = Value{Type: tdef.Types[i], Null: true}
+				isValidInput = true
+			} else if valStr == "" && tdef.Types[i] != TYPE_BYTES {
+				fmt.Printf("%s is NOT NULL, please enter a value:\n", col)
+			} else if tdef.Types[i] == TYPE_BYTES {
 				val = Value{Type: TYPE_BYTES, Str: []byte(valStr)}
 				isValidInput = true
 			} else if tdef.Types[i] == TYPE_INT64 {
@@ -419,14 +990,14 @@ func HandleDelete(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			fmt.Println("Failed to delete record.")
 		}
 	} else {
-		db.kv.Begin(&writer)
-		if deleted, err := db.Delete(tableName, rec, &writer); err != nil {
+		deleted, err := db.autocommit(func(tx *DBTX) (bool, error) {
+			return tx.Delete(tableName, rec)
+		})
+		if err != nil {
 			fmt.Println("Failed to delete: ", err.Error())
 		} else if deleted {
-			db.kv.Commit(&writer)
 			fmt.Println("Record deleted successfully.")
 		} else {
-			db.kv.Abort(&writer)
 			fmt.Println("Failed to delete record.")
 		}
 	}
@@ -440,18 +1011,19 @@ func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 		Vals: []Value{},
 	}
 
-	var writer KVTX
+	// writes go through the transaction, which routes them by the alias
+	src, name := db.resolve(tableName)
 	var reader KVReader
-	db.kv.BeginRead(&reader)
-	tdef := GetTableDef(db, tableName, &reader.Tree)
-	db.kv.EndRead(&reader)
+	src.kv.BeginRead(&reader)
+	tdef := GetTableDef(src, name, &reader.Tree)
+	src.kv.EndRead(&reader)
 
 	if tdef == nil {
 		fmt.Printf("Table '%s' not found.\n", tableName)
 		return
 	}
 	for i, col := range tdef.Cols {
-		if i == 0 {
+		if i < tdef.PKeys {
 			fmt.Printf("Enter primary key for %s: ", col)
 		} else {
 			fmt.Printf("Enter value for %s: ", col)
@@ -463,7 +1035,12 @@ func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			valStr, _ := scanner.ReadString('\n')
 			valStr = strings.TrimSpace(valStr)
 
-			if tdef.Types[i] == TYPE_BYTES {
+			if isNullInput(tdef, i, valStr) {
+				val = Value{Type: tdef.Types[i], Null: true}
+				isValidInput = true
+			} else if valStr == "" && tdef.Types[i] != TYPE_BYTES {
+				fmt.Printf("%s is NOT NULL, please enter a value: ", col)
+			} else if tdef.Types[i] == TYPE_BYTES {
 				val = Value{Type: TYPE_BYTES, Str: []byte(valStr)}
 				isValidInput = true
 			} else if tdef.Types[i] == TYPE_INT64 {
@@ -537,15 +1114,14 @@ func HandleUpdate(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 			fmt.Println("Failed to update record.")
 		}
 	} else {
-		db.kv.Begin(&writer)
-		if updated, err := db.Update(tableName, rec, &writer); err != nil {
-			db.kv.Abort(&writer)
+		updated, err := db.autocommit(func(tx *DBTX) (bool, error) {
+			return tx.Set(tableName, rec, MODE_UPDATE_ONLY)
+		})
+		if err != nil {
 			fmt.Println("Error while updating: ", err.Error())
 		} else if updated {
-			db.kv.Commit(&writer)
 			printRecord(rec)
 		} else {
-			db.kv.Abort(&writer)
 			fmt.Println("Failed to update record.")
 		}
 	}
@@ -571,6 +1147,9 @@ func HandleCommit(scanner *bufio.Reader, db *DB, currentTX *DBTX) *DBTX {
 
 	if err := db.Commit(currentTX); err != nil {
 		fmt.Printf("Failed to commit transaction: %v\n", err)
+		if errors.Is(err, ErrTxDone) || errors.Is(err, ErrTxAborted) {
+			return nil
+		}
 		return currentTX
 	}
 
@@ -590,11 +1169,46 @@ func HandleAbort(scanner *bufio.Reader, db *DB, currentTX *DBTX) *DBTX {
 }
 
 func processQueryRequest(req QueryRequest, db *DB) {
+	// a transaction routes the qualified name itself
+	qualified := req.tableName
+	limit := db.Limits().StatementTimeout
+	db, req.tableName = db.resolve(req.tableName)
 	var reader KVReader
-	db.kv.BeginRead(&reader)
+	if err := beginReadAsOf(db, &reader, req.asOf); err != nil {
+		req.response <- GetResponse{
+			records: nil,
+			found:   false,
+			err:     err,
+		}
+		return
+	}
 	defer db.kv.EndRead(&reader)
+	if limit > 0 {
+		// the scans stop about when GET stops waiting for them
+		deadline := time.Now().Add(limit)
+		reader.Tree.interrupt = func() error {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w after %v", ErrStatementTimeout, limit)
+			}
+			return nil
+		}
+	}
 
 	tdef := GetTableDef(db, req.tableName, &reader.Tree)
+	view := false
+	if tdef == nil && getView(db, req.tableName, &reader.Tree) != nil {
+		// a view reads the committed rows, not those of the transaction
+		var err error
+		if tdef, err = db.QueryDef(req.tableName, &reader.Tree); err != nil {
+			req.response <- GetResponse{
+				records: nil,
+				found:   false,
+				err:     err,
+			}
+			return
+		}
+		view = true
+	}
 	if tdef == nil {
 		req.response <- GetResponse{
 			records: nil,
@@ -619,22 +1233,22 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 
 	for i, col := range req.cols {
-		idx := ColIndex(tdef, col)
-		if tdef.Types[idx] == TYPE_BYTES {
+		typ := indexKeyType(tdef, col)
+		if typ == TYPE_BYTES {
 			startRecord.Vals[i] = Value{Type: TYPE_BYTES, Str: []byte(req.startVals[i])}
-		} else if tdef.Types[idx] == TYPE_INT64 {
+		} else if typ == TYPE_INT64 {
 			var key int64
 			fmt.Sscanf(req.startVals[i], "%d", &key)
 			startRecord.Vals[i] = Value{Type: TYPE_INT64, I64: key}
-		} else if tdef.Types[idx] == TYPE_FLOAT64 {
+		} else if typ == TYPE_FLOAT64 {
 			var floatVal float64
 			fmt.Sscanf(req.startVals[i], "%f", &floatVal)
 			startRecord.Vals[i] = Value{Type: TYPE_FLOAT64, F64: floatVal}
-		} else if tdef.Types[idx] == TYPE_BOOLEAN {
+		} else if typ == TYPE_BOOLEAN {
 			valStrLower := strings.ToLower(req.startVals[i])
 			boolVal := valStrLower == "true" || valStrLower == "1" || valStrLower == "yes" || valStrLower == "y"
 			startRecord.Vals[i] = Value{Type: TYPE_BOOLEAN, Bool: boolVal}
-		} else if tdef.Types[idx] == TYPE_DATETIME {
+		} else if typ == TYPE_DATETIME {
 			var parsedTime time.Time
 			var err error
 
@@ -656,8 +1270,29 @@ func processQueryRequest(req QueryRequest, db *DB) {
 		startRecord.Cols[i] = col
 	}
 
+	if view && req.queryType != RangeQuery {
+		records, err := db.QueryView(req.tableName, req.queryType, &startRecord, nil, &reader)
+		req.response <- GetResponse{
+			records: records,
+			found:   len(records) > 0,
+			err:     err,
+		}
+		return
+	}
+
 	if req.queryType == SingleRecord {
-		found, err := db.Get(req.tableName, &startRecord, &reader)
+		var found bool
+		var err error
+		switch {
+		case req.tx == nil:
+			found, err = db.Get(req.tableName, &startRecord, &reader)
+		case req.lock == LOCK_EXCLUSIVE:
+			found, err = req.tx.GetForUpdate(qualified, &startRecord)
+		case req.lock == LOCK_SHARED:
+			found, err = req.tx.GetForShare(qualified, &startRecord)
+		default:
+			found, err = req.tx.Get(qualified, &startRecord)
+		}
 		req.response <- GetResponse{
 			records: []*Record{&startRecord},
 			found:   found,
@@ -667,14 +1302,14 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 
 	if req.queryType == TableScan {
-		results, err := db.QueryWithFilter(req.tableName, tdef, &startRecord)
+		results, err := db.QueryWithFilter(req.tableName, tdef, &startRecord, &reader)
 		if err != nil {
 			req.response <- GetResponse{
 				records: nil,
 				found:   false,
 				err:     err,
 			}
-
+			return
 		}
 
 		req.response <- GetResponse{
@@ -690,22 +1325,22 @@ func processQueryRequest(req QueryRequest, db *DB) {
 		Vals: make([]Value, len(req.cols)),
 	}
 	for i, col := range req.cols {
-		idx := ColIndex(tdef, col)
-		if tdef.Types[idx] == TYPE_BYTES {
+		typ := indexKeyType(tdef, col)
+		if typ == TYPE_BYTES {
 			endRecord.Vals[i] = Value{Type: TYPE_BYTES, Str: []byte(req.endVals[i])}
-		} else if tdef.Types[idx] == TYPE_INT64 {
+		} else if typ == TYPE_INT64 {
 			var key int64
 			fmt.Sscanf(req.endVals[i], "%d", &key)
 			endRecord.Vals[i] = Value{Type: TYPE_INT64, I64: key}
-		} else if tdef.Types[idx] == TYPE_FLOAT64 {
+		} else if typ == TYPE_FLOAT64 {
 			var floatVal float64
 			fmt.Sscanf(req.endVals[i], "%f", &floatVal)
 			endRecord.Vals[i] = Value{Type: TYPE_FLOAT64, F64: floatVal}
-		} else if tdef.Types[idx] == TYPE_BOOLEAN {
+		} else if typ == TYPE_BOOLEAN {
 			valStrLower := strings.ToLower(req.endVals[i])
 			boolVal := valStrLower == "true" || valStrLower == "1" || valStrLower == "yes" || valStrLower == "y"
 			endRecord.Vals[i] = Value{Type: TYPE_BOOLEAN, Bool: boolVal}
-		} else if tdef.Types[idx] == TYPE_DATETIME {
+		} else if typ == TYPE_DATETIME {
 			var parsedTime time.Time
 			var err error
 
@@ -727,7 +1362,26 @@ func processQueryRequest(req QueryRequest, db *DB) {
 		endRecord.Cols[i] = col
 	}
 
-	records, err := db.GetRange(req.tableName, &startRecord, &endRecord, &reader)
+	var records []*Record
+	var err error
+	for _, col := range req.project {
+		if ColIndex(tdef, col) < 0 {
+			err = fmt.Errorf("column '%s' not found in table", col)
+		}
+	}
+	switch {
+	case err != nil:
+	case view:
+		records, err = db.QueryView(req.tableName, req.queryType, &startRecord, &endRecord, &reader)
+		for i := range records {
+			records[i] = project(records[i], req.project)
+		}
+	case req.project != nil:
+		// answered from a covering index if there is one
+		records, err = db.GetRangeCols(req.tableName, &startRecord, &endRecord, req.project, &reader)
+	default:
+		records, err = db.GetRange(req.tableName, &startRecord, &endRecord, &reader)
+	}
 	req.response <- GetResponse{
 		records: records,
 		found:   len(records) > 0,
@@ -735,6 +1389,80 @@ func processQueryRequest(req QueryRequest, db *DB) {
 	}
 }
 
+// start a reader at the version, snapshot or datetime given by the user,
+// or at the latest version when `asOf` is empty
+func beginReadAsOf(db *DB, reader *KVReader, asOf string) error {
+	if asOf == "" {
+		db.kv.BeginRead(reader)
+		return nil
+	}
+	if version, err := strconv.ParseUint(asOf, 10, 64); err == nil {
+		return db.BeginReadAt(reader, version)
+	}
+	if err := db.kv.BeginReadSnapshot(reader, asOf); !errors.Is(err, ErrSnapshotNotFound) {
+		return err
+	}
+	// Parse as UTC to ensure consistent timezone handling
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", asOf, time.UTC)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", asOf, time.UTC)
+	}
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, asOf)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid AS OF '%s': expected a version, a snapshot or a datetime", asOf)
+	}
+	return db.BeginReadAsOf(reader, t)
+}
+
+// NULL, or an empty input for a column that isn't text, is NULL in a
+// nullable column
+func isNullInput(tdef *TableDef, i int, valStr string) bool {
+	if !isNullable(tdef, i) {
+		return false
+	}
+	return strings.EqualFold(valStr, "null") || (valStr == "" && tdef.Types[i] != TYPE_BYTES)
+}
+
+// DEFAULT, or an empty input, is the default of a column that has one,
+// or the next id of an AUTO_INCREMENT table
+func isDefaultInput(tdef *TableDef, i int, valStr string) bool {
+	auto := tdef.AutoIncrement && i == 0
+	if !auto && (i >= len(tdef.Defaults) || tdef.Defaults[i] == "") {
+		return false
+	}
+	return valStr == "" || strings.EqualFold(valStr, "default")
+}
+
+// split a list of columns and index expressions on the commas outside
+// the parentheses and the strings, e.g. `coalesce(a, b), c`
+func splitKeys(list string) []string {
+	var keys []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			switch c := list[i]; {
+			case c == '\'':
+				quoted = !quoted
+			case quoted:
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+			}
+			if list[i] != ',' || quoted || depth > 0 {
+				continue
+			}
+		}
+		if key := strings.TrimSpace(list[start:i]); key != "" {
+			keys = append(keys, key)
+		}
+		start = i + 1
+	}
+	return keys
+}
+
 func verifyColumns(tdef *TableDef, cols []string) error {
 	for _, col := range cols {
 		found := false
@@ -744,7 +1472,7 @@ func verifyColumns(tdef *TableDef, cols []string) error {
 				break
 			}
 		}
-		if !found {
+		if !found && !isIndexExpr(tdef, col) {
 			return fmt.Errorf("column '%s' not found in table", col)
 		}
 	}
@@ -752,6 +1480,9 @@ func verifyColumns(tdef *TableDef, cols []string) error {
 }
 
 func formatValue(v Value) string {
+	if v.Null {
+		return "NULL"
+	}
 	switch v.Type {
 	case TYPE_INT64:
 		return fmt.Sprintf("%d", v.I64)
@@ -868,20 +1599,485 @@ func (db *DB) handleStatsCommand() {
 	db.kv.BeginRead(reader)
 	defer db.kv.EndRead(reader)
 
-	tableCount := 0
-	// You can enhance this to count actual records
-	fmt.Printf("Active Tables: %d\n", tableCount)
+	tables, err := db.UserTables(&reader.Tree)
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	fmt.Printf("Active Tables: %d\n", len(tables))
 	fmt.Printf("Memory Usage: Optimized with B+ tree structure\n")
 	fmt.Printf("Transaction Support: ACID Compliant\n")
 	fmt.Printf("Concurrent Reads: Enabled\n")
 	fmt.Println("========================")
 }
 
+// HandleTables lists the tables with their sizes
+func HandleTables(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	tables, err := db.UserTables(&reader.Tree)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if len(tables) == 0 {
+		fmt.Println("No tables.")
+		return
+	}
+	fmt.Printf("%-20s %8s %8s %8s %8s\n", "TABLE", "COLUMNS", "INDEXES", "~ROWS", "~PAGES")
+	for _, name := range tables {
+		tdef, stats, err := db.TableStats(name, &reader.Tree)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		fmt.Printf("%-20s %8d %8d %8d %8d\n", name, len(tdef.Cols), len(tdef.Indexes), stats.Rows.Keys, stats.Rows.Pages)
+	}
+}
+
+// HandleDescribe shows the columns and the constraints of a table
+func HandleDescribe(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	tableName := helper.GetTableName(scanner)
+	src, name := db.resolve(tableName)
+	var reader KVReader
+	src.kv.BeginRead(&reader)
+	defer src.kv.EndRead(&reader)
+	tdef, stats, err := src.TableStats(name, &reader.Tree)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	fmt.Printf("%-20s %-10s %-9s %s\n", "COLUMN", "TYPE", "NULL", "DEFAULT")
+	for i, col := range tdef.Cols {
+		null := "NOT NULL"
+		if isNullable(tdef, i) {
+			null = "NULL"
+		}
+		def := ""
+		if i < len(tdef.Defaults) {
+			def = tdef.Defaults[i]
+		}
+		fmt.Printf("%-20s %-10s %-9s %s\n", col, typeName(tdef.Types[i]), null, def)
+	}
+	pk := strings.Join(tdef.Cols[:tdef.PKeys], ", ")
+	if tdef.AutoIncrement {
+		pk += " AUTO_INCREMENT"
+	}
+	fmt.Printf("Primary key: %s\n", pk)
+	for _, check := range tdef.Checks {
+		fmt.Printf("Check: %s\n", check)
+	}
+	for _, fk := range tdef.ForeignKeys {
+		fmt.Printf("Foreign key: %s -> %s ON DELETE %s\n", strings.Join(fk.Cols, ", "), fk.Table, fk.OnDelete)
+	}
+	if tdef.TTL != nil {
+		fmt.Printf("TTL: %s\n", tdef.TTL)
+	}
+	fmt.Printf("Indexes: %d, triggers: %d\n", len(tdef.Indexes), len(tdef.Triggers))
+	fmt.Printf("~%d rows in ~%d pages\n", stats.Rows.Keys, stats.Rows.Pages)
+}
+
+// HandleIndexes shows the primary key and the indexes of a table with
+// their key prefixes and sizes
+func HandleIndexes(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	tableName := helper.GetTableName(scanner)
+	src, name := db.resolve(tableName)
+	var reader KVReader
+	src.kv.BeginRead(&reader)
+	defer src.kv.EndRead(&reader)
+	tdef, stats, err := src.TableStats(name, &reader.Tree)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	fmt.Printf("%-30s %-8s %8s %8s %8s\n", "INDEX", "KIND", "PREFIX", "~KEYS", "~PAGES")
+	fmt.Printf("%-30s %-8s %8d %8d %8d\n", strings.Join(tdef.Cols[:tdef.PKeys], "+"), "PRIMARY",
+		stats.Rows.Prefix, stats.Rows.Keys, stats.Rows.Pages)
+	for i, index := range tdef.Indexes {
+		kind := "INDEX"
+		if uniqueCols(tdef, i) > 0 {
+			kind = "UNIQUE"
+		}
+		if i < len(tdef.Building) && tdef.Building[i] {
+			kind += "*"
+		}
+		size := stats.Indexes[i]
+		fmt.Printf("%-30s %-8s %8d %8d %8d", strings.Join(index, "+"), kind, size.Prefix, size.Keys, size.Pages)
+		if include := indexInclude(tdef, i); len(include) > 0 {
+			fmt.Printf("  INCLUDE (%s)", strings.Join(include, ", "))
+		}
+		if where := indexWhere(tdef, i); where != "" {
+			fmt.Printf("  WHERE %s", where)
+		}
+		fmt.Println()
+	}
+	if len(tdef.Building) > 0 {
+		fmt.Println("(* still being built)")
+	}
+}
+
 // HandleStats shows database statistics and performance metrics
 func HandleStats(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	db.handleStatsCommand()
 }
 
+// HandleTimeout shows and changes the transaction limits enforced by the reaper
+func HandleTimeout(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	limits := db.Limits()
+	fmt.Println("\n=== Transaction Limits ===")
+	fmt.Printf("statement:   %v\n", limits.StatementTimeout)
+	fmt.Printf("transaction: %v\n", limits.TransactionTimeout)
+	fmt.Printf("idle:        %v\n", limits.IdleTimeout)
+	fmt.Printf("reader:      %v\n", limits.ReaderWarning)
+	fmt.Println("(0s means disabled)")
+
+	fmt.Print("Enter setting to change (statement, transaction, idle, reader or leave empty): ")
+	name, _ := scanner.ReadString('\n')
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return
+	}
+	var limit *time.Duration
+	switch name {
+	case "statement":
+		limit = &limits.StatementTimeout
+	case "transaction":
+		limit = &limits.TransactionTimeout
+	case "idle":
+		limit = &limits.IdleTimeout
+	case "reader":
+		limit = &limits.ReaderWarning
+	default:
+		fmt.Printf("Unknown setting '%s'.\n", name)
+		return
+	}
+
+	fmt.Print("Enter duration (e.g. 30s, 5m, 0 to disable): ")
+	durStr, _ := scanner.ReadString('\n')
+	durStr = strings.TrimSpace(durStr)
+	if durStr == "0" {
+		durStr = "0s"
+	}
+	dur, err := time.ParseDuration(durStr)
+	if err != nil || dur < 0 {
+		fmt.Printf("Invalid duration '%s'.\n", durStr)
+		return
+	}
+	*limit = dur
+	db.SetLimits(limits)
+	fmt.Printf("%s timeout set to %v.\n", name, dur)
+}
+
+// HandleHistory lists the retained versions for AS OF queries and changes how many are kept
+func HandleHistory(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	history := db.kv.History()
+	fmt.Println("\n=== Version History ===")
+	if len(history) == 0 {
+		fmt.Println("No committed versions retained yet.")
+	}
+	for _, commit := range history {
+		fmt.Printf("version %-8d %s\n", commit.Version, commit.Time.UTC().Format(time.DateTime))
+	}
+
+	fmt.Printf("Enter new history size (1-%d, leave empty to keep): ", MAX_HISTORY)
+	sizeStr, _ := scanner.ReadString('\n')
+	sizeStr = strings.TrimSpace(sizeStr)
+	if sizeStr == "" {
+		return
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		fmt.Printf("Invalid size '%s'.\n", sizeStr)
+		return
+	}
+	if err := db.kv.SetHistorySize(size); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Retaining the last %d versions.\n", size)
+}
+
+// HandleSnapshot creates, drops and lists named snapshots
+func HandleSnapshot(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	switch action {
+	case "list":
+		snaps := db.kv.Snapshots()
+		if len(snaps) == 0 {
+			fmt.Println("No snapshots.")
+		}
+		for _, snap := range snaps {
+			fmt.Printf("%-20s version %-8d %s\n", snap.Name, snap.Version, snap.Time.UTC().Format(time.DateTime))
+		}
+	case "create", "drop":
+		fmt.Print("Enter snapshot name: ")
+		name, _ := scanner.ReadString('\n')
+		name = strings.TrimSpace(name)
+		err := db.catalogOp(currentTX, func(tx *KVTX) error {
+			if action == "create" {
+				return tx.SnapshotCreate(name)
+			}
+			return tx.SnapshotDrop(name)
+		})
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if action == "create" {
+			fmt.Printf("Snapshot '%s' created.\n", name)
+		} else {
+			fmt.Printf("Snapshot '%s' dropped.\n", name)
+		}
+	default:
+		fmt.Printf("Unknown action '%s'.\n", action)
+	}
+}
+
+// HandleBranch creates, drops, lists and switches between branches
+func HandleBranch(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list, use): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	if action == "list" {
+		branches, current := db.kv.Branches()
+		for _, name := range branches {
+			marker := " "
+			if name == current {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, name)
+		}
+		return
+	}
+	if action != "create" && action != "drop" && action != "use" {
+		fmt.Printf("Unknown action '%s'.\n", action)
+		return
+	}
+
+	fmt.Print("Enter branch name: ")
+	name, _ := scanner.ReadString('\n')
+	name = strings.TrimSpace(name)
+
+	var err error
+	switch action {
+	case "create":
+		fmt.Print("Enter snapshot to branch from: ")
+		from, _ := scanner.ReadString('\n')
+		from = strings.TrimSpace(from)
+		err = db.catalogOp(currentTX, func(tx *KVTX) error {
+			return tx.BranchCreate(name, from)
+		})
+	case "drop":
+		err = db.catalogOp(currentTX, func(tx *KVTX) error {
+			return tx.BranchDrop(name)
+		})
+	case "use":
+		if currentTX != nil {
+			fmt.Println("Cannot switch branches inside a transaction.")
+			return
+		}
+		err = db.UseBranch(name)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	switch action {
+	case "create":
+		fmt.Printf("Branch '%s' created.\n", name)
+	case "drop":
+		fmt.Printf("Branch '%s' dropped.\n", name)
+	case "use":
+		fmt.Printf("Now on branch '%s'.\n", name)
+	}
+}
+
+// HandleAttach opens another database file under an alias
+func HandleAttach(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter database file path: ")
+	path, _ := scanner.ReadString('\n')
+	path = strings.TrimSpace(path)
+	fmt.Print("Enter alias: ")
+	alias, _ := scanner.ReadString('\n')
+	alias = strings.TrimSpace(alias)
+
+	if err := db.Attach(alias, path); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Attached '%s' as '%s', its tables are named %s.<table>.\n", path, alias, alias)
+}
+
+// HandleDetach closes an attached database file
+func HandleDetach(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter alias: ")
+	alias, _ := scanner.ReadString('\n')
+	alias = strings.TrimSpace(alias)
+
+	if currentTX != nil {
+		fmt.Println("Cannot detach inside a transaction.")
+		return
+	}
+	if err := db.Detach(alias); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Detached '%s'.\n", alias)
+}
+
+// HandleDatabases lists the main and the attached database files
+func HandleDatabases(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Printf("%-20s %s\n", "main", db.Path)
+	attached := db.Attached()
+	aliases := make([]string, 0, len(attached))
+	for alias := range attached {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		fmt.Printf("%-20s %s\n", alias, attached[alias])
+	}
+}
+
+// HandleSequence creates, drops and lists sequences, and takes their next value
+func HandleSequence(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list, nextval): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	if action == "list" {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		seqs, err := db.Sequences(&reader.Tree)
+		db.kv.EndRead(&reader)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if len(seqs) == 0 {
+			fmt.Println("No sequences.")
+		}
+		names := make([]string, 0, len(seqs))
+		for name := range seqs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s next %d\n", name, seqs[name])
+		}
+		return
+	}
+	if action != "create" && action != "drop" && action != "nextval" {
+		fmt.Printf("Unknown action '%s'.\n", action)
+		return
+	}
+
+	fmt.Print("Enter sequence name: ")
+	name, _ := scanner.ReadString('\n')
+	name = strings.TrimSpace(name)
+	target, seq := db.resolve(name)
+
+	switch action {
+	case "create":
+		fmt.Print("Enter start value (leave empty for 1): ")
+		startStr, _ := scanner.ReadString('\n')
+		start := int64(1)
+		if startStr = strings.TrimSpace(startStr); startStr != "" {
+			if _, err := fmt.Sscanf(startStr, "%d", &start); err != nil {
+				fmt.Println("Invalid start value.")
+				return
+			}
+		}
+		err := target.catalogOp(currentTX, func(tx *KVTX) error {
+			return target.SequenceCreate(seq, start, tx)
+		})
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		fmt.Printf("Sequence '%s' created.\n", name)
+	case "drop":
+		err := target.catalogOp(currentTX, func(tx *KVTX) error {
+			return target.SequenceDrop(seq, tx)
+		})
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		fmt.Printf("Sequence '%s' dropped.\n", name)
+	case "nextval":
+		// not part of the transaction, the value is used even if it aborts
+		v, err := target.NextVal(seq)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		fmt.Println(v)
+	}
+}
+
+// HandleSchema creates, drops and lists the schemas
+func HandleSchema(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
+	fmt.Print("Enter action (create, drop, list): ")
+	action, _ := scanner.ReadString('\n')
+	action = strings.ToLower(strings.TrimSpace(action))
+
+	switch action {
+	case "list":
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		schemas, err := db.Schemas(&reader.Tree)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if len(schemas) == 0 {
+			fmt.Println("No schemas.")
+		}
+		for _, schema := range schemas {
+			tables, views, err := db.SchemaObjects(schema.Name, &reader.Tree)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			fmt.Printf("%-20s %d tables, %d views, prefixes %d-%d\n", schema.Name,
+				len(tables), len(views), schema.Base, schema.Base+SCHEMA_PREFIXES-1)
+		}
+	case "create", "drop":
+		fmt.Print("Enter schema name: ")
+		name, _ := scanner.ReadString('\n')
+		name = strings.TrimSpace(name)
+		var op func(tx *KVTX) error
+		if action == "create" {
+			op = func(tx *KVTX) error { return db.SchemaCreate(name, tx) }
+		} else {
+			fmt.Print("Drop its tables and views too (CASCADE)? (y/N): ")
+			confirm, _ := scanner.ReadString('\n')
+			confirm = strings.ToLower(strings.TrimSpace(confirm))
+			cascade := confirm == "y" || confirm == "yes"
+			op = func(tx *KVTX) error { return db.SchemaDrop(name, cascade, tx) }
+		}
+		if err := db.catalogOp(currentTX, op); err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if action == "create" {
+			fmt.Printf("Schema '%s' created.\n", name)
+		} else {
+			fmt.Printf("Schema '%s' dropped.\n", name)
+		}
+	default:
+		fmt.Printf("Unknown action '%s'.\n", action)
+	}
+}
+
 // HandleHelp shows available commands
 func HandleHelp(scanner *bufio.Reader, db *DB, currentTX *DBTX) {
 	helper.PrintWelcomeMessage(false)
@@ -2,11 +2,13 @@ package database
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -81,15 +83,25 @@ func TestCreateTable(t *testing.T) {
 			errorMsg:    "invalid data type",
 		},
 		{
-			name: "multiple primary keys",
+			name: "composite primary key",
+			tableDef: &TableDef{
+				Name:  "readings",
+				Types: []uint32{TYPE_INT64, TYPE_INT64},
+				Cols:  []string{"device_id", "ts"},
+				PKeys: 2,
+			},
+			expectError: false,
+		},
+		{
+			name: "primary key wider than the table",
 			tableDef: &TableDef{
 				Name:  "test",
 				Types: []uint32{TYPE_INT64, TYPE_INT64},
 				Cols:  []string{"id1", "id2"},
-				PKeys: 2,
+				PKeys: 3,
 			},
 			expectError: true,
-			errorMsg:    "only one primary key is allowed",
+			errorMsg:    "primary key has more columns than the table",
 		},
 	}
 
@@ -660,6 +672,14 @@ func setupTestTable(t *testing.T, db *DB) {
 	db.kv.Commit(&writer)
 }
 
+// the rows of a table or a view as of the latest commit
+func queryAll(db *DB, table string) ([]*Record, error) {
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	return getAllRecords(db, table, &reader)
+}
+
 func insertTestRecord(t *testing.T, db *DB, id int64) {
 	var writer KVTX
 	db.kv.Begin(&writer)
@@ -686,3 +706,2782 @@ func insertTestRecord(t *testing.T, db *DB, id int64) {
 func isEqual(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
+
+func TestIdleTransactionReaped(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+
+	db.SetLimits(TxLimits{IdleTimeout: time.Millisecond})
+	var tx DBTX
+	db.Begin(&tx)
+	db.reap(time.Now().Add(time.Second))
+
+	if err := tx.Err(); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected idle timeout, got %v", err)
+	}
+	record := Record{
+		Cols: []string{"id", "name", "email"},
+		Vals: []Value{
+			{Type: TYPE_INT64, I64: 1},
+			{Type: TYPE_BYTES, Str: []byte("John")},
+			{Type: TYPE_BYTES, Str: []byte("john@example.com")},
+		},
+	}
+	if _, err := tx.Set("users", record, MODE_INSERT_ONLY); !errors.Is(err, ErrTxAborted) {
+		t.Errorf("expected statement on reaped transaction to fail, got %v", err)
+	}
+	// the writer lock must have been released
+	if !db.kv.writer.TryLock() {
+		t.Fatal("writer is still held by the reaped transaction")
+	}
+	db.kv.writer.Unlock()
+	db.Abort(&tx) // no-op
+}
+
+func TestStatementTimeoutAbortsAfterStatement(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+
+	db.SetLimits(TxLimits{StatementTimeout: time.Millisecond})
+	var tx DBTX
+	db.Begin(&tx)
+	err := tx.exec(func() error {
+		db.reap(time.Now().Add(time.Second))
+		return nil
+	})
+	if !errors.Is(err, ErrStatementTimeout) {
+		t.Fatalf("expected statement timeout, got %v", err)
+	}
+	if err := db.Commit(&tx); !errors.Is(err, ErrTxAborted) {
+		t.Errorf("expected commit of aborted transaction to fail, got %v", err)
+	}
+}
+
+func TestStatementTimeoutInterruptsStatement(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+
+	user := func(id int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte("John")).AddStr("email", []byte(fmt.Sprintf("u%d@example.com", id)))
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for id := int64(1); id <= 100; id++ {
+		if _, err := db.Insert("users", user(id), &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	db.SetLimits(TxLimits{StatementTimeout: time.Millisecond})
+	var tx DBTX
+	db.Begin(&tx)
+	rows := 0
+	var scanErr, writeErr error
+	err := tx.exec(func() error {
+		tdef := getTableDefTX(db, "users", &tx.kv)
+		sc := Scanner{
+			Cmp1: CMP_GE, Cmp2: CMP_LE,
+			Key1: *(&Record{}).AddInt64("id", 0),
+			Key2: *(&Record{}).AddInt64("id", 1000),
+		}
+		if err := dbScan(db, tdef, &sc, &tx.kv.Tree); err != nil {
+			return err
+		}
+		for ; sc.Valid(); sc.Next() {
+			if rows++; rows == 10 {
+				db.reap(time.Now().Add(time.Second))
+			}
+		}
+		scanErr = sc.Err()
+		_, writeErr = dbUpdate(db, tdef, user(101), MODE_UPSERT, &tx.kv)
+		return scanErr
+	})
+	if rows != 10 || !errors.Is(scanErr, ErrStatementTimeout) {
+		t.Errorf("scanned %d rows, err %v", rows, scanErr)
+	}
+	if !errors.Is(writeErr, ErrStatementTimeout) {
+		t.Errorf("write after the timeout: %v", writeErr)
+	}
+	if !errors.Is(err, ErrStatementTimeout) || !errors.Is(tx.Err(), ErrTxAborted) {
+		t.Errorf("statement: %v, transaction: %v", err, tx.Err())
+	}
+}
+
+func TestTransactionalCreateTable(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	newTable := func() *TableDef {
+		return &TableDef{
+			Name:  "orders",
+			Types: []uint32{TYPE_INT64, TYPE_BYTES},
+			Cols:  []string{"id", "status"},
+			PKeys: 1,
+		}
+	}
+	record := Record{
+		Cols: []string{"id", "status"},
+		Vals: []Value{{Type: TYPE_INT64, I64: 1}, {Type: TYPE_BYTES, Str: []byte("open")}},
+	}
+	visible := func() bool {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		return GetTableDef(db, "orders", &reader.Tree) != nil
+	}
+
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.TableNew(newTable()); err != nil {
+		t.Fatalf("create in transaction: %v", err)
+	}
+	if _, err := tx.Set("orders", record, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert into table created in the same transaction: %v", err)
+	}
+	db.Abort(&tx)
+	if visible() {
+		t.Fatal("table from aborted transaction is visible")
+	}
+	if _, ok := db.tables["orders"]; ok {
+		t.Fatal("table from aborted transaction leaked into the cache")
+	}
+
+	db.Begin(&tx)
+	if err := tx.TableNew(newTable()); err != nil {
+		t.Fatalf("create in transaction: %v", err)
+	}
+	if visible() {
+		t.Fatal("uncommitted table is visible to readers")
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if !visible() {
+		t.Fatal("committed table is not visible")
+	}
+}
+
+func TestTimeTravelRead(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+	before := db.kv.version
+
+	rename := func(name string) {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		record := Record{
+			Cols: []string{"id", "name", "email"},
+			Vals: []Value{
+				{Type: TYPE_INT64, I64: 1},
+				{Type: TYPE_BYTES, Str: []byte(name)},
+				{Type: TYPE_BYTES, Str: []byte("john@example.com")},
+			},
+		}
+		if _, err := db.Update("users", record, &writer); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	nameAt := func(version uint64) string {
+		var reader KVReader
+		if err := db.BeginReadAt(&reader, version); err != nil {
+			t.Fatalf("begin read at %d: %v", version, err)
+		}
+		defer db.kv.EndRead(&reader)
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: 1}}}
+		if ok, err := db.Get("users", &rec, &reader); err != nil || !ok {
+			t.Fatalf("get at %d: %v", version, err)
+		}
+		return string(rec.Get("name").Str)
+	}
+
+	// churn enough pages that freed ones would be reused
+	for i := 0; i < 20; i++ {
+		rename(fmt.Sprintf("Jane%d", i))
+	}
+	if got := nameAt(before); got != "John" {
+		t.Errorf("expected John as of version %d, got %s", before, got)
+	}
+
+	// the history survives a restart
+	db.kv.Close()
+	if err := db.kv.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := nameAt(before); got != "John" {
+		t.Errorf("expected John after reopen, got %s", got)
+	}
+	rename("Jim")
+	if got := nameAt(db.kv.version - 1); got != "Jane19" {
+		t.Errorf("expected Jane19, got %s", got)
+	}
+
+	var reader KVReader
+	if err := db.BeginReadAsOf(&reader, time.Now().Add(-time.Hour)); !errors.Is(err, ErrVersionNotRetained) {
+		t.Errorf("expected an error for a time before the history, got %v", err)
+	}
+	if err := db.kv.SetHistorySize(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BeginReadAt(&reader, before); !errors.Is(err, ErrVersionNotRetained) {
+		t.Errorf("expected version %d to be dropped, got %v", before, err)
+	}
+}
+
+func TestFreedPagesAreReused(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	if err := db.kv.SetHistorySize(1); err != nil {
+		t.Fatal(err)
+	}
+	setupTestTable(t, db)
+
+	// enough rows to split leaves and internal nodes
+	const rows = 500
+	for i := int64(0); i < rows; i++ {
+		insertTestRecord(t, db, i)
+	}
+	db.kv.Close()
+	if err := db.kv.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for i := int64(0); i < rows; i++ {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: i}}}
+		if ok, err := db.Get("users", &rec, &reader); err != nil || !ok {
+			t.Fatalf("row %d not found: %v", i, err)
+		}
+	}
+	if used := db.kv.page.flushed; used > 50 {
+		t.Errorf("%d pages used for %d rows, freed pages are not reused", used, rows)
+	}
+}
+
+func TestFreeListIsUpdatedIncrementally(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	if err := db.kv.SetHistorySize(1); err != nil {
+		t.Fatal(err)
+	}
+	setupTestTable(t, db)
+
+	// free pages for several free list nodes
+	const rows = 3000
+	email := []byte(strings.Repeat("x", 500))
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for i := int64(0); i < rows; i++ {
+		rec := Record{Cols: []string{"id", "name", "email"},
+			Vals: []Value{{Type: TYPE_INT64, I64: i}, {Type: TYPE_BYTES, Str: []byte("John")}, {Type: TYPE_BYTES, Str: email}}}
+		if _, err := db.Insert("users", rec, &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	db.kv.Begin(&writer)
+	for i := int64(0); i < rows; i++ {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: i}}}
+		if _, err := db.Delete("users", rec, &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	insertTestRecord(t, db, 0)
+
+	// a commit writes the pages it changes, not the whole list
+	db.kv.Begin(&writer)
+	total := writer.free.Total()
+	if total < 2*FREE_LIST_CAP {
+		t.Fatalf("expected more than %d free pages, got %d", 2*FREE_LIST_CAP, total)
+	}
+	rec := Record{Cols: []string{"id", "name", "email"},
+		Vals: []Value{{Type: TYPE_INT64, I64: 1}, {Type: TYPE_BYTES, Str: []byte("Jane")}, {Type: TYPE_BYTES, Str: email}}}
+	if _, err := db.Insert("users", rec, &writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(writer.page.updates); n > 10 {
+		t.Errorf("%d pages written for one row", n)
+	}
+
+	// the count survives a restart
+	db.kv.Close()
+	if err := db.kv.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if got := writer.free.Total(); got < total-10 || got > total+10 {
+		t.Errorf("expected about %d free pages after reopen, got %d", total, got)
+	}
+}
+
+func TestSnapshotsAndBranches(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	for i := int64(1); i <= 300; i++ {
+		insertTestRecord(t, db, i)
+	}
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.SnapshotCreate("before") }); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	exists := func(reader *KVReader, id int64) bool {
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		ok, err := db.Get("users", &rec, reader)
+		if err != nil {
+			t.Fatalf("get %d: %v", id, err)
+		}
+		return ok
+	}
+	deleteRow := func(id int64) {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		rec := Record{Cols: []string{"id"}, Vals: []Value{{Type: TYPE_INT64, I64: id}}}
+		if _, err := db.Delete("users", rec, &writer); err != nil {
+			t.Fatalf("delete %d: %v", id, err)
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	// main moves on, the snapshot keeps its pages
+	for i := int64(1); i <= 100; i++ {
+		deleteRow(i)
+	}
+	insertTestRecord(t, db, 1000)
+
+	var reader KVReader
+	if err := db.kv.BeginReadSnapshot(&reader, "before"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(&reader, 1) || !exists(&reader, 300) || exists(&reader, 1000) {
+		t.Error("snapshot does not show the data at the time it was taken")
+	}
+	db.kv.EndRead(&reader)
+
+	// a branch starts from the snapshot and diverges from main
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.BranchCreate("qa", "before") }); err != nil {
+		t.Fatalf("branch: %v", err)
+	}
+	if err := db.UseBranch("qa"); err != nil {
+		t.Fatal(err)
+	}
+	insertTestRecord(t, db, 2000)
+	db.kv.BeginRead(&reader)
+	if !exists(&reader, 1) || !exists(&reader, 2000) || exists(&reader, 1000) {
+		t.Error("branch does not show its own data")
+	}
+	db.kv.EndRead(&reader)
+
+	// the catalog survives a restart
+	db.kv.Close()
+	if err := db.kv.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := db.UseBranch(MAIN_BRANCH); err != nil {
+		t.Fatal(err)
+	}
+	db.kv.BeginRead(&reader)
+	if exists(&reader, 1) || exists(&reader, 2000) || !exists(&reader, 1000) {
+		t.Error("main shows data of the snapshot or the branch")
+	}
+	db.kv.EndRead(&reader)
+
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.BranchDrop("qa") }); err != nil {
+		t.Fatalf("drop branch: %v", err)
+	}
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.SnapshotDrop("before") }); err != nil {
+		t.Fatalf("drop snapshot: %v", err)
+	}
+	if n := len(db.kv.catalog.refs); n != 0 {
+		t.Errorf("%d shared pages left after dropping every snapshot and branch", n)
+	}
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for i := int64(101); i <= 300; i++ {
+		if !exists(&reader, i) {
+			t.Fatalf("row %d lost after dropping the snapshot", i)
+		}
+	}
+}
+
+func TestIteratorWalksMultiLevelTree(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	const rows = 300
+	for i := int64(1); i <= rows; i++ {
+		insertTestRecord(t, db, i)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	tdef := GetTableDef(db, "users", &reader.Tree)
+	first := encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_INT64, I64: 1}})
+	last := encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_INT64, I64: rows}})
+
+	count := 0
+	iter := reader.Seek(first, CMP_GE)
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if bytes.Compare(key, last) > 0 {
+			t.Fatalf("key beyond the table: %q", key)
+		}
+		count++
+	}
+	if count != rows {
+		t.Errorf("forward scan found %d rows, want %d", count, rows)
+	}
+
+	count = 0
+	for iter = reader.Seek(last, CMP_LE); iter.Valid(); iter.Prev() {
+		key, _ := iter.Deref()
+		if bytes.Compare(key, first) < 0 {
+			break
+		}
+		count++
+	}
+	if count != rows {
+		t.Errorf("backward scan found %d rows, want %d", count, rows)
+	}
+}
+
+func TestRowLockSerializesWriters(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+
+	row := func(name string) Record {
+		return Record{
+			Cols: []string{"id", "name", "email"},
+			Vals: []Value{
+				{Type: TYPE_INT64, I64: 1},
+				{Type: TYPE_BYTES, Str: []byte(name)},
+				{Type: TYPE_BYTES, Str: []byte("john@example.com")},
+			},
+		}
+	}
+	key := func() *Record {
+		return (&Record{}).AddInt64("id", 1)
+	}
+
+	var tx1, tx2 DBTX
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	if ok, err := tx1.GetForUpdate("users", key()); err != nil || !ok {
+		t.Fatalf("lock row: %v %v", ok, err)
+	}
+
+	// tx2 waits for tx1, then sees its change
+	done := make(chan *Record)
+	go func() {
+		rec := key()
+		if ok, err := tx2.GetForUpdate("users", rec); err != nil || !ok {
+			t.Errorf("lock row in second transaction: %v %v", ok, err)
+		}
+		done <- rec
+	}()
+	select {
+	case <-done:
+		t.Fatal("second transaction did not wait for the row lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := tx1.Set("users", row("Alice"), MODE_UPDATE_ONLY); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	rec := <-done
+	if got := string(rec.Get("name").Str); got != "Alice" {
+		t.Fatalf("locked read saw %q, want the committed change", got)
+	}
+	if _, err := tx2.Set("users", row("Bob"), MODE_UPDATE_ONLY); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := db.Commit(&tx2); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	rec = key()
+	if ok, _ := db.Get("users", rec, &reader); !ok || string(rec.Get("name").Str) != "Bob" {
+		t.Fatalf("expected the last committed update, got %v", rec)
+	}
+}
+
+func TestAlterWaitsForTransactions(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	defer db.pool.Stop() // waits for the migration started by the ALTER
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+
+	row := func(id int64) *Record {
+		return (&Record{}).AddInt64("id", id).AddStr("name", []byte("Alice")).AddStr("email", []byte(fmt.Sprintf("a%d@example.com", id)))
+	}
+	var tx1, tx2 DBTX
+	db.Begin(&tx1)
+	db.Begin(&tx2) // reads the table before the ALTER, writes it after
+	if _, err := tx1.Set("users", *row(2), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := db.autocommit(func(tx *DBTX) (bool, error) {
+			return true, tx.AlterTable("users", TableAlter{Op: ALTER_ADD_COLUMN, Col: "age", Type: TYPE_INT64})
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("ALTER did not wait for the transaction writing the table: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("alter: %v", err)
+	}
+
+	// the first write reads the definition again
+	if _, err := tx2.Set("users", *row(3).AddInt64("age", 30), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert with the new column: %v", err)
+	}
+	if err := db.Commit(&tx2); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	rows, err := queryAll(db, "users")
+	if err != nil || len(rows) != 3 || rows[2].Get("age").I64 != 30 || !rows[1].Get("age").Null {
+		t.Errorf("rows %v, err %v", rows, err)
+	}
+}
+
+func TestDeadlockAbortsYoungestTransaction(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+	insertTestRecord(t, db, 2)
+
+	key := func(id int64) *Record {
+		return (&Record{}).AddInt64("id", id)
+	}
+	var older, younger DBTX
+	db.Begin(&older)
+	time.Sleep(time.Millisecond)
+	db.Begin(&younger)
+	if _, err := older.GetForUpdate("users", key(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := younger.GetForUpdate("users", key(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error)
+	go func() {
+		_, err := younger.GetForUpdate("users", key(1))
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// closes the cycle, the younger transaction is the victim
+	if _, err := older.GetForUpdate("users", key(2)); err != nil {
+		t.Fatalf("older transaction: %v", err)
+	}
+	if err := <-waited; !errors.Is(err, ErrDeadlock) || !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("expected the younger transaction to be aborted by a deadlock, got %v", err)
+	}
+	if err := db.Commit(&older); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func TestTransactionWritesPagesOnceAtCommit(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "accounts",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"id", "email", "name"},
+		PKeys:   1,
+		Indexes: [][]string{{"email"}},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	row := func(id int64, email string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddStr("name", []byte("user"))
+	}
+	before := db.kv.page.flushed
+	db.kv.Begin(&writer)
+	for i := int64(1); i <= 1000; i++ {
+		if _, err := db.Insert("accounts", row(i, fmt.Sprintf("user%d@example.com", i)), &writer); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if db.kv.page.flushed != before {
+		t.Fatal("pages were written before the commit")
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	// the intermediate versions of the leaves are not written
+	if grown := db.kv.page.flushed - before; grown > 100 {
+		t.Errorf("a 1000-row transaction appended %d pages", grown)
+	}
+
+	// updating and deleting indexed rows removes their index entries
+	db.kv.Begin(&writer)
+	if _, err := db.Update("accounts", row(1, "first@example.com"), &writer); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := db.Delete("accounts", row(2, ""), &writer); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for email, want := range map[string]bool{
+		"first@example.com": true,
+		"user1@example.com": false,
+		"user2@example.com": false,
+		"user3@example.com": true,
+	} {
+		rec := (&Record{}).AddStr("email", []byte(email))
+		if ok, err := db.Get("accounts", rec, &reader); err != nil || ok != want {
+			t.Errorf("lookup %s: found %v, err %v, want found %v", email, ok, err, want)
+		}
+	}
+}
+
+func TestAttachedCommitIsAtomic(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	setupTestTable(t, db)
+	insertTestRecord(t, db, 1)
+	insertTestRecord(t, db, 2)
+	const tenantPath = "test_tenant.db"
+	defer os.Remove(tenantPath)
+	if err := db.Attach("tenant", tenantPath); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	defer db.closeAttached()
+
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.TableNew(&TableDef{
+		Name:  "tenant.users",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:  []string{"id", "name", "email"},
+		PKeys: 1,
+	}); err != nil {
+		t.Fatalf("create attached table: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// move records from the main file to the attached one
+	move := func(id int64) {
+		rec := (&Record{}).AddInt64("id", id)
+		if ok, err := tx.GetForUpdate("users", rec); err != nil || !ok {
+			t.Fatalf("read %d: %v %v", id, ok, err)
+		}
+		if _, err := tx.Delete("users", *rec); err != nil {
+			t.Fatalf("delete %d: %v", id, err)
+		}
+		if _, err := tx.Set("tenant.users", *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("insert %d: %v", id, err)
+		}
+	}
+	found := func(db *DB, table string, id int64) bool {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		ok, _ := db.Get(table, (&Record{}).AddInt64("id", id), &reader)
+		return ok
+	}
+	tenant, _ := db.resolve("tenant.users")
+
+	db.Begin(&tx)
+	move(1)
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if found(db, "users", 1) || !found(tenant, "users", 1) {
+		t.Fatal("record was not moved")
+	}
+	if _, err := os.Stat(commitLogPath(db.Path)); !os.IsNotExist(err) {
+		t.Fatal("coordinator log left behind")
+	}
+	if err := db.Detach("tenant"); err != nil {
+		t.Fatalf("detach: %v", err)
+	}
+
+	// interrupted right after the commit point, the master pages are
+	// written when the main file is opened again
+	if err := db.Attach("tenant", tenantPath); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	db.Begin(&tx)
+	move(2)
+	var writers []*KVTX
+	for _, part := range []*DBTX{&tx, tx.attached["tenant"]} {
+		writer := &KVTX{}
+		if changed, err := part.db.replay(part, writer); err != nil || !changed {
+			t.Fatalf("prepare: %v %v", changed, err)
+		}
+		writers = append(writers, writer)
+	}
+	if err := writeCommitLog(db.Path, writers); err != nil {
+		t.Fatal(err)
+	}
+	for _, writer := range writers {
+		writer.kv.Abort(writer)
+	}
+	db.Abort(&tx)
+	db.closeAttached()
+	db.kv.Close()
+
+	// the attached file opened on its own is rolled forward too
+	alone := &DB{Path: tenantPath, kv: *newKV(tenantPath), tables: map[string]*TableDef{}, pool: db.pool}
+	if err := alone.kv.Open(); err != nil {
+		t.Fatalf("open attached file: %v", err)
+	}
+	if !found(alone, "users", 2) {
+		t.Fatal("interrupted commit was not recovered on the attached file")
+	}
+	alone.kv.Close()
+	if _, err := os.Stat(preparedPath(tenantPath)); !os.IsNotExist(err) {
+		t.Fatal("prepared marker left behind")
+	}
+
+	db.kv = *newKV(db.Path)
+	db.tables = map[string]*TableDef{}
+	if err := db.kv.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := db.Attach("tenant", tenantPath); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	tenant, _ = db.resolve("tenant.users")
+	if found(db, "users", 2) || !found(tenant, "users", 2) {
+		t.Fatal("interrupted commit was not recovered on both files")
+	}
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	tdef := &TableDef{
+		Name:    "readings",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_FLOAT64},
+		Cols:    []string{"ts", "device_id", "value"},
+		Indexes: [][]string{{"value"}},
+	}
+	if err := setPrimaryKey(tdef, []string{"device_id", "ts"}); err != nil {
+		t.Fatal(err)
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for device := int64(1); device <= 3; device++ {
+		for ts := int64(1); ts <= 5; ts++ {
+			rec := (&Record{}).AddInt64("ts", ts).AddInt64("device_id", device).AddFloat64("value", float64(device*100+ts))
+			if _, err := db.Insert("readings", *rec, &writer); err != nil {
+				t.Fatalf("insert %d/%d: %v", device, ts, err)
+			}
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	rec := (&Record{}).AddInt64("ts", 4).AddInt64("device_id", 2)
+	if ok, err := db.Get("readings", rec, &reader); err != nil || !ok || rec.Get("value").F64 != 204 {
+		t.Errorf("point lookup: found %v, err %v, row %v", ok, err, rec.Vals)
+	}
+	// a range on the leading key column
+	start, end := (&Record{}).AddInt64("device_id", 2), (&Record{}).AddInt64("device_id", 2)
+	if rows, err := db.GetRange("readings", start, end, &reader); err != nil || len(rows) != 5 {
+		t.Errorf("device range: %d rows, err %v", len(rows), err)
+	}
+	start = (&Record{}).AddInt64("device_id", 3).AddInt64("ts", 2)
+	end = (&Record{}).AddInt64("device_id", 3).AddInt64("ts", 4)
+	rows, err := db.GetRange("readings", start, end, &reader)
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("window range: %d rows, err %v", len(rows), err)
+	}
+	for i, row := range rows {
+		if row.Get("device_id").I64 != 3 || row.Get("ts").I64 != int64(i+2) {
+			t.Errorf("window range row %d: %v", i, row.Vals)
+		}
+	}
+	// the secondary index holds both key columns
+	rec = (&Record{}).AddFloat64("value", 305)
+	if ok, err := db.Get("readings", rec, &reader); err != nil || !ok || rec.Get("device_id").I64 != 3 || rec.Get("ts").I64 != 5 {
+		t.Errorf("index lookup: found %v, err %v, row %v", ok, err, rec.Vals)
+	}
+	db.kv.EndRead(&reader)
+
+	db.kv.Begin(&writer)
+	if _, err := db.Delete("readings", *(&Record{}).AddInt64("device_id", 3).AddInt64("ts", 5), &writer); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := db.Update("readings", *(&Record{}).AddInt64("ts", 1).AddInt64("device_id", 1).AddFloat64("value", 999), &writer); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for value, want := range map[float64]bool{305: false, 101: false, 999: true, 102: true} {
+		rec := (&Record{}).AddFloat64("value", value)
+		if ok, err := db.Get("readings", rec, &reader); err != nil || ok != want {
+			t.Errorf("lookup %v: found %v, err %v, want found %v", value, ok, err, want)
+		}
+	}
+}
+
+func TestNullValues(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	tdef := &TableDef{
+		Name:    "people",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"id", "name", "age", "phone"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}},
+	}
+	if err := setNotNull(tdef, []string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	rows := []*Record{
+		(&Record{}).AddInt64("id", 1).AddStr("name", []byte("a")).AddInt64("age", 30).AddStr("phone", []byte("555")),
+		(&Record{}).AddInt64("id", 2).AddStr("name", []byte("b")).AddNull("age").AddNull("phone"),
+		(&Record{}).AddInt64("id", 3).AddStr("name", []byte("c")), // absent columns are NULL
+		(&Record{}).AddInt64("id", 4).AddStr("name", []byte("d")).AddInt64("age", -5),
+	}
+	for _, rec := range rows {
+		if _, err := db.Insert("people", *rec, &writer); err != nil {
+			t.Fatalf("insert %v: %v", rec.Vals, err)
+		}
+	}
+	for _, rec := range []*Record{
+		(&Record{}).AddInt64("id", 5).AddInt64("age", 1),
+		(&Record{}).AddInt64("id", 6).AddNull("name"),
+		(&Record{}).AddNull("id").AddStr("name", []byte("e")),
+	} {
+		if _, err := db.Insert("people", *rec, &writer); err == nil {
+			t.Errorf("insert %v: NULL accepted in a NOT NULL column", rec.Cols)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	rec := (&Record{}).AddInt64("id", 2)
+	if ok, err := db.Get("people", rec, &reader); err != nil || !ok {
+		t.Fatalf("get: %v %v", ok, err)
+	}
+	if !rec.Get("age").Null || !rec.Get("phone").Null || rec.Get("name").Null {
+		t.Errorf("row 2: %+v", rec.Vals)
+	}
+	rec = (&Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("people", rec, &reader); err != nil || !ok || rec.Get("age").Null || string(rec.Get("phone").Str) != "555" {
+		t.Errorf("row 1: %v %v %+v", ok, err, rec.Vals)
+	}
+
+	// the NULLs sort before every value in the index
+	start, end := (&Record{}).AddInt64("age", -100), (&Record{}).AddInt64("age", 100)
+	found, err := db.GetRange("people", start, end, &reader)
+	if err != nil || len(found) != 2 {
+		t.Errorf("age range: %d rows, err %v", len(found), err)
+	}
+	rec = (&Record{}).AddNull("age")
+	if ok, err := db.Get("people", rec, &reader); err != nil || !ok || !rec.Get("age").Null {
+		t.Errorf("lookup by NULL: %v %v %+v", ok, err, rec.Vals)
+	}
+
+	all, err := fullTableScan(db, "people", GetTableDef(db, "people", &reader.Tree), &reader)
+	if err != nil || len(all) != 4 {
+		t.Fatalf("scan: %d rows, err %v", len(all), err)
+	}
+	if n := len(nonNullRecords(all, ColIndex(tdef, "age"))); n != 2 {
+		t.Errorf("COUNT(age) = %d, want 2", n)
+	}
+
+	// rows without NULLs keep the encoding they had before
+	vals := []Value{{Type: TYPE_INT64, I64: 7}, {Type: TYPE_BYTES, Str: []byte("x")}}
+	if got := encodeValues(nil, vals); len(got) != 10 {
+		t.Errorf("a row without NULLs has %d bytes", len(got))
+	}
+}
+
+func TestDefaultsAndChecks(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	tdef := &TableDef{
+		Name:     "products",
+		Types:    []uint32{TYPE_INT64, TYPE_FLOAT64, TYPE_BYTES, TYPE_DATETIME},
+		Cols:     []string{"id", "price", "status", "created"},
+		PKeys:    1,
+		Defaults: []string{"", "0", "'new'", "now()"},
+		Checks:   []string{"price >= 0", "status IN ('new', 'paid', 'shipped')"},
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, bad := range []*TableDef{
+		{Name: "b1", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "n"}, PKeys: 1, Defaults: []string{"", "id + 1"}},
+		{Name: "b2", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "n"}, PKeys: 1, Defaults: []string{"", "'abc'"}},
+		{Name: "b3", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "n"}, PKeys: 1, Checks: []string{"m > 0"}},
+		{Name: "b4", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "n"}, PKeys: 1, Checks: []string{"n > "}},
+	} {
+		if err := db.TableNew(bad, &writer); err == nil {
+			t.Errorf("table %s: bad expression accepted", bad.Name)
+		}
+	}
+
+	before := time.Now().UTC().Add(-time.Second)
+	if _, err := db.Insert("products", *(&Record{}).AddInt64("id", 1), &writer); err != nil {
+		t.Fatalf("insert with defaults: %v", err)
+	}
+	for _, rec := range []*Record{
+		(&Record{}).AddInt64("id", 2).AddFloat64("price", -1),
+		(&Record{}).AddInt64("id", 3).AddStr("status", []byte("lost")),
+	} {
+		if _, err := db.Insert("products", *rec, &writer); !errors.Is(err, ErrCheckViolation) {
+			t.Errorf("insert %v: got %v, want a CHECK violation", rec.Vals, err)
+		}
+	}
+	// NULL is unknown, it passes the CHECK
+	if _, err := db.Insert("products", *(&Record{}).AddInt64("id", 4).AddNull("price"), &writer); err != nil {
+		t.Errorf("insert NULL price: %v", err)
+	}
+	// parsed once, on the definition the writes share
+	if def := getTableDefTX(db, "products", &writer); def.exprs["price >= 0"] == nil {
+		t.Errorf("the CHECKs are not cached on the definition")
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	rec := (&Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("products", rec, &reader); err != nil || !ok {
+		t.Fatalf("get: %v %v", ok, err)
+	}
+	db.kv.EndRead(&reader)
+	if rec.Get("price").F64 != 0 || string(rec.Get("status").Str) != "new" || rec.Get("created").Time.Before(before) {
+		t.Errorf("defaults: %+v", rec.Vals)
+	}
+
+	// a transaction evaluates the defaults once, its replay writes the same row
+	var tx DBTX
+	db.Begin(&tx)
+	if _, err := tx.Set("products", *(&Record{}).AddInt64("id", 5).AddFloat64("price", 9.5), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("tx insert: %v", err)
+	}
+	if _, err := tx.Set("products", *(&Record{}).AddInt64("id", 6).AddFloat64("price", -9.5), MODE_INSERT_ONLY); !errors.Is(err, ErrCheckViolation) {
+		t.Errorf("tx insert: got %v, want a CHECK violation", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(&TableDef{
+		Name:    "accounts",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"id", "email", "name"},
+		PKeys:   1,
+		Indexes: [][]string{{"email"}, {"name"}},
+		Unique:  []int{1, 0},
+	}, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db.kv.Commit(&writer)
+
+	account := func(id int64, email string) Record {
+		rec := (&Record{}).AddInt64("id", id).AddStr("name", []byte("same"))
+		if email == "" {
+			return *rec.AddNull("email")
+		}
+		return *rec.AddStr("email", []byte(email))
+	}
+	db.kv.Begin(&writer)
+	for _, rec := range []Record{account(1, "a@x"), account(2, "b@x"), account(3, ""), account(4, "")} {
+		if _, err := db.Insert("accounts", rec, &writer); err != nil {
+			t.Fatalf("insert %v: %v", rec.Vals, err)
+		}
+	}
+	var dup *DuplicateKeyError
+	if _, err := db.Insert("accounts", account(5, "a@x"), &writer); !errors.As(err, &dup) || dup.Index[0] != "email" {
+		t.Errorf("insert a duplicate: %v", err)
+	}
+	if _, err := db.Update("accounts", account(2, "a@x"), &writer); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("update to a duplicate: %v", err)
+	}
+	// a row keeps its own value
+	if _, err := db.Update("accounts", account(1, "a@x"), &writer); err != nil {
+		t.Errorf("update keeping the value: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second transaction writing the same value waits for the first
+	var tx1, tx2 DBTX
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	if _, err := tx1.Set("accounts", account(10, "c@x"), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := tx2.Set("accounts", account(11, "c@x"), MODE_INSERT_ONLY)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("second transaction did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := <-done; !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("second insert: %v, want a duplicate key", err)
+	}
+	db.Abort(&tx2)
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tables := []*TableDef{
+		{Name: "customers", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1},
+		{
+			Name: "orders", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "customer"}, PKeys: 1,
+			ForeignKeys: []ForeignKey{{Cols: []string{"customer"}, Table: "customers", OnDelete: FK_CASCADE}},
+		},
+		{
+			Name: "invoices", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "customer"}, PKeys: 1,
+			ForeignKeys: []ForeignKey{{Cols: []string{"customer"}, Table: "customers"}},
+		},
+		{
+			Name: "notes", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "customer"}, PKeys: 1,
+			ForeignKeys: []ForeignKey{{Cols: []string{"customer"}, Table: "customers", OnDelete: FK_SET_NULL}},
+		},
+	}
+	for _, tdef := range tables {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	bad := &TableDef{
+		Name: "bad", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "customer"}, PKeys: 1,
+		ForeignKeys: []ForeignKey{{Cols: []string{"customer"}, Table: "customers"}},
+	}
+	if err := db.TableNew(bad, &writer); err == nil {
+		t.Error("created a foreign key of another type")
+	}
+	db.kv.Commit(&writer)
+
+	row := func(id, customer int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddInt64("customer", customer)
+	}
+	db.kv.Begin(&writer)
+	for _, id := range []int64{1, 2, 3} {
+		if _, err := db.Insert("customers", *(&Record{}).AddInt64("id", id).AddStr("name", []byte("c")), &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Insert("orders", row(10, 9), &writer); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("insert referencing a missing row: %v", err)
+	}
+	for _, ins := range []struct {
+		table   string
+		id, ref int64
+	}{{"orders", 10, 1}, {"orders", 11, 1}, {"invoices", 20, 2}, {"notes", 30, 3}} {
+		if _, err := db.Insert(ins.table, row(ins.id, ins.ref), &writer); err != nil {
+			t.Fatalf("insert into %s: %v", ins.table, err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx DBTX
+	db.Begin(&tx)
+	customer := func(id int64) Record { return *(&Record{}).AddInt64("id", id) }
+	if _, err := tx.Delete("customers", customer(2)); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("delete a restricted row: %v", err)
+	}
+	for _, id := range []int64{1, 3} {
+		if ok, err := tx.Delete("customers", customer(id)); !ok || err != nil {
+			t.Fatalf("delete customer %d: %v %v", id, ok, err)
+		}
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for _, id := range []int64{10, 11} {
+		if ok, _ := db.Get("orders", (&Record{}).AddInt64("id", id), &reader); ok {
+			t.Errorf("order %d survived the cascade", id)
+		}
+	}
+	note := (&Record{}).AddInt64("id", 30)
+	if ok, _ := db.Get("notes", note, &reader); !ok || !note.Get("customer").Null {
+		t.Errorf("note after SET NULL: %v %v", ok, note.Vals)
+	}
+	invoice := (&Record{}).AddInt64("id", 20)
+	if ok, _ := db.Get("invoices", invoice, &reader); !ok {
+		t.Error("the restricted invoice is gone")
+	}
+}
+
+func TestSequences(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.SequenceCreate("tickets", 1000, &writer); err != nil {
+		t.Fatalf("create sequence: %v", err)
+	}
+	if err := db.TableNew(&TableDef{
+		Name:          "events",
+		Types:         []uint32{TYPE_INT64, TYPE_INT64},
+		Cols:          []string{"id", "ticket"},
+		PKeys:         1,
+		AutoIncrement: true,
+		Defaults:      []string{"", "nextval('tickets')"},
+	}, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := db.SequenceCreate("tickets", 1, &writer); !errors.Is(err, ErrSequenceExists) {
+		t.Errorf("create again: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent callers never get the same value, past the cached range too
+	seen := map[int64]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < SEQUENCE_CACHE; i++ {
+				v, err := db.NextVal("tickets")
+				mu.Lock()
+				if err != nil || seen[v] || v < 1000 {
+					t.Errorf("nextval: %d %v", v, err)
+				}
+				seen[v] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the id is left out, by a transaction and by a plain writer
+	var tx DBTX
+	db.Begin(&tx)
+	if _, err := tx.Set("events", Record{}, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	// an explicit id in the range the transaction took from the sequence
+	db.kv.Begin(&writer)
+	if _, err := db.Insert("events", Record{}, &writer); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := db.Insert("events", *(&Record{}).AddInt64("id", 10), &writer); err != nil {
+		t.Fatalf("insert an explicit id: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	db.kv.Begin(&writer)
+	if _, err := db.Insert("events", *(&Record{}).AddInt64("id", 100), &writer); err != nil {
+		t.Fatalf("insert an explicit id: %v", err)
+	}
+	if _, err := db.Insert("events", Record{}, &writer); err != nil {
+		t.Fatalf("insert after it: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	for _, id := range []int64{1, 10, 100, 101} {
+		rec := (&Record{}).AddInt64("id", id)
+		if ok, _ := db.Get("events", rec, &reader); !ok {
+			t.Errorf("no event %d", id)
+		} else if ticket := rec.Get("ticket").I64; seen[ticket] || ticket < 1000 {
+			t.Errorf("event %d got the ticket %d", id, ticket)
+		}
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	db.pool = nil // migrate below instead of in the background
+
+	exec := func(f func(*KVTX) error) error {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		if err := f(&writer); err != nil {
+			db.kv.Abort(&writer)
+			return err
+		}
+		return db.kv.Commit(&writer)
+	}
+	get := func(id int64) *Record {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		rec := (&Record{}).AddInt64("id", id)
+		if ok, err := db.Get("products", rec, &reader); !ok || err != nil {
+			t.Fatalf("get %d: %v %v", id, ok, err)
+		}
+		return rec
+	}
+
+	err := exec(func(w *KVTX) error {
+		if err := db.TableNew(&TableDef{
+			Name:    "products",
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64},
+			Cols:    []string{"id", "name", "price"},
+			PKeys:   1,
+			Indexes: [][]string{{"name"}},
+		}, w); err != nil {
+			return err
+		}
+		for _, id := range []int64{1, 2} {
+			rec := (&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("p", id))).AddFloat64("price", 9.5)
+			if _, err := db.Insert("products", *rec, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rows written before take the default
+	err = exec(func(w *KVTX) error {
+		return db.AlterTable("products", TableAlter{Op: ALTER_ADD_COLUMN, Col: "stock", Type: TYPE_INT64, NotNull: true, Default: "5"}, w)
+	})
+	if err != nil {
+		t.Fatalf("add column: %v", err)
+	}
+	if rec := get(1); rec.Get("stock") == nil || rec.Get("stock").I64 != 5 || rec.Get("price").F64 != 9.5 {
+		t.Errorf("old row after ADD COLUMN: %v %v", rec.Cols, rec.Vals)
+	}
+	err = exec(func(w *KVTX) error {
+		rec := (&Record{}).AddInt64("id", 3).AddStr("name", []byte("p3")).AddFloat64("price", 1).AddInt64("stock", 9)
+		_, err := db.Insert("products", *rec, w)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	err = exec(func(w *KVTX) error {
+		return db.AlterTable("products", TableAlter{Op: ALTER_DROP_COLUMN, Col: "name"}, w)
+	})
+	if !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("drop an indexed column: %v", err)
+	}
+	err = exec(func(w *KVTX) error {
+		if err := db.AlterTable("products", TableAlter{Op: ALTER_DROP_COLUMN, Col: "price"}, w); err != nil {
+			return err
+		}
+		return db.AlterTable("products", TableAlter{Op: ALTER_RENAME_COLUMN, Col: "name", NewName: "title"}, w)
+	})
+	if err != nil {
+		t.Fatalf("drop and rename: %v", err)
+	}
+	for id, stock := range map[int64]int64{1: 5, 3: 9} {
+		rec := get(id)
+		if rec.Get("price") != nil || string(rec.Get("title").Str) != fmt.Sprint("p", id) || rec.Get("stock").I64 != stock {
+			t.Errorf("row %d after DROP and RENAME: %v %v", id, rec.Cols, rec.Vals)
+		}
+	}
+
+	// the renamed column keeps its index
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	key := *(&Record{}).AddStr("title", []byte("p2"))
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := db.Scan("products", &sc, &reader.Tree); err != nil || !sc.Valid() {
+		t.Errorf("lookup by the renamed column: %v", err)
+	}
+	db.kv.EndRead(&reader)
+
+	// the migration rewrites the old rows, then forgets their layouts
+	if err := db.MigrateTable("products"); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	db.kv.BeginRead(&reader)
+	tdef := GetTableDef(db, "products", &reader.Tree)
+	for iter := reader.Tree.Seek(encodeKey(nil, tdef.Prefix, nil), CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if binary.BigEndian.Uint32(key) != tdef.Prefix {
+			break
+		}
+		if v := rowVersion(tdef, val); v != tdef.Version {
+			t.Errorf("row of version %d after the migration, want %d", v, tdef.Version)
+		}
+	}
+	db.kv.EndRead(&reader)
+	if len(tdef.Layouts) != 0 {
+		t.Errorf("layouts after the migration: %v", tdef.Layouts)
+	}
+	if rec := get(2); rec.Get("stock").I64 != 5 || string(rec.Get("title").Str) != "p2" {
+		t.Errorf("migrated row: %v %v", rec.Cols, rec.Vals)
+	}
+
+	// a table from before the versions keeps its rows untagged after its
+	// first ALTER, read under the layout of version 0 until the migration
+	err = exec(func(w *KVTX) error {
+		legacy := &TableDef{Name: "legacy", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"}, PKeys: 1}
+		if err := db.TableNew(legacy, w); err != nil {
+			return err
+		}
+		legacy.Version, legacy.ColIDs, legacy.NextColID = 0, nil, 0
+		if err := tableDefUpdate(db, legacy, w); err != nil {
+			return err
+		}
+		_, err := db.Insert("legacy", *(&Record{}).AddInt64("id", 1).AddStr("v", []byte("old")), w)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alter := range []TableAlter{
+		{Op: ALTER_ADD_COLUMN, Col: "n", Type: TYPE_INT64},
+		{Op: ALTER_DROP_COLUMN, Col: "v"},
+	} {
+		if err := exec(func(w *KVTX) error { return db.AlterTable("legacy", alter, w) }); err != nil {
+			t.Fatalf("alter a legacy table: %v", err)
+		}
+	}
+	// no zero byte before its bitmap, it would read as an untagged `v`
+	// without the padding
+	const n = 0x0101010101010101
+	err = exec(func(w *KVTX) error {
+		_, err := db.Insert("legacy", *(&Record{}).AddInt64("id", 2).AddInt64("n", n), w)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyRows := func(stage string, versions ...uint32) {
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		tdef := GetTableDef(db, "legacy", &reader.Tree)
+		for i, want := range []struct {
+			n    int64
+			null bool
+		}{{0, true}, {n, false}} {
+			rec := (&Record{}).AddInt64("id", int64(i+1))
+			if ok, err := db.Get("legacy", rec, &reader); !ok || err != nil {
+				t.Fatalf("%s: get %d: %v %v", stage, i+1, ok, err)
+			}
+			if len(rec.Cols) != 2 || rec.Get("n").Null != want.null || rec.Get("n").I64 != want.n {
+				t.Errorf("%s: legacy row %d: %v %v", stage, i+1, rec.Cols, rec.Vals)
+			}
+			val, _, _ := reader.Tree.Get(encodeKey(nil, tdef.Prefix, rec.Vals[:1]))
+			if v := rowVersion(tdef, val); v != versions[i] {
+				t.Errorf("%s: legacy row %d of version %d, want %d", stage, i+1, v, versions[i])
+			}
+		}
+	}
+	legacyRows("before the migration", 0, 3)
+	if err := db.MigrateTable("legacy"); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	legacyRows("after the migration", 3, 3)
+}
+
+func TestDropTable(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+	if err := db.kv.SetHistorySize(1); err != nil {
+		t.Fatal(err)
+	}
+
+	users := func() *TableDef {
+		return &TableDef{
+			Name: "users", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1,
+			Indexes: [][]string{{"name"}},
+		}
+	}
+	fill := func(table string, rows int64) {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		for i := int64(1); i <= rows; i++ {
+			rec := (&Record{}).AddInt64("id", i).AddStr("name", []byte(fmt.Sprintf("name-%04d", i)))
+			if _, err := db.Insert(table, *rec, &writer); err != nil {
+				t.Fatalf("insert into %s: %v", table, err)
+			}
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{users(), {
+		Name: "orders", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1,
+	}} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	fill("users", 400)
+	fill("orders", 100)
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.SnapshotCreate("before") }); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	dropped := GetTableDef(db, "users", &reader.Tree)
+	db.kv.EndRead(&reader)
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.TableDrop("users"); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	db.kv.BeginRead(&reader)
+	if GetTableDef(db, "users", &reader.Tree) != nil {
+		t.Error("the definition survived the drop")
+	}
+	for _, prefix := range append([]uint32{dropped.Prefix}, dropped.IndexPrefix...) {
+		start, end := prefixRange(prefix)
+		if iter := reader.Tree.Seek(start, CMP_GE); iter.Valid() {
+			if key, _ := iter.Deref(); bytes.Compare(key, end) < 0 {
+				t.Errorf("keys left under the prefix %d", prefix)
+			}
+		}
+	}
+	for i := int64(1); i <= 100; i++ {
+		if ok, _ := db.Get("orders", (&Record{}).AddInt64("id", i), &reader); !ok {
+			t.Fatalf("order %d lost by the drop", i)
+		}
+	}
+	db.kv.EndRead(&reader)
+
+	// the snapshot keeps the pages it shares with the dropped table
+	if err := db.kv.BeginReadSnapshot(&reader, "before"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 200, 400} {
+		if ok, _ := db.Get("users", (&Record{}).AddInt64("id", id), &reader); !ok {
+			t.Errorf("user %d missing from the snapshot", id)
+		}
+	}
+	db.kv.EndRead(&reader)
+	if err := db.catalogOp(nil, func(tx *KVTX) error { return tx.SnapshotDrop("before") }); err != nil {
+		t.Fatalf("drop snapshot: %v", err)
+	}
+	if n := len(db.kv.catalog.refs); n != 0 {
+		t.Errorf("%d shared pages left after dropping the snapshot", n)
+	}
+
+	// the name is free again, and the new rows take the freed pages
+	used := db.kv.page.flushed
+	db.kv.Begin(&writer)
+	if err := db.TableNew(users(), &writer); err != nil {
+		t.Fatalf("create again: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	fill("users", 400)
+	if grown := db.kv.page.flushed - used; grown > 10 {
+		t.Errorf("the file grew by %d pages, the dropped pages are not reused", grown)
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(&TableDef{
+		Name: "people", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "city", "email"}, PKeys: 1,
+	}, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	person := func(id int64, city string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("city", []byte(city)).AddStr("email", []byte(fmt.Sprintf("p%d@x", id)))
+	}
+	for i := int64(1); i <= 600; i++ {
+		if _, err := db.Insert("people", person(i, fmt.Sprintf("c%d", i%10)), &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writes go on while the index is built
+	done := make(chan error)
+	go func() {
+		for i := int64(1); i <= 200; i++ {
+			var writer KVTX
+			db.kv.Begin(&writer)
+			_, err := db.Insert("people", person(1000+i, "new"), &writer)
+			if err == nil {
+				_, err = db.Delete("people", *(&Record{}).AddInt64("id", i), &writer)
+			}
+			if err == nil {
+				_, err = db.Update("people", person(300+i, "moved"), &writer)
+			}
+			if err != nil {
+				db.kv.Abort(&writer)
+				done <- err
+				return
+			}
+			if err := db.kv.Commit(&writer); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.IndexCreate("people", []string{"city"}, IndexOptions{}); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("concurrent writes: %v", err)
+	}
+
+	// every row has exactly one entry, with its current value
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	tdef := GetTableDef(db, "people", &reader.Tree)
+	if i, err := findIndex(tdef, []string{"city"}); err != nil || tdef.Building != nil {
+		t.Fatalf("index not ready: %d %v %v", i, err, tdef.Building)
+	}
+	cities := map[int64]string{}
+	start, end := prefixRange(tdef.Prefix)
+	for iter := reader.Tree.Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+		if key, _ := iter.Deref(); bytes.Compare(key, end) >= 0 {
+			break
+		}
+		key, val := iter.Deref()
+		values := []Value{{Type: TYPE_INT64}, {Type: TYPE_BYTES}, {Type: TYPE_BYTES}}
+		decodeValues(key[4:], values[:1])
+		decodeRow(tdef, val, values[1:])
+		cities[values[0].I64] = string(values[1].Str)
+	}
+	entries := 0
+	start, end = prefixRange(tdef.IndexPrefix[0])
+	for iter := reader.Tree.Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		entries++
+		ivals := []Value{{Type: TYPE_BYTES}, {Type: TYPE_INT64}}
+		decodeIndexKey(key[4:], tdef, tdef.Indexes[0], ivals)
+		if city, ok := cities[ivals[1].I64]; !ok || city != string(ivals[0].Str) {
+			t.Fatalf("stale entry %s for row %d (%q)", ivals[0].Str, ivals[1].I64, city)
+		}
+	}
+	if entries != len(cities) || len(cities) != 600 {
+		t.Errorf("%d entries for %d rows", entries, len(cities))
+	}
+	db.kv.EndRead(&reader)
+
+	if err := db.IndexCreate("people", []string{"city"}, IndexOptions{}); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("create the same index again: %v", err)
+	}
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.IndexDrop("people", []string{"city"}); err != nil {
+		t.Fatalf("drop index: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	db.kv.BeginRead(&reader)
+	dropped := tdef.IndexPrefix[0]
+	tdef = GetTableDef(db, "people", &reader.Tree)
+	if _, err := findIndex(tdef, []string{"city"}); err == nil {
+		t.Error("the dropped index is still used")
+	}
+	start, end = prefixRange(dropped)
+	if iter := reader.Tree.Seek(start, CMP_GE); iter.Valid() {
+		if key, _ := iter.Deref(); bytes.Compare(key, end) < 0 {
+			t.Error("entries left after DROP INDEX")
+		}
+	}
+	db.kv.EndRead(&reader)
+
+	// a UNIQUE index is checked against the rows already there
+	if err := db.IndexCreate("people", []string{"city"}, IndexOptions{Unique: true}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("unique index over duplicates: %v", err)
+	}
+	if err := db.IndexCreate("people", []string{"email"}, IndexOptions{Unique: true}); err != nil {
+		t.Fatalf("create unique index: %v", err)
+	}
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if tdef := getTableDefTX(db, "people", &writer); len(tdef.Indexes) != 1 {
+		t.Errorf("indexes after the failed build: %v", tdef.Indexes)
+	}
+	dup := person(5000, "x")
+	dup.Get("email").Str = []byte("p600@x")
+	if _, err := db.Insert("people", dup, &writer); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert a duplicate email: %v", err)
+	}
+}
+
+func TestRenameTable(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{
+		{Name: "customers", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1},
+		{
+			Name: "orders", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "customer"}, PKeys: 1,
+			ForeignKeys: []ForeignKey{{Cols: []string{"customer"}, Table: "customers"}},
+		},
+	} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	if _, err := db.Insert("customers", *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("c")), &writer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("orders", *(&Record{}).AddInt64("id", 10).AddInt64("customer", 1), &writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.TableRename("customers", "clients", true); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	// the old name works in the same transaction
+	if ok, err := tx.Get("customers", (&Record{}).AddInt64("id", 1)); !ok || err != nil {
+		t.Errorf("get through the alias: %v %v", ok, err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	clients := GetTableDef(db, "clients", &reader.Tree)
+	if clients == nil || GetTableDef(db, "customers", &reader.Tree) != clients {
+		t.Fatal("the alias doesn't stand for the renamed table")
+	}
+	if orders := GetTableDef(db, "orders", &reader.Tree); orders.ForeignKeys[0].Table != "clients" {
+		t.Errorf("the foreign key still names %s", orders.ForeignKeys[0].Table)
+	}
+	if ok, _ := db.Get("clients", (&Record{}).AddInt64("id", 1), &reader); !ok {
+		t.Error("the rows didn't follow the table")
+	}
+	db.kv.EndRead(&reader)
+
+	db.Begin(&tx)
+	if _, err := tx.Delete("customers", *(&Record{}).AddInt64("id", 1)); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("delete a referenced row through the alias: %v", err)
+	}
+	if _, err := tx.Set("orders", *(&Record{}).AddInt64("id", 11).AddInt64("customer", 1), MODE_INSERT_ONLY); err != nil {
+		t.Errorf("insert referencing the renamed table: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	db.kv.Begin(&writer)
+	if err := db.TableNew(&TableDef{Name: "customers", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}, &writer); !errors.Is(err, ErrTableAlreadyExists) {
+		t.Errorf("create a table named like an alias: %v", err)
+	}
+	if err := db.TableRename("orders", "purchases", false, &writer); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := db.TableAliasDrop("customers", &writer); err != nil {
+		t.Fatalf("drop alias: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	if GetTableDef(db, "customers", &reader.Tree) != nil || GetTableDef(db, "orders", &reader.Tree) != nil {
+		t.Error("an old name survived")
+	}
+	if refs := GetTableDef(db, "clients", &reader.Tree).ReferencedBy; len(refs) != 1 || refs[0] != "purchases" {
+		t.Errorf("referenced by %v", refs)
+	}
+}
+
+func TestViews(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	orders := &TableDef{
+		Name: "orders", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64}, Cols: []string{"id", "status", "total"}, PKeys: 1,
+	}
+	if err := db.TableNew(orders, &writer); err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range []string{"open", "paid", "open", "open"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("status", []byte(status)).AddInt64("total", int64(10*(i+1)))
+		if _, err := db.Insert("orders", *rec, &writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.ViewCreate("open_orders", "SELECT id, total FROM orders WHERE status = 'open'"); err != nil {
+		t.Fatalf("create view: %v", err)
+	}
+	if err := tx.ViewCreate("big_orders", "select * from open_orders where total > 10"); err != nil {
+		t.Fatalf("create a view of a view: %v", err)
+	}
+	for _, query := range []string{"SELECT id FROM nope", "SELECT id, nope FROM orders", "SELECT id FROM orders WHERE nope = 1", "DELETE FROM orders"} {
+		if err := tx.ViewCreate("bad", query); err == nil {
+			t.Errorf("created a view of %q", query)
+		}
+	}
+	if err := tx.ViewCreate("orders", "SELECT * FROM orders"); !errors.Is(err, ErrTableAlreadyExists) {
+		t.Errorf("create a view named like a table: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// projected and filtered, by the aggregates and GET alike
+	rows, err := queryAll(db, "open_orders")
+	if err != nil || len(rows) != 3 || len(rows[0].Cols) != 2 || rows[2].Get("total").I64 != 40 {
+		t.Fatalf("scan the view: %v %v", rows, err)
+	}
+	if rows, err := queryAll(db, "big_orders"); err != nil || len(rows) != 2 {
+		t.Errorf("scan a view of a view: %v %v", rows, err)
+	}
+	get := func(req QueryRequest) GetResponse {
+		req.response = make(chan GetResponse, 1)
+		processQueryRequest(req, db)
+		return <-req.response
+	}
+	resp := get(QueryRequest{tableName: "open_orders", cols: []string{"id"}, startVals: []string{"3"}, queryType: SingleRecord})
+	if resp.err != nil || !resp.found || len(resp.records) != 1 || resp.records[0].Get("total").I64 != 30 {
+		t.Errorf("get from the view: %+v", resp)
+	}
+	if resp := get(QueryRequest{tableName: "open_orders", cols: []string{"id"}, startVals: []string{"2"}, queryType: SingleRecord}); resp.found {
+		t.Error("got a row filtered out by the view")
+	}
+	resp = get(QueryRequest{tableName: "big_orders", cols: []string{"total"}, startVals: []string{"20"}, endVals: []string{"30"}, queryType: RangeQuery})
+	if resp.err != nil || len(resp.records) != 1 || resp.records[0].Get("id").I64 != 3 {
+		t.Errorf("range over the view: %+v", resp)
+	}
+
+	db.kv.Begin(&writer)
+	if err := db.TableNew(&TableDef{Name: "open_orders", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}, &writer); !errors.Is(err, ErrViewExists) {
+		t.Errorf("create a table named like a view: %v", err)
+	}
+	// the view follows its table
+	if err := db.TableRename("orders", "purchases", false, &writer); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if view := getView(db, "open_orders", &writer.Tree); view == nil || view.Table != "purchases" {
+		t.Errorf("the view doesn't follow the renamed table: %+v", view)
+	}
+	if err := db.ViewDrop("open_orders", &writer); err != nil {
+		t.Fatalf("drop view: %v", err)
+	}
+	if err := db.ViewDrop("open_orders", &writer); !errors.Is(err, ErrViewNotFound) {
+		t.Errorf("drop a dropped view: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queryAll(db, "big_orders"); err == nil {
+		t.Error("read a view of a dropped view")
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{
+		{Name: "orders", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64}, Cols: []string{"id", "status", "total"}, PKeys: 1},
+		{Name: "order_log", Types: []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "order_id", "status"}, PKeys: 1, AutoIncrement: true},
+		{Name: "totals", Types: []uint32{TYPE_BYTES, TYPE_INT64}, Cols: []string{"status", "total"}, PKeys: 1},
+	} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx DBTX
+	db.Begin(&tx)
+	for _, trig := range []Trigger{
+		{Name: "norm", Timing: "before", Event: "insert", Action: "set", Cols: []string{"status"}, Exprs: []string{"lower(status)"}},
+		{Name: "keep_paid", Timing: "before", Event: "delete", When: "old.status = 'paid'", Action: "reject", Message: "paid orders are kept"},
+		{
+			Name: "audit", Timing: "after", Event: "update", When: "OLD.status != NEW.status", Action: "insert",
+			Table: "order_log", Cols: []string{"order_id", "status"}, Exprs: []string{"id", "new.status"},
+		},
+		{
+			Name: "summary", Timing: "after", Event: "insert", Action: "upsert",
+			Table: "totals", Cols: []string{"status", "total"}, Exprs: []string{"status", "total"},
+		},
+	} {
+		if err := tx.TriggerCreate("orders", trig); err != nil {
+			t.Fatalf("create trigger %s: %v", trig.Name, err)
+		}
+	}
+	for _, trig := range []Trigger{
+		{Name: "t", Timing: "before", Event: "insert", When: "old.total > 0", Action: "reject"},
+		{Name: "t", Timing: "after", Event: "insert", Action: "set", Cols: []string{"total"}, Exprs: []string{"1"}},
+		{Name: "t", Timing: "before", Event: "update", Action: "set", Cols: []string{"id"}, Exprs: []string{"1"}},
+		{Name: "t", Timing: "after", Event: "insert", Action: "insert", Table: "nope"},
+		{Name: "t", Timing: "after", Event: "insert", Action: "insert", Table: "totals", Cols: []string{"nope"}, Exprs: []string{"1"}},
+		{Name: "norm", Timing: "before", Event: "delete", Action: "reject"},
+	} {
+		if err := tx.TriggerCreate("orders", trig); err == nil {
+			t.Errorf("created the trigger %+v", trig)
+		}
+	}
+	for i, status := range []string{"OPEN", "paid"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("status", []byte(status)).AddInt64("total", int64(10*(i+1)))
+		if _, err := tx.Set("orders", *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if _, err := tx.Set("orders", *(&Record{}).AddInt64("id", 1).AddStr("status", []byte("paid")).AddInt64("total", 10), MODE_UPDATE_ONLY); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := tx.Delete("orders", *(&Record{}).AddInt64("id", 2)); !errors.Is(err, ErrTriggerRejected) {
+		t.Errorf("delete a paid order: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// the replay wrote the same rows as the transaction
+	rows, err := queryAll(db, "orders")
+	if err != nil || len(rows) != 2 || string(rows[0].Get("status").Str) != "paid" {
+		t.Errorf("orders: %v %v", rows, err)
+	}
+	rows, err = queryAll(db, "order_log")
+	if err != nil || len(rows) != 1 || rows[0].Get("order_id").I64 != 1 || string(rows[0].Get("status").Str) != "paid" {
+		t.Errorf("order_log: %v %v", rows, err)
+	}
+	rows, err = queryAll(db, "totals")
+	if err != nil || len(rows) != 2 || string(rows[0].Get("status").Str) != "open" || rows[0].Get("total").I64 != 10 {
+		t.Errorf("totals: %v %v", rows, err)
+	}
+
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if err := db.AlterTable("orders", TableAlter{Op: ALTER_DROP_COLUMN, Col: "total"}, &writer); !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("drop a column read by a trigger: %v", err)
+	}
+	if err := db.TableRename("order_log", "history", false, &writer); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if trig := getTableDefTX(db, "orders", &writer).Triggers[2]; trig.Table != "history" {
+		t.Errorf("the trigger still writes to %s", trig.Table)
+	}
+	if err := db.TriggerDrop("orders", "keep_paid", &writer); err != nil {
+		t.Fatalf("drop trigger: %v", err)
+	}
+	if _, err := db.Delete("orders", *(&Record{}).AddInt64("id", 2), &writer); err != nil {
+		t.Errorf("delete once the trigger is dropped: %v", err)
+	}
+	if err := db.TriggerDrop("orders", "keep_paid", &writer); !errors.Is(err, ErrTriggerNotFound) {
+		t.Errorf("drop a dropped trigger: %v", err)
+	}
+
+	// a table written by a trigger of another table is kept
+	err = db.TableDrop("history", &writer)
+	if !errors.Is(err, ErrTriggerTarget) || !strings.Contains(err.Error(), "audit on orders") {
+		t.Errorf("drop a table written by a trigger: %v", err)
+	}
+	if err := db.TriggerDrop("orders", "audit", &writer); err != nil {
+		t.Fatalf("drop trigger: %v", err)
+	}
+	if err := db.TableDrop("history", &writer); err != nil {
+		t.Errorf("drop once the trigger is dropped: %v", err)
+	}
+	if err := db.TableDrop("orders", &writer); err != nil {
+		t.Errorf("drop the table of the triggers: %v", err)
+	}
+	if err := db.TableDrop("totals", &writer); err != nil {
+		t.Errorf("drop once the table of the trigger is dropped: %v", err)
+	}
+}
+
+func TestTriggerWritesLockRows(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{
+		{Name: "orders", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "status"}, PKeys: 1},
+		{Name: "latest", Types: []uint32{TYPE_BYTES, TYPE_INT64}, Cols: []string{"status", "id"}, PKeys: 1},
+	} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	trig := Trigger{
+		Name: "track", Timing: TRIGGER_AFTER, Event: TRIGGER_INSERT, Action: ACTION_UPSERT,
+		Table: "latest", Cols: []string{"status", "id"}, Exprs: []string{"status", "id"},
+	}
+	if err := db.TriggerCreate("orders", trig, &writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	order := func(id int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("status", []byte("open"))
+	}
+	var tx1, tx2 DBTX
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	if _, err := tx1.Set("orders", order(1), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	// the trigger of the second one upserts the row of the first
+	done := make(chan error)
+	go func() {
+		_, err := tx2.Set("orders", order(2), MODE_INSERT_ONLY)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("the trigger did not wait for the row locked by the other one: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := db.Commit(&tx2); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	rows, err := queryAll(db, "latest")
+	if err != nil || len(rows) != 1 || rows[0].Get("id").I64 != 2 {
+		t.Errorf("latest: %v %v", rows, err)
+	}
+
+	// the expressions are parsed once per definition
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if tdef := getTableDefTX(db, "orders", &writer); tdef.exprs["status"] == nil || tdef.exprs["id"] == nil {
+		t.Errorf("trigger expressions not cached: %v", tdef.exprs)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	tdef := &TableDef{
+		Name:    "sessions",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_DATETIME},
+		Cols:    []string{"id", "token", "created"},
+		PKeys:   1,
+		Indexes: [][]string{{"token"}},
+		Unique:  []int{1},
+		TTL:     &TTL{Col: "created", Seconds: 3600},
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := db.TableNew(&TableDef{
+		Name: "logins", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "session"}, PKeys: 1,
+		ForeignKeys: []ForeignKey{{Cols: []string{"session"}, Table: "sessions"}},
+	}, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	now := time.Now()
+	session := func(id int64, token string) *Record {
+		return (&Record{}).AddInt64("id", id).AddStr("token", []byte(token))
+	}
+	for _, rec := range []*Record{
+		session(1, "a").AddDateTime("created", now.Add(-2*time.Hour)),
+		session(2, "b").AddDateTime("created", now),
+		session(3, "c").AddNull("created"),
+		session(4, "d").AddDateTime("created", now.Add(-3*time.Hour)),
+	} {
+		if _, err := db.Insert("sessions", *rec, &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	// a write over an expired row is an insert
+	if _, err := db.Insert("sessions", *session(4, "e").AddDateTime("created", now), &writer); err != nil {
+		t.Errorf("insert over an expired row: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	if ok, err := db.Get("sessions", (&Record{}).AddInt64("id", 1), &reader); err != nil || ok {
+		t.Errorf("get an expired row: %v %v", ok, err)
+	}
+	if ok, err := db.Get("sessions", (&Record{}).AddInt64("id", 3), &reader); err != nil || !ok {
+		t.Errorf("get a row with no expiry: %v %v", ok, err)
+	}
+	start, end := (&Record{}).AddInt64("id", 1), (&Record{}).AddInt64("id", 4)
+	if rows, err := db.GetRange("sessions", start, end, &reader); err != nil || len(rows) != 3 {
+		t.Errorf("range: %d rows, err %v", len(rows), err)
+	}
+	scan := func(key1, key2 *Record) int {
+		sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *key1, Key2: *key2}
+		if err := db.Scan("sessions", &sc, &reader.Tree); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		n := 0
+		for ; sc.Valid(); sc.Next() {
+			var rec Record
+			sc.Deref(&rec, &reader.Tree)
+			if rec.Get("id").I64 == 1 {
+				t.Errorf("scanned an expired row")
+			}
+			n++
+		}
+		return n
+	}
+	if n := scan(start, end); n != 3 {
+		t.Errorf("scan: %d rows", n)
+	}
+	if n := scan((&Record{}).AddStr("token", []byte("a")), (&Record{}).AddStr("token", []byte("z"))); n != 3 {
+		t.Errorf("index scan: %d rows", n)
+	}
+	db.kv.EndRead(&reader)
+	if rows, err := queryAll(db, "sessions"); err != nil || len(rows) != 3 {
+		t.Errorf("scan: %d rows, err %v", len(rows), err)
+	}
+
+	// an expired row is absent to the constraints before it is purged
+	db.kv.Begin(&writer)
+	login := func(session int64) error {
+		_, err := db.Insert("logins", *(&Record{}).AddInt64("id", session).AddInt64("session", session), &writer)
+		return err
+	}
+	if err := login(1); !errors.Is(err, ErrForeignKey) {
+		t.Errorf("reference an expired row: %v", err)
+	}
+	if err := login(2); err != nil {
+		t.Errorf("reference a row: %v", err)
+	}
+	if _, err := db.Insert("sessions", *session(5, "a").AddDateTime("created", now), &writer); err != nil {
+		t.Errorf("take the token of an expired row: %v", err)
+	}
+	db.kv.Abort(&writer)
+	if n, err := db.PurgeExpired(); err != nil || n != 1 {
+		t.Errorf("purge: %d rows, err %v", n, err)
+	}
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if _, err := db.Insert("sessions", *session(5, "a").AddDateTime("created", now), &writer); err != nil {
+		t.Errorf("take the token of a purged row: %v", err)
+	}
+	if err := db.AlterTable("sessions", TableAlter{Op: ALTER_DROP_COLUMN, Col: "created"}, &writer); !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("drop the TTL column: %v", err)
+	}
+	if err := db.TableSetTTL("sessions", &TTL{Col: "token"}, &writer); err == nil {
+		t.Errorf("TTL on a BYTES column")
+	}
+}
+
+func TestPurgeTakesRowLocks(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{{
+		Name: "sessions", Types: []uint32{TYPE_INT64, TYPE_DATETIME}, Cols: []string{"id", "created"}, PKeys: 1,
+		TTL: &TTL{Col: "created", Seconds: 3600},
+	}, {
+		Name: "events", Types: []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "session", "name"}, PKeys: 1,
+		ForeignKeys: []ForeignKey{{Cols: []string{"session"}, Table: "sessions", OnDelete: FK_CASCADE}},
+	}} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	if _, err := db.Insert("sessions", *(&Record{}).AddInt64("id", 1).AddDateTime("created", time.Now()), &writer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("events", *(&Record{}).AddInt64("id", 1).AddInt64("session", 1).AddStr("name", []byte("login")), &writer); err != nil {
+		t.Fatal(err)
+	}
+	// expired once it is referenced
+	if _, err := db.Set("sessions", *(&Record{}).AddInt64("id", 1).AddDateTime("created", time.Now().Add(-2*time.Hour)), MODE_UPDATE_ONLY, &writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the purge would cascade to a row another transaction has locked,
+	// it waits for it instead of failing that transaction
+	var tx DBTX
+	db.Begin(&tx)
+	event := (&Record{}).AddInt64("id", 1)
+	if ok, err := tx.GetForUpdate("events", event); err != nil || !ok {
+		t.Fatalf("lock: %v %v", ok, err)
+	}
+	event.Vals[1] = Value{Type: TYPE_INT64, Null: true}
+	if _, err := tx.Set("events", *event, MODE_UPDATE_ONLY); err != nil {
+		t.Fatal(err)
+	}
+	purged := make(chan int)
+	go func() {
+		n, err := db.PurgeExpired()
+		if err != nil {
+			t.Errorf("purge: %v", err)
+		}
+		purged <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := db.Commit(&tx); err != nil {
+		t.Errorf("commit while purging: %v", err)
+	}
+	if n := <-purged; n != 1 {
+		t.Errorf("purged %d rows", n)
+	}
+	// the cascade sees the row as the transaction left it
+	if rows, err := queryAll(db, "events"); err != nil || len(rows) != 1 || !rows[0].Get("session").Null {
+		t.Errorf("events after the purge: %v, err %v", rows, err)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, tdef := range []*TableDef{
+		{Name: "users", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1, Indexes: [][]string{{"name"}}},
+		{Name: "empty", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1},
+		{Name: "big", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "name"}, PKeys: 1},
+	} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	for i := 0; i < 300; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprintf("user %03d", i)))
+		if _, err := db.Insert("users", *rec, &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	const bigRows = 10000
+	for i := 0; i < bigRows; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("name", []byte(fmt.Sprintf("%0100d", i)))
+		if _, err := db.Insert("big", *rec, &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	if tables, err := db.UserTables(&reader.Tree); err != nil || strings.Join(tables, ",") != "big,empty,users" {
+		t.Errorf("tables: %v %v", tables, err)
+	}
+	tdef, stats, err := db.TableStats("users", &reader.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows.Prefix != tdef.Prefix || stats.Rows.Keys != 300 || stats.Rows.Pages < 2 {
+		t.Errorf("rows: %+v", stats.Rows)
+	}
+	if len(stats.Indexes) != 1 || stats.Indexes[0].Prefix != tdef.IndexPrefix[0] || stats.Indexes[0].Keys != 300 {
+		t.Errorf("indexes: %+v", stats.Indexes)
+	}
+	if _, stats, err := db.TableStats("empty", &reader.Tree); err != nil || stats.Rows.Keys != 0 || stats.Rows.Pages != 0 {
+		t.Errorf("empty: %+v %v", stats.Rows, err)
+	}
+	if _, _, err := db.TableStats("nope", &reader.Tree); err == nil {
+		t.Errorf("stats of a missing table")
+	}
+	// a prefix before every key in the tree
+	if stats := prefixStats(&reader.Tree, 0); stats.Keys != 0 || stats.Pages != 0 {
+		t.Errorf("prefix 0: %+v", stats)
+	}
+
+	// a tree holding a single table, then emptied by a range delete
+	pages := map[uint64]BNode{}
+	tree := BTree{
+		get: func(ptr uint64) BNode { return pages[ptr] },
+		new: func(node BNode) uint64 {
+			ptr := uint64(len(pages) + 1)
+			pages[ptr] = node
+			return ptr
+		},
+		del:  func(uint64) {},
+		free: func(uint64) {},
+	}
+	for i := 0; i < 1000; i++ {
+		key := encodeKey(nil, 7, []Value{{Type: TYPE_INT64, I64: int64(i)}})
+		if err := tree.Insert(key, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := prefixStats(&tree, 7); stats.Keys != 1000 {
+		t.Errorf("single table: %+v", stats)
+	}
+	if stats := prefixStats(&tree, 8); stats.Keys != 0 || stats.Pages != 0 {
+		t.Errorf("prefix after every key: %+v", stats)
+	}
+	tree.DeleteRange(prefixRange(7))
+	for _, prefix := range []uint32{0, 7, 8} {
+		if stats := prefixStats(&tree, prefix); stats.Keys != 0 || stats.Pages != 0 {
+			t.Errorf("emptied tree, prefix %d: %+v", prefix, stats)
+		}
+	}
+	// a large table is estimated from a sample of its leaves
+	_, stats, err = db.TableStats("big", &reader.Tree)
+	if err != nil || stats.Rows.Pages <= STATS_SAMPLE+2 || stats.Rows.Keys < bigRows*9/10 || stats.Rows.Keys > bigRows*11/10 {
+		t.Errorf("big: %+v %v", stats.Rows, err)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	for _, name := range []string{"billing", "crm"} {
+		if err := db.SchemaCreate(name, &writer); err != nil {
+			t.Fatalf("create schema %s: %v", name, err)
+		}
+	}
+	if err := db.SchemaCreate("crm", &writer); !errors.Is(err, ErrSchemaExists) {
+		t.Errorf("create a schema twice: %v", err)
+	}
+	invoices := func(name string) *TableDef {
+		return &TableDef{Name: name, Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "status"}, PKeys: 1, Indexes: [][]string{{"status"}}}
+	}
+	if err := db.TableNew(invoices("nope.invoices"), &writer); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("create a table in a missing schema: %v", err)
+	}
+	for _, tdef := range []*TableDef{
+		invoices("invoices"), invoices("billing.invoices"), invoices("crm.invoices"),
+		{
+			Name: "billing.lines", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "invoice_id"}, PKeys: 1,
+			ForeignKeys: []ForeignKey{{Cols: []string{"invoice_id"}, Table: "billing.invoices"}},
+		},
+	} {
+		if err := db.TableNew(tdef, &writer); err != nil {
+			t.Fatalf("create %s: %v", tdef.Name, err)
+		}
+	}
+	if err := db.ViewCreate("billing.open", "SELECT id FROM billing.invoices WHERE status = 'open'", &writer); err != nil {
+		t.Fatalf("create view: %v", err)
+	}
+	for _, table := range []string{"billing.invoices", "crm.invoices"} {
+		if _, err := db.Insert(table, *(&Record{}).AddInt64("id", 1).AddStr("status", []byte("open")), &writer); err != nil {
+			t.Fatalf("insert into %s: %v", table, err)
+		}
+	}
+	if _, err := db.Insert("billing.lines", *(&Record{}).AddInt64("id", 1).AddInt64("invoice_id", 1), &writer); err != nil {
+		t.Fatalf("insert line: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tables of a schema take their prefixes from its block
+	var tx DBTX
+	db.Begin(&tx)
+	if err := tx.TableNew(invoices("crm.contacts")); err != nil {
+		t.Fatalf("create in a transaction: %v", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	for _, schema := range []string{"billing", "crm"} {
+		def := getSchema(db, schema, &reader.Tree)
+		tables, _, _ := db.SchemaObjects(schema, &reader.Tree)
+		for _, table := range tables {
+			tdef := GetTableDef(db, table, &reader.Tree)
+			for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefix...) {
+				if prefix < def.Base || prefix >= def.Next {
+					t.Errorf("%s: prefix %d out of [%d, %d)", table, prefix, def.Base, def.Next)
+				}
+			}
+		}
+	}
+	rows, err := db.QueryRows("billing.open", &reader)
+	db.kv.EndRead(&reader)
+	if err != nil || len(rows) != 1 {
+		t.Errorf("view in a schema: %v %v", rows, err)
+	}
+
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if err := db.TableRename("billing.invoices", "crm.bills", false, &writer); err == nil {
+		t.Errorf("moved a table to another schema")
+	}
+	if err := db.TableRename("billing.invoices", "bills", false, &writer); err != nil || getTableDefTX(db, "billing.bills", &writer) == nil {
+		t.Errorf("rename within the schema: %v", err)
+	}
+	if err := db.SchemaDrop("billing", false, &writer); !errors.Is(err, ErrSchemaNotEmpty) {
+		t.Errorf("drop a schema with tables: %v", err)
+	}
+	// a table written by a trigger in the schema goes after the trigger
+	if err := db.TableNew(invoices("billing.audit"), &writer); err != nil {
+		t.Fatal(err)
+	}
+	trig := Trigger{
+		Name: "audit", Timing: TRIGGER_AFTER, Event: TRIGGER_INSERT, Action: ACTION_INSERT,
+		Table: "billing.audit", Cols: []string{"id", "status"}, Exprs: []string{"id", "status"},
+	}
+	if err := db.TriggerCreate("billing.bills", trig, &writer); err != nil {
+		t.Fatal(err)
+	}
+	billing := getTableDefTX(db, "billing.bills", &writer)
+	if err := db.SchemaDrop("billing", true, &writer); err != nil {
+		t.Fatalf("drop cascade: %v", err)
+	}
+	if tables, views, err := db.SchemaObjects("billing", &writer.Tree); err != nil || len(tables)+len(views) > 0 {
+		t.Errorf("left after the drop: %v %v %v", tables, views, err)
+	}
+	if stats := prefixStats(&writer.Tree, billing.Prefix); stats.Keys != 0 {
+		t.Errorf("%d rows left after the drop", stats.Keys)
+	}
+	if getTableDefTX(db, "crm.invoices", &writer) == nil || getTableDefTX(db, "invoices", &writer) == nil {
+		t.Errorf("dropped the tables of other schemas")
+	}
+	if err := db.TableNew(invoices("billing.invoices"), &writer); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("create in a dropped schema: %v", err)
+	}
+}
+
+func TestPartialIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{Name: "tickets", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "status", "owner"}, PKeys: 1}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ticket := func(id int64, status, owner string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("status", []byte(status)).AddStr("owner", []byte(owner))
+	}
+	for i := int64(1); i <= 10; i++ {
+		status := "closed"
+		if i <= 2 {
+			status = "open"
+		}
+		if _, err := db.Insert("tickets", ticket(i, status, fmt.Sprintf("user%d", i%3)), &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.IndexCreate("tickets", []string{"status"}, IndexOptions{Where: "nope = 1"}); err == nil {
+		t.Errorf("created an index on an unknown column")
+	}
+	if err := db.IndexCreate("tickets", []string{"status"}, IndexOptions{Where: "status = 'open'"}); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	entries := func() int {
+		var reader KVReader
+		db.kv.BeginRead(&reader)
+		defer db.kv.EndRead(&reader)
+		tdef := GetTableDef(db, "tickets", &reader.Tree)
+		return prefixStats(&reader.Tree, tdef.IndexPrefix[0]).Keys
+	}
+	if n := entries(); n != 2 {
+		t.Errorf("%d entries after the backfill", n)
+	}
+
+	// the rows move in and out of the index as they change
+	db.kv.Begin(&writer)
+	for _, rec := range []Record{ticket(3, "open", "user0"), ticket(1, "closed", "user1")} {
+		if _, err := db.Update("tickets", rec, &writer); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if _, err := db.Delete("tickets", *(&Record{}).AddInt64("id", 2), &writer); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+	if n := entries(); n != 1 {
+		t.Errorf("%d entries after the updates", n)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	tdef = GetTableDef(db, "tickets", &reader.Tree)
+	open := (&Record{}).AddStr("status", []byte("open"))
+	closed := (&Record{}).AddStr("status", []byte("closed"))
+	if i, err := scanIndex(tdef, &Scanner{Key1: *open, Key2: *open}); err != nil || i != 0 {
+		t.Errorf("open tickets: index %d, err %v", i, err)
+	}
+	if _, err := scanIndex(tdef, &Scanner{Key1: *closed, Key2: *closed}); err == nil {
+		t.Errorf("used the partial index for the closed tickets")
+	}
+	if rows, err := db.GetRange("tickets", open, open, &reader); err != nil || len(rows) != 1 || rows[0].Get("id").I64 != 3 {
+		t.Errorf("open range: %v %v", rows, err)
+	}
+	if rows, err := db.GetRange("tickets", closed, closed, &reader); err != nil || len(rows) != 8 {
+		t.Errorf("closed range: %d rows, err %v", len(rows), err)
+	}
+	db.kv.EndRead(&reader)
+
+	// unique among the open tickets only
+	if err := db.IndexCreate("tickets", []string{"owner"}, IndexOptions{Unique: true, Where: "status = 'open'"}); err != nil {
+		t.Fatalf("create unique index: %v", err)
+	}
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if _, err := db.Insert("tickets", ticket(11, "closed", "user0"), &writer); err != nil {
+		t.Errorf("insert a closed ticket: %v", err)
+	}
+	if _, err := db.Insert("tickets", ticket(12, "open", "user0"), &writer); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert a second open ticket: %v", err)
+	}
+	if err := db.AlterTable("tickets", TableAlter{Op: ALTER_DROP_COLUMN, Col: "status"}, &writer); !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("drop a column of an index condition: %v", err)
+	}
+}
+
+func TestExpressionIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	e, err := parseExpr("price*qty + -1 > 2.0 AND NOT (lower(name) IN ('a''b', 'c'))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := parseExpr(e.String()); err != nil || again.String() != e.String() {
+		t.Errorf("%s reparsed as %v, err %v", e, again, err)
+	}
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:  "orders",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_DATETIME},
+		Cols:  []string{"id", "email", "qty", "price", "created_at"},
+		PKeys: 1,
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	order := func(id int64, email string, qty int64, price float64, day int) Record {
+		created := time.Date(2026, 1, day, 10+day, 0, 0, 0, time.UTC)
+		return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddInt64("qty", qty).
+			AddFloat64("price", price).AddDateTime("created_at", created)
+	}
+	for _, rec := range []Record{
+		order(1, "Bob@example.com", 2, 5, 1),
+		order(2, "alice@example.com", 1, 30, 1),
+		order(3, "carol@example.com", 4, 2.5, 2),
+	} {
+		if _, err := db.Insert("orders", rec, &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"lower(nope)", "now()", "lower(qty)", "lower(email", "lower(email) + 1", "coalesce(NULL)"} {
+		if err := db.IndexCreate("orders", []string{bad}, IndexOptions{}); err == nil {
+			t.Errorf("created an index on %s", bad)
+		}
+	}
+	if err := db.IndexCreate("orders", []string{"LOWER( email )"}, IndexOptions{Unique: true}); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	// typed from the columns: the row with 1 divides by zero and has a NULL key
+	for _, index := range [][]string{{"date(created_at)"}, {"price*qty"}, {"qty / (qty - 1)"}} {
+		if err := db.IndexCreate("orders", index, IndexOptions{}); err != nil {
+			t.Fatalf("create index: %v", err)
+		}
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	tdef = GetTableDef(db, "orders", &reader.Tree)
+	if got := strings.Join(tdef.Indexes[2], ","); got != "price * qty,id" {
+		t.Errorf("stored as %s", got)
+	}
+	bob := (&Record{}).AddStr("lower(email)", []byte("bob@example.com"))
+	if rows, err := db.GetRange("orders", bob, bob, &reader); err != nil || len(rows) != 1 || rows[0].Get("id").I64 != 1 {
+		t.Errorf("by email: %v %v", rows, err)
+	}
+	// the day is given as a string, converted to the type of the expression
+	day := (&Record{}).AddStr("date(created_at)", []byte("2026-01-01"))
+	if rows, err := db.GetRange("orders", day, day, &reader); err != nil || len(rows) != 2 {
+		t.Errorf("by day: %d rows, err %v", len(rows), err)
+	}
+	low, high := (&Record{}).AddFloat64("price * qty", 10), (&Record{}).AddFloat64("price*qty", 30)
+	if i, err := findIndex(tdef, low.Cols); err != nil || i != 2 {
+		t.Errorf("total: index %d, err %v", i, err)
+	}
+	if rows, err := db.GetRange("orders", low, high, &reader); err != nil || len(rows) != 3 {
+		t.Errorf("by total: %d rows, err %v", len(rows), err)
+	}
+	if typ := indexKeyType(tdef, tdef.Indexes[3][0]); typ != TYPE_INT64 {
+		t.Errorf("ratio typed %s", typeName(typ))
+	}
+	ratio := (&Record{}).AddInt64("qty/(qty-1)", 2)
+	if rows, err := db.GetRange("orders", ratio, ratio, &reader); err != nil || len(rows) != 1 || rows[0].Get("id").I64 != 1 {
+		t.Errorf("by ratio: %v %v", rows, err)
+	}
+	db.kv.EndRead(&reader)
+
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if _, err := db.Insert("orders", order(4, "BOB@example.com", 1, 1, 3), &writer); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert the same email in another case: %v", err)
+	}
+	if _, err := db.Update("orders", order(1, "bobby@example.com", 2, 5, 1), &writer); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := db.Insert("orders", order(4, "BOB@example.com", 1, 1, 3), &writer); err != nil {
+		t.Errorf("insert the email given up: %v", err)
+	}
+	if err := db.AlterTable("orders", TableAlter{Op: ALTER_RENAME_COLUMN, Col: "email", NewName: "mail"}, &writer); !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("rename a column of an index expression: %v", err)
+	}
+	if err := db.IndexDrop("orders", []string{"price * qty"}, &writer); err != nil {
+		t.Errorf("drop index: %v", err)
+	}
+}
+
+func TestCoveringIndex(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(t, db)
+
+	var writer KVTX
+	db.kv.Begin(&writer)
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "email", "name", "age"},
+		PKeys:   1,
+		NotNull: []bool{true, true, false, false},
+	}
+	if err := db.TableNew(tdef, &writer); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	user := func(id int64, email, name string) Record {
+		rec := (&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddInt64("age", 20+id)
+		if name == "" {
+			return *rec.AddNull("name")
+		}
+		return *rec.AddStr("name", []byte(name))
+	}
+	for _, rec := range []Record{user(1, "a@x", "Ann"), user(2, "b@x", ""), user(3, "c@x", "Cid")} {
+		if _, err := db.Insert("users", rec, &writer); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, include := range [][]string{{"nope"}, {"email"}, {"name", "name"}} {
+		if err := db.IndexCreate("users", []string{"email"}, IndexOptions{Include: include}); err == nil {
+			t.Errorf("created an index including %v", include)
+		}
+	}
+	if err := db.IndexCreate("users", []string{"email"}, IndexOptions{Include: []string{"name"}}); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+
+	// a row changing only an included column updates its entry
+	db.kv.Begin(&writer)
+	if _, err := db.Update("users", user(3, "c@x", "Cyd"), &writer); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	start, end := (&Record{}).AddStr("email", []byte("a@x")), (&Record{}).AddStr("email", []byte("z@x"))
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *start, Key2: *end, Cols: []string{"name", "id"}}
+	if err := db.Scan("users", &sc, &reader.Tree); err != nil {
+		t.Fatal(err)
+	}
+	if !sc.covered {
+		t.Errorf("not an index-only scan")
+	}
+	var names []string
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, &reader.Tree)
+		names = append(names, fmt.Sprintf("%d:%s", rec.Get("id").I64, formatValue(*rec.Get("name"))))
+	}
+	if got := strings.Join(names, ","); got != "1:Ann,2:NULL,3:Cyd" {
+		t.Errorf("index-only scan: %s", got)
+	}
+
+	// a column outside the index reads the rows
+	rows, err := db.GetRangeCols("users", start, end, []string{"email", "age"}, &reader)
+	if err != nil || len(rows) != 3 || len(rows[2].Cols) != 2 || rows[2].Get("age").I64 != 23 {
+		t.Errorf("rows: %v %v", rows, err)
+	}
+	sc.Cols = []string{"email", "age"}
+	if err := db.Scan("users", &sc, &reader.Tree); err != nil || sc.covered {
+		t.Errorf("covered %v, err %v", sc.covered, err)
+	}
+	db.kv.EndRead(&reader)
+
+	db.kv.Begin(&writer)
+	defer db.kv.Abort(&writer)
+	if err := db.AlterTable("users", TableAlter{Op: ALTER_DROP_COLUMN, Col: "name"}, &writer); !errors.Is(err, ErrColumnInUse) {
+		t.Errorf("drop an included column: %v", err)
+	}
+	if err := db.AlterTable("users", TableAlter{Op: ALTER_RENAME_COLUMN, Col: "name", NewName: "full_name"}, &writer); err != nil {
+		t.Fatalf("rename an included column: %v", err)
+	}
+	if tdef := getTableDefTX(db, "users", &writer); strings.Join(indexInclude(tdef, 0), ",") != "full_name" {
+		t.Errorf("included after the rename: %v", indexInclude(tdef, 0))
+	}
+}
@@ -18,7 +18,8 @@ import (
 
 func newKV(filename string) *KV {
 	return &KV{
-		Path: filename,
+		Path:        filename,
+		historySize: DEFAULT_HISTORY,
 	}
 }
 
@@ -28,6 +29,7 @@ func newDB() *DB {
 		kv:     *newKV(fileName),
 		tables: make(map[string]*TableDef),
 		pool:   NewPool(3),
+		limits: DefaultTxLimits,
 	}
 }
 
@@ -68,6 +70,8 @@ func StartDB() {
 			os.Exit(0)
 		}
 	}
+	db.startReaper()
+	db.startExpiry()
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -110,6 +114,9 @@ func StartDB() {
 }
 
 func shutdownDB(db *DB) {
+	db.stopReaper()
+	db.stopExpiry()
+	db.closeAttached()
 	db.kv.Close()
 	db.pool.Stop()
 	fmt.Println("Exiting...")
@@ -0,0 +1,1078 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var ErrCheckViolation = errors.New("CHECK constraint violated")
+
+// A small expression language for the column defaults, the CHECK
+// constraints, the triggers and the indexes, e.g. `price >= 0 AND status IN ('new', 'paid')`.
+//
+//	or      := and { OR and }
+//	and     := not { AND not }
+//	not     := NOT not | cmp
+//	cmp     := add [ op add | IS [NOT] NULL | [NOT] IN ( expr, ... ) ]
+//	add     := mul { (+|-) mul }
+//	mul     := unary { (*|/|%) unary }
+//	unary   := - unary | primary
+//	primary := number | 'string' | TRUE | FALSE | NULL
+//	         | column | row.column | func ( expr, ... ) | ( expr )
+type expr struct {
+	op   string // "lit", "col", "call", or the operator
+	val  Value  // "lit"
+	name string // "col" and "call"
+	args []*expr
+}
+
+// what an expression is evaluated against
+type exprEnv struct {
+	row Record
+	// for nextval(), which allocates from the sequences in @meta
+	db   *DB
+	kvtx *KVTX
+}
+
+type exprFunc func(env *exprEnv, args []Value) (Value, error)
+
+var exprFuncs map[string]exprFunc
+
+func init() {
+	exprFuncs = map[string]exprFunc{
+		"now": func(_ *exprEnv, args []Value) (Value, error) {
+			if len(args) != 0 {
+				return Value{}, errors.New("now() takes no arguments")
+			}
+			return Value{Type: TYPE_DATETIME, Time: time.Now().UTC().Truncate(time.Second)}, nil
+		},
+		"date": func(_ *exprEnv, args []Value) (Value, error) {
+			if len(args) != 1 || (args[0].Type != TYPE_DATETIME && !args[0].Null) {
+				return Value{}, errors.New("date() takes a datetime")
+			}
+			if args[0].Null {
+				return Value{Type: TYPE_DATETIME, Null: true}, nil
+			}
+			y, m, d := args[0].Time.UTC().Date()
+			return Value{Type: TYPE_DATETIME, Time: time.Date(y, m, d, 0, 0, 0, 0, time.UTC)}, nil
+		},
+		"lower": stringFunc("lower", bytes.ToLower),
+		"upper": stringFunc("upper", bytes.ToUpper),
+		"length": func(_ *exprEnv, args []Value) (Value, error) {
+			if len(args) != 1 || (args[0].Type != TYPE_BYTES && !args[0].Null) {
+				return Value{}, errors.New("length() takes a string")
+			}
+			if args[0].Null {
+				return Value{Type: TYPE_INT64, Null: true}, nil
+			}
+			return Value{Type: TYPE_INT64, I64: int64(len(args[0].Str))}, nil
+		},
+		"nextval": func(env *exprEnv, args []Value) (Value, error) {
+			if len(args) != 1 || args[0].Type != TYPE_BYTES || args[0].Null {
+				return Value{}, errors.New("nextval() takes a sequence name")
+			}
+			if env.db == nil {
+				return Value{}, errors.New("nextval() is only allowed in defaults")
+			}
+			v, err := env.db.nextval(string(args[0].Str), env.kvtx)
+			return Value{Type: TYPE_INT64, I64: v}, err
+		},
+		"coalesce": func(_ *exprEnv, args []Value) (Value, error) {
+			for _, v := range args {
+				if !v.Null {
+					return v, nil
+				}
+			}
+			return Value{Null: true}, nil
+		},
+	}
+}
+
+func stringFunc(name string, f func([]byte) []byte) exprFunc {
+	return func(_ *exprEnv, args []Value) (Value, error) {
+		if len(args) != 1 || (args[0].Type != TYPE_BYTES && !args[0].Null) {
+			return Value{}, fmt.Errorf("%s() takes a string", name)
+		}
+		if args[0].Null {
+			return Value{Type: TYPE_BYTES, Null: true}, nil
+		}
+		return Value{Type: TYPE_BYTES, Str: f(args[0].Str)}, nil
+	}
+}
+
+func parseExpr(src string) (*expr, error) {
+	p := &exprParser{}
+	if err := p.tokenize(src); err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	e, err := p.parseOr()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return e, nil
+}
+
+// an expression of a definition, e.g. an index key or a CHECK, parsed
+// and typed once
+type parsedExpr struct {
+	e   *expr // nil if it doesn't parse
+	err error
+	typ uint32
+}
+
+// the definitions are shared by the statements reading the same version
+var parsedExprsMu sync.Mutex
+
+func (tdef *TableDef) parsed(src string) *parsedExpr {
+	parsedExprsMu.Lock()
+	defer parsedExprsMu.Unlock()
+	if pe := tdef.exprs[src]; pe != nil {
+		return pe
+	}
+	pe := &parsedExpr{}
+	if pe.e, pe.err = parseExpr(src); pe.err == nil {
+		pe.typ, _ = exprType(tdef, pe.e)
+	}
+	if tdef.exprs == nil {
+		tdef.exprs = map[string]*parsedExpr{}
+	}
+	tdef.exprs[src] = pe
+	return pe
+}
+
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *exprParser) tokenize(src string) error {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'':
+			// a string, '' is a quote
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(src) {
+				return errors.New("unterminated string")
+			}
+			p.toks = append(p.toks, src[i:j+1])
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			p.toks = append(p.toks, src[i:j])
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || isQualifier(src, j)) {
+				j++
+			}
+			p.toks = append(p.toks, src[i:j])
+			i = j
+		case strings.ContainsRune("<>!=", rune(c)):
+			j := i + 1
+			if j < len(src) && (src[j] == '=' || (c == '<' && src[j] == '>')) {
+				j++
+			}
+			p.toks = append(p.toks, src[i:j])
+			i = j
+		case strings.ContainsRune("+-*/%(),", rune(c)):
+			p.toks = append(p.toks, src[i:i+1])
+			i++
+		default:
+			return fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return nil
+}
+
+// a dot joining the row and the column of a trigger, e.g. new.total
+func isQualifier(src string, i int) bool {
+	return src[i] == '.' && i+1 < len(src) && (src[i+1] == '_' || unicode.IsLetter(rune(src[i+1])))
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+// consume the next token if it is one of `toks`, keywords in any case
+func (p *exprParser) accept(toks ...string) (string, bool) {
+	next := p.peek()
+	for _, tok := range toks {
+		if next != "" && strings.EqualFold(next, tok) {
+			p.pos++
+			return tok, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(tok string) error {
+	if _, ok := p.accept(tok); !ok {
+		if p.peek() == "" {
+			return fmt.Errorf("expected %q at the end", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (*expr, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("or"); !ok {
+			break
+		}
+		var right *expr
+		if right, err = p.parseAnd(); err == nil {
+			left = &expr{op: "or", args: []*expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (*expr, error) {
+	left, err := p.parseNot()
+	for err == nil {
+		if _, ok := p.accept("and"); !ok {
+			break
+		}
+		var right *expr
+		if right, err = p.parseNot(); err == nil {
+			left = &expr{op: "and", args: []*expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseNot() (*expr, error) {
+	if _, ok := p.accept("not"); ok {
+		arg, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: "not", args: []*expr{arg}}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (*expr, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept("=", "==", "!=", "<>", "<", "<=", ">", ">="); ok {
+		right, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			op = "="
+		case "<>":
+			op = "!="
+		}
+		return &expr{op: op, args: []*expr{left, right}}, nil
+	}
+	if _, ok := p.accept("is"); ok {
+		_, not := p.accept("not")
+		if err := p.expect("null"); err != nil {
+			return nil, err
+		}
+		e := &expr{op: "isnull", args: []*expr{left}}
+		if not {
+			e = &expr{op: "not", args: []*expr{e}}
+		}
+		return e, nil
+	}
+	save := p.pos
+	_, not := p.accept("not")
+	if _, ok := p.accept("in"); ok {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		e := &expr{op: "in", args: append([]*expr{left}, list...)}
+		if not {
+			e = &expr{op: "not", args: []*expr{e}}
+		}
+		return e, nil
+	}
+	p.pos = save
+	return left, nil
+}
+
+// the expressions up to the closing parenthesis
+func (p *exprParser) parseList() ([]*expr, error) {
+	var list []*expr
+	if _, ok := p.accept(")"); ok {
+		return list, nil
+	}
+	for {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if _, ok := p.accept(")"); ok {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseAdd() (*expr, error) {
+	left, err := p.parseMul()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			break
+		}
+		var right *expr
+		if right, err = p.parseMul(); err == nil {
+			left = &expr{op: op, args: []*expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseMul() (*expr, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			break
+		}
+		var right *expr
+		if right, err = p.parseUnary(); err == nil {
+			left = &expr{op: op, args: []*expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (*expr, error) {
+	if _, ok := p.accept("-"); ok {
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: "neg", args: []*expr{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*expr, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, errors.New("unexpected end")
+	}
+	p.pos++
+	switch {
+	case tok == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case tok[0] == '\'':
+		str := strings.ReplaceAll(tok[1:len(tok)-1], "''", "'")
+		return &expr{op: "lit", val: Value{Type: TYPE_BYTES, Str: []byte(str)}}, nil
+	case tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.':
+		if !strings.Contains(tok, ".") {
+			if i, err := strconv.ParseInt(tok, 10, 64); err == nil {
+				return &expr{op: "lit", val: Value{Type: TYPE_INT64, I64: i}}, nil
+			}
+		}
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok)
+		}
+		return &expr{op: "lit", val: Value{Type: TYPE_FLOAT64, F64: f}}, nil
+	case strings.EqualFold(tok, "true"), strings.EqualFold(tok, "false"):
+		return &expr{op: "lit", val: Value{Type: TYPE_BOOLEAN, Bool: strings.EqualFold(tok, "true")}}, nil
+	case strings.EqualFold(tok, "null"):
+		return &expr{op: "lit", val: Value{Null: true}}, nil
+	case tok[0] == '_' || unicode.IsLetter(rune(tok[0])):
+		if _, ok := p.accept("("); ok {
+			name := strings.ToLower(tok)
+			if exprFuncs[name] == nil {
+				return nil, fmt.Errorf("unknown function %s()", tok)
+			}
+			args, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return &expr{op: "call", name: name, args: args}, nil
+		}
+		if row, col, ok := strings.Cut(tok, "."); ok {
+			// OLD.col and NEW.col in any case
+			tok = strings.ToLower(row) + "." + col
+		}
+		return &expr{op: "col", name: tok}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+// the columns referenced by an expression
+func (e *expr) columns() []string {
+	var cols []string
+	if e.op == "col" {
+		cols = append(cols, e.name)
+	}
+	for _, arg := range e.args {
+		cols = append(cols, arg.columns()...)
+	}
+	return cols
+}
+
+// whether the expression calls the function `name`
+func (e *expr) calls(name string) bool {
+	if e.op == "call" && e.name == name {
+		return true
+	}
+	for _, arg := range e.args {
+		if arg.calls(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the canonical text of an expression, which parses back to it. the
+// operands that are operations themselves are parenthesized.
+func (e *expr) String() string {
+	switch e.op {
+	case "lit":
+		v := e.val
+		switch {
+		case v.Null:
+			return "NULL"
+		case v.Type == TYPE_BYTES:
+			return "'" + strings.ReplaceAll(string(v.Str), "'", "''") + "'"
+		case v.Type == TYPE_FLOAT64:
+			s := strconv.FormatFloat(v.F64, 'f', -1, 64)
+			if !strings.Contains(s, ".") {
+				s += ".0" // not an INT64
+			}
+			return s
+		case v.Type == TYPE_BOOLEAN:
+			return strings.ToUpper(formatValue(v))
+		}
+		return formatValue(v)
+	case "col":
+		return e.name
+	case "call":
+		args := make([]string, len(e.args))
+		for i, arg := range e.args {
+			args[i] = arg.String()
+		}
+		return e.name + "(" + strings.Join(args, ", ") + ")"
+	case "not":
+		return "NOT " + e.args[0].operand()
+	case "neg":
+		return "-" + e.args[0].operand()
+	case "isnull":
+		return e.args[0].operand() + " IS NULL"
+	case "in":
+		list := make([]string, len(e.args)-1)
+		for i, arg := range e.args[1:] {
+			list[i] = arg.String()
+		}
+		return e.args[0].operand() + " IN (" + strings.Join(list, ", ") + ")"
+	}
+	return e.args[0].operand() + " " + strings.ToUpper(e.op) + " " + e.args[1].operand()
+}
+
+func (e *expr) operand() string {
+	switch e.op {
+	case "lit", "col", "call":
+		return e.String()
+	}
+	return "(" + e.String() + ")"
+}
+
+func (e *expr) eval(env *exprEnv) (Value, error) {
+	switch e.op {
+	case "lit":
+		return e.val, nil
+	case "col":
+		v := env.row.Get(e.name)
+		if v == nil {
+			return Value{}, fmt.Errorf("unknown column %s", e.name)
+		}
+		return *v, nil
+	case "call":
+		args, err := evalArgs(env, e.args)
+		if err != nil {
+			return Value{}, err
+		}
+		return exprFuncs[e.name](env, args)
+	case "and", "or":
+		// three-valued logic, NULL is unknown
+		left, err := evalBool(env, e.args[0])
+		if err != nil {
+			return Value{}, err
+		}
+		if !left.Null && left.Bool == (e.op == "or") {
+			return left, nil
+		}
+		right, err := evalBool(env, e.args[1])
+		if err != nil {
+			return Value{}, err
+		}
+		if !right.Null && right.Bool == (e.op == "or") {
+			return right, nil
+		}
+		if left.Null || right.Null {
+			return Value{Type: TYPE_BOOLEAN, Null: true}, nil
+		}
+		return left, nil
+	case "not":
+		v, err := evalBool(env, e.args[0])
+		if err != nil || v.Null {
+			return v, err
+		}
+		return Value{Type: TYPE_BOOLEAN, Bool: !v.Bool}, nil
+	case "isnull":
+		v, err := e.args[0].eval(env)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: TYPE_BOOLEAN, Bool: v.Null}, nil
+	case "in":
+		args, err := evalArgs(env, e.args)
+		if err != nil {
+			return Value{}, err
+		}
+		result := Value{Type: TYPE_BOOLEAN}
+		for _, item := range args[1:] {
+			if args[0].Null || item.Null {
+				result.Null = true
+				continue
+			}
+			r, err := exprCompare(args[0], item)
+			if err != nil {
+				return Value{}, err
+			}
+			if r == 0 {
+				return Value{Type: TYPE_BOOLEAN, Bool: true}, nil
+			}
+		}
+		return result, nil
+	case "neg":
+		v, err := e.args[0].eval(env)
+		if err != nil || v.Null {
+			return v, err
+		}
+		switch v.Type {
+		case TYPE_INT64:
+			return Value{Type: TYPE_INT64, I64: -v.I64}, nil
+		case TYPE_FLOAT64:
+			return Value{Type: TYPE_FLOAT64, F64: -v.F64}, nil
+		}
+		return Value{}, errors.New("cannot negate a non-number")
+	}
+
+	args, err := evalArgs(env, e.args)
+	if err != nil {
+		return Value{}, err
+	}
+	left, right := args[0], args[1]
+	switch e.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		if left.Null || right.Null {
+			return Value{Type: TYPE_BOOLEAN, Null: true}, nil
+		}
+		r, err := exprCompare(left, right)
+		if err != nil {
+			return Value{}, err
+		}
+		ok := map[string]bool{"=": r == 0, "!=": r != 0, "<": r < 0, "<=": r <= 0, ">": r > 0, ">=": r >= 0}[e.op]
+		return Value{Type: TYPE_BOOLEAN, Bool: ok}, nil
+	default:
+		return exprArith(e.op, left, right)
+	}
+}
+
+func evalArgs(env *exprEnv, list []*expr) ([]Value, error) {
+	vals := make([]Value, len(list))
+	for i, arg := range list {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func evalBool(env *exprEnv, e *expr) (Value, error) {
+	v, err := e.eval(env)
+	if err == nil && !v.Null && v.Type != TYPE_BOOLEAN {
+		err = fmt.Errorf("not a condition: %s", formatExprValue(v))
+	}
+	return v, err
+}
+
+// compare two non-NULL values. numbers compare across INT64 and
+// FLOAT64, a string compares with a DATETIME as a date.
+func exprCompare(a, b Value) (int, error) {
+	if a.Type != b.Type {
+		var err error
+		if a, b, err = unifyTypes(a, b); err != nil {
+			return 0, err
+		}
+	}
+	switch a.Type {
+	case TYPE_INT64:
+		return cmpOrdered(a.I64, b.I64), nil
+	case TYPE_FLOAT64:
+		return cmpOrdered(a.F64, b.F64), nil
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str), nil
+	case TYPE_BOOLEAN:
+		return cmpOrdered(boolInt(a.Bool), boolInt(b.Bool)), nil
+	case TYPE_DATETIME:
+		return a.Time.Compare(b.Time), nil
+	}
+	return 0, errors.New("invalid type")
+}
+
+func unifyTypes(a, b Value) (Value, Value, error) {
+	var err error
+	switch {
+	case a.Type == TYPE_INT64 && b.Type == TYPE_FLOAT64:
+		a = Value{Type: TYPE_FLOAT64, F64: float64(a.I64)}
+	case a.Type == TYPE_FLOAT64 && b.Type == TYPE_INT64:
+		b = Value{Type: TYPE_FLOAT64, F64: float64(b.I64)}
+	case a.Type == TYPE_DATETIME && b.Type == TYPE_BYTES:
+		b, err = convertValue(b, TYPE_DATETIME)
+	case a.Type == TYPE_BYTES && b.Type == TYPE_DATETIME:
+		a, err = convertValue(a, TYPE_DATETIME)
+	default:
+		err = fmt.Errorf("cannot compare %s with %s", formatExprValue(a), formatExprValue(b))
+	}
+	return a, b, err
+}
+
+func cmpOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func exprArith(op string, left, right Value) (Value, error) {
+	if left.Null || right.Null {
+		return Value{Null: true}, nil
+	}
+	if left.Type == TYPE_INT64 && right.Type == TYPE_INT64 {
+		a, b := left.I64, right.I64
+		switch op {
+		case "+":
+			return Value{Type: TYPE_INT64, I64: a + b}, nil
+		case "-":
+			return Value{Type: TYPE_INT64, I64: a - b}, nil
+		case "*":
+			return Value{Type: TYPE_INT64, I64: a * b}, nil
+		case "/", "%":
+			if b == 0 {
+				return Value{}, errors.New("division by zero")
+			}
+			if op == "/" {
+				return Value{Type: TYPE_INT64, I64: a / b}, nil
+			}
+			return Value{Type: TYPE_INT64, I64: a % b}, nil
+		}
+	}
+	left, right, err := unifyTypes(left, right)
+	if err != nil || left.Type != TYPE_FLOAT64 {
+		return Value{}, fmt.Errorf("%s needs numbers", op)
+	}
+	a, b := left.F64, right.F64
+	switch op {
+	case "+":
+		return Value{Type: TYPE_FLOAT64, F64: a + b}, nil
+	case "-":
+		return Value{Type: TYPE_FLOAT64, F64: a - b}, nil
+	case "*":
+		return Value{Type: TYPE_FLOAT64, F64: a * b}, nil
+	case "/":
+		if b == 0 {
+			return Value{}, errors.New("division by zero")
+		}
+		return Value{Type: TYPE_FLOAT64, F64: a / b}, nil
+	case "%":
+		if b == 0 {
+			return Value{}, errors.New("division by zero")
+		}
+		return Value{Type: TYPE_FLOAT64, F64: math.Mod(a, b)}, nil
+	}
+	return Value{}, fmt.Errorf("unknown operator %s", op)
+}
+
+// convert the result of an expression to a column type
+func convertValue(v Value, typ uint32) (Value, error) {
+	if v.Null {
+		return Value{Type: typ, Null: true}, nil
+	}
+	if v.Type == typ {
+		return v, nil
+	}
+	switch {
+	case typ == TYPE_FLOAT64 && v.Type == TYPE_INT64:
+		return Value{Type: typ, F64: float64(v.I64)}, nil
+	case typ == TYPE_INT64 && v.Type == TYPE_FLOAT64 && v.F64 == math.Trunc(v.F64):
+		return Value{Type: typ, I64: int64(v.F64)}, nil
+	case typ == TYPE_DATETIME && v.Type == TYPE_BYTES:
+		for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339} {
+			if t, err := time.ParseInLocation(layout, string(v.Str), time.UTC); err == nil {
+				return Value{Type: typ, Time: t.UTC()}, nil
+			}
+		}
+	}
+	return Value{}, fmt.Errorf("%s is not a %s", formatExprValue(v), typeName(typ))
+}
+
+func formatExprValue(v Value) string {
+	if v.Type == TYPE_BYTES && !v.Null {
+		return "'" + string(v.Str) + "'"
+	}
+	return formatValue(v)
+}
+
+func typeName(typ uint32) string {
+	switch typ {
+	case TYPE_INT64:
+		return "INT64"
+	case TYPE_BYTES:
+		return "BYTES"
+	case TYPE_FLOAT64:
+		return "FLOAT64"
+	case TYPE_BOOLEAN:
+		return "BOOLEAN"
+	case TYPE_DATETIME:
+		return "DATETIME"
+	}
+	return "unknown type"
+}
+
+// check the defaults and the CHECK constraints of a new table
+func checkTableExprs(tdef *TableDef) error {
+	if tdef.Defaults != nil && len(tdef.Defaults) != len(tdef.Cols) {
+		return errors.New("length of columns & defaults do not match")
+	}
+	for i, src := range tdef.Defaults {
+		if src == "" {
+			continue
+		}
+		e, err := parseExpr(src)
+		if err != nil {
+			return fmt.Errorf("default of %s: %w", tdef.Cols[i], err)
+		}
+		if cols := e.columns(); len(cols) > 0 {
+			return fmt.Errorf("default of %s: cannot reference the column %s", tdef.Cols[i], cols[0])
+		}
+		if e.calls("nextval") {
+			// evaluating it would take a value from the sequence
+			if tdef.Types[i] != TYPE_INT64 {
+				return fmt.Errorf("default of %s: nextval() of a %s column", tdef.Cols[i], typeName(tdef.Types[i]))
+			}
+			continue
+		}
+		if _, err := evalDefault(&exprEnv{}, tdef, i); err != nil {
+			return err
+		}
+	}
+	for _, src := range tdef.Checks {
+		e, err := parseExpr(src)
+		if err != nil {
+			return fmt.Errorf("CHECK: %w", err)
+		}
+		for _, col := range e.columns() {
+			if ColIndex(tdef, col) < 0 {
+				return fmt.Errorf("CHECK %s: unknown column %s", src, col)
+			}
+		}
+	}
+	if len(tdef.IndexWhere) > len(tdef.Indexes) {
+		return errors.New("length of indexes & conditions do not match")
+	}
+	for _, src := range tdef.IndexWhere {
+		if err := checkIndexWhere(tdef, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the condition of a partial index reads the columns of the row only
+func checkIndexWhere(tdef *TableDef, src string) error {
+	if src == "" {
+		return nil
+	}
+	e, err := parseExpr(src)
+	if err != nil {
+		return fmt.Errorf("index WHERE: %w", err)
+	}
+	for _, col := range e.columns() {
+		if ColIndex(tdef, col) < 0 {
+			return fmt.Errorf("index WHERE %s: unknown column %s", src, col)
+		}
+	}
+	if e.calls("nextval") || e.calls("now") {
+		return fmt.Errorf("index WHERE %s: must give the same result for a row every time", src)
+	}
+	return nil
+}
+
+// an indexed expression reads the columns of the row only, and has the
+// same type for every row
+func checkIndexExpr(tdef *TableDef, e *expr) error {
+	for _, col := range e.columns() {
+		if ColIndex(tdef, col) < 0 {
+			return fmt.Errorf("index expression %s: unknown column %s", e, col)
+		}
+	}
+	if e.calls("nextval") || e.calls("now") {
+		return fmt.Errorf("index expression %s: must give the same result for a row every time", e)
+	}
+	if _, err := exprType(tdef, e); err != nil {
+		return fmt.Errorf("index expression %s: %w", e, err)
+	}
+	return nil
+}
+
+// the type of an expression of the columns, from the types of its
+// operands. the values may still fail for some rows, a division by
+// zero gives a NULL key.
+func exprType(tdef *TableDef, e *expr) (uint32, error) {
+	typ, err := staticType(tdef, e)
+	if err == nil && typ == 0 {
+		err = errors.New("the type of NULL is unknown")
+	}
+	return typ, err
+}
+
+// the type of the values of `e`, 0 if they are always NULL
+func staticType(tdef *TableDef, e *expr) (uint32, error) {
+	switch e.op {
+	case "lit":
+		if e.val.Null {
+			return 0, nil
+		}
+		return e.val.Type, nil
+	case "col":
+		i := ColIndex(tdef, e.name)
+		if i < 0 {
+			return 0, fmt.Errorf("unknown column %s", e.name)
+		}
+		return tdef.Types[i], nil
+	}
+	args := make([]uint32, len(e.args))
+	for i, arg := range e.args {
+		typ, err := staticType(tdef, arg)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = typ
+	}
+	takes := func(typ uint32) bool {
+		return len(args) == 1 && (args[0] == typ || args[0] == 0)
+	}
+	switch e.op {
+	case "call":
+		switch e.name {
+		case "now":
+			if len(args) != 0 {
+				return 0, errors.New("now() takes no arguments")
+			}
+			return TYPE_DATETIME, nil
+		case "date":
+			if !takes(TYPE_DATETIME) {
+				return 0, errors.New("date() takes a datetime")
+			}
+			return TYPE_DATETIME, nil
+		case "lower", "upper":
+			if !takes(TYPE_BYTES) {
+				return 0, fmt.Errorf("%s() takes a string", e.name)
+			}
+			return TYPE_BYTES, nil
+		case "length":
+			if !takes(TYPE_BYTES) {
+				return 0, errors.New("length() takes a string")
+			}
+			return TYPE_INT64, nil
+		case "nextval":
+			if len(args) != 1 || args[0] != TYPE_BYTES {
+				return 0, errors.New("nextval() takes a sequence name")
+			}
+			return TYPE_INT64, nil
+		case "coalesce":
+			typ := uint32(0)
+			for _, t := range args {
+				switch {
+				case t == 0 || t == typ:
+				case typ == 0:
+					typ = t
+				case isNumberType(typ) && isNumberType(t):
+					typ = TYPE_FLOAT64
+				default:
+					return 0, fmt.Errorf("coalesce() of %s and %s", typeName(typ), typeName(t))
+				}
+			}
+			return typ, nil
+		}
+		return 0, fmt.Errorf("unknown function %s()", e.name)
+	case "and", "or", "not":
+		for _, t := range args {
+			if t != 0 && t != TYPE_BOOLEAN {
+				return 0, fmt.Errorf("not a condition: %s", typeName(t))
+			}
+		}
+		return TYPE_BOOLEAN, nil
+	case "isnull":
+		return TYPE_BOOLEAN, nil
+	case "in", "=", "!=", "<", "<=", ">", ">=":
+		for _, t := range args[1:] {
+			if !comparableTypes(args[0], t) {
+				return 0, fmt.Errorf("cannot compare %s with %s", typeName(args[0]), typeName(t))
+			}
+		}
+		return TYPE_BOOLEAN, nil
+	case "neg":
+		if args[0] != 0 && !isNumberType(args[0]) {
+			return 0, errors.New("cannot negate a non-number")
+		}
+		return args[0], nil
+	}
+	left, right := args[0], args[1]
+	switch {
+	case left == 0 || right == 0:
+		if (left == 0 || isNumberType(left)) && (right == 0 || isNumberType(right)) {
+			return 0, nil
+		}
+	case left == TYPE_INT64 && right == TYPE_INT64:
+		return TYPE_INT64, nil
+	case isNumberType(left) && isNumberType(right):
+		return TYPE_FLOAT64, nil
+	}
+	return 0, fmt.Errorf("%s needs numbers", e.op)
+}
+
+func isNumberType(typ uint32) bool {
+	return typ == TYPE_INT64 || typ == TYPE_FLOAT64
+}
+
+// the types exprCompare accepts, NULL compares with anything
+func comparableTypes(a, b uint32) bool {
+	switch {
+	case a == 0 || b == 0 || a == b:
+		return true
+	case isNumberType(a) && isNumberType(b):
+		return true
+	}
+	return (a == TYPE_DATETIME && b == TYPE_BYTES) || (a == TYPE_BYTES && b == TYPE_DATETIME)
+}
+
+func evalDefault(env *exprEnv, tdef *TableDef, i int) (Value, error) {
+	e, err := parseExpr(tdef.Defaults[i])
+	if err != nil {
+		return Value{}, fmt.Errorf("default of %s: %w", tdef.Cols[i], err)
+	}
+	v, err := e.eval(env)
+	if err == nil {
+		v, err = convertValue(v, tdef.Types[i])
+	}
+	if err != nil {
+		return Value{}, fmt.Errorf("default of %s: %w", tdef.Cols[i], err)
+	}
+	return v, nil
+}
+
+// add the defaults of the columns absent from `rec`, and the next id of
+// an AUTO_INCREMENT table. the sequences allocate in `kvtx`, or in their
+// own write transaction if nil.
+func applyDefaults(db *DB, tdef *TableDef, rec Record, kvtx *KVTX) (Record, error) {
+	add := func(col string, v Value) {
+		rec = Record{append(rec.Cols[:len(rec.Cols):len(rec.Cols)], col), append(rec.Vals[:len(rec.Vals):len(rec.Vals)], v)}
+	}
+	if tdef.AutoIncrement && !contains(rec.Cols, tdef.Cols[0]) {
+		id, err := db.nextval(autoSequence(tdef), kvtx)
+		if err != nil {
+			return rec, err
+		}
+		add(tdef.Cols[0], Value{Type: TYPE_INT64, I64: id})
+	}
+	for i, src := range tdef.Defaults {
+		if src == "" || contains(rec.Cols, tdef.Cols[i]) {
+			continue
+		}
+		v, err := evalDefault(&exprEnv{db: db, kvtx: kvtx}, tdef, i)
+		if err != nil {
+			return rec, err
+		}
+		add(tdef.Cols[i], v)
+	}
+	return rec, nil
+}
+
+// a row passes a CHECK unless it evaluates to false, NULL passes
+func checkConstraints(tdef *TableDef, row Record) error {
+	for _, src := range tdef.Checks {
+		pe := tdef.parsed(src)
+		if pe.err != nil {
+			return pe.err
+		}
+		v, err := evalBool(&exprEnv{row: row}, pe.e)
+		if err != nil {
+			return fmt.Errorf("CHECK %s: %w", src, err)
+		}
+		if !v.Null && !v.Bool {
+			return fmt.Errorf("%w: %s: %s", ErrCheckViolation, tdef.Name, src)
+		}
+	}
+	return nil
+}
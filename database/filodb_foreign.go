@@ -0,0 +1,273 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrForeignKey = errors.New("foreign key violation")
+
+// what deleting a referenced row does to the rows referencing it
+const (
+	FK_RESTRICT = "RESTRICT" // refuse the delete
+	FK_CASCADE  = "CASCADE"  // delete them too
+	FK_SET_NULL = "SET NULL" // set their foreign key to NULL
+)
+
+// columns referencing the primary key of another table, or of the same one
+type ForeignKey struct {
+	Cols     []string // in the order of the referenced primary key
+	Table    string
+	OnDelete string // FK_RESTRICT if empty
+}
+
+// check the foreign keys of a new table against the tables they
+// reference, and index them for the checks on delete
+func checkForeignKeys(db *DB, tdef *TableDef, kvtx *KVTX) error {
+	for i := range tdef.ForeignKeys {
+		fk := &tdef.ForeignKeys[i]
+		if fk.OnDelete == "" {
+			fk.OnDelete = FK_RESTRICT
+		}
+		fk.OnDelete = strings.ToUpper(fk.OnDelete)
+		if fk.OnDelete != FK_RESTRICT && fk.OnDelete != FK_CASCADE && fk.OnDelete != FK_SET_NULL {
+			return fmt.Errorf("foreign key %v: invalid ON DELETE action: %s", fk.Cols, fk.OnDelete)
+		}
+		parent := tdef
+		if fk.Table != tdef.Name {
+			parent = getTableDefTX(db, fk.Table, kvtx)
+		}
+		if parent == nil {
+			return fmt.Errorf("foreign key %v: table not found: %s", fk.Cols, fk.Table)
+		}
+		if len(fk.Cols) != parent.PKeys {
+			return fmt.Errorf("foreign key %v: %s has %d primary key columns", fk.Cols, fk.Table, parent.PKeys)
+		}
+		for j, col := range fk.Cols {
+			c := ColIndex(tdef, col)
+			if c < 0 {
+				return fmt.Errorf("foreign key: invalid column: %s", col)
+			}
+			if tdef.Types[c] != parent.Types[j] {
+				return fmt.Errorf("foreign key: %s and %s.%s differ in type", col, fk.Table, parent.Cols[j])
+			}
+			if fk.OnDelete == FK_SET_NULL && !isNullable(tdef, c) {
+				return fmt.Errorf("foreign key: ON DELETE SET NULL of the NOT NULL column %s", col)
+			}
+		}
+		if _, err := findIndex(tdef, fk.Cols); err != nil {
+			index, err := checkIndexKeys(tdef, append([]string(nil), fk.Cols...))
+			if err != nil {
+				return err
+			}
+			tdef.Indexes = append(tdef.Indexes, index)
+			if tdef.Unique != nil {
+				tdef.Unique = append(tdef.Unique, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// record a new table in the tables its foreign keys reference
+func addReferences(db *DB, tdef *TableDef, kvtx *KVTX) error {
+	for _, fk := range tdef.ForeignKeys {
+		if fk.Table == tdef.Name {
+			continue
+		}
+		parent := getTableDefTX(db, fk.Table, kvtx)
+		if contains(parent.ReferencedBy, tdef.Name) {
+			continue
+		}
+		// the cached definition is shared, change a copy
+		updated := *parent
+		updated.ReferencedBy = append(append([]string(nil), parent.ReferencedBy...), tdef.Name)
+		if err := tableDefUpdate(db, &updated, kvtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove a dropped table from the tables its foreign keys reference
+func dropReferences(db *DB, tdef *TableDef, kvtx *KVTX) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent := getTableDefTX(db, fk.Table, kvtx)
+		if fk.Table == tdef.Name || parent == nil || !contains(parent.ReferencedBy, tdef.Name) {
+			continue
+		}
+		updated := *parent
+		updated.ReferencedBy = nil
+		for _, name := range parent.ReferencedBy {
+			if name != tdef.Name {
+				updated.ReferencedBy = append(updated.ReferencedBy, name)
+			}
+		}
+		if err := tableDefUpdate(db, &updated, kvtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether deleting a row of the table may affect other rows
+func isReferenced(tdef *TableDef) bool {
+	if len(tdef.ReferencedBy) > 0 {
+		return true
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if fk.Table == tdef.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite the definition of an existing table
+func tableDefUpdate(db *DB, tdef *TableDef, kvtx *KVTX) error {
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return fmt.Errorf("failed to marshal table definition: %w", err)
+	}
+	table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+	if _, err := dbUpdate(db, TDEF_TABLE, *table, MODE_UPDATE_ONLY, kvtx); err != nil {
+		return fmt.Errorf("failed to update table definition: %w", err)
+	}
+	tableDefChanged(db, tdef.Name, tdef, kvtx)
+	return nil
+}
+
+// check that the rows a row in table order references exist
+func checkReferences(db *DB, tdef *TableDef, values []Value, kvtx *KVTX) error {
+	for _, fk := range tdef.ForeignKeys {
+		ref, ok := fkValues(tdef, fk, values)
+		if !ok {
+			continue // a NULL references nothing
+		}
+		parent := tdef
+		if fk.Table != tdef.Name {
+			parent = getTableDefTX(db, fk.Table, kvtx)
+		} else if samePK(tdef, ref, values) {
+			continue // the row references itself
+		}
+		if parent == nil {
+			return fmt.Errorf("%w: table not found: %s", ErrForeignKey, fk.Table)
+		}
+		// an expired row is missing, see `rowExpired`
+		if row, exists := currentRow(parent, ref, kvtx); !exists || rowExpired(parent, row, time.Now()) {
+			return fmt.Errorf("%w: %s(%s) = (%s) is not in %s",
+				ErrForeignKey, tdef.Name, strings.Join(fk.Cols, ", "), formatValues(ref), fk.Table)
+		}
+	}
+	return nil
+}
+
+// the foreign key of a row in table order, false if it has a NULL
+func fkValues(tdef *TableDef, fk ForeignKey, values []Value) ([]Value, bool) {
+	ref := make([]Value, len(fk.Cols))
+	for i, col := range fk.Cols {
+		ref[i] = values[ColIndex(tdef, col)]
+		if ref[i].Null {
+			return nil, false
+		}
+	}
+	return ref, true
+}
+
+func formatValues(vals []Value) string {
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		out[i] = formatExprValue(v)
+	}
+	return strings.Join(out, ", ")
+}
+
+// a row referencing the row being deleted
+type reference struct {
+	tdef *TableDef
+	fk   ForeignKey
+	row  Record
+}
+
+// the rows referencing a row of `tdef` with the primary key `pk`
+func findReferences(db *DB, tdef *TableDef, pk []Value, kvtx *KVTX) ([]reference, error) {
+	var refs []reference
+	for _, name := range append([]string{tdef.Name}, tdef.ReferencedBy...) {
+		child := getTableDefTX(db, name, kvtx)
+		if child == nil {
+			continue
+		}
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != tdef.Name {
+				continue
+			}
+			err := scanReferences(db, child, fk, pk, &kvtx.Tree, func(row Record) {
+				if child == tdef && samePK(tdef, row.Vals, pk) {
+					return // the row references itself
+				}
+				refs = append(refs, reference{child, fk, row})
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return refs, nil
+}
+
+// visit the rows of `child` whose foreign key `fk` is `pk`, found by the
+// index on the foreign key
+func scanReferences(db *DB, child *TableDef, fk ForeignKey, pk []Value, tree *BTree, fn func(Record)) error {
+	key := Record{Cols: fk.Cols, Vals: pk}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := dbScan(db, child, &sc, tree); err != nil {
+		return err
+	}
+	var rows []Record
+	for ; sc.Valid(); sc.Next() {
+		var row Record
+		sc.Deref(&row, tree)
+		rows = append(rows, copyRecord(row))
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	// visited after the scan, `fn` may change the tree
+	for _, row := range rows {
+		fn(row)
+	}
+	return nil
+}
+
+// apply the ON DELETE actions to the rows referencing a row, before it
+// is deleted. a RESTRICT refuses before anything is changed.
+func deleteReferences(db *DB, tdef *TableDef, pk []Value, kvtx *KVTX) error {
+	refs, err := findReferences(db, tdef, pk, kvtx)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.fk.OnDelete == FK_RESTRICT {
+			return fmt.Errorf("%w: %s(%s) = (%s) is referenced by %s",
+				ErrForeignKey, tdef.Name, strings.Join(tdef.Cols[:tdef.PKeys], ", "), formatValues(pk), ref.tdef.Name)
+		}
+	}
+	for _, ref := range refs {
+		switch ref.fk.OnDelete {
+		case FK_CASCADE:
+			_, err = dbDelete(db, ref.tdef, ref.row, kvtx)
+		case FK_SET_NULL:
+			for _, col := range ref.fk.Cols {
+				ref.row.Get(col).Null = true
+			}
+			_, err = dbUpdate(db, ref.tdef, ref.row, MODE_UPDATE_ONLY, kvtx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrVersionNotRetained = errors.New("version is no longer retained")
+
+// the history after a commit, without the oldest entries beyond
+// the history size. the caller holds `kv.mu`.
+func (kv *KV) remember(commit CommitInfo) []CommitInfo {
+	history := append(kv.history[:len(kv.history):len(kv.history)], commit)
+	if n := len(history) - max(kv.historySize, 1); n > 0 {
+		history = append([]CommitInfo(nil), history[n:]...)
+	}
+	return history
+}
+
+// the oldest version that can still be read, pages freed after it
+// must not be reused. the caller holds `kv.mu`.
+func (kv *KV) minReader() uint64 {
+	version := kv.version
+	if len(kv.readers) > 0 && versionBefore(kv.readers[0].version, version) {
+		version = kv.readers[0].version
+	}
+	if len(kv.history) > 0 && versionBefore(kv.history[0].Version, version) {
+		version = kv.history[0].Version
+	}
+	return version
+}
+
+// History returns the retained versions, oldest first.
+func (kv *KV) History() []CommitInfo {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return append([]CommitInfo(nil), kv.history...)
+}
+
+// SetHistorySize changes how many committed versions are retained.
+// Shrinking the history takes effect on disk with the next commit.
+func (kv *KV) SetHistorySize(n int) error {
+	if n < 1 || n > MAX_HISTORY {
+		return fmt.Errorf("history size must be between 1 and %d", MAX_HISTORY)
+	}
+	// not while a commit is between computing and publishing the history
+	kv.writer.Lock()
+	defer kv.writer.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.historySize = n
+	if extra := len(kv.history) - n; extra > 0 {
+		kv.history = append([]CommitInfo(nil), kv.history[extra:]...)
+	}
+	return nil
+}
+
+// initialising the reader from a retained version
+func (kv *KV) BeginReadAt(tx *KVReader, version uint64) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for _, commit := range kv.history {
+		if commit.Version == version {
+			kv.beginReadLocked(tx, commit)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d", ErrVersionNotRetained, version)
+}
+
+// initialising the reader from the version that was the latest at `t`
+func (kv *KV) BeginReadAsOf(tx *KVReader, t time.Time) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for i := len(kv.history) - 1; i >= 0; i-- {
+		if !kv.history[i].Time.After(t) {
+			kv.beginReadLocked(tx, kv.history[i])
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrVersionNotRetained, t.Format(time.DateTime))
+}
+
+func (kv *KV) beginReadLocked(tx *KVReader, commit CommitInfo) {
+	tx.mmap.chunks = kv.mmap.chunks
+	tx.Tree.root = commit.Root
+	tx.Tree.get = tx.pageGetMapped
+	tx.version = commit.Version
+	tx.started = time.Now()
+	tx.reported = false
+	heap.Push(&kv.readers, tx)
+}
+
+// BeginReadAt starts a read-only snapshot of an older committed version.
+func (db *DB) BeginReadAt(tx *KVReader, version uint64) error {
+	return db.kv.BeginReadAt(tx, version)
+}
+
+// BeginReadAsOf starts a read-only snapshot of the database as it was at `t`.
+func (db *DB) BeginReadAsOf(tx *KVReader, t time.Time) error {
+	return db.kv.BeginReadAsOf(tx, t)
+}
@@ -1,10 +1,35 @@
 package database
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// a row repeats the value of a UNIQUE index
+type DuplicateKeyError struct {
+	Table string
+	Index []string // the unique columns
+	Key   []Value
+}
+
+func (e *DuplicateKeyError) Error() string {
+	vals := make([]string, len(e.Key))
+	for i, v := range e.Key {
+		vals[i] = formatExprValue(v)
+	}
+	return fmt.Sprintf("duplicate key in unique index %s(%s): %s",
+		e.Table, strings.Join(e.Index, ", "), strings.Join(vals, ", "))
+}
+
+func (e *DuplicateKeyError) Unwrap() error {
+	return ErrDuplicateKey
+}
+
 const (
 	INDEX_ADD = 1
 	INDEX_DEL = 2
@@ -15,17 +40,23 @@ func indexOp(_ *DB, tdef *TableDef, rec Record, op int, kvtx *KVTX) {
 	irec := make([]Value, len(rec.Cols))
 
 	for i, index := range tdef.Indexes {
+		if !indexHolds(tdef, i, rec) {
+			continue // not in the partial index
+		}
 		// indexed key
 		for j, c := range index {
-			irec[j] = *rec.Get(c)
+			irec[j] = indexKeyValue(tdef, c, rec)
 		}
-		key = encodeKey(key[:0], tdef.IndexPrefix[i], irec[:len(index)])
+		key = encodeIndexKey(key[:0], tdef.IndexPrefix[i], tdef, index, irec[:len(index)])
 		done, err := false, error(nil)
 		switch op {
 		case INDEX_ADD:
-			done, err = kvtx.SetWithMode(&InsertReq{Key: key})
+			done, err = kvtx.SetWithMode(&InsertReq{Key: key, Value: indexEntryValue(tdef, i, rec)})
 		case INDEX_DEL:
 			done, err = kvtx.Delete(&DeleteReq{Key: key})
+			if !done && !indexReady(tdef, i) {
+				continue // not filled in yet
+			}
 		default:
 			panic("invalid index op")
 		}
@@ -36,6 +67,222 @@ func indexOp(_ *DB, tdef *TableDef, rec Record, op int, kvtx *KVTX) {
 	}
 }
 
+// whether the index `i` has an entry for every row
+func indexReady(tdef *TableDef, i int) bool {
+	return i >= len(tdef.Building) || !tdef.Building[i]
+}
+
+// the condition of the partial index `i`, "" if it indexes every row
+func indexWhere(tdef *TableDef, i int) string {
+	if i < len(tdef.IndexWhere) {
+		return tdef.IndexWhere[i]
+	}
+	return ""
+}
+
+// the columns the entries of the index `i` keep besides the keys
+func indexInclude(tdef *TableDef, i int) []string {
+	if i < len(tdef.IndexInclude) {
+		return tdef.IndexInclude[i]
+	}
+	return nil
+}
+
+// the value of the entry of a row in the index `i`: its INCLUDE columns
+func indexEntryValue(tdef *TableDef, i int, row Record) []byte {
+	include := indexInclude(tdef, i)
+	if len(include) == 0 {
+		return nil
+	}
+	vals := make([]Value, len(include))
+	for j, c := range include {
+		vals[j] = *row.Get(c)
+	}
+	return encodeValues(nil, vals)
+}
+
+// whether the entries of the index `i` hold every column of `cols`, in
+// their keys or their INCLUDE columns
+func indexCovers(tdef *TableDef, i int, cols []string) bool {
+	if i < 0 || cols == nil {
+		return false
+	}
+	for _, c := range cols {
+		if ColIndex(tdef, c) < 0 || (!contains(tdef.Indexes[i], c) && !contains(indexInclude(tdef, i), c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// whether a row in table order has an entry in the index `i`. the rows
+// the condition is NULL for have none.
+func indexHolds(tdef *TableDef, i int, row Record) bool {
+	src := indexWhere(tdef, i)
+	if src == "" {
+		return true
+	}
+	e := tdef.parsed(src).e
+	if e == nil {
+		return false
+	}
+	v, err := evalBool(&exprEnv{row: row}, e)
+	return err == nil && !v.Null && v.Bool
+}
+
+// whether every row in the range of a scan is in the partial index `i`.
+// each term of the condition, ANDed, holds at both ends of the range and
+// either fixes its columns there, or compares one column to a constant,
+// so holds in between too.
+func indexImplied(tdef *TableDef, i int, req *Scanner) bool {
+	src := indexWhere(tdef, i)
+	if src == "" {
+		return true
+	}
+	e := tdef.parsed(src).e
+	if e == nil {
+		return false
+	}
+	var terms []*expr
+	for stack := []*expr{e}; len(stack) > 0; {
+		term := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if term.op == "and" {
+			stack = append(stack, term.args...)
+		} else {
+			terms = append(terms, term)
+		}
+	}
+	for _, term := range terms {
+		fixed := true
+		for _, col := range term.columns() {
+			v1, v2 := req.Key1.Get(col), req.Key2.Get(col)
+			if v1 == nil || v2 == nil {
+				return false
+			}
+			if c, err := exprCompare(*v1, *v2); err != nil || c != 0 {
+				fixed = false
+			}
+		}
+		if !fixed && !isColumnBound(term) {
+			return false
+		}
+		for _, end := range []Record{req.Key1, req.Key2} {
+			v, err := evalBool(&exprEnv{row: end}, term)
+			if err != nil || v.Null || !v.Bool {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// `col op constant` or `constant op col`, for an ordering op
+func isColumnBound(e *expr) bool {
+	switch e.op {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		return false
+	}
+	left, right := e.args[0], e.args[1]
+	return (left.op == "col" && len(right.columns()) == 0) ||
+		(right.op == "col" && len(left.columns()) == 0)
+}
+
+// the number of leading columns of the index `i` that are UNIQUE, 0 if none
+func uniqueCols(tdef *TableDef, i int) int {
+	if i < len(tdef.Unique) {
+		return tdef.Unique[i]
+	}
+	return 0
+}
+
+// the encoded unique part of the index `i` for a row in table order,
+// nil if the index isn't UNIQUE or the row has a NULL in it
+func uniqueKey(tdef *TableDef, i int, values []Value) []byte {
+	n := uniqueCols(tdef, i)
+	if n == 0 {
+		return nil
+	}
+	if !indexHolds(tdef, i, Record{tdef.Cols, values}) {
+		return nil // unique among the rows of the partial index
+	}
+	index := tdef.Indexes[i]
+	ivals := make([]Value, n)
+	for j, c := range index[:n] {
+		ivals[j] = indexKeyValue(tdef, c, Record{tdef.Cols, values})
+		if ivals[j].Null {
+			return nil // NULLs are never equal
+		}
+	}
+	return encodeIndexKey(nil, tdef.IndexPrefix[i], tdef, index, ivals)
+}
+
+// check a row in table order against the UNIQUE indexes, before it is
+// written. its own entries, from before an update, don't count. an
+// expired row is absent, it is deleted first as by `dropExpired`.
+func checkUnique(db *DB, tdef *TableDef, values []Value, kvtx *KVTX) error {
+	for i, index := range tdef.Indexes {
+		prefix := uniqueKey(tdef, i, values)
+		if prefix == nil {
+			continue
+		}
+		for {
+			other := uniqueOwner(tdef, i, prefix, values, &kvtx.Tree)
+			if other == nil {
+				break
+			}
+			if tdef.TTL != nil {
+				row, exists := currentRow(tdef, other, kvtx)
+				if exists && rowExpired(tdef, row, time.Now()) {
+					if _, err := dbRemove(db, tdef, row, kvtx); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			n := uniqueCols(tdef, i)
+			dup := &DuplicateKeyError{Table: tdef.Name, Index: index[:n]}
+			for _, c := range index[:n] {
+				dup.Key = append(dup.Key, indexKeyValue(tdef, c, Record{tdef.Cols, values}))
+			}
+			return dup
+		}
+	}
+	return nil
+}
+
+// the primary key of another row with the UNIQUE value `prefix` in the
+// index `i`, nil if there is none
+func uniqueOwner(tdef *TableDef, i int, prefix []byte, values []Value, tree *BTree) []Value {
+	for iter := tree.Seek(prefix, CMP_GE); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if other := indexEntryPK(tdef, i, key); !samePK(tdef, other, values) {
+			return other
+		}
+	}
+	return nil
+}
+
+// the primary key of the row an entry of the index `i` points to
+func indexEntryPK(tdef *TableDef, i int, key []byte) []Value {
+	index := tdef.Indexes[i]
+	ivals := make([]Value, len(index))
+	for j, c := range index {
+		ivals[j].Type = indexKeyType(tdef, c)
+	}
+	decodeIndexKey(key[4:], tdef, index, ivals)
+	irec := Record{index, ivals}
+	pk := make([]Value, tdef.PKeys)
+	for j, c := range tdef.Cols[:tdef.PKeys] {
+		pk[j] = *irec.Get(c)
+	}
+	return pk
+}
+
 func encodeKeyPartial(
 	out []byte,
 	prefix uint32,
@@ -44,12 +291,17 @@ func encodeKeyPartial(
 	keys []string,
 	cmp int,
 ) []byte {
-	out = encodeKey(out, prefix, values)
+	out = encodeIndexKey(out, prefix, tdef, keys, values)
 	max := cmp == CMP_GT || cmp == CMP_LE
 
 loop:
 	for i := len(values); max && i < len(keys); i++ {
-		switch tdef.Types[ColIndex(tdef, keys[i])] {
+		if indexKeyNullable(tdef, keys[i]) {
+			// greater than the NULL and the value tags
+			out = append(out, 0xff)
+			break loop
+		}
+		switch indexKeyType(tdef, keys[i]) {
 		case TYPE_BYTES:
 			out = append(out, 0xff)
 			//	Any byte string with a prefix of [X, 0xFF] will be greater than all byte strings with prefix [X]
@@ -69,43 +321,76 @@ loop:
 	return out
 }
 
+// encode the leading `index` keys of an entry. a nullable key is
+// tagged, a NULL sorts before every value of the key.
+func encodeIndexKey(out []byte, prefix uint32, tdef *TableDef, index []string, vals []Value) []byte {
+	out = encodeKey(out, prefix, nil)
+	for i, v := range vals {
+		if indexKeyNullable(tdef, index[i]) {
+			if v.Null {
+				out = append(out, 0)
+				continue
+			}
+			out = append(out, 1)
+		}
+		out = encodeValues(out, []Value{v})
+	}
+	return out
+}
+
+func decodeIndexKey(in []byte, tdef *TableDef, index []string, out []Value) {
+	for i := range out {
+		if indexKeyNullable(tdef, index[i]) {
+			if len(in) == 0 {
+				return
+			}
+			tag := in[0]
+			in = in[1:]
+			if tag == 0 {
+				out[i] = Value{Type: out[i].Type, Null: true}
+				continue
+			}
+		}
+		var ok bool
+		if in, ok = decodeValue(in, &out[i]); !ok {
+			return
+		}
+	}
+}
+
+// find the primary key or the shortest index whose leading columns
+// are `keys`, in any order. the partial indexes don't have every row,
+// they are left out.
 func findIndex(tdef *TableDef, keys []string) (int, error) {
+	return planIndex(tdef, keys, nil)
+}
+
+// the index for a scan: the partial indexes holding its range count too
+func scanIndex(tdef *TableDef, req *Scanner) (int, error) {
+	return planIndex(tdef, req.Key1.Cols, req)
+}
+
+func planIndex(tdef *TableDef, keys []string, req *Scanner) (int, error) {
 	pk := tdef.Cols[:tdef.PKeys]
+	keys = indexKeyNames(tdef, keys)
 
 	if isPrefix(pk, keys) {
 		// use primary key
 		return -1, nil
 	}
 
-	// For range queries with single column, check if column exists in any index
-	if len(keys) == 1 {
-		targetCol := keys[0]
-
-		// Check if the column is the primary key
-		for _, pkCol := range pk {
-			if pkCol == targetCol {
-				return -1, nil
-			}
-		}
-
-		// Check if the column exists in any index (not necessarily as prefix)
-		for i, index := range tdef.Indexes {
-			for _, indexCol := range index {
-				if indexCol == targetCol {
-					return i, nil
-				}
-			}
-		}
-	}
-
-	// find suitable index for multi-column queries (original logic)
 	winner := -2
 	for i, index := range tdef.Indexes {
-		if !isPrefix(index, keys) {
+		if !isPrefix(index, keys) || !indexReady(tdef, i) {
+			continue
+		}
+		if indexWhere(tdef, i) != "" && (req == nil || !indexImplied(tdef, i, req)) {
 			continue
 		}
 		if winner == -2 || len(index) < len(tdef.Indexes[winner]) {
 			winner = i
+		} else if len(index) == len(tdef.Indexes[winner]) && indexWhere(tdef, i) != "" && indexWhere(tdef, winner) == "" {
+			winner = i // the partial one has fewer entries
 		}
 	}
 	if winner == -2 {
@@ -114,24 +399,59 @@ func findIndex(tdef *TableDef, keys []string) (int, error) {
 	return winner, nil
 }
 
+// whether the first len(short) columns of `long` are the columns of `short`
 func isPrefix(long []string, short []string) bool {
 	if len(long) < len(short) {
 		return false
 	}
-	for i, c := range short {
-		if long[i] != c {
+	for _, c := range long[:len(short)] {
+		if !contains(short, c) {
 			return false
 		}
 	}
 	return true
 }
 
+// the values of `rec` in the order of the leading keys of `index`
+func indexValues(tdef *TableDef, index []string, rec Record) ([]Value, error) {
+	keys := Record{indexKeyNames(tdef, rec.Cols), rec.Vals}
+	if !isPrefix(index, keys.Cols) {
+		return nil, fmt.Errorf("columns %v are not a prefix of %v", rec.Cols, index)
+	}
+	vals := make([]Value, len(keys.Cols))
+	for i, c := range index[:len(keys.Cols)] {
+		vals[i] = *keys.Get(c)
+		if ColIndex(tdef, c) < 0 {
+			v, err := convertValue(vals[i], indexKeyType(tdef, c))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", c, err)
+			}
+			vals[i] = v
+		}
+		if vals[i].Null && !indexKeyNullable(tdef, c) {
+			return nil, fmt.Errorf("column cannot be NULL: %s", c)
+		}
+	}
+	return vals, nil
+}
+
 func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 	icols := map[string]bool{}
 
-	for _, c := range index {
+	for i, c := range index {
 		if !isValidCol(tdef, c) {
-			return nil, fmt.Errorf("invalid index column: %s", c)
+			e, err := parseExpr(c)
+			if err != nil || (e.op == "col" && !isValidCol(tdef, e.name)) {
+				return nil, fmt.Errorf("invalid index column: %s", c)
+			}
+			if err := checkIndexExpr(tdef, e); err != nil {
+				return nil, err
+			}
+			c = e.String()
+			index[i] = c
+		}
+		if icols[c] {
+			return nil, fmt.Errorf("duplicate index column: %s", c)
 		}
 		icols[c] = true
 	}
@@ -142,12 +462,22 @@ func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 			index = append(index, c)
 		}
 	}
-	if len(index) >= len(tdef.Cols) {
-		return nil, errors.New("index len should be shorter than columns")
-	}
 	return index, nil
 }
 
+// the INCLUDE columns of an index are columns of the table, not its keys
+func checkIndexInclude(tdef *TableDef, index []string, include []string) error {
+	for j, c := range include {
+		if !isValidCol(tdef, c) {
+			return fmt.Errorf("invalid INCLUDE column: %s", c)
+		}
+		if contains(index, c) || contains(include[:j], c) {
+			return fmt.Errorf("duplicate INCLUDE column: %s", c)
+		}
+	}
+	return nil
+}
+
 func isValidCol(tdef *TableDef, col string) bool {
 	for _, c := range tdef.Cols {
 		if c == col {
@@ -165,3 +495,73 @@ func ColIndex(tdef *TableDef, col string) int {
 	}
 	return -1
 }
+
+// a key of an index is a column, or an expression of the columns kept
+// in its canonical text, e.g. `lower(email)`. a query names the same
+// expression, in any spelling, to use the index.
+
+// the canonical text of the index keys named by a query
+func indexKeyNames(tdef *TableDef, keys []string) []string {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key
+		if ColIndex(tdef, key) >= 0 || tdef.indexKey(key) {
+			continue // already canonical
+		}
+		if e, err := parseExpr(key); err == nil {
+			names[i] = e.String()
+		}
+	}
+	return names
+}
+
+// whether `key` names an expression an index is on
+func isIndexExpr(tdef *TableDef, key string) bool {
+	name := indexKeyNames(tdef, []string{key})[0]
+	return ColIndex(tdef, name) < 0 && tdef.indexKey(name)
+}
+
+// whether `key` is the text of a key of an index
+func (tdef *TableDef) indexKey(key string) bool {
+	for _, index := range tdef.Indexes {
+		if contains(index, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func indexKeyType(tdef *TableDef, key string) uint32 {
+	if i := ColIndex(tdef, key); i >= 0 {
+		return tdef.Types[i]
+	}
+	return tdef.parsed(key).typ
+}
+
+// an expression may be NULL for any row
+func indexKeyNullable(tdef *TableDef, key string) bool {
+	if i := ColIndex(tdef, key); i >= 0 {
+		return isNullable(tdef, i)
+	}
+	return true
+}
+
+// the value of an index key for a row. an expression failing for the
+// row, e.g. dividing by zero, is NULL.
+func indexKeyValue(tdef *TableDef, key string, row Record) Value {
+	if ColIndex(tdef, key) >= 0 {
+		return *row.Get(key)
+	}
+	pe := tdef.parsed(key)
+	if pe.e == nil {
+		return Value{Type: pe.typ, Null: true}
+	}
+	v, err := pe.e.eval(&exprEnv{row: row})
+	if err == nil {
+		v, err = convertValue(v, pe.typ)
+	}
+	if err != nil {
+		return Value{Type: pe.typ, Null: true}
+	}
+	return v
+}
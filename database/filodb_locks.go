@@ -0,0 +1,564 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// row lock modes, a stronger mode has a larger value
+type LockMode int
+
+const (
+	LOCK_SHARED    LockMode = 1
+	LOCK_EXCLUSIVE LockMode = 2
+)
+
+var (
+	ErrDeadlock    = errors.New("deadlock detected")
+	ErrLockTimeout = errors.New("lock wait timeout")
+	// the latest tree disagrees with the one the transaction ran on,
+	// i.e. a row was changed without taking its lock
+	ErrWriteConflict = errors.New("write conflict")
+)
+
+// hands out row locks keyed by the encoded primary key
+type lockManager struct {
+	mu    sync.Mutex
+	locks map[string]*lockEntry
+}
+
+type lockEntry struct {
+	holders map[*DBTX]LockMode
+	queue   []*lockRequest // waiting requests, granted in order
+}
+
+type lockRequest struct {
+	tx    *DBTX
+	key   string
+	mode  LockMode
+	ready chan error // receives nil once granted
+}
+
+func (e *lockEntry) compatible(tx *DBTX, mode LockMode) bool {
+	for holder, held := range e.holders {
+		if holder != tx && (mode == LOCK_EXCLUSIVE || held == LOCK_EXCLUSIVE) {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire a lock, waiting for conflicting holders. returns true if
+// the transaction held no lock on the key before.
+func (lm *lockManager) acquire(tx *DBTX, key string, mode LockMode, timeout time.Duration) (bool, error) {
+	lm.mu.Lock()
+	if lm.locks == nil {
+		lm.locks = map[string]*lockEntry{}
+	}
+	e := lm.locks[key]
+	if e == nil {
+		e = &lockEntry{holders: map[*DBTX]LockMode{}}
+		lm.locks[key] = e
+	}
+	held := e.holders[tx]
+	if held >= mode {
+		lm.mu.Unlock()
+		return false, nil
+	}
+	if len(e.queue) == 0 && e.compatible(tx, mode) {
+		lm.grantLocked(tx, key, mode)
+		lm.mu.Unlock()
+		return held == 0, nil
+	}
+
+	req := &lockRequest{tx: tx, key: key, mode: mode, ready: make(chan error, 1)}
+	if held != 0 {
+		// an upgrade waits only for the other holders
+		e.queue = append([]*lockRequest{req}, e.queue...)
+	} else {
+		e.queue = append(e.queue, req)
+	}
+	tx.waiting = req
+	if victim := lm.deadlockVictim(tx); victim != nil {
+		vreq := victim.waiting
+		lm.cancelLocked(vreq)
+		if victim == tx {
+			lm.mu.Unlock()
+			return false, ErrDeadlock
+		}
+		vreq.ready <- ErrDeadlock
+	}
+	lm.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-req.ready:
+		return held == 0 && err == nil, err
+	case <-expired:
+		lm.mu.Lock()
+		if tx.waiting == req {
+			lm.cancelLocked(req)
+			lm.mu.Unlock()
+			return false, ErrLockTimeout
+		}
+		lm.mu.Unlock()
+		// granted or cancelled meanwhile
+		err := <-req.ready
+		return held == 0 && err == nil, err
+	}
+}
+
+func (lm *lockManager) grantLocked(tx *DBTX, key string, mode LockMode) {
+	lm.locks[key].holders[tx] = mode
+	if tx.locks == nil {
+		tx.locks = map[string]LockMode{}
+	}
+	tx.locks[key] = mode
+}
+
+// grant the waiting requests at the front of the queue that no
+// longer conflict with the holders
+func (lm *lockManager) wakeLocked(key string) {
+	e := lm.locks[key]
+	for len(e.queue) > 0 {
+		req := e.queue[0]
+		if !e.compatible(req.tx, req.mode) {
+			break
+		}
+		e.queue = e.queue[1:]
+		lm.grantLocked(req.tx, key, req.mode)
+		req.tx.waiting = nil
+		req.ready <- nil
+	}
+	if len(e.holders) == 0 && len(e.queue) == 0 {
+		delete(lm.locks, key)
+	}
+}
+
+// remove a waiting request, the caller notifies the waiter
+func (lm *lockManager) cancelLocked(req *lockRequest) {
+	e := lm.locks[req.key]
+	for i, queued := range e.queue {
+		if queued == req {
+			e.queue = append(e.queue[:i:i], e.queue[i+1:]...)
+			break
+		}
+	}
+	req.tx.waiting = nil
+	lm.wakeLocked(req.key)
+}
+
+// release every lock of a transaction, at commit or abort
+func (lm *lockManager) releaseAll(tx *DBTX) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if req := tx.waiting; req != nil {
+		lm.cancelLocked(req)
+		req.ready <- ErrTxDone
+	}
+	for key := range tx.locks {
+		delete(lm.locks[key].holders, tx)
+		lm.wakeLocked(key)
+	}
+	tx.locks = nil
+}
+
+// the transactions `tx` waits for
+func (lm *lockManager) waitsFor(tx *DBTX) []*DBTX {
+	req := tx.waiting
+	if req == nil {
+		return nil
+	}
+	e := lm.locks[req.key]
+	var out []*DBTX
+	for holder, held := range e.holders {
+		if holder != tx && (req.mode == LOCK_EXCLUSIVE || held == LOCK_EXCLUSIVE) {
+			out = append(out, holder)
+		}
+	}
+	// and the conflicting requests queued before it
+	for _, queued := range e.queue {
+		if queued == req {
+			break
+		}
+		if queued.tx != tx && (req.mode == LOCK_EXCLUSIVE || queued.mode == LOCK_EXCLUSIVE) {
+			out = append(out, queued.tx)
+		}
+	}
+	return out
+}
+
+// look for a cycle in the waits-for graph through `tx`, the youngest
+// transaction in the cycle is the victim. returns nil if there is none.
+func (lm *lockManager) deadlockVictim(tx *DBTX) *DBTX {
+	var path []*DBTX
+	visited := map[*DBTX]bool{}
+	var dfs func(t *DBTX) bool
+	dfs = func(t *DBTX) bool {
+		path = append(path, t)
+		for _, next := range lm.waitsFor(t) {
+			if next == tx {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if dfs(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if !dfs(tx) {
+		return nil
+	}
+	victim := path[0]
+	for _, t := range path[1:] {
+		if t.started.After(victim.started) {
+			victim = t
+		}
+	}
+	return victim
+}
+
+// lock a row of `table` by the primary key in `rec`
+func (tx *DBTX) lockRow(table string, rec Record, mode LockMode) error {
+	tdef := getTableDefTX(tx.db, table, &tx.kv)
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return err
+	}
+	return tx.lockKey(tdef, values[:tdef.PKeys], mode)
+}
+
+func (tx *DBTX) lockKey(tdef *TableDef, pk []Value, mode LockMode) error {
+	if err := tx.shareTableDef(tdef.Name); err != nil {
+		return err
+	}
+	key := encodeKey(nil, tdef.Prefix, pk)
+	fresh, err := tx.db.locks.acquire(tx, string(key), mode, tx.db.Limits().StatementTimeout)
+	if err != nil || !fresh {
+		return err
+	}
+	// the private tree may predate the last change to the row
+	return tx.refreshRow(tdef, pk)
+}
+
+// DDL locks the table definition and serializes the prefix allocation,
+// per schema
+func (tx *DBTX) lockTableDef(name string) error {
+	keys := [][]byte{
+		encodeKey(nil, TDEF_TABLE.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(name)}}),
+		encodeKey(nil, TDEF_META.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(prefixCounter(name))}}),
+		encodeKey(nil, TDEF_META.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(TABLE_ALIAS_KEY + name)}}),
+		encodeKey(nil, TDEF_META.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(VIEW_KEY + name)}}),
+	}
+	for _, key := range keys {
+		fresh, err := tx.db.locks.acquire(tx, string(key), LOCK_EXCLUSIVE, tx.db.Limits().StatementTimeout)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			tx.refreshKey(key)
+		}
+	}
+	// read the definition again from the refreshed private tree
+	delete(tx.kv.tables, name)
+	// an alias locks the table it stands for
+	if tdef := getTableDefTX(tx.db, name, &tx.kv); tdef != nil && tdef.Name != name {
+		return tx.lockTableDef(tdef.Name)
+	}
+	return nil
+}
+
+// the statements on the rows of a table share the lock on its
+// definition, so that DDL waits for the transactions using the table
+// rather than failing them at commit
+func (tx *DBTX) shareTableDef(name string) error {
+	key := encodeKey(nil, TDEF_TABLE.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(name)}})
+	fresh, err := tx.db.locks.acquire(tx, string(key), LOCK_SHARED, tx.db.Limits().StatementTimeout)
+	if err != nil || !fresh {
+		return err
+	}
+	// the definition may have changed since the transaction began
+	tx.refreshKey(key)
+	delete(tx.kv.tables, name)
+	if tdef := getTableDefTX(tx.db, name, &tx.kv); tdef != nil && tdef.Name != name {
+		return tx.shareTableDef(tdef.Name)
+	}
+	return nil
+}
+
+// copy the latest committed row into the private tree
+func (tx *DBTX) refreshRow(tdef *TableDef, pk []Value) error {
+	var reader KVReader
+	tx.db.kv.BeginRead(&reader)
+	defer tx.db.kv.EndRead(&reader)
+	latest := GetTableDef(tx.db, tdef.Name, &reader.Tree)
+	if latest == nil || latest.Prefix != tdef.Prefix {
+		return nil // created by this transaction
+	}
+
+	// read under the latest schema, the table may have been altered since
+	row := Record{Cols: append([]string(nil), latest.Cols[:latest.PKeys]...), Vals: append([]Value(nil), pk...)}
+	found, err := dbGet(tx.db, latest, &row, &reader.Tree)
+	if err != nil {
+		return err
+	}
+	if found {
+		// copied as it is, the constraints held when it was written
+		values := convertRow(latest, tdef, row.Vals)
+		_, err = dbPut(tx.db, tdef, values, MODE_UPSERT, &tx.kv)
+		return err
+	}
+	if _, exists, _ := tx.kv.Get(encodeKey(nil, tdef.Prefix, pk)); exists {
+		values := make([]Value, len(tdef.Cols))
+		copy(values, pk)
+		_, err = dbRemove(tx.db, tdef, values, &tx.kv)
+	}
+	return err
+}
+
+// lock the values a row takes in the UNIQUE indexes, so that two
+// transactions writing the same value wait for each other instead of
+// failing at commit
+func (tx *DBTX) lockUnique(tdef *TableDef, rec Record) error {
+	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return nil // the write reports it
+	}
+	for i := range tdef.Indexes {
+		key := uniqueKey(tdef, i, values)
+		if key == nil {
+			continue
+		}
+		fresh, err := tx.db.locks.acquire(tx, string(key), LOCK_EXCLUSIVE, tx.db.Limits().StatementTimeout)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			if err := tx.refreshIndexPrefix(tdef, i, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copy the latest committed rows with an index value into the private
+// tree, except the rows the transaction has locked
+func (tx *DBTX) refreshIndexPrefix(tdef *TableDef, i int, prefix []byte) error {
+	pks := map[string][]Value{}
+	collect := func(tree *BTree) {
+		for iter := tree.Seek(prefix, CMP_GE); iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+			pk := indexEntryPK(tdef, i, key)
+			pks[string(encodeKey(nil, tdef.Prefix, pk))] = pk
+		}
+	}
+	var reader KVReader
+	tx.db.kv.BeginRead(&reader)
+	latest := GetTableDef(tx.db, tdef.Name, &reader.Tree)
+	if latest != nil && latest.Prefix == tdef.Prefix {
+		collect(&reader.Tree)
+	}
+	tx.db.kv.EndRead(&reader)
+	collect(&tx.kv.Tree)
+
+	for key, pk := range pks {
+		tx.db.locks.mu.Lock()
+		_, held := tx.locks[key]
+		tx.db.locks.mu.Unlock()
+		if held {
+			continue // changed by the transaction itself
+		}
+		if err := tx.refreshRow(tdef, pk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock the rows referencing a row about to be deleted, and the rows a
+// cascade reaches from them. the private tree may miss the rows
+// referencing it committed since the transaction began.
+func (tx *DBTX) lockReferences(tdef *TableDef, pk []Value, seen map[string]bool) error {
+	for _, name := range append([]string{tdef.Name}, tdef.ReferencedBy...) {
+		child := getTableDefTX(tx.db, name, &tx.kv)
+		if child == nil {
+			continue
+		}
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != tdef.Name {
+				continue
+			}
+			pks := map[string][]Value{}
+			collect := func(row Record) {
+				pks[string(encodeKey(nil, child.Prefix, row.Vals[:child.PKeys]))] = row.Vals[:child.PKeys]
+			}
+			var reader KVReader
+			tx.db.kv.BeginRead(&reader)
+			var err error
+			if latest := GetTableDef(tx.db, name, &reader.Tree); latest != nil && latest.Prefix == child.Prefix {
+				err = scanReferences(tx.db, child, fk, pk, &reader.Tree, collect)
+			}
+			tx.db.kv.EndRead(&reader)
+			if err == nil {
+				err = scanReferences(tx.db, child, fk, pk, &tx.kv.Tree, collect)
+			}
+			if err != nil {
+				return err
+			}
+			for key, cpk := range pks {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				if err := tx.lockKey(child, cpk, LOCK_EXCLUSIVE); err != nil {
+					return err
+				}
+				if fk.OnDelete == FK_CASCADE {
+					if err := tx.lockReferences(child, cpk, seen); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lock a row about to be written, with its UNIQUE values and the rows
+// it references
+func (tx *DBTX) lockWrite(tdef *TableDef, rec Record) error {
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return err
+	}
+	if err := tx.lockKey(tdef, values[:tdef.PKeys], LOCK_EXCLUSIVE); err != nil {
+		return err
+	}
+	if err := tx.lockUnique(tdef, rec); err != nil {
+		return err
+	}
+	return tx.lockReferenced(tdef, rec)
+}
+
+// lock the rows a row references in SHARE mode, they can't be deleted
+// before the transaction ends
+func (tx *DBTX) lockReferenced(tdef *TableDef, rec Record) error {
+	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return nil // the write reports it
+	}
+	for _, fk := range tdef.ForeignKeys {
+		ref, ok := fkValues(tdef, fk, values)
+		if !ok {
+			continue
+		}
+		parent := getTableDefTX(tx.db, fk.Table, &tx.kv)
+		if parent == nil {
+			continue // the write reports it
+		}
+		if err := tx.lockKey(parent, ref, LOCK_SHARED); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy the latest committed value of an internal table key
+func (tx *DBTX) refreshKey(key []byte) {
+	var reader KVReader
+	tx.db.kv.BeginRead(&reader)
+	defer tx.db.kv.EndRead(&reader)
+	if val, ok, _ := reader.Tree.Get(key); ok {
+		tx.kv.Tree.Insert(key, val)
+	} else if _, exists, _ := tx.kv.Get(key); exists {
+		tx.kv.Tree.Delete(key)
+	}
+}
+
+// read a row and lock it. a lookup by a secondary index locks the row
+// it finds, then looks again in case the row has changed meanwhile.
+func (tx *DBTX) getLocked(table string, rec *Record, mode LockMode) (bool, error) {
+	var ok bool
+	err := tx.exec(func() error {
+		tx, table := tx.route(table)
+		if err := tx.shareTableDef(table); err != nil {
+			return err
+		}
+		tdef := getTableDefTX(tx.db, table, &tx.kv)
+		if tdef == nil {
+			return fmt.Errorf("table not found: %s", table)
+		}
+		values, err := checkRecord(tdef, *rec, tdef.PKeys)
+		byPK := err == nil
+		for {
+			if byPK {
+				err = tx.lockKey(tdef, values[:tdef.PKeys], mode)
+			} else {
+				row := copyRecord(*rec)
+				found, err := dbGet(tx.db, tdef, &row, &tx.kv.Tree)
+				if err != nil || !found {
+					return err
+				}
+				values = row.Vals
+				err = tx.lockKey(tdef, values[:tdef.PKeys], mode)
+			}
+			if err != nil {
+				return err
+			}
+
+			row := copyRecord(*rec)
+			found, err := dbGet(tx.db, tdef, &row, &tx.kv.Tree)
+			if err != nil || (!found && byPK) {
+				return err
+			}
+			if found && (byPK || samePK(tdef, row.Vals, values)) {
+				if rowExpired(tdef, row.Vals, time.Now()) {
+					return nil
+				}
+				*rec, ok = row, true
+				return nil
+			}
+			// the index entry moved to another row, or is gone
+		}
+	})
+	return ok, err
+}
+
+func samePK(tdef *TableDef, a, b []Value) bool {
+	return bytes.Equal(encodeKey(nil, tdef.Prefix, a[:tdef.PKeys]), encodeKey(nil, tdef.Prefix, b[:tdef.PKeys]))
+}
+
+// the statements keep a record after they return, don't share its slices
+func copyRecord(rec Record) Record {
+	return Record{Cols: append([]string(nil), rec.Cols...), Vals: append([]Value(nil), rec.Vals...)}
+}
+
+// check a replayed statement against its result in the private tree
+func replayed(table string, got, want bool, err error) error {
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrWriteConflict, table, err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s", ErrWriteConflict, table)
+	}
+	return nil
+}
@@ -4,22 +4,39 @@ import (
 	"encoding/binary"
 )
 
+// the free list is a linked list of nodes holding the free pages in the
+// order they were freed, oldest first. a commit pops from the head and
+// pushes to the tail, so it only writes the nodes it changes: the head
+// node is copied on write and records where the tail ends, the tail
+// node is appended to in place past that end, which the committed list
+// doesn't read, and the nodes in between are full and never change.
 type FreeListData struct {
-	head uint64
-	// cached pointers to list nodes for accessing both ends
-	nodes []uint64 // from tail to head
-	// cached total number of items; stored in the head node
-	total int
-	// cached number of discarded items in the tail nodes
-	offset int
+	head uint64 // the head node on disk, 0 for an empty list
+	// the state of the list, read from the head node on first use
+	loaded   bool
+	items    []freeItem // the items of the head node not popped yet
+	next     uint64     // the node after the head, 0 if it's the only one
+	tail     uint64     // the last node, 0 if it's the head
+	tailSize int        // the items in the tail node
+	total    int
+	// the nodes emptied by the pops, freed with the old head
+	emptied []uint64
+	// the head node must be written again on commit
+	dirty bool
+}
+
+// a free page and the version in which it was freed, the page
+// can be reused once no reader is older than that version.
+type freeItem struct {
+	ptr     uint64
+	version uint64
 }
 
 type FreeList struct {
 	FreeListData
 	// for each transaction
-	version   uint64   // current version
-	minReader uint64   // minimum reader version
-	freed     []uint64 // pages that will be added to the free list
+	version   uint64 // version created by the transaction
+	minReader uint64 // minimum reader version
 
 	// callbacks for managing on-disk pages
 	get func(uint64) BNode  // de-reference a pointer
@@ -28,87 +45,213 @@ type FreeList struct {
 }
 
 // Free List Node Format
-// | type | size | total | next |  pointers-version-pairs |
-// |  2B  |  2B  |   8B  |  8B  |       size * 16B        |
+// | type | size | total | next | tail | tail size | pointer-version pairs |
+// |  2B  |  2B  |   8B  |  8B  |  8B  |    4B     |      size * 16B       |
+// the total and the tail are only kept in the head node.
 
 const (
-	BNODE_FREE_LIST  = 3
-	FREE_LIST_HEADER = 4 + 8 + 8
-	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+	BNODE_FREE_LIST  = 4
+	FREE_LIST_HEADER = 4 + 8 + 8 + 8 + 4
+	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 16
+
+	// the list rewritten on every commit, with a shorter header
+	BNODE_FREE_LIST_REWRITTEN  = 3
+	FREE_LIST_REWRITTEN_HEADER = 4 + 8 + 8
 )
 
+// take a page that no reader can reach, returns 0 if there is none
 func (fl *FreeList) Pop() uint64 {
 	fl.loadCache()
-	return flPop1(fl)
+	if len(fl.items) == 0 && fl.next != 0 {
+		fl.popNode()
+	}
+	if len(fl.items) == 0 || versionBefore(fl.minReader, fl.items[0].version) {
+		// cannot use; possibly reachable by the minimum version reader
+		return 0
+	}
+	ptr := fl.items[0].ptr
+	fl.items = fl.items[1:]
+	fl.total--
+	fl.dirty = true
+	return ptr
 }
 
+// make the node after the emptied head the head
+func (fl *FreeList) popNode() {
+	node := fl.get(fl.next)
+	size := FREE_LIST_CAP
+	if fl.next == fl.tail {
+		size = fl.tailSize
+	}
+	fl.items = make([]freeItem, size)
+	for i := range fl.items {
+		fl.items[i].ptr, fl.items[i].version = flnItem(node, FREE_LIST_HEADER, i)
+	}
+	fl.emptied = append(fl.emptied, fl.head)
+	fl.head = fl.next
+	if fl.next == fl.tail {
+		fl.next, fl.tail, fl.tailSize = 0, 0, 0
+	} else {
+		fl.next = flnNext(node)
+	}
+	fl.dirty = true
+}
+
+// add the pages freed by the transaction
 func (fl *FreeList) Add(freed []uint64) {
 	if len(freed) == 0 {
 		return
 	}
-	total := fl.Total() + len(freed)
-	flPush(fl, freed, nil)
-	if fl.head != 0 {
-		flnSetTotal(fl.get(fl.head), uint64(total))
+	items := make([]freeItem, len(freed))
+	for i, ptr := range freed {
+		items[i] = freeItem{ptr: ptr, version: fl.version}
+	}
+	fl.push(items)
+}
+
+func (fl *FreeList) push(items []freeItem) {
+	fl.loadCache()
+	fl.total += len(items)
+	fl.dirty = true // the head node counts them
+	if fl.next == 0 {
+		// the head takes them while it's the only node
+		n := min(len(items), FREE_LIST_CAP-len(fl.items))
+		fl.items = append(fl.items[:len(fl.items):len(fl.items)], items[:n]...)
+		items = items[n:]
+	}
+	var tail BNode
+	for len(items) > 0 {
+		if fl.tail != 0 && fl.tailSize < FREE_LIST_CAP {
+			if tail.data == nil {
+				// a copy, the committed list may read the page until the commit
+				tail = BNode{append([]byte(nil), fl.get(fl.tail).data...)}
+			}
+			flnSetItem(tail, fl.tailSize, items[0].ptr, items[0].version)
+			fl.tailSize++
+			flnSetHeader(tail, uint16(fl.tailSize), 0)
+			fl.use(fl.tail, tail)
+			items = items[1:]
+			continue
+		}
+		// a new tail
+		node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		flnSetHeader(node, 0, 0)
+		ptr := fl.new(node)
+		if fl.tail == 0 {
+			fl.next = ptr
+		} else {
+			if tail.data == nil {
+				tail = BNode{append([]byte(nil), fl.get(fl.tail).data...)}
+			}
+			flnSetHeader(tail, uint16(fl.tailSize), ptr)
+			fl.use(fl.tail, tail)
+		}
+		fl.tail, fl.tailSize, tail = ptr, 0, node
 	}
 }
 
 func (fl *FreeList) loadCache() {
-	if len(fl.nodes) > 0 {
+	if fl.loaded {
 		return
 	}
-
-	curr := fl.head
-	if curr == 0 {
-		fl.total = 0
-		fl.offset = 0
+	fl.loaded = true
+	if fl.head == 0 {
 		return
 	}
+	node := fl.get(fl.head)
+	switch node.bNodeType() {
+	case BNODE_FREE_LIST:
+		fl.items = make([]freeItem, flnSize(node))
+		for i := range fl.items {
+			fl.items[i].ptr, fl.items[i].version = flnItem(node, FREE_LIST_HEADER, i)
+		}
+		fl.total = int(binary.LittleEndian.Uint64(node.data[4:]))
+		fl.next = flnNext(node)
+		fl.tail = binary.LittleEndian.Uint64(node.data[20:])
+		fl.tailSize = int(binary.LittleEndian.Uint32(node.data[28:]))
+	case BNODE_FREE_LIST_REWRITTEN:
+		fl.loadRewritten()
+	default:
+		// written by an older release that didn't persist the
+		// popped items, so the pages may be in use. drop the list.
+		fl.head = 0
+		fl.dirty = true
+	}
+}
 
+// move the items of a list in the rewritten format to a new list,
+// its nodes are freed
+func (fl *FreeList) loadRewritten() {
+	var items []freeItem
 	var nodes []uint64
-	for curr != 0 {
-		nodes = append(nodes, curr)
+	for curr := fl.head; curr != 0; {
 		node := fl.get(curr)
+		if node.bNodeType() != BNODE_FREE_LIST_REWRITTEN {
+			items, nodes = nil, nil
+			break
+		}
+		nodes = append(nodes, curr)
+		for i := 0; i < flnSize(node); i++ {
+			ptr, ver := flnItem(node, FREE_LIST_REWRITTEN_HEADER, i)
+			items = append(items, freeItem{ptr: ptr, version: ver})
+		}
 		curr = flnNext(node)
 	}
-
-	for i := 0; i < len(nodes)/2; i++ {
-		nodes[i], nodes[len(nodes)-1-i] = nodes[len(nodes)-1-i], nodes[i]
-	}
-
-	fl.nodes = nodes
-	headNode := fl.get(fl.head)
-	fl.total = flnSize(headNode)
-	fl.offset = 0
+	fl.head = 0
+	fl.dirty = true
+	fl.push(items)
+	fl.Add(nodes)
 }
 
-func flPop1(fl *FreeList) uint64 {
-	if fl.total == 0 {
-		return 0
+// write the head node to a new page, the old one is freed. called once
+// per commit.
+func (fl *FreeList) Flush() {
+	if !fl.dirty {
+		return
+	}
+	// the head node takes a free page when possible
+	ptr := fl.Pop()
+	old := fl.emptied
+	if fl.head != 0 {
+		old = append(old, fl.head)
 	}
+	fl.emptied = nil
+	fl.Add(old)
+	fl.dirty = false
 
-	assert(fl.offset < flnSize(fl.get(fl.nodes[0])))
-	ptr, ver := flnItem(fl.get(fl.nodes[0]), fl.offset)
-	if versionBefore(fl.minReader, ver) {
-		// cannot use; possibly reachable by the minimum version reader
-		return 0
+	if len(fl.items) == 0 && fl.next == 0 {
+		fl.head = 0 // nothing was popped or freed
+		return
 	}
-	fl.offset++
-	fl.total--
-	if fl.offset >= flnSize(fl.get(fl.nodes[0])) {
-		fl.nodes = fl.nodes[1:]
-		fl.offset = 0
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	flnSetHeader(node, uint16(len(fl.items)), fl.next)
+	binary.LittleEndian.PutUint64(node.data[4:], uint64(fl.total))
+	binary.LittleEndian.PutUint64(node.data[20:], fl.tail)
+	binary.LittleEndian.PutUint32(node.data[28:], uint32(fl.tailSize))
+	for i, item := range fl.items {
+		flnSetItem(node, i, item.ptr, item.version)
 	}
-	return ptr
+	if ptr != 0 {
+		fl.head = ptr
+		fl.use(ptr, node)
+	} else {
+		fl.head = fl.new(node)
+	}
+}
+
+// number of free pages, including the ones still pinned by readers
+func (fl *FreeList) Total() int {
+	fl.loadCache()
+	return fl.total
 }
 
 func versionBefore(u uint64, ver uint64) bool {
 	return int64(u-ver) < 0
 }
 
-func flnItem(node BNode, offset int) (uint64, uint64) {
-	pos := FREE_LIST_HEADER + offset*16
-	if len(node.data) < int(pos)+16 {
+func flnItem(node BNode, header int, offset int) (uint64, uint64) {
+	pos := header + offset*16
+	if len(node.data) < pos+16 {
 		return 0, 0
 	}
 	ptr := binary.LittleEndian.Uint64(node.data[pos : pos+8])
@@ -116,6 +259,12 @@ func flnItem(node BNode, offset int) (uint64, uint64) {
 	return ptr, ver
 }
 
+func flnSetItem(node BNode, offset int, ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER + offset*16
+	binary.LittleEndian.PutUint64(node.data[pos:pos+8], ptr)
+	binary.LittleEndian.PutUint64(node.data[pos+8:pos+16], ver)
+}
+
 func flnSize(node BNode) int {
 	return int(node.nKeys())
 }
@@ -124,103 +273,8 @@ func flnNext(node BNode) uint64 {
 	return binary.LittleEndian.Uint64(node.data[4+8:])
 }
 
-func flnPtr(node BNode, idx int) uint64 {
-	return binary.LittleEndian.Uint64(node.data[FREE_LIST_HEADER+idx*8:])
-}
-
-func flnSetPtr(node BNode, idx int, ptr uint64) {
-	binary.LittleEndian.PutUint64(node.data[FREE_LIST_HEADER+idx*8:], ptr)
-}
-
 func flnSetHeader(node BNode, size uint16, next uint64) {
+	binary.LittleEndian.PutUint16(node.data[0:], BNODE_FREE_LIST)
 	binary.LittleEndian.PutUint16(node.data[2:], size)
 	binary.LittleEndian.PutUint64(node.data[4+8:], next)
 }
-
-func flnSetTotal(node BNode, total uint64) {
-	binary.LittleEndian.PutUint64(node.data[4:], total)
-}
-
-func (fl *FreeList) Get(pgnum int) uint64 {
-	node := fl.get(fl.head)
-	for flnSize(node) < pgnum {
-		pgnum -= flnSize(node)
-		next := flnNext(node)
-		node = fl.get(next)
-	}
-	return flnPtr(node, flnSize(node)-pgnum-1)
-}
-
-// calculates the number of page `pointers` across all nodes
-func (fl *FreeList) Total() int {
-	if fl == nil || fl.head == 0 {
-		return 0 // Handle nil case or empty list
-	}
-
-	total := 0
-	nodeId := fl.head
-
-	for nodeId > 0 {
-		node := fl.get(nodeId)
-		total += flnSize(node)
-		nodeId = flnNext(node)
-	}
-	return total
-}
-
-// remove the `popn` pointers & add new `freed` pointers
-func (fl *FreeList) Update(popn int, freed []uint64) {
-	if popn == 0 || len(freed) == 0 {
-		return // no change to be done
-	}
-
-	total := fl.Total()
-	reuse := []uint64{} // construct the new list
-
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
-		node := fl.get(fl.head)
-		freed = append(freed, fl.head) // reuse the node itself
-
-		if popn >= flnSize(node) {
-			popn -= flnSize(node)
-		} else {
-			remain := flnSize(node) - popn
-			popn = 0
-			// collect resuable pointers
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-				remain--
-				reuse = append(reuse, flnPtr(node, remain))
-			}
-			for i := 0; i < remain; i++ {
-				freed = append(freed, flnPtr(node, i))
-			}
-		}
-		total -= flnSize(node)
-		fl.head = flnNext(node)
-	}
-	assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0)
-	flPush(fl, freed, reuse)
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
-}
-
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-
-		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
-		}
-		flnSetHeader(new, uint16(size), fl.head)
-		for i, ptr := range freed[:size] {
-			flnSetPtr(new, i, ptr)
-		}
-		freed = freed[size:]
-		if len(reuse) > 0 {
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, new)
-		} else {
-			fl.head = fl.new(new)
-		}
-	}
-}
@@ -0,0 +1,219 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrSchemaExists   = errors.New("schema already exists")
+	ErrSchemaNotFound = errors.New("schema not found")
+	ErrSchemaNotEmpty = errors.New("schema not empty")
+)
+
+// a schema is a namespace for the tables and the views named
+// `schema.name`. it is kept in @meta, keyed `schema:<name>`.
+const SCHEMA_KEY = "schema:"
+
+// the key prefixes a schema takes from `next_prefix` when created. its
+// tables and indexes take theirs from that block, so the DDL of
+// different schemas doesn't serialize on one counter.
+const SCHEMA_PREFIXES = 1 << 20
+
+type SchemaDef struct {
+	Name string
+	Base uint32 // the first prefix of the block
+	Next uint32 // the next prefix not allocated yet
+}
+
+func schemaRecord(name string) *Record {
+	return (&Record{}).AddStr("key", []byte(SCHEMA_KEY+name))
+}
+
+// the schema of a qualified name and the name within it, "" for the
+// names outside schemas
+func splitSchema(name string) (string, string) {
+	schema, rest, ok := strings.Cut(name, ".")
+	if !ok {
+		return "", name
+	}
+	return schema, rest
+}
+
+// a new name for `name` without a schema is a name in the schema of `name`
+func inSchemaOf(name, newName string) string {
+	schema, _ := splitSchema(name)
+	if newSchema, _ := splitSchema(newName); newSchema == "" && schema != "" {
+		return schema + "." + newName
+	}
+	return newName
+}
+
+// the @meta key the prefixes of a table are allocated from
+func prefixCounter(name string) string {
+	if schema, _ := splitSchema(name); schema != "" {
+		return SCHEMA_KEY + schema
+	}
+	return "next_prefix"
+}
+
+func getSchema(db *DB, name string, tree *BTree) *SchemaDef {
+	rec := schemaRecord(name)
+	if ok, err := dbGet(db, TDEF_META, rec, tree); err != nil || !ok {
+		return nil
+	}
+	schema := &SchemaDef{}
+	if err := json.Unmarshal(rec.Get("val").Str, schema); err != nil {
+		return nil
+	}
+	return schema
+}
+
+func schemaStore(db *DB, schema *SchemaDef, kvtx *KVTX) error {
+	val, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	rec := schemaRecord(schema.Name).AddStr("val", val)
+	_, err = dbUpdate(db, TDEF_META, *rec, MODE_UPSERT, kvtx)
+	return err
+}
+
+// a qualified name must be in a schema that exists
+func checkSchemaName(db *DB, name string, tree *BTree) error {
+	schema, rest := splitSchema(name)
+	if schema == "" {
+		return nil
+	}
+	if !isValidTableName(rest) {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	if getSchema(db, schema, tree) == nil {
+		return fmt.Errorf("%w: %s", ErrSchemaNotFound, schema)
+	}
+	return nil
+}
+
+// allocate `n` consecutive prefixes from the block of a schema
+func allocSchemaPrefixes(db *DB, name string, n uint32, kvtx *KVTX) (uint32, error) {
+	schema := getSchema(db, name, &kvtx.Tree)
+	if schema == nil {
+		return 0, fmt.Errorf("%w: %s", ErrSchemaNotFound, name)
+	}
+	prefix := schema.Next
+	if uint64(prefix)+uint64(n) > uint64(schema.Base)+SCHEMA_PREFIXES {
+		return 0, fmt.Errorf("schema %s is out of key prefixes", name)
+	}
+	schema.Next += n
+	return prefix, schemaStore(db, schema, kvtx)
+}
+
+// SchemaCreate adds an empty schema.
+func (db *DB) SchemaCreate(name string, kvtx *KVTX) error {
+	if !isValidTableName(name) {
+		return fmt.Errorf("invalid schema name: %q", name)
+	}
+	if getSchema(db, name, &kvtx.Tree) != nil {
+		return fmt.Errorf("%w: %s", ErrSchemaExists, name)
+	}
+	// `name.table` would name a table of the attached database
+	db.attachMu.Lock()
+	_, attached := db.attached[name]
+	db.attachMu.Unlock()
+	if attached {
+		return fmt.Errorf("%w: %s is an attached database", ErrSchemaExists, name)
+	}
+	base, err := allocPrefixes(db, "", SCHEMA_PREFIXES, kvtx)
+	if err != nil {
+		return err
+	}
+	return schemaStore(db, &SchemaDef{Name: name, Base: base, Next: base}, kvtx)
+}
+
+// SchemaDrop removes an empty schema. with `cascade`, its views and
+// tables are dropped first, the tables referenced by others in the
+// schema, or written by their triggers, last.
+func (db *DB) SchemaDrop(name string, cascade bool, kvtx *KVTX) error {
+	if getSchema(db, name, &kvtx.Tree) == nil {
+		return fmt.Errorf("%w: %s", ErrSchemaNotFound, name)
+	}
+	tables, views, err := db.SchemaObjects(name, &kvtx.Tree)
+	if err != nil {
+		return err
+	}
+	if !cascade && len(tables)+len(views) > 0 {
+		return fmt.Errorf("%w: %s has %s", ErrSchemaNotEmpty, name,
+			strings.Join(append(tables, views...), ", "))
+	}
+	for _, view := range views {
+		if err := db.ViewDrop(view, kvtx); err != nil {
+			return err
+		}
+	}
+	for len(tables) > 0 {
+		var rest []string
+		var lastErr error
+		for _, table := range tables {
+			err := db.TableDrop(table, kvtx)
+			if errors.Is(err, ErrForeignKey) || errors.Is(err, ErrTriggerTarget) {
+				rest, lastErr = append(rest, table), err
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(rest) == len(tables) {
+			return lastErr // referenced or written from outside the schema
+		}
+		tables = rest
+	}
+	_, err = dbDelete(db, TDEF_META, *schemaRecord(name), kvtx)
+	return err
+}
+
+// SchemaObjects returns the tables and the views of a schema.
+func (db *DB) SchemaObjects(name string, tree *BTree) ([]string, []string, error) {
+	names, err := db.TableNames(tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tables []string
+	for _, table := range names {
+		if strings.HasPrefix(table, name+".") {
+			tables = append(tables, table)
+		}
+	}
+	all, err := db.Views(tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	var views []string
+	for _, view := range all {
+		if strings.HasPrefix(view.Name, name+".") {
+			views = append(views, view.Name)
+		}
+	}
+	return tables, views, nil
+}
+
+// Schemas returns every schema.
+func (db *DB) Schemas(tree *BTree) ([]*SchemaDef, error) {
+	start := (&Record{}).AddStr("key", []byte(SCHEMA_KEY))
+	end := (&Record{}).AddStr("key", []byte("schema;")) // after every `schema:` key
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LT, Key1: *start, Key2: *end}
+	if err := dbScan(db, TDEF_META, &sc, tree); err != nil {
+		return nil, err
+	}
+	var schemas []*SchemaDef
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		schema := &SchemaDef{}
+		if err := json.Unmarshal(rec.Get("val").Str, schema); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", rec.Get("key").Str, err)
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
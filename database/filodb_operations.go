@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
+	"time"
 )
 
 const (
@@ -40,6 +42,9 @@ func (db *DB) TableNew(tdef *TableDef, kvtx *KVTX) error {
 	if err := tableDefCheck(tdef); err != nil {
 		return fmt.Errorf("invalid table definition: %w", err)
 	}
+	if err := checkForeignKeys(db, tdef, kvtx); err != nil {
+		return fmt.Errorf("invalid table definition: %w", err)
+	}
 	table := (&Record{}).AddStr("name", []byte(tdef.Name))
 
 	// Table existence check
@@ -50,70 +55,147 @@ func (db *DB) TableNew(tdef *TableDef, kvtx *KVTX) error {
 	if ok {
 		return fmt.Errorf("%w: %s", ErrTableAlreadyExists, tdef.Name)
 	}
-	tdef.Prefix = TABLE_PREFIX_MIN
+	if target := aliasTarget(db, tdef.Name, &kvtx.Tree); target != "" {
+		return fmt.Errorf("%w: %s is an alias of %s", ErrTableAlreadyExists, tdef.Name, target)
+	}
+	if getView(db, tdef.Name, &kvtx.Tree) != nil {
+		return fmt.Errorf("%w: %s", ErrViewExists, tdef.Name)
+	}
+	if err := checkSchemaName(db, tdef.Name, &kvtx.Tree); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(tdef.Name, "@") {
+		// the internal tables keep the rows without a version
+		initVersion(tdef)
+	}
+	prefix, err := allocPrefixes(db, tdef.Name, 1+uint32(len(tdef.Indexes)), kvtx)
+	if err != nil {
+		return err
+	}
+	tdef.Prefix = prefix
+	if len(tdef.Indexes) > 0 {
+		tdef.IndexPrefix = make([]uint32, len(tdef.Indexes))
+		for i := range tdef.Indexes {
+			tdef.IndexPrefix[i] = tdef.Prefix + 1 + uint32(i)
+		}
+	}
+
+	// Marshal and store table definition
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return fmt.Errorf("failed to marshal table definition: %w", err)
+	}
+	table.AddStr("def", val)
+	added, err := dbUpdate(db, TDEF_TABLE, *table, MODE_UPSERT, kvtx)
+	if err != nil {
+		return fmt.Errorf("failed to update table definition: %w", err)
+	}
+	if !added {
+		return fmt.Errorf("failed to add table definition")
+	}
+	tableDefChanged(db, tdef.Name, tdef, kvtx)
+	if tdef.AutoIncrement {
+		if err := db.SequenceCreate(autoSequence(tdef), 1, kvtx); err != nil {
+			return err
+		}
+	}
+	return addReferences(db, tdef, kvtx)
+}
+
+// allocate `n` consecutive key prefixes for the table `table`, from the
+// block of its schema or from `next_prefix`. returns the first.
+func allocPrefixes(db *DB, table string, n uint32, kvtx *KVTX) (uint32, error) {
+	if schema, _ := splitSchema(table); schema != "" {
+		return allocSchemaPrefixes(db, schema, n, kvtx)
+	}
+	prefix := uint32(TABLE_PREFIX_MIN)
 	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(db, TDEF_META, meta, &kvtx.Tree)
+	ok, err := dbGet(db, TDEF_META, meta, &kvtx.Tree)
 	if err != nil {
-		return fmt.Errorf("error reading meta: %w", err)
+		return 0, fmt.Errorf("error reading meta: %w", err)
 	}
 
 	if ok {
 		if len(meta.Get("val").Str) < 4 {
-			return fmt.Errorf("corrupted meta value: invalid length")
+			return 0, fmt.Errorf("corrupted meta value: invalid length")
 		}
-		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		if TABLE_PREFIX_MIN > tdef.Prefix {
-			return errors.New("table prefix less than the min TABLE_PREFIX")
+		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+		if TABLE_PREFIX_MIN > prefix {
+			return 0, errors.New("table prefix less than the min TABLE_PREFIX")
 		}
 	} else {
 		meta.AddStr("val", make([]byte, 4))
 	}
 
-	if len(tdef.Indexes) > 0 {
-		tdef.IndexPrefix = make([]uint32, len(tdef.Indexes))
-		for i := range tdef.Indexes {
-			prefix := tdef.Prefix + 1 + uint32(i)
-			if prefix < tdef.Prefix { // Check for overflow
-				return fmt.Errorf("index prefix overflow")
-			}
-			tdef.IndexPrefix[i] = prefix
-		}
-	}
-
-	ntree := 1 + uint32(len(tdef.IndexPrefix))
-	nextPrefix := tdef.Prefix + ntree
-	if nextPrefix < tdef.Prefix {
-		return fmt.Errorf("prefix overflow")
+	nextPrefix := prefix + n
+	if nextPrefix < prefix {
+		return 0, fmt.Errorf("prefix overflow")
 	}
 	// Update meta
 	binary.LittleEndian.PutUint32(meta.Get("val").Str, nextPrefix)
 
 	added, err := dbUpdate(db, TDEF_META, *meta, MODE_UPSERT, kvtx)
 	if err != nil {
-		return fmt.Errorf("failed to update meta: %w", err)
+		return 0, fmt.Errorf("failed to update meta: %w", err)
 	}
 	if !added {
-		return fmt.Errorf("failed to add meta entry")
+		return 0, fmt.Errorf("failed to add meta entry")
 	}
+	return prefix, nil
+}
 
-	// Marshal and store table definition
-	val, err := json.Marshal(tdef)
-	if err != nil {
-		return fmt.Errorf("failed to marshal table definition: %w", err)
+// TableDrop removes a table with its rows and indexes. the keys are
+// removed by prefix, the pages they used are freed on commit.
+func (db *DB) TableDrop(name string, kvtx *KVTX) error {
+	if strings.HasPrefix(name, "@") {
+		return fmt.Errorf("cannot drop the internal table %s", name)
 	}
-	table.AddStr("def", val)
-	added, err = dbUpdate(db, TDEF_TABLE, *table, MODE_UPSERT, kvtx)
+	tdef := getTableDefTX(db, name, kvtx)
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", name)
+	}
+	name = tdef.Name // not an alias
+	if len(tdef.ReferencedBy) > 0 {
+		return fmt.Errorf("%w: %s is referenced by %s",
+			ErrForeignKey, name, strings.Join(tdef.ReferencedBy, ", "))
+	}
+	writers, err := triggersWriting(db, name, kvtx)
 	if err != nil {
-		return fmt.Errorf("failed to update table definition: %w", err)
+		return err
 	}
-	if !added {
-		return fmt.Errorf("failed to add table definition")
+	if len(writers) > 0 {
+		return fmt.Errorf("%w: %s by %s", ErrTriggerTarget, name, strings.Join(writers, ", "))
 	}
-	return nil
+	if err := dropReferences(db, tdef, kvtx); err != nil {
+		return err
+	}
+
+	for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefix...) {
+		start, end := prefixRange(prefix)
+		kvtx.Tree.DeleteRange(start, end)
+	}
+	table := (&Record{}).AddStr("name", []byte(name))
+	if _, err := dbDelete(db, TDEF_TABLE, *table, kvtx); err != nil {
+		return fmt.Errorf("failed to delete table definition: %w", err)
+	}
+	if tdef.AutoIncrement {
+		if err := db.SequenceDrop(autoSequence(tdef), kvtx); err != nil && !errors.Is(err, ErrSequenceNotFound) {
+			return err
+		}
+	}
+	tableDefChanged(db, name, nil, kvtx)
+	return dropAliases(db, name, kvtx)
+}
+
+// the keys of a table or an index, [start, end)
+func prefixRange(prefix uint32) ([]byte, []byte) {
+	start := binary.BigEndian.AppendUint32(nil, prefix)
+	end := binary.BigEndian.AppendUint32(nil, prefix+1)
+	return start, end
 }
 
 func (db *DB) Set(table string, rec Record, mode int, kvtx *KVTX) (bool, error) {
-	tdef := GetTableDef(db, table, &kvtx.Tree)
+	tdef := getTableDefTX(db, table, kvtx)
 	if tdef == nil {
 		return false, fmt.Errorf("table not found: %s", table)
 	}
@@ -125,21 +207,57 @@ func (db *DB) Get(table string, rec *Record, kvReader *KVReader) (bool, error) {
 	if tdef == nil {
 		return false, fmt.Errorf("table not found: %s", table)
 	}
-	return dbGet(db, tdef, rec, &kvReader.Tree)
+	ok, err := dbGet(db, tdef, rec, &kvReader.Tree)
+	if ok && rowExpired(tdef, rec.Vals, time.Now()) {
+		return false, nil
+	}
+	return ok, err
 }
 
 func (db *DB) GetRange(table string, start, end *Record, kvReader *KVReader) ([]*Record, error) {
+	return db.getRange(table, start, end, nil, kvReader)
+}
+
+// GetRangeCols is GetRange reading the columns `cols` of the rows only.
+// an index keeping them, in its keys or its INCLUDE columns, answers
+// without reading the rows.
+func (db *DB) GetRangeCols(table string, start, end *Record, cols []string, kvReader *KVReader) ([]*Record, error) {
+	if len(cols) == 0 {
+		return nil, errors.New("no columns to read")
+	}
+	return db.getRange(table, start, end, cols, kvReader)
+}
+
+func (db *DB) getRange(table string, start, end *Record, cols []string, kvReader *KVReader) ([]*Record, error) {
 	tdef := GetTableDef(db, table, &kvReader.Tree)
 	if tdef == nil {
 		return nil, fmt.Errorf("table not found: %s", table)
 	}
+	for _, col := range cols {
+		if ColIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("column '%s' not found", col)
+		}
+	}
+
+	sc := Scanner{
+		Cmp1: CMP_GE,
+		Cmp2: CMP_LE,
+		Key1: *start,
+		Key2: *end,
+		Cols: cols,
+		live: true,
+	}
 
 	// Check if we can use direct range scanning
-	_, err := findIndex(tdef, start.Cols)
+	_, err := scanIndex(tdef, &sc)
 	if err != nil {
 		// If no index found for direct scanning, try filtered approach for single column queries
 		if len(start.Cols) == 1 {
-			return db.getRangeFiltered(table, start, end, kvReader, tdef)
+			rows, err := db.getRangeFiltered(table, start, end, kvReader, tdef)
+			for i := range rows {
+				rows[i] = project(rows[i], cols)
+			}
+			return rows, err
 		}
 		return nil, err
 	}
@@ -147,13 +265,6 @@ func (db *DB) GetRange(table string, start, end *Record, kvReader *KVReader) ([]
 	var results []*Record
 	maxResults := 500 // Safety limit
 
-	sc := Scanner{
-		Cmp1: CMP_GE,
-		Cmp2: CMP_LE,
-		Key1: *start,
-		Key2: *end,
-	}
-
 	if err := dbScan(db, tdef, &sc, &kvReader.Tree); err != nil {
 		return nil, err
 	}
@@ -167,11 +278,13 @@ func (db *DB) GetRange(table string, start, end *Record, kvReader *KVReader) ([]
 		copy(rec.Cols, tdef.Cols)
 
 		sc.Deref(rec, &kvReader.Tree)
-		results = append(results, rec)
-
 		sc.Next()
+		results = append(results, project(rec, cols))
 		count++
 	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
 
 	if count >= maxResults {
 		return results, fmt.Errorf("reached maximum result limit")
@@ -180,6 +293,18 @@ func (db *DB) GetRange(table string, start, end *Record, kvReader *KVReader) ([]
 	return results, nil
 }
 
+// the columns `cols` of a record, all of them if nil
+func project(rec *Record, cols []string) *Record {
+	if cols == nil {
+		return rec
+	}
+	projected := &Record{Cols: cols}
+	for _, col := range cols {
+		projected.Vals = append(projected.Vals, *rec.Get(col))
+	}
+	return projected
+}
+
 // getRangeFiltered performs range filtering on a single column by scanning and filtering
 func (db *DB) getRangeFiltered(table string, start, end *Record, kvReader *KVReader, tdef *TableDef) ([]*Record, error) {
 	if len(start.Cols) != 1 || len(end.Cols) != 1 {
@@ -257,12 +382,12 @@ func (db *DB) getRangeFiltered(table string, start, end *Record, kvReader *KVRea
 		}
 	}
 
-	return results, nil
+	return unexpired(tdef, results), nil
 }
 
 // isValueInRange checks if a value is within the specified range
 func isValueInRange(val, start, end Value) bool {
-	if val.Type != start.Type || val.Type != end.Type {
+	if val.Null || val.Type != start.Type || val.Type != end.Type {
 		return false
 	}
 
@@ -299,7 +424,7 @@ func (db *DB) Upsert(table string, rec Record, kvtx *KVTX) (bool, error) {
 }
 
 func (db *DB) Delete(table string, rec Record, kvtx *KVTX) (bool, error) {
-	tdef := GetTableDef(db, table, &kvtx.Tree)
+	tdef := getTableDefTX(db, table, kvtx)
 	if tdef == nil {
 		return false, fmt.Errorf("table not found: %s", table)
 	}
@@ -311,33 +436,108 @@ func dbDelete(db *DB, tdef *TableDef, rec Record, kvtx *KVTX) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	var old []Value
+	if len(tdef.Triggers) > 0 {
+		if old, _ = currentRow(tdef, values, kvtx); old != nil {
+			if _, err := fireTriggers(db, tdef, TRIGGER_BEFORE, TRIGGER_DELETE, old, nil, kvtx); err != nil {
+				return false, err
+			}
+		}
+	}
+	if isReferenced(tdef) {
+		key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+		if _, exists, _ := kvtx.Get(key); exists {
+			if err := deleteReferences(db, tdef, values[:tdef.PKeys], kvtx); err != nil {
+				return false, err
+			}
+		}
+	}
+	deleted, err := dbRemove(db, tdef, values, kvtx)
+	if err != nil || !deleted || old == nil {
+		return deleted, err
+	}
+	_, err = fireTriggers(db, tdef, TRIGGER_AFTER, TRIGGER_DELETE, old, nil, kvtx)
+	return deleted, err
+}
+
+// delete a row and its index entries, `values` is in table order with
+// the primary key set
+func dbRemove(db *DB, tdef *TableDef, values []Value, kvtx *KVTX) (bool, error) {
+	if err := kvtx.Tree.interrupted(); err != nil {
+		return false, err
+	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
 	req := DeleteReq{Key: key}
 	deleted, err := kvtx.Delete(&req)
 	if err != nil || !deleted || len(tdef.Indexes) == 0 {
 		return deleted, err
 	}
-	for i := tdef.PKeys; i <= len(tdef.Cols[tdef.PKeys:]); i++ {
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
 		values[i] = Value{Type: tdef.Types[i]}
 	}
 	if deleted {
-		decodeValues(req.Old, values[tdef.PKeys:])
+		decodeRow(tdef, req.Old, values[tdef.PKeys:])
 		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_DEL, kvtx)
 	}
 	return deleted, nil
 }
 
 func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int, kvtx *KVTX) (bool, error) {
+	if err := kvtx.Tree.interrupted(); err != nil {
+		return false, err
+	}
+	rec, err := applyDefaults(db, tdef, rec, kvtx)
+	if err != nil {
+		return false, err
+	}
 	values, err := checkRecord(tdef, rec, len(tdef.Cols))
 	if err != nil {
 		return false, err
 	}
-	isTableValid := validateTableTypes(tdef, rec)
+	if tdef.TTL != nil {
+		if err := dropExpired(db, tdef, values, kvtx); err != nil {
+			return false, err
+		}
+	}
+	// the BEFORE triggers may change the row, the checks see the result
+	var event string
+	var old []Value
+	if len(tdef.Triggers) > 0 {
+		event, old = triggerEvent(tdef, values, mode, kvtx)
+		if values, err = fireTriggers(db, tdef, TRIGGER_BEFORE, event, old, values, kvtx); err != nil {
+			return false, err
+		}
+	}
+	if tdef.AutoIncrement {
+		if err := db.seqAdvance(autoSequence(tdef), values[0].I64, kvtx); err != nil {
+			return false, err
+		}
+	}
+	isTableValid := validateTableTypes(tdef, Record{tdef.Cols, values})
 	if !isTableValid {
 		return false, errors.New("invalid type")
 	}
+	if err := checkConstraints(tdef, Record{tdef.Cols, values}); err != nil {
+		return false, err
+	}
+	if err := checkUnique(db, tdef, values, kvtx); err != nil {
+		return false, err
+	}
+	if err := checkReferences(db, tdef, values, kvtx); err != nil {
+		return false, err
+	}
+	added, err := dbPut(db, tdef, values, mode, kvtx)
+	if err != nil || !added || event == "" {
+		return added, err
+	}
+	_, err = fireTriggers(db, tdef, TRIGGER_AFTER, event, old, values, kvtx)
+	return added, err
+}
+
+// write a checked row in table order, and its index entries
+func dbPut(db *DB, tdef *TableDef, values []Value, mode int, kvtx *KVTX) (bool, error) {
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	vals := encodeValues(nil, values[tdef.PKeys:])
+	vals := encodeRow(tdef, values)
 	req := InsertReq{Key: key, Value: vals, Mode: mode}
 	added, err := kvtx.SetWithMode(&req)
 	// if err or no changes made return
@@ -347,11 +547,13 @@ func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int, kvtx *KVTX) (bool, e
 
 	if req.Updated && !req.Added {
 		//  delete the old index entries
-		decodeValues(req.Old, values[tdef.PKeys:]) // get the old row
-		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_DEL, kvtx)
+		old := append([]Value(nil), values...)
+		decodeRow(tdef, req.Old, old[tdef.PKeys:]) // get the old row
+		indexOp(db, tdef, Record{tdef.Cols, old}, INDEX_DEL, kvtx)
 	}
 	if req.Updated || req.Added {
-		indexOp(db, tdef, rec, INDEX_ADD, kvtx)
+		// absent columns are NULL
+		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_ADD, kvtx)
 	}
 	return added, nil
 }
@@ -428,6 +630,7 @@ func (db *KVTX) SetWithMode(req *InsertReq) (bool, error) {
 		}
 		err := db.Set(req.Key, req.Value)
 		req.Updated = true
+		req.Added = !exists
 		return true, err
 
 	case MODE_INSERT_ONLY:
@@ -473,19 +676,119 @@ func tableDefCheck(tdef *TableDef) error {
 		}
 	}
 
-	if tdef.PKeys > 1 {
-		return errors.New("only one primary key is allowed")
+	if tdef.PKeys < 1 {
+		return errors.New("table must have a primary key")
+	}
+	if tdef.PKeys > len(tdef.Cols) {
+		return errors.New("primary key has more columns than the table")
+	}
+	if tdef.NotNull == nil {
+		tdef.NotNull = make([]bool, len(tdef.Cols))
+	}
+	if len(tdef.NotNull) != len(tdef.Cols) {
+		return errors.New("length of columns & NOT NULL flags do not match")
+	}
+	for i := 0; i < tdef.PKeys; i++ {
+		tdef.NotNull[i] = true // the primary key is never NULL
+	}
+	if tdef.AutoIncrement {
+		if tdef.PKeys != 1 || tdef.Types[0] != TYPE_INT64 {
+			return errors.New("AUTO_INCREMENT needs a single INT64 primary key")
+		}
+		if len(tdef.Defaults) > 0 && tdef.Defaults[0] != "" {
+			return errors.New("AUTO_INCREMENT column cannot have a default")
+		}
+	}
+	if err := checkTableExprs(tdef); err != nil {
+		return err
+	}
+	if err := checkTTL(tdef); err != nil {
+		return err
+	}
+	if len(tdef.Unique) > len(tdef.Indexes) {
+		return errors.New("length of indexes & unique flags do not match")
+	}
+	if len(tdef.IndexInclude) > len(tdef.Indexes) {
+		return errors.New("length of indexes & included columns do not match")
 	}
 	for i, index := range tdef.Indexes {
+		if n := uniqueCols(tdef, i); n < 0 || n > len(index) {
+			return fmt.Errorf("invalid unique column count for index %v", index)
+		}
 		index, err := checkIndexKeys(tdef, index)
 		if err != nil {
 			return err
 		}
+		if err := checkIndexInclude(tdef, index, indexInclude(tdef, i)); err != nil {
+			return err
+		}
 		tdef.Indexes[i] = index
 	}
 	return nil
 }
 
+// make `pk` the primary key by moving its columns to the front, in the
+// given order. an empty `pk` keeps the first column.
+func setPrimaryKey(tdef *TableDef, pk []string) error {
+	if len(pk) == 0 {
+		tdef.PKeys = 1
+		return nil
+	}
+	if len(tdef.Cols) != len(tdef.Types) {
+		return errors.New("length of columns & types do not match")
+	}
+	cols := make([]string, 0, len(tdef.Cols))
+	types := make([]uint32, 0, len(tdef.Types))
+	for _, col := range pk {
+		i := ColIndex(tdef, col)
+		if i < 0 {
+			return fmt.Errorf("invalid primary key column: %s", col)
+		}
+		if contains(cols, col) {
+			return fmt.Errorf("duplicate primary key column: %s", col)
+		}
+		cols = append(cols, col)
+		types = append(types, tdef.Types[i])
+	}
+	for i, col := range tdef.Cols {
+		if !contains(pk, col) {
+			cols = append(cols, col)
+			types = append(types, tdef.Types[i])
+		}
+	}
+	tdef.Cols, tdef.Types, tdef.PKeys = cols, types, len(pk)
+	return nil
+}
+
+// declare the columns in `cols` NOT NULL, the others are nullable
+func setNotNull(tdef *TableDef, cols []string) error {
+	tdef.NotNull = make([]bool, len(tdef.Cols))
+	for _, col := range cols {
+		i := ColIndex(tdef, col)
+		if i < 0 {
+			return fmt.Errorf("invalid NOT NULL column: %s", col)
+		}
+		tdef.NotNull[i] = true
+	}
+	return nil
+}
+
+// set the default expressions by column name
+func setDefaults(tdef *TableDef, defaults map[string]string) error {
+	if len(defaults) == 0 {
+		return nil
+	}
+	tdef.Defaults = make([]string, len(tdef.Cols))
+	for col, src := range defaults {
+		i := ColIndex(tdef, col)
+		if i < 0 {
+			return fmt.Errorf("invalid default column: %s", col)
+		}
+		tdef.Defaults[i] = src
+	}
+	return nil
+}
+
 func isValidTableName(name string) bool {
 	return regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`).MatchString(name)
 }
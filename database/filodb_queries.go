@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 const (
@@ -23,7 +24,16 @@ type Scanner struct {
 	Cmp2    int
 	Key1    Record
 	Key2    Record
+	// the columns the rows are read for, nil for every column. an index
+	// covering them answers from its entries alone.
+	Cols []string
 	// internal
+	covered  bool // the rows are read from the index entries
+	live     bool // the expired rows are skipped, see `rowExpired`
+	now      time.Time
+	row      *Record // the current row, read to tell if it expired
+	tree     *BTree
+	err      error // the scan was interrupted, see `BTree.interrupt`
 	tdef     *TableDef
 	iter     *BIter // underlying BTree iterator
 	keyEnd   []byte // the encoded Key2
@@ -35,6 +45,7 @@ func (db *DB) Scan(table string, req *Scanner, tree *BTree) error {
 	if tdef == nil {
 		return fmt.Errorf("table not found: %s", table)
 	}
+	req.live = true
 	return dbScan(db, tdef, req, tree)
 }
 
@@ -46,7 +57,7 @@ func dbScan(db *DB, tdef *TableDef, req *Scanner, tree *BTree) error {
 	default:
 		return fmt.Errorf("bad range")
 	}
-	indexNo, err := findIndex(tdef, req.Key1.Cols)
+	indexNo, err := scanIndex(tdef, req)
 	if err != nil {
 		return err
 	}
@@ -55,17 +66,58 @@ func dbScan(db *DB, tdef *TableDef, req *Scanner, tree *BTree) error {
 		index, prefix = tdef.Indexes[indexNo], tdef.IndexPrefix[indexNo]
 	}
 
+	// the keys may list the columns in any order
+	start, err := indexValues(tdef, index, req.Key1)
+	if err != nil {
+		return err
+	}
+	end, err := indexValues(tdef, index, req.Key2)
+	if err != nil {
+		return err
+	}
+
 	req.db = db
 
 	req.tdef = tdef
 	req.indexNo = indexNo
+	req.covered = indexCovers(tdef, indexNo, req.Cols)
+	req.live = req.live && tdef.TTL != nil
+	if req.live {
+		// the index entries must tell the expired rows too
+		req.covered = req.covered && indexCovers(tdef, indexNo, []string{tdef.TTL.Col})
+		req.now = time.Now()
+	}
+	req.tree = tree
+	req.row = nil
+	req.err = nil
 	// seek to the start key
-	req.keyStart = encodeKeyPartial(nil, prefix, req.Key1.Vals, tdef, index, req.Cmp1)
-	req.keyEnd = encodeKeyPartial(nil, prefix, req.Key2.Vals, tdef, index, req.Cmp2)
+	req.keyStart = encodeKeyPartial(nil, prefix, start, tdef, index, req.Cmp1)
+	req.keyEnd = encodeKeyPartial(nil, prefix, end, tdef, index, req.Cmp2)
 	req.iter = tree.Seek(req.keyStart, req.Cmp1)
+	req.skipExpired()
 	return nil
 }
 
+// move past the expired rows
+func (sc *Scanner) skipExpired() {
+	for sc.live && sc.Valid() {
+		if sc.covered {
+			entry := sc.indexEntry()
+			if v := entry.Get(sc.tdef.TTL.Col); v == nil || !sc.tdef.TTL.passed(*v, sc.now) {
+				return
+			}
+		} else {
+			row := &Record{}
+			sc.deref(row, sc.tree)
+			if !recordExpired(sc.tdef, row, sc.now) {
+				sc.row = row
+				return
+			}
+		}
+		sc.step()
+	}
+}
+
 func (sc *Scanner) Valid() bool {
 	if !sc.iter.Valid() {
 		return false
@@ -86,9 +138,19 @@ func (sc *Scanner) Valid() bool {
 }
 
 func (sc *Scanner) Next() {
+	sc.step()
+	sc.skipExpired()
+}
+
+func (sc *Scanner) step() {
+	sc.row = nil
 	if !sc.iter.Valid() {
 		return
 	}
+	if sc.err = sc.tree.interrupted(); sc.err != nil {
+		sc.iter = &BIter{} // ends the scan
+		return
+	}
 
 	currentKey, _ := sc.iter.Deref()
 	sc.iter.Next()
@@ -107,11 +169,25 @@ func (sc *Scanner) Next() {
 	}
 }
 
+// why the scan ended early, nil if it reached the end of the range
+func (sc *Scanner) Err() error {
+	return sc.err
+}
+
 // fetch the current row
 func (sc *Scanner) Deref(rec *Record, tree *BTree) {
 	if !sc.Valid() {
 		return
 	}
+	if sc.row != nil {
+		rec.Cols = sc.row.Cols
+		rec.Vals = append(rec.Vals[:0], sc.row.Vals...)
+		return
+	}
+	sc.deref(rec, tree)
+}
+
+func (sc *Scanner) deref(rec *Record, tree *BTree) {
 	tdef := sc.tdef
 	rec.Cols = tdef.Cols
 	rec.Vals = rec.Vals[:0]
@@ -122,16 +198,18 @@ func (sc *Scanner) Deref(rec *Record, tree *BTree) {
 			values[i].Type = tdef.Types[i]
 		}
 		decodeValues(key[4:], values[:tdef.PKeys])
-		decodeValues(val, values[tdef.PKeys:])
+		decodeRow(tdef, val, values[tdef.PKeys:])
 		rec.Vals = append(rec.Vals, values...)
 	} else {
-		index := tdef.Indexes[sc.indexNo]
-		ival := make([]Value, len(index))
-		for i, col := range index {
-			ival[i].Type = tdef.Types[ColIndex(tdef, col)]
+		icol := sc.indexEntry()
+		if sc.covered {
+			// an index-only scan
+			rec.Cols = sc.Cols
+			for _, col := range rec.Cols {
+				rec.Vals = append(rec.Vals, *icol.Get(col))
+			}
+			return
 		}
-		decodeValues(key[4:], ival)
-		icol := Record{index, ival}
 
 		rec.Cols = rec.Cols[:tdef.PKeys]
 		for _, col := range rec.Cols {
@@ -145,6 +223,29 @@ func (sc *Scanner) Deref(rec *Record, tree *BTree) {
 	}
 }
 
+// the key of the current index entry, with the INCLUDE columns of a
+// covered scan
+func (sc *Scanner) indexEntry() Record {
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	index := tdef.Indexes[sc.indexNo]
+	ival := make([]Value, len(index))
+	for i, col := range index {
+		ival[i].Type = indexKeyType(tdef, col)
+	}
+	decodeIndexKey(key[4:], tdef, index, ival)
+	if !sc.covered {
+		return Record{index, ival}
+	}
+	include := indexInclude(tdef, sc.indexNo)
+	vals := make([]Value, len(include))
+	for i, col := range include {
+		vals[i].Type = tdef.Types[ColIndex(tdef, col)]
+	}
+	decodeValues(val, vals)
+	return Record{append(index[:len(index):len(index)], include...), append(ival, vals...)}
+}
+
 // B-Tree Iterator
 type BIter struct {
 	tree *BTree
@@ -170,13 +271,23 @@ func (iter *BIter) Valid() bool {
 	return lastNode.data != nil && iter.pos[len(iter.pos)-1] < lastNode.nKeys()
 }
 
-// moving backward and forward
+// moving backward and forward, the iterator becomes invalid
+// when it moves past either end
 func (iter *BIter) Prev() {
-	iterPrev(iter, len(iter.path)-1)
+	if len(iter.path) > 0 && !iterPrev(iter, len(iter.path)-1) {
+		iter.invalidate()
+	}
 }
 
 func (iter *BIter) Next() {
-	iterNext(iter, 0)
+	if len(iter.path) > 0 && !iterNext(iter, len(iter.path)-1) {
+		iter.invalidate()
+	}
+}
+
+func (iter *BIter) invalidate() {
+	leaf := len(iter.path) - 1
+	iter.pos[leaf] = iter.path[leaf].nKeys()
 }
 
 func (tree *BTree) Seek(key []byte, cmp int) *BIter {
@@ -227,13 +338,12 @@ func cmpOK(key []byte, cmp int, ref []byte) bool {
 	}
 }
 
-func iterPrev(iter *BIter, level int) {
+// returns false if there is no previous key
+func iterPrev(iter *BIter, level int) bool {
 	if iter.pos[level] > 0 {
 		iter.pos[level]-- // move within this node
-	} else if level > 0 { // make sure the level is not less than the `root`
-		iterPrev(iter, level-1)
-	} else {
-		return
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid prevNode
@@ -242,16 +352,16 @@ func iterPrev(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = kid.nKeys() - 1
 	}
+	return true
 }
 
-func iterNext(iter *BIter, level int) {
+// returns false if there is no next key
+func iterNext(iter *BIter, level int) bool {
 	currentNode := iter.path[level]
-	if iter.pos[level] < uint16(currentNode.nKeys())-1 {
+	if iter.pos[level]+1 < currentNode.nKeys() {
 		iter.pos[level]++ // move within this node
-	} else if level < len(iter.path)-1 {
-		iterNext(iter, level+1)
-	} else {
-		return
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid nextNode
@@ -260,6 +370,7 @@ func iterNext(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = 0
 	}
+	return true
 }
 
 // JSONQuery represents a JSON-style query
@@ -294,6 +405,7 @@ func (db *DB) ExecuteJSONQuery(table string, queryStr string, kvReader *KVReader
 	scanner := Scanner{
 		Cmp1: CMP_GE,
 		Cmp2: CMP_LE,
+		live: true,
 	}
 
 	if err := dbScan(db, tdef, &scanner, &kvReader.Tree); err != nil {
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// limits enforced on interactive transactions, a zero duration disables a limit
+type TxLimits struct {
+	StatementTimeout   time.Duration // longest a single statement may run
+	TransactionTimeout time.Duration // longest a transaction may stay open
+	IdleTimeout        time.Duration // longest a transaction may sit between statements
+	ReaderWarning      time.Duration // report readers that stay open longer than this
+}
+
+var DefaultTxLimits = TxLimits{
+	IdleTimeout:   10 * time.Minute,
+	ReaderWarning: time.Minute,
+}
+
+// how often the reaper wakes up
+var reaperInterval time.Duration = time.Second
+
+var (
+	ErrTxDone             = errors.New("transaction has ended")
+	ErrTxAborted          = errors.New("transaction aborted")
+	ErrStatementTimeout   = errors.New("statement timeout")
+	ErrTransactionTimeout = errors.New("transaction timeout")
+	ErrIdleTimeout        = errors.New("idle-in-transaction timeout")
+)
+
+func (db *DB) txRegister(tx *DBTX) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if db.txs == nil {
+		db.txs = map[*DBTX]struct{}{}
+	}
+	now := time.Now()
+	tx.started, tx.active, tx.stmt, tx.kill = now, now, time.Time{}, nil
+	tx.killed.Store(false)
+	db.txs[tx] = struct{}{}
+}
+
+func (db *DB) txUnregister(tx *DBTX) {
+	db.txMu.Lock()
+	delete(db.txs, tx)
+	db.txMu.Unlock()
+}
+
+// SetLimits replaces the limits used by the reaper.
+func (db *DB) SetLimits(limits TxLimits) {
+	db.txMu.Lock()
+	db.limits = limits
+	db.txMu.Unlock()
+}
+
+func (db *DB) Limits() TxLimits {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	return db.limits
+}
+
+// start the background goroutine that enforces the transaction limits
+func (db *DB) startReaper() {
+	db.reaper = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				db.reap(now)
+			}
+		}
+	}(db.reaper)
+}
+
+func (db *DB) stopReaper() {
+	if db.reaper != nil {
+		close(db.reaper)
+		db.reaper = nil
+	}
+}
+
+// one pass of the reaper
+func (db *DB) reap(now time.Time) {
+	limits := db.Limits()
+
+	db.txMu.Lock()
+	txs := make([]*DBTX, 0, len(db.txs))
+	for tx := range db.txs {
+		txs = append(txs, tx)
+	}
+	db.txMu.Unlock()
+
+	for _, tx := range txs {
+		if !tx.mu.TryLock() {
+			// a statement is running, flag it. its scans and writes stop
+			// at the next row, and the transaction is aborted once it returns.
+			if reason := tx.overdue(limits, now); reason != nil {
+				db.txMu.Lock()
+				tx.kill = reason
+				db.txMu.Unlock()
+				tx.killed.Store(true)
+			}
+			continue
+		}
+		if tx.err == nil {
+			if reason := tx.overdue(limits, now); reason != nil {
+				tx.end(fmt.Errorf("%w: %w", ErrTxAborted, reason))
+				log.Printf("reaper: %v", tx.err)
+			}
+		}
+		tx.mu.Unlock()
+	}
+
+	if limits.ReaderWarning > 0 {
+		db.kv.mu.Lock()
+		for _, reader := range db.kv.readers {
+			age := now.Sub(reader.started)
+			if !reader.reported && age > limits.ReaderWarning {
+				reader.reported = true
+				log.Printf("reaper: reader at version %d has been open for %v", reader.version, age.Round(time.Second))
+			}
+		}
+		db.kv.mu.Unlock()
+	}
+}
+
+// returns why the transaction should be aborted, or nil
+func (tx *DBTX) overdue(limits TxLimits, now time.Time) error {
+	tx.db.txMu.Lock()
+	defer tx.db.txMu.Unlock()
+	switch {
+	case limits.TransactionTimeout > 0 && now.Sub(tx.started) > limits.TransactionTimeout:
+		return ErrTransactionTimeout
+	case !tx.stmt.IsZero():
+		if limits.StatementTimeout > 0 && now.Sub(tx.stmt) > limits.StatementTimeout {
+			return ErrStatementTimeout
+		}
+	case limits.IdleTimeout > 0 && now.Sub(tx.active) > limits.IdleTimeout:
+		return ErrIdleTimeout
+	}
+	return nil
+}
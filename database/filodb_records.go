@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,6 +34,7 @@ type Value struct {
 	F64  float64   // NEW: for FLOAT64 type
 	Bool bool      // NEW: for BOOLEAN type
 	Time time.Time // NEW: for DATETIME type
+	Null bool      // SQL NULL, `Type` is still the column type
 }
 
 type DB struct {
@@ -39,17 +42,76 @@ type DB struct {
 	kv     KV
 	pool   *WorkerPool
 	tables map[string]*TableDef // cached table definition
+	// guards `tables`, which is shared with the worker pool
+	tablesMu sync.Mutex
+	// open interactive transactions and their limits
+	txMu   sync.Mutex
+	txs    map[*DBTX]struct{}
+	limits TxLimits
+	reaper chan struct{} // closed to stop the reaper
+	// row locks of the interactive transactions
+	locks lockManager
+	// other database files, by alias
+	attachMu sync.Mutex
+	attached map[string]*DB
+	// the cached ranges of the sequences
+	seqMu sync.Mutex
+	seqs  map[string]*seqRange
+	// the purge of the expired rows
+	expiry  chan struct{} // closed to stop the purge
+	purging atomic.Bool
 }
 
 type TableDef struct {
-	Name    string
-	Types   []uint32 // column types
-	Cols    []string // column names
-	PKeys   int      // the first `PKeys` columns are the pimary key
+	Name  string
+	Types []uint32 // column types
+	Cols  []string // column names
+	PKeys int      // the first `PKeys` columns are the pimary key
+	// the INT64 primary key is taken from a sequence when left out
+	AutoIncrement bool
+	// per column, whether NULL is rejected. nil for the tables created
+	// before NULLs, none of their columns is nullable.
+	NotNull []bool
+	// per column default expressions, "" for none
+	Defaults []string
+	// CHECK constraints, expressions every row satisfies
+	Checks  []string
 	Indexes [][]string
+	// per index, the number of its leading columns that are UNIQUE, i.e.
+	// the columns declared before the primary key is appended. 0 or
+	// absent for an index that isn't UNIQUE.
+	Unique []int
+	// per index, the condition of a partial index: only the rows it holds
+	// for have an entry. "" or absent for an index of every row.
+	IndexWhere []string
+	// per index, the columns whose values its entries keep, so that a
+	// scan needing only them doesn't read the rows. nil or absent for none.
+	IndexInclude [][]string
+	// per index, whether CREATE INDEX is still filling it in: the writes
+	// keep it up to date, the queries don't use it yet. nil once every
+	// index is ready.
+	Building []bool
+	// foreign keys, and the tables with foreign keys referencing this one
+	ForeignKeys  []ForeignKey
+	ReferencedBy []string
+	// run on the writes to the table, in order
+	Triggers []Trigger
+	// the rows expire after a DATETIME column, nil if they never do
+	TTL *TTL
+	// the schema version of the rows written now, 0 for the tables created
+	// before versions, and the layouts of the older versions rows may
+	// still have. a column keeps its id when renamed.
+	Version   uint32
+	ColIDs    []uint32
+	NextColID uint32
+	Layouts   []RowLayout
+	// per added column, its value in the rows written before
+	Fills map[uint32]Value
 	// auto-assigned B-tree key prefixes for different tables/indexes
 	Prefix      uint32
 	IndexPrefix []uint32
+	// the expressions of the definition parsed so far, by their text
+	exprs map[string]*parsedExpr
 }
 
 // internal table: metadata
@@ -105,6 +167,12 @@ func (rec *Record) AddDateTime(key string, val time.Time) *Record {
 	return rec
 }
 
+func (rec *Record) AddNull(key string) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Null: true})
+	return rec
+}
+
 func (rec *Record) Get(key string) *Value {
 	for i, col := range rec.Cols {
 		if key == col {
@@ -114,20 +182,83 @@ func (rec *Record) Get(key string) *Value {
 	return nil
 }
 
+// TableNames returns the names in @table in order, the internal tables
+// included.
+func (db *DB) TableNames(tree *BTree) ([]string, error) {
+	sc := Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddStr("name", []byte{}),
+		Key2: *(&Record{}).AddStr("name", []byte{0xff}), // after every name
+	}
+	if err := dbScan(db, TDEF_TABLE, &sc, tree); err != nil {
+		return nil, err
+	}
+	var names []string
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		names = append(names, string(rec.Get("name").Str))
+	}
+	return names, nil
+}
+
 func GetTableDef(db *DB, name string, tree *BTree) *TableDef {
+	if tdef := getTableDefCached(db, name, tree); tdef != nil {
+		return tdef
+	}
+	// an old name kept by RENAME TABLE, cached under the table's name
+	if target := aliasTarget(db, name, tree); target != "" {
+		return getTableDefCached(db, target, tree)
+	}
+	return nil
+}
+
+func getTableDefCached(db *DB, name string, tree *BTree) *TableDef {
+	// the cache describes the latest committed tree only. other trees,
+	// e.g. an uncommitted transaction or an older snapshot, may disagree.
+	if !db.kv.isLatest(tree.root) {
+		return getTableDefDB(db, name, tree)
+	}
+	db.tablesMu.Lock()
 	tdef, ok := db.tables[name]
+	db.tablesMu.Unlock()
 	if !ok {
-		if db.tables == nil {
-			db.tables = map[string]*TableDef{}
-		}
 		tdef = getTableDefDB(db, name, tree)
-		if tdef != nil {
+		if tdef != nil && db.kv.isLatest(tree.root) {
+			db.tablesMu.Lock()
+			if db.tables == nil {
+				db.tables = map[string]*TableDef{}
+			}
 			db.tables[name] = tdef
+			db.tablesMu.Unlock()
 		}
 	}
 	return tdef
 }
 
+// table definition as seen by a write transaction
+func getTableDefTX(db *DB, name string, kvtx *KVTX) *TableDef {
+	if tdef, ok := kvtx.tables[name]; ok {
+		return tdef
+	}
+	tdef := GetTableDef(db, name, &kvtx.Tree)
+	if tdef != nil && tdef.Name == name {
+		kvtx.tables[name] = tdef
+	}
+	return tdef
+}
+
+// record a definition created, changed or dropped (nil) by a transaction.
+// the cached definition is dropped once the transaction commits.
+func tableDefChanged(db *DB, name string, tdef *TableDef, kvtx *KVTX) {
+	kvtx.tables[name] = tdef
+	kvtx.onCommit = append(kvtx.onCommit, func() {
+		db.tablesMu.Lock()
+		delete(db.tables, name)
+		db.tablesMu.Unlock()
+	})
+}
+
 func getTableDefDB(db *DB, name string, tree *BTree) *TableDef {
 	rec := (&Record{}).AddStr("name", []byte(name))
 	// get the tdef from the `BTree` using the PKey - `name`
@@ -201,11 +332,21 @@ func dbGetRange(db *DB, tdef *TableDef, start *Record, end *Record, tree *BTree)
 		sc.Next()
 	}
 
-	return results, nil
+	return results, sc.Err()
 }
 
+// a NULL is encoded as the zero value of its type, and a bitmap of the
+// NULLs follows the values. rows without NULLs, and keys, have no bitmap.
 func encodeValues(out []byte, vals []Value) []byte {
-	for _, v := range vals {
+	var nulls []byte
+	for i, v := range vals {
+		if v.Null {
+			if nulls == nil {
+				nulls = make([]byte, (len(vals)+7)/8)
+			}
+			nulls[i/8] |= 1 << (i % 8)
+			v = Value{Type: v.Type}
+		}
 		switch v.Type {
 		case TYPE_INT64:
 			var buf [8]byte
@@ -239,62 +380,89 @@ func encodeValues(out []byte, vals []Value) []byte {
 			panic("invalid type while encodeValues")
 		}
 	}
-	return out
+	return append(out, nulls...)
 }
 
 func decodeValues(in []byte, out []Value) {
+	remaining, ok := decodeEach(in, out)
+	// the bitmap of the NULLs, if any
+	if ok && len(remaining) == (len(out)+7)/8 {
+		decodeNulls(remaining, out)
+	}
+}
+
+// decode the values without the NULL bitmap, returns the rest of the
+// input and whether every value was there
+func decodeEach(in []byte, out []Value) ([]byte, bool) {
 	remaining := in
-	for i, v := range out {
-		switch v.Type {
-		case TYPE_INT64:
-			if len(remaining) < 8 {
-				return
-			}
-			u := binary.BigEndian.Uint64(remaining[:8])
-			val := int64(u - (1 << 63))
-			out[i] = Value{Type: TYPE_INT64, I64: val}
-			remaining = remaining[8:]
-		case TYPE_BYTES:
-			end := 0
-			for end < len(remaining) && remaining[end] != 0 {
-				end++
-			}
-			if end >= len(remaining) {
-				return
-			}
-			unEscStr := unEscapeString(remaining[:end])
-			out[i] = Value{Type: TYPE_BYTES, Str: unEscStr}
-			remaining = remaining[end+1:]
-		case TYPE_FLOAT64: // NEW: Deserialize FLOAT64
-			if len(remaining) < 8 {
-				return
-			}
-			bits := binary.BigEndian.Uint64(remaining[:8])
-			val := math.Float64frombits(bits)
-			out[i] = Value{Type: TYPE_FLOAT64, F64: val}
-			remaining = remaining[8:]
-		case TYPE_BOOLEAN: // NEW: Deserialize BOOLEAN
-			if len(remaining) < 1 {
-				return
-			}
-			val := remaining[0] != 0
-			out[i] = Value{Type: TYPE_BOOLEAN, Bool: val}
-			remaining = remaining[1:]
-		case TYPE_DATETIME: // NEW: Deserialize DATETIME from Unix timestamp
-			if len(remaining) < 8 {
-				return
-			}
-			u := binary.BigEndian.Uint64(remaining[:8])
-			unixTime := int64(u - (1 << 63))
-			val := time.Unix(unixTime, 0).UTC() // Ensure UTC timezone consistency
-			out[i] = Value{Type: TYPE_DATETIME, Time: val}
-			remaining = remaining[8:]
-		default:
-			panic("invalid type while decodeValues")
+	for i := range out {
+		var ok bool
+		if remaining, ok = decodeValue(remaining, &out[i]); !ok {
+			return remaining, false
+		}
+	}
+	return remaining, true
+}
+
+func decodeNulls(bitmap []byte, out []Value) {
+	for i := range out {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			out[i] = Value{Type: out[i].Type, Null: true}
 		}
 	}
 }
 
+// decode a value of the type given in `out`, returns the rest of the input
+func decodeValue(remaining []byte, out *Value) ([]byte, bool) {
+	switch out.Type {
+	case TYPE_INT64:
+		if len(remaining) < 8 {
+			return remaining, false
+		}
+		u := binary.BigEndian.Uint64(remaining[:8])
+		val := int64(u - (1 << 63))
+		*out = Value{Type: TYPE_INT64, I64: val}
+		return remaining[8:], true
+	case TYPE_BYTES:
+		end := 0
+		for end < len(remaining) && remaining[end] != 0 {
+			end++
+		}
+		if end >= len(remaining) {
+			return remaining, false
+		}
+		unEscStr := unEscapeString(remaining[:end])
+		*out = Value{Type: TYPE_BYTES, Str: unEscStr}
+		return remaining[end+1:], true
+	case TYPE_FLOAT64: // NEW: Deserialize FLOAT64
+		if len(remaining) < 8 {
+			return remaining, false
+		}
+		bits := binary.BigEndian.Uint64(remaining[:8])
+		val := math.Float64frombits(bits)
+		*out = Value{Type: TYPE_FLOAT64, F64: val}
+		return remaining[8:], true
+	case TYPE_BOOLEAN: // NEW: Deserialize BOOLEAN
+		if len(remaining) < 1 {
+			return remaining, false
+		}
+		val := remaining[0] != 0
+		*out = Value{Type: TYPE_BOOLEAN, Bool: val}
+		return remaining[1:], true
+	case TYPE_DATETIME: // NEW: Deserialize DATETIME from Unix timestamp
+		if len(remaining) < 8 {
+			return remaining, false
+		}
+		u := binary.BigEndian.Uint64(remaining[:8])
+		unixTime := int64(u - (1 << 63))
+		val := time.Unix(unixTime, 0).UTC() // Ensure UTC timezone consistency
+		*out = Value{Type: TYPE_DATETIME, Time: val}
+		return remaining[8:], true
+	default:
+		panic("invalid type while decodeValues")
+	}
+}
+
 // Strings are encoded as nul terminated strings,
 // escape the nul byte so that strings contain no nul byte.
 func escapeString(in []byte) []byte {
@@ -382,21 +550,40 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 			}
 			index := indexOf(rec.Cols, tdef.Cols[i])
 			orderedValues[i] = rec.Vals[index]
+			if orderedValues[i].Null {
+				return nil, fmt.Errorf("primary key column cannot be NULL: %s", tdef.Cols[i])
+			}
 		}
 	}
 
 	if n == len(tdef.Cols) {
 		for i, col := range tdef.Cols {
 			if !contains(rec.Cols, col) {
-				return nil, fmt.Errorf("missing column: %s", col)
+				if !isNullable(tdef, i) {
+					return nil, fmt.Errorf("missing column: %s", col)
+				}
+				// an absent nullable column is NULL
+				orderedValues[i] = Value{Type: tdef.Types[i], Null: true}
+				continue
 			}
 			index := indexOf(rec.Cols, col)
 			orderedValues[i] = rec.Vals[index]
+			if orderedValues[i].Null {
+				if !isNullable(tdef, i) {
+					return nil, fmt.Errorf("column cannot be NULL: %s", col)
+				}
+				orderedValues[i].Type = tdef.Types[i]
+			}
 		}
 	}
 	return orderedValues, nil
 }
 
+// whether the column `i` may hold NULL
+func isNullable(tdef *TableDef, i int) bool {
+	return i >= tdef.PKeys && i < len(tdef.NotNull) && !tdef.NotNull[i]
+}
+
 func contains(slice []string, item string) bool {
 	for _, v := range slice {
 		if v == item {
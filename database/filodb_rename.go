@@ -0,0 +1,203 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrTableAliasNotFound = errors.New("table alias not found")
+
+// an old name kept by RENAME TABLE is an alias in @meta, keyed
+// `alias:<name>`, holding the name of the table
+const TABLE_ALIAS_KEY = "alias:"
+
+func aliasRecord(name string) *Record {
+	return (&Record{}).AddStr("key", []byte(TABLE_ALIAS_KEY+name))
+}
+
+// the table an alias stands for, "" if `name` isn't an alias
+func aliasTarget(db *DB, name string, tree *BTree) string {
+	rec := aliasRecord(name)
+	if ok, err := dbGet(db, TDEF_META, rec, tree); err != nil || !ok {
+		return ""
+	}
+	return string(rec.Get("val").Str)
+}
+
+// TableRename gives a table a new name. the rows are keyed by the table
+// prefix, only the definition moves. with `alias`, the old name keeps
+// working until the alias is dropped.
+func (db *DB) TableRename(name, newName string, alias bool, kvtx *KVTX) error {
+	current := getTableDefTX(db, name, kvtx)
+	if current == nil || strings.HasPrefix(name, "@") {
+		return fmt.Errorf("table not found: %s", name)
+	}
+	if current.Name != name {
+		return fmt.Errorf("%s is an alias of %s", name, current.Name)
+	}
+	// the keys of a table are in the prefixes of its schema, it stays there
+	newName = inSchemaOf(name, newName)
+	schema, _ := splitSchema(name)
+	newSchema, rest := splitSchema(newName)
+	if newSchema != schema {
+		return fmt.Errorf("cannot move %s to another schema", name)
+	}
+	if !isValidTableName(rest) {
+		return fmt.Errorf("invalid table name: %q", newName)
+	}
+	if getView(db, newName, &kvtx.Tree) != nil {
+		return fmt.Errorf("%w: %s", ErrViewExists, newName)
+	}
+	if other := getTableDefTX(db, newName, kvtx); other != nil {
+		if other.Name != name || newName == name {
+			return fmt.Errorf("%w: %s", ErrTableAlreadyExists, newName)
+		}
+		// back to a name it was known by
+		if err := db.TableAliasDrop(newName, kvtx); err != nil {
+			return err
+		}
+	}
+
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	tdef.Name = newName
+	for i := range tdef.ForeignKeys {
+		if tdef.ForeignKeys[i].Table == name {
+			tdef.ForeignKeys[i].Table = newName
+		}
+	}
+	if _, err := dbDelete(db, TDEF_TABLE, *(&Record{}).AddStr("name", []byte(name)), kvtx); err != nil {
+		return fmt.Errorf("failed to delete table definition: %w", err)
+	}
+	tableDefChanged(db, name, nil, kvtx)
+	if err := tableDefInsert(db, tdef, kvtx); err != nil {
+		return err
+	}
+
+	// the tables it references and the ones referencing it record its name
+	for _, child := range current.ReferencedBy {
+		updated, err := copyTableDef(getTableDefTX(db, child, kvtx))
+		if err != nil {
+			return err
+		}
+		for i := range updated.ForeignKeys {
+			if updated.ForeignKeys[i].Table == name {
+				updated.ForeignKeys[i].Table = newName
+			}
+		}
+		if err := tableDefUpdate(db, updated, kvtx); err != nil {
+			return err
+		}
+	}
+	for _, fk := range current.ForeignKeys {
+		parent := getTableDefTX(db, fk.Table, kvtx)
+		if fk.Table == name || parent == nil || !contains(parent.ReferencedBy, name) {
+			continue
+		}
+		updated := *parent
+		updated.ReferencedBy = make([]string, len(parent.ReferencedBy))
+		for i, ref := range parent.ReferencedBy {
+			if ref == name {
+				ref = newName
+			}
+			updated.ReferencedBy[i] = ref
+		}
+		if err := tableDefUpdate(db, &updated, kvtx); err != nil {
+			return err
+		}
+	}
+
+	// the aliases, the views and the triggers follow the table
+	if err := renameInViews(db, name, newName, kvtx); err != nil {
+		return err
+	}
+	if err := renameInTriggers(db, name, newName, kvtx); err != nil {
+		return err
+	}
+	aliases, err := db.TableAliases(&kvtx.Tree)
+	if err != nil {
+		return err
+	}
+	for old, target := range aliases {
+		if target == name {
+			if err := aliasSet(db, old, newName, kvtx); err != nil {
+				return err
+			}
+		}
+	}
+	if alias {
+		return aliasSet(db, name, newName, kvtx)
+	}
+	return nil
+}
+
+// store the definition of a table under a name that is free
+func tableDefInsert(db *DB, tdef *TableDef, kvtx *KVTX) error {
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return fmt.Errorf("failed to marshal table definition: %w", err)
+	}
+	table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+	if _, err := dbUpdate(db, TDEF_TABLE, *table, MODE_INSERT_ONLY, kvtx); err != nil {
+		return fmt.Errorf("failed to add table definition: %w", err)
+	}
+	tableDefChanged(db, tdef.Name, tdef, kvtx)
+	return nil
+}
+
+func aliasSet(db *DB, name, target string, kvtx *KVTX) error {
+	rec := aliasRecord(name).AddStr("val", []byte(target))
+	if _, err := dbUpdate(db, TDEF_META, *rec, MODE_UPSERT, kvtx); err != nil {
+		return err
+	}
+	// the name is read through the alias from now on
+	delete(kvtx.tables, name)
+	return nil
+}
+
+// TableAliasDrop removes an old name kept by RENAME TABLE.
+func (db *DB) TableAliasDrop(name string, kvtx *KVTX) error {
+	if aliasTarget(db, name, &kvtx.Tree) == "" {
+		return fmt.Errorf("%w: %s", ErrTableAliasNotFound, name)
+	}
+	_, err := dbDelete(db, TDEF_META, *aliasRecord(name), kvtx)
+	return err
+}
+
+// TableAliases returns the table each alias stands for.
+func (db *DB) TableAliases(tree *BTree) (map[string]string, error) {
+	start := (&Record{}).AddStr("key", []byte(TABLE_ALIAS_KEY))
+	end := (&Record{}).AddStr("key", []byte("alias;")) // after every `alias:` key
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LT, Key1: *start, Key2: *end}
+	if err := dbScan(db, TDEF_META, &sc, tree); err != nil {
+		return nil, err
+	}
+	aliases := map[string]string{}
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		name := strings.TrimPrefix(string(rec.Get("key").Str), TABLE_ALIAS_KEY)
+		aliases[name] = string(rec.Get("val").Str)
+	}
+	return aliases, nil
+}
+
+// drop the aliases of a dropped table
+func dropAliases(db *DB, name string, kvtx *KVTX) error {
+	aliases, err := db.TableAliases(&kvtx.Tree)
+	if err != nil {
+		return err
+	}
+	for alias, target := range aliases {
+		if target == name {
+			if err := db.TableAliasDrop(alias, kvtx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -13,8 +13,8 @@ type TableScanner struct {
 	prefix   []byte
 }
 
-func (db *DB) QueryWithFilter(table string, tdef *TableDef, filterRec *Record) ([]*Record, error) {
-	results, err := fullTableScan(db, table, tdef)
+func (db *DB) QueryWithFilter(table string, tdef *TableDef, filterRec *Record, kvReader *KVReader) ([]*Record, error) {
+	results, err := fullTableScan(db, table, tdef, kvReader)
 	if err != nil {
 		return nil, err
 	}
@@ -53,12 +53,8 @@ func NewTableScanner(db *DB, table string, kvReader *KVReader, tdef *TableDef) (
 	}, nil
 }
 
-func fullTableScan(db *DB, table string, tdef *TableDef) ([]*Record, error) {
-	var kvReader KVReader
-	db.kv.BeginRead(&kvReader)
-	defer db.kv.EndRead(&kvReader)
-
-	scanner, err := NewTableScanner(db, table, &kvReader, tdef)
+func fullTableScan(db *DB, table string, tdef *TableDef, kvReader *KVReader) ([]*Record, error) {
+	scanner, err := NewTableScanner(db, table, kvReader, tdef)
 	if err != nil {
 		return nil, fmt.Errorf("scanner creation failed: %v", err)
 	}
@@ -77,7 +73,7 @@ func fullTableScan(db *DB, table string, tdef *TableDef) ([]*Record, error) {
 		results = append(results, rec)
 	}
 
-	return results, nil
+	return unexpired(tdef, results), nil
 }
 
 func (ts *TableScanner) Start() {
@@ -109,9 +105,13 @@ func (ts *TableScanner) Next() (*Record, bool, bool) {
 	}
 	copy(rec.Cols, ts.tdef.Cols)
 	decodeValues(key[4:], rec.Vals[:ts.tdef.PKeys])
-	decodeValues(val, rec.Vals[ts.tdef.PKeys:])
+	decodeRow(ts.tdef, val, rec.Vals[ts.tdef.PKeys:])
 
 	ts.iter.Next()
+	if !ts.iter.Valid() {
+		// past the last key of the tree
+		return rec, false, true
+	}
 
 	nextKey, _ := ts.iter.Deref()
 	if bytes.Equal(key, nextKey) {
@@ -133,12 +133,13 @@ func (ts *TableScanner) Current() (*Record, error) {
 		rec.Vals[i] = Value{Type: ts.tdef.Types[i]}
 	}
 	decodeValues(key[4:], rec.Vals[:ts.tdef.PKeys])
-	decodeValues(val, rec.Vals[ts.tdef.PKeys:])
+	decodeRow(ts.tdef, val, rec.Vals[ts.tdef.PKeys:])
 	return rec, nil
 }
 
 func compareValues(v1, v2 Value) bool {
-	if v1.Type != v2.Type {
+	// NULL equals nothing, not even NULL
+	if v1.Type != v2.Type || v1.Null || v2.Null {
 		return false
 	}
 
@@ -0,0 +1,800 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrColumnInUse   = errors.New("column is in use")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexNotFound = errors.New("index not found")
+)
+
+// the changes of ALTER TABLE
+const (
+	ALTER_ADD_COLUMN    = "ADD COLUMN"
+	ALTER_DROP_COLUMN   = "DROP COLUMN"
+	ALTER_RENAME_COLUMN = "RENAME COLUMN"
+)
+
+type TableAlter struct {
+	Op      string
+	Col     string
+	NewName string // RENAME COLUMN
+	// ADD COLUMN
+	Type    uint32
+	NotNull bool
+	Default string
+}
+
+// the columns after the primary key stored by the rows of an older
+// schema version
+type RowLayout struct {
+	Version uint32
+	Cols    []uint32 // by id
+	Types   []uint32
+}
+
+// the rows migrated by a write transaction of the background migration
+const MIGRATE_BATCH = 256
+
+// The row value of a versioned table.
+// | version | values after the primary key | NULL bitmap | padding |
+// | uvarint |                              | if any NULL |  zeros  |
+// the tables created before schema versions have version 0, their rows
+// are the values only. their first ALTER leaves those rows untagged,
+// under the layout of version 0, until the migration gets to them. a row
+// is untagged if it decodes under that layout, so the rows tagged
+// meanwhile always have the bitmap, and are padded when they would
+// decode too.
+
+func encodeRow(tdef *TableDef, values []Value) []byte {
+	var out []byte
+	if tdef.Version > 0 {
+		out = binary.AppendUvarint(out, uint64(tdef.Version))
+	}
+	out = encodeValues(out, values[tdef.PKeys:])
+	if untagged := tdef.layout(0); untagged != nil {
+		if !slices.ContainsFunc(values[tdef.PKeys:], func(v Value) bool { return v.Null }) {
+			out = append(out, make([]byte, (len(values)-tdef.PKeys+7)/8)...)
+		}
+		// at most 2 bytes, the rest after the values only grows
+		for isUntagged(untagged, out) {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+// whether a row value decodes under the layout of version 0, the rest
+// after the values is empty or its NULL bitmap
+func isUntagged(layout *RowLayout, val []byte) bool {
+	values := make([]Value, len(layout.Types))
+	for i, typ := range layout.Types {
+		values[i].Type = typ
+	}
+	rest, ok := decodeEach(val, values)
+	return ok && (len(rest) == 0 || len(rest) == (len(values)+7)/8)
+}
+
+// decode a row value into the columns after the primary key, `out` has
+// their types. a row of an older version is decoded under its layout:
+// the columns added since take their fill value, the dropped ones are
+// skipped.
+func decodeRow(tdef *TableDef, val []byte, out []Value) {
+	if tdef.Version == 0 {
+		decodeValues(val, out)
+		return
+	}
+	layout := tdef.layout(0)
+	if layout == nil || !isUntagged(layout, val) {
+		version, n := binary.Uvarint(val)
+		val = val[max(n, 0):]
+		layout = tdef.layout(uint32(version))
+	}
+	if layout == nil {
+		decodeTagged(val, out)
+		return
+	}
+	stored := make([]Value, len(layout.Cols))
+	for i, typ := range layout.Types {
+		stored[i].Type = typ
+	}
+	decodeTagged(val, stored)
+	for j := range out {
+		id := tdef.ColIDs[tdef.PKeys+j]
+		out[j] = Value{Type: out[j].Type, Null: true}
+		if fill, ok := tdef.Fills[id]; ok {
+			out[j] = fill
+		}
+		for k, storedID := range layout.Cols {
+			if storedID == id {
+				out[j] = stored[k]
+			}
+		}
+	}
+}
+
+// the values of a versioned row, its bitmap may be followed by padding
+func decodeTagged(val []byte, out []Value) {
+	rest, ok := decodeEach(val, out)
+	if n := (len(out) + 7) / 8; ok && len(rest) >= n {
+		decodeNulls(rest[:n], out)
+	}
+}
+
+// the layout of an older version, nil for the current one
+func (tdef *TableDef) layout(version uint32) *RowLayout {
+	for i := range tdef.Layouts {
+		if tdef.Layouts[i].Version == version {
+			return &tdef.Layouts[i]
+		}
+	}
+	return nil
+}
+
+// the schema version of a stored row
+func rowVersion(tdef *TableDef, val []byte) uint32 {
+	if tdef.Version == 0 {
+		return 0
+	}
+	if layout := tdef.layout(0); layout != nil && isUntagged(layout, val) {
+		return 0
+	}
+	version, _ := binary.Uvarint(val)
+	return uint32(version)
+}
+
+// the id of the column `i`, its position in a table never altered
+func colID(tdef *TableDef, i int) uint32 {
+	if tdef.ColIDs == nil {
+		return uint32(i)
+	}
+	return tdef.ColIDs[i]
+}
+
+// a row in the column order of `from` in that of `to`, the columns are
+// matched by id. the columns `from` doesn't have are NULL, or their fill.
+func convertRow(from, to *TableDef, values []Value) []Value {
+	out := make([]Value, len(to.Cols))
+	for j := range to.Cols {
+		id := colID(to, j)
+		out[j] = Value{Type: to.Types[j], Null: true}
+		if fill, ok := to.Fills[id]; ok {
+			out[j] = fill
+		}
+		for i := range from.Cols {
+			if colID(from, i) == id {
+				out[j] = values[i]
+			}
+		}
+	}
+	return out
+}
+
+// start the schema versions of a new table
+func initVersion(tdef *TableDef) {
+	tdef.Version = 1
+	tdef.ColIDs = make([]uint32, len(tdef.Cols))
+	for i := range tdef.ColIDs {
+		tdef.ColIDs[i] = uint32(i)
+	}
+	tdef.NextColID = uint32(len(tdef.Cols))
+}
+
+// the table definitions are shared by the cache, change a copy
+func copyTableDef(tdef *TableDef) (*TableDef, error) {
+	data, err := json.Marshal(tdef)
+	if err != nil {
+		return nil, err
+	}
+	out := &TableDef{}
+	return out, json.Unmarshal(data, out)
+}
+
+// AlterTable changes the columns of a table. adding or dropping a column
+// starts a schema version, the rows of the older ones are decoded under
+// their layout until they are rewritten, by an update or by the
+// background migration started once the change commits.
+func (db *DB) AlterTable(name string, alter TableAlter, kvtx *KVTX) error {
+	current := getTableDefTX(db, name, kvtx)
+	if current == nil {
+		return fmt.Errorf("table not found: %s", name)
+	}
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	if tdef.NotNull == nil {
+		// created before NULLs, none of the columns is nullable
+		tdef.NotNull = make([]bool, len(tdef.Cols))
+		for i := range tdef.NotNull {
+			tdef.NotNull[i] = true
+		}
+	}
+	if tdef.Version == 0 {
+		// the rows have no version yet, the migration tags them
+		initVersion(tdef)
+		tdef.Layouts = append(tdef.Layouts, RowLayout{
+			Cols:  slices.Clone(tdef.ColIDs[tdef.PKeys:]),
+			Types: slices.Clone(tdef.Types[tdef.PKeys:]),
+		})
+	}
+
+	switch strings.ToUpper(alter.Op) {
+	case ALTER_ADD_COLUMN:
+		err = addColumn(tdef, alter)
+	case ALTER_DROP_COLUMN:
+		err = dropColumn(tdef, alter.Col)
+	case ALTER_RENAME_COLUMN:
+		err = renameColumn(tdef, alter.Col, alter.NewName)
+	default:
+		err = fmt.Errorf("unknown ALTER TABLE change: %s", alter.Op)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tableDefUpdate(db, tdef, kvtx); err != nil {
+		return err
+	}
+	if len(tdef.Layouts) > 0 && db.pool != nil {
+		kvtx.onCommit = append(kvtx.onCommit, func() {
+			db.pool.Submit(func() {
+				if err := db.MigrateTable(name); err != nil {
+					log.Printf("migrate %s: %v", name, err)
+				}
+			})
+		})
+	}
+	return nil
+}
+
+// end the current layout, the next rows are written under a new version
+func newVersion(tdef *TableDef) {
+	layout := RowLayout{Version: tdef.Version}
+	layout.Cols = append(layout.Cols, tdef.ColIDs[tdef.PKeys:]...)
+	layout.Types = append(layout.Types, tdef.Types[tdef.PKeys:]...)
+	tdef.Layouts = append(tdef.Layouts, layout)
+	tdef.Version++
+}
+
+func addColumn(tdef *TableDef, alter TableAlter) error {
+	if !isValidTableName(alter.Col) {
+		return fmt.Errorf("invalid column name: %q", alter.Col)
+	}
+	if ColIndex(tdef, alter.Col) >= 0 {
+		return fmt.Errorf("duplicate column name: %s", alter.Col)
+	}
+	if alter.Default != "" {
+		e, err := parseExpr(alter.Default)
+		if err != nil {
+			return fmt.Errorf("default of %s: %w", alter.Col, err)
+		}
+		if e.calls("nextval") {
+			return fmt.Errorf("default of %s: the existing rows can't take nextval()", alter.Col)
+		}
+	}
+	if alter.NotNull && alter.Default == "" {
+		return fmt.Errorf("NOT NULL column %s needs a default", alter.Col)
+	}
+	n := len(tdef.Cols)
+	newVersion(tdef)
+	tdef.Cols = append(tdef.Cols, alter.Col)
+	tdef.Types = append(tdef.Types, alter.Type)
+	tdef.NotNull = append(tdef.NotNull, alter.NotNull)
+	if tdef.Defaults != nil || alter.Default != "" {
+		tdef.Defaults = append(tdef.Defaults, make([]string, n+1-len(tdef.Defaults))...)
+		tdef.Defaults[n] = alter.Default
+	}
+	id := tdef.NextColID
+	tdef.ColIDs = append(tdef.ColIDs, id)
+	tdef.NextColID++
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+
+	// the rows written before have the default, evaluated once
+	if alter.Default == "" {
+		return nil
+	}
+	fill, err := evalDefault(&exprEnv{}, tdef, n)
+	if err != nil {
+		return err
+	}
+	if tdef.Fills == nil {
+		tdef.Fills = map[uint32]Value{}
+	}
+	tdef.Fills[id] = fill
+	return nil
+}
+
+func dropColumn(tdef *TableDef, col string) error {
+	i := ColIndex(tdef, col)
+	if i < 0 {
+		return fmt.Errorf("invalid column: %s", col)
+	}
+	if err := columnInUse(tdef, col, true); err != nil {
+		return err
+	}
+	newVersion(tdef)
+	delete(tdef.Fills, tdef.ColIDs[i])
+	tdef.Cols = append(tdef.Cols[:i], tdef.Cols[i+1:]...)
+	tdef.Types = append(tdef.Types[:i], tdef.Types[i+1:]...)
+	tdef.ColIDs = append(tdef.ColIDs[:i], tdef.ColIDs[i+1:]...)
+	tdef.NotNull = append(tdef.NotNull[:i], tdef.NotNull[i+1:]...)
+	if tdef.Defaults != nil {
+		tdef.Defaults = append(tdef.Defaults[:i], tdef.Defaults[i+1:]...)
+	}
+	return tableDefCheck(tdef)
+}
+
+func renameColumn(tdef *TableDef, col, newName string) error {
+	i := ColIndex(tdef, col)
+	if i < 0 {
+		return fmt.Errorf("invalid column: %s", col)
+	}
+	if !isValidTableName(newName) {
+		return fmt.Errorf("invalid column name: %q", newName)
+	}
+	if ColIndex(tdef, newName) >= 0 {
+		return fmt.Errorf("duplicate column name: %s", newName)
+	}
+	if err := columnInUse(tdef, col, false); err != nil {
+		return err
+	}
+	// the rows refer to the column by id, only the definition changes
+	tdef.Cols[i] = newName
+	for _, index := range tdef.Indexes {
+		for j := range index {
+			if index[j] == col {
+				index[j] = newName
+			}
+		}
+	}
+	for _, include := range tdef.IndexInclude {
+		for j := range include {
+			if include[j] == col {
+				include[j] = newName
+			}
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		for j := range fk.Cols {
+			if fk.Cols[j] == col {
+				fk.Cols[j] = newName
+			}
+		}
+	}
+	if tdef.TTL != nil && tdef.TTL.Col == col {
+		tdef.TTL.Col = newName
+	}
+	return nil
+}
+
+// the uses of a column that keep it from being dropped, or renamed
+func columnInUse(tdef *TableDef, col string, drop bool) error {
+	for _, src := range tdef.Checks {
+		e, err := parseExpr(src)
+		if err == nil && contains(e.columns(), col) {
+			return fmt.Errorf("%w: %s is in CHECK %s", ErrColumnInUse, col, src)
+		}
+	}
+	for _, trig := range tdef.Triggers {
+		if contains(triggerColumns(trig), col) {
+			return fmt.Errorf("%w: %s is in the trigger %s", ErrColumnInUse, col, trig.Name)
+		}
+	}
+	for _, src := range tdef.IndexWhere {
+		e, err := parseExpr(src)
+		if err == nil && contains(e.columns(), col) {
+			return fmt.Errorf("%w: %s is in the index WHERE %s", ErrColumnInUse, col, src)
+		}
+	}
+	for _, index := range tdef.Indexes {
+		for _, key := range index {
+			if ColIndex(tdef, key) >= 0 {
+				continue
+			}
+			e, err := parseExpr(key)
+			if err == nil && contains(e.columns(), col) {
+				return fmt.Errorf("%w: %s is in the index expression %s", ErrColumnInUse, col, key)
+			}
+		}
+	}
+	if !drop {
+		return nil
+	}
+	if ColIndex(tdef, col) < tdef.PKeys {
+		return fmt.Errorf("%w: %s is in the primary key", ErrColumnInUse, col)
+	}
+	if tdef.AutoIncrement && tdef.Cols[0] == col {
+		return fmt.Errorf("%w: %s is AUTO_INCREMENT", ErrColumnInUse, col)
+	}
+	for i, index := range tdef.Indexes {
+		// the primary key appended to every index is checked above
+		if contains(index, col) {
+			return fmt.Errorf("%w: %s is in the index %v", ErrColumnInUse, col, index)
+		}
+		if contains(indexInclude(tdef, i), col) {
+			return fmt.Errorf("%w: %s is included in the index %v", ErrColumnInUse, col, index)
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if contains(fk.Cols, col) {
+			return fmt.Errorf("%w: %s is in a foreign key to %s", ErrColumnInUse, col, fk.Table)
+		}
+	}
+	if tdef.TTL != nil && tdef.TTL.Col == col {
+		return fmt.Errorf("%w: %s is the TTL column", ErrColumnInUse, col)
+	}
+	return nil
+}
+
+// rewrite up to `limit` rows of an older version under the current one,
+// from the key `start` on. returns where to continue, nil at the end of
+// the table.
+func rewriteBatch(tdef *TableDef, kvtx *KVTX, start []byte, limit int) ([]byte, error) {
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	if start == nil {
+		start = prefix
+	}
+	var rows []storedRow
+	iter := kvtx.Seek(start, CMP_GE)
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) < len(prefix) || string(key[:len(prefix)]) != string(prefix) {
+			break
+		}
+		if rowVersion(tdef, val) == tdef.Version {
+			continue
+		}
+		if err := kvtx.Tree.interrupted(); err != nil {
+			return nil, err
+		}
+		if len(rows) == limit {
+			// resumed from this key
+			return append([]byte(nil), key...), applyRows(rows, tdef, kvtx)
+		}
+		rows = append(rows, storedRow{append([]byte(nil), key...), append([]byte(nil), val...)})
+	}
+	return nil, applyRows(rows, tdef, kvtx)
+}
+
+type storedRow struct {
+	key, val []byte
+}
+
+func applyRows(rows []storedRow, tdef *TableDef, kvtx *KVTX) error {
+	values := make([]Value, len(tdef.Cols))
+	for _, row := range rows {
+		for i := range values {
+			values[i] = Value{Type: tdef.Types[i]}
+		}
+		decodeRow(tdef, row.val, values[tdef.PKeys:])
+		req := InsertReq{Key: row.key, Value: encodeRow(tdef, values), Mode: MODE_UPDATE_ONLY}
+		if _, err := kvtx.SetWithMode(&req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateTable rewrites the rows of the older schema versions of a table
+// under the current one, a batch per write transaction. the layouts are
+// forgotten once no row uses them.
+func (db *DB) MigrateTable(name string) error {
+	var start []byte
+	for {
+		var writer KVTX
+		db.kv.Begin(&writer)
+		tdef := getTableDefTX(db, name, &writer)
+		if tdef == nil || len(tdef.Layouts) == 0 {
+			db.kv.Abort(&writer)
+			return nil // dropped, or done by another migration
+		}
+		next, err := rewriteBatch(tdef, &writer, start, MIGRATE_BATCH)
+		if err == nil && next == nil {
+			done, cerr := copyTableDef(tdef)
+			if err = cerr; err == nil {
+				done.Layouts, done.Fills = nil, nil
+				err = tableDefUpdate(db, done, &writer)
+			}
+		}
+		if err != nil {
+			db.kv.Abort(&writer)
+			return err
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		start = next
+	}
+}
+
+// the choices of CREATE INDEX besides the columns
+type IndexOptions struct {
+	Unique bool
+	Where  string // the condition of a partial index
+	// the columns kept in the entries besides the keys
+	Include []string
+}
+
+// IndexCreate adds an index to a table that may have rows, without
+// blocking its writers. the index is declared first, from then on the
+// writes keep it up to date. the rows of a snapshot taken then are
+// indexed a batch per write transaction, reading each row again as it is
+// now, and the queries use the index once every row has its entry.
+func (db *DB) IndexCreate(table string, cols []string, opts IndexOptions) error {
+	var writer KVTX
+	db.kv.Begin(&writer)
+	prefix, err := db.indexDeclare(table, cols, opts, &writer)
+	if err != nil {
+		db.kv.Abort(&writer)
+		return err
+	}
+	if err := db.kv.Commit(&writer); err != nil {
+		return err
+	}
+
+	if err = db.indexBackfill(table, prefix); err == nil {
+		db.kv.Begin(&writer)
+		if err = indexPublish(db, table, prefix, &writer); err != nil {
+			db.kv.Abort(&writer)
+		} else {
+			err = db.kv.Commit(&writer)
+		}
+	}
+	if err != nil {
+		// the writes stop maintaining the index
+		db.kv.Begin(&writer)
+		if i, tdef := indexByPrefix(db, table, prefix, &writer); i < 0 || indexRemove(db, tdef, i, &writer) != nil {
+			db.kv.Abort(&writer)
+		} else if cerr := db.kv.Commit(&writer); cerr != nil {
+			log.Printf("create index on %s: %v", table, cerr)
+		}
+	}
+	return err
+}
+
+// add an index that isn't ready to a table, returns its prefix
+func (db *DB) indexDeclare(name string, cols []string, opts IndexOptions, kvtx *KVTX) (uint32, error) {
+	current := getTableDefTX(db, name, kvtx)
+	if current == nil || strings.HasPrefix(name, "@") {
+		return 0, fmt.Errorf("table not found: %s", name)
+	}
+	if len(cols) == 0 {
+		return 0, errors.New("an index needs at least one column")
+	}
+	index, err := checkIndexKeys(current, append([]string(nil), cols...))
+	if err != nil {
+		return 0, err
+	}
+	if indexNo(current, index) >= 0 {
+		return 0, fmt.Errorf("%w: %v", ErrIndexExists, cols)
+	}
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkIndexWhere(tdef, opts.Where); err != nil {
+		return 0, err
+	}
+	if err := checkIndexInclude(tdef, index, opts.Include); err != nil {
+		return 0, err
+	}
+	prefix, err := allocPrefixes(db, tdef.Name, 1, kvtx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := len(tdef.Indexes)
+	if opts.Unique || tdef.Unique != nil {
+		for len(tdef.Unique) < n {
+			tdef.Unique = append(tdef.Unique, 0)
+		}
+		if opts.Unique {
+			tdef.Unique = append(tdef.Unique, len(cols))
+		} else {
+			tdef.Unique = append(tdef.Unique, 0)
+		}
+	}
+	if opts.Where != "" || tdef.IndexWhere != nil {
+		for len(tdef.IndexWhere) < n {
+			tdef.IndexWhere = append(tdef.IndexWhere, "")
+		}
+		tdef.IndexWhere = append(tdef.IndexWhere, opts.Where)
+	}
+	if opts.Include != nil || tdef.IndexInclude != nil {
+		for len(tdef.IndexInclude) < n {
+			tdef.IndexInclude = append(tdef.IndexInclude, nil)
+		}
+		tdef.IndexInclude = append(tdef.IndexInclude, opts.Include)
+	}
+	for len(tdef.Building) < n {
+		tdef.Building = append(tdef.Building, false)
+	}
+	tdef.Indexes = append(tdef.Indexes, index)
+	tdef.IndexPrefix = append(tdef.IndexPrefix, prefix)
+	tdef.Building = append(tdef.Building, true)
+	return prefix, tableDefUpdate(db, tdef, kvtx)
+}
+
+// the position of an index by its columns, the primary key included
+func indexNo(tdef *TableDef, index []string) int {
+	for i, cols := range tdef.Indexes {
+		if strings.Join(cols, ",") == strings.Join(index, ",") {
+			return i
+		}
+	}
+	return -1
+}
+
+// the position of an index by its prefix, -1 if it's gone
+func indexByPrefix(db *DB, name string, prefix uint32, kvtx *KVTX) (int, *TableDef) {
+	tdef := getTableDefTX(db, name, kvtx)
+	if tdef == nil {
+		return -1, nil
+	}
+	for i, p := range tdef.IndexPrefix {
+		if p == prefix {
+			return i, tdef
+		}
+	}
+	return -1, tdef
+}
+
+// index the rows of a snapshot, a batch per write transaction
+func (db *DB) indexBackfill(name string, prefix uint32) error {
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	tdef := GetTableDef(db, name, &reader.Tree)
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", name)
+	}
+
+	start, end := prefixRange(tdef.Prefix)
+	iter := reader.Tree.Seek(start, CMP_GE)
+	for {
+		var keys [][]byte
+		for ; iter.Valid() && len(keys) < MIGRATE_BATCH; iter.Next() {
+			key, _ := iter.Deref()
+			if bytes.Compare(key, end) >= 0 {
+				break
+			}
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		var writer KVTX
+		db.kv.Begin(&writer)
+		if err := indexBatch(db, name, prefix, keys, &writer); err != nil {
+			db.kv.Abort(&writer)
+			return err
+		}
+		if err := db.kv.Commit(&writer); err != nil {
+			return err
+		}
+	}
+}
+
+// add the entries of the rows with the keys `keys` as they are now. the
+// rows deleted since the snapshot are skipped, the ones written since
+// have their entries already.
+func indexBatch(db *DB, name string, prefix uint32, keys [][]byte, kvtx *KVTX) error {
+	i, tdef := indexByPrefix(db, name, prefix, kvtx)
+	if i < 0 {
+		return fmt.Errorf("%w: dropped while it was built", ErrIndexNotFound)
+	}
+	index := tdef.Indexes[i]
+	values := make([]Value, len(tdef.Cols))
+	ivals := make([]Value, len(index))
+	for _, key := range keys {
+		val, ok, err := kvtx.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		for j := range values {
+			values[j] = Value{Type: tdef.Types[j]}
+		}
+		decodeValues(key[4:], values[:tdef.PKeys])
+		decodeRow(tdef, val, values[tdef.PKeys:])
+		if !indexHolds(tdef, i, Record{tdef.Cols, values}) {
+			continue
+		}
+		if err := checkUnique(db, tdef, values, kvtx); err != nil {
+			return err
+		}
+		for j, c := range index {
+			ivals[j] = indexKeyValue(tdef, c, Record{tdef.Cols, values})
+		}
+		req := InsertReq{
+			Key:   encodeIndexKey(nil, prefix, tdef, index, ivals),
+			Value: indexEntryValue(tdef, i, Record{tdef.Cols, values}),
+		}
+		if _, err := kvtx.SetWithMode(&req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// make a filled in index visible to the queries
+func indexPublish(db *DB, name string, prefix uint32, kvtx *KVTX) error {
+	i, current := indexByPrefix(db, name, prefix, kvtx)
+	if i < 0 {
+		return fmt.Errorf("%w: dropped while it was built", ErrIndexNotFound)
+	}
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	tdef.Building[i] = false
+	if !slices.Contains(tdef.Building, true) {
+		tdef.Building = nil
+	}
+	return tableDefUpdate(db, tdef, kvtx)
+}
+
+// IndexDrop removes the index on `cols`, with its entries.
+func (db *DB) IndexDrop(name string, cols []string, kvtx *KVTX) error {
+	tdef := getTableDefTX(db, name, kvtx)
+	if tdef == nil || strings.HasPrefix(name, "@") {
+		return fmt.Errorf("table not found: %s", name)
+	}
+	index, err := checkIndexKeys(tdef, append([]string(nil), cols...))
+	if err != nil {
+		return err
+	}
+	i := indexNo(tdef, index)
+	if i < 0 {
+		return fmt.Errorf("%w: %v", ErrIndexNotFound, cols)
+	}
+	return indexRemove(db, tdef, i, kvtx)
+}
+
+// remove the index `i` and its entries
+func indexRemove(db *DB, current *TableDef, i int, kvtx *KVTX) error {
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	prefix := tdef.IndexPrefix[i]
+	tdef.Indexes = append(tdef.Indexes[:i], tdef.Indexes[i+1:]...)
+	tdef.IndexPrefix = append(tdef.IndexPrefix[:i], tdef.IndexPrefix[i+1:]...)
+	if i < len(tdef.Unique) {
+		tdef.Unique = append(tdef.Unique[:i], tdef.Unique[i+1:]...)
+	}
+	if i < len(tdef.IndexWhere) {
+		tdef.IndexWhere = append(tdef.IndexWhere[:i], tdef.IndexWhere[i+1:]...)
+	}
+	if i < len(tdef.IndexInclude) {
+		tdef.IndexInclude = append(tdef.IndexInclude[:i], tdef.IndexInclude[i+1:]...)
+	}
+	if i < len(tdef.Building) {
+		tdef.Building = append(tdef.Building[:i], tdef.Building[i+1:]...)
+	}
+	// the deletes find the referencing rows by an index
+	for _, fk := range tdef.ForeignKeys {
+		if _, err := findIndex(tdef, fk.Cols); err != nil {
+			return fmt.Errorf("the index %v is used by the foreign key to %s", current.Indexes[i], fk.Table)
+		}
+	}
+	start, end := prefixRange(prefix)
+	kvtx.Tree.DeleteRange(start, end)
+	return tableDefUpdate(db, tdef, kvtx)
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrSequenceExists   = errors.New("sequence already exists")
+	ErrSequenceNotFound = errors.New("sequence not found")
+)
+
+// the values a NEXTVAL takes from the writer at once, the next ones are
+// served from memory. the values of a range not used before a restart
+// are skipped.
+const SEQUENCE_CACHE = 64
+
+// the sequences are counters in @meta, keyed `seq:<name>`, holding the
+// next value not handed out yet
+const SEQUENCE_KEY = "seq:"
+
+// the values of a sequence allocated to this process, from next to limit
+type seqRange struct {
+	next  int64
+	limit int64
+}
+
+func seqRecord(name string) *Record {
+	return (&Record{}).AddStr("key", []byte(SEQUENCE_KEY+name))
+}
+
+// the sequence of an AUTO_INCREMENT table, by its prefix so that it
+// follows the table rather than its name
+func autoSequence(tdef *TableDef) string {
+	return fmt.Sprintf("@table:%d", tdef.Prefix)
+}
+
+// SequenceCreate creates a sequence whose first value is `start`.
+func (db *DB) SequenceCreate(name string, start int64, kvtx *KVTX) error {
+	if !strings.HasPrefix(name, "@") && !isValidTableName(name) {
+		return fmt.Errorf("invalid sequence name: %q", name)
+	}
+	if exists, err := dbGet(db, TDEF_META, seqRecord(name), &kvtx.Tree); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%w: %s", ErrSequenceExists, name)
+	}
+	rec := seqRecord(name).AddStr("val", binary.LittleEndian.AppendUint64(nil, uint64(start)))
+	if _, err := dbUpdate(db, TDEF_META, *rec, MODE_INSERT_ONLY, kvtx); err != nil {
+		return err
+	}
+	db.seqForget(name, kvtx)
+	return nil
+}
+
+// SequenceDrop removes a sequence.
+func (db *DB) SequenceDrop(name string, kvtx *KVTX) error {
+	deleted, err := dbDelete(db, TDEF_META, *seqRecord(name), kvtx)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	db.seqForget(name, kvtx)
+	return nil
+}
+
+// Sequences returns the next value of every named sequence, not counting
+// the values cached by the process.
+func (db *DB) Sequences(tree *BTree) (map[string]int64, error) {
+	start := (&Record{}).AddStr("key", []byte(SEQUENCE_KEY))
+	end := (&Record{}).AddStr("key", []byte("seq;")) // after every `seq:` key
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LT, Key1: *start, Key2: *end}
+	if err := dbScan(db, TDEF_META, &sc, tree); err != nil {
+		return nil, err
+	}
+	seqs := map[string]int64{}
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		name := strings.TrimPrefix(string(rec.Get("key").Str), SEQUENCE_KEY)
+		if !strings.HasPrefix(name, "@") {
+			seqs[name] = int64(binary.LittleEndian.Uint64(rec.Get("val").Str))
+		}
+	}
+	return seqs, nil
+}
+
+// NextVal returns the next value of a sequence. the value is handed out
+// even if the transaction using it aborts.
+func (db *DB) NextVal(name string) (int64, error) {
+	return db.nextval(name, nil)
+}
+
+// the next value of a sequence, from the cached range if there's one left.
+// otherwise a range is allocated in `kvtx`, or in its own write
+// transaction if nil; the caller must not hold the writer then.
+func (db *DB) nextval(name string, kvtx *KVTX) (int64, error) {
+	db.seqMu.Lock()
+	if r := db.seqs[name]; r != nil && r.next < r.limit {
+		v := r.next
+		r.next++
+		db.seqMu.Unlock()
+		return v, nil
+	}
+	db.seqMu.Unlock()
+
+	if kvtx != nil {
+		return db.seqAllocate(name, kvtx)
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	v, err := db.seqAllocate(name, &writer)
+	if err != nil {
+		db.kv.Abort(&writer)
+		return 0, err
+	}
+	return v, db.kv.Commit(&writer)
+}
+
+// allocate the next range of a sequence, the first value is returned and
+// the rest is cached once the allocation commits
+func (db *DB) seqAllocate(name string, kvtx *KVTX) (int64, error) {
+	rec := seqRecord(name)
+	ok, err := dbGet(db, TDEF_META, rec, &kvtx.Tree)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || len(rec.Get("val").Str) < 8 {
+		return 0, fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	next := int64(binary.LittleEndian.Uint64(rec.Get("val").Str))
+	limit := next + SEQUENCE_CACHE
+	rec.Get("val").Str = binary.LittleEndian.AppendUint64(nil, uint64(limit))
+	if _, err := dbUpdate(db, TDEF_META, *rec, MODE_UPDATE_ONLY, kvtx); err != nil {
+		return 0, err
+	}
+	kvtx.onCommit = append(kvtx.onCommit, func() {
+		db.seqMu.Lock()
+		if db.seqs == nil {
+			db.seqs = map[string]*seqRange{}
+		}
+		db.seqs[name] = &seqRange{next: next + 1, limit: limit}
+		db.seqMu.Unlock()
+	})
+	return next, nil
+}
+
+// move a sequence past a value written explicitly, so that it's never
+// handed out again. the cached range moves at once, and again on commit
+// in case `kvtx` allocated the next one. if the write is rolled back,
+// the values skipped are a gap.
+func (db *DB) seqAdvance(name string, v int64, kvtx *KVTX) error {
+	advance := func() {
+		db.seqMu.Lock()
+		if r := db.seqs[name]; r != nil && r.next <= v {
+			r.next = v + 1
+		}
+		db.seqMu.Unlock()
+	}
+	advance()
+	kvtx.onCommit = append(kvtx.onCommit, advance)
+
+	rec := seqRecord(name)
+	ok, err := dbGet(db, TDEF_META, rec, &kvtx.Tree)
+	if err != nil || !ok || len(rec.Get("val").Str) < 8 {
+		return err
+	}
+	if next := int64(binary.LittleEndian.Uint64(rec.Get("val").Str)); v >= next {
+		rec.Get("val").Str = binary.LittleEndian.AppendUint64(nil, uint64(v+1))
+		if _, err := dbUpdate(db, TDEF_META, *rec, MODE_UPDATE_ONLY, kvtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop the cached range of a sequence once `kvtx` commits
+func (db *DB) seqForget(name string, kvtx *KVTX) {
+	kvtx.onCommit = append(kvtx.onCommit, func() {
+		db.seqMu.Lock()
+		delete(db.seqs, name)
+		db.seqMu.Unlock()
+	})
+}
@@ -0,0 +1,430 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const MAIN_BRANCH = "main"
+
+var (
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrBranchExists     = errors.New("branch already exists")
+	ErrBranchNotFound   = errors.New("branch not found")
+	ErrBranchInUse      = errors.New("branch is in use")
+)
+
+var catalogNameRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// a named root kept readable until it's dropped
+type Snapshot struct {
+	Name    string
+	Root    uint64
+	Version uint64 // the last committed version when it was taken
+	Time    time.Time
+}
+
+// named roots and the reference counts of the pages they share
+type Catalog struct {
+	snapshots map[string]Snapshot
+	branches  map[string]uint64 // writable roots other than main
+	// extra references to pages reachable from several roots,
+	// a page without an entry has a single reference.
+	refs map[uint64]uint32
+	// pages holding the catalog on disk
+	head  uint64
+	pages []uint64
+	// the maps are private to the transaction
+	owned bool
+	// the catalog has changed and must be rewritten on commit
+	dirty bool
+}
+
+// Catalog Node Format, the data continues in the next node
+// | type | size | next | data |
+// |  2B  |  2B  |  8B  | size |
+
+const (
+	BNODE_CATALOG  = 4
+	CATALOG_HEADER = 4 + 8
+	CATALOG_CAP    = BTREE_PAGE_SIZE - CATALOG_HEADER
+)
+
+// copy the maps shared with `kv.catalog` before changing them
+func (c *Catalog) own() {
+	if !c.owned {
+		c.snapshots = maps.Clone(c.snapshots)
+		c.branches = maps.Clone(c.branches)
+		c.refs = maps.Clone(c.refs)
+		if c.snapshots == nil {
+			c.snapshots = map[string]Snapshot{}
+		}
+		if c.branches == nil {
+			c.branches = map[string]uint64{}
+		}
+		if c.refs == nil {
+			c.refs = map[uint64]uint32{}
+		}
+		c.owned = true
+	}
+	c.dirty = true
+}
+
+func (c *Catalog) incref(ptr uint64) {
+	if ptr != 0 {
+		c.own()
+		c.refs[ptr]++
+	}
+}
+
+func (c *Catalog) decref(ptr uint64) {
+	c.own()
+	if c.refs[ptr] <= 1 {
+		delete(c.refs, ptr)
+	} else {
+		c.refs[ptr]--
+	}
+}
+
+func (c *Catalog) encode() []byte {
+	var data []byte
+	putString := func(s string) {
+		data = binary.AppendUvarint(data, uint64(len(s)))
+		data = append(data, s...)
+	}
+
+	data = binary.AppendUvarint(data, uint64(len(c.snapshots)))
+	for _, name := range sortedKeys(c.snapshots) {
+		snap := c.snapshots[name]
+		putString(name)
+		data = binary.LittleEndian.AppendUint64(data, snap.Root)
+		data = binary.LittleEndian.AppendUint64(data, snap.Version)
+		data = binary.LittleEndian.AppendUint64(data, uint64(snap.Time.UnixNano()))
+	}
+	data = binary.AppendUvarint(data, uint64(len(c.branches)))
+	for _, name := range sortedKeys(c.branches) {
+		putString(name)
+		data = binary.LittleEndian.AppendUint64(data, c.branches[name])
+	}
+	data = binary.AppendUvarint(data, uint64(len(c.refs)))
+	for ptr, n := range c.refs {
+		data = binary.AppendUvarint(data, ptr)
+		data = binary.AppendUvarint(data, uint64(n))
+	}
+	return data
+}
+
+func (c *Catalog) decode(data []byte) error {
+	bad := errors.New("bad catalog")
+	getUvarint := func() uint64 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			panic(bad)
+		}
+		data = data[n:]
+		return v
+	}
+	getUint64 := func() uint64 {
+		if len(data) < 8 {
+			panic(bad)
+		}
+		v := binary.LittleEndian.Uint64(data)
+		data = data[8:]
+		return v
+	}
+	getString := func() string {
+		n := getUvarint()
+		if uint64(len(data)) < n {
+			panic(bad)
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s
+	}
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = bad
+			}
+		}()
+		c.snapshots = map[string]Snapshot{}
+		for i := getUvarint(); i > 0; i-- {
+			snap := Snapshot{Name: getString()}
+			snap.Root = getUint64()
+			snap.Version = getUint64()
+			snap.Time = time.Unix(0, int64(getUint64()))
+			c.snapshots[snap.Name] = snap
+		}
+		c.branches = map[string]uint64{}
+		for i := getUvarint(); i > 0; i-- {
+			name := getString()
+			c.branches[name] = getUint64()
+		}
+		c.refs = map[uint64]uint32{}
+		for i := getUvarint(); i > 0; i-- {
+			ptr := getUvarint()
+			c.refs[ptr] = uint32(getUvarint())
+		}
+	}()
+	return err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// read the catalog referenced by the master page
+func catalogLoad(kv *KV) error {
+	var reader KVReader
+	reader.mmap.chunks = kv.mmap.chunks
+
+	var data []byte
+	for curr := kv.catalog.head; curr != 0; {
+		node := reader.pageGetMapped(curr)
+		if node.bNodeType() != BNODE_CATALOG {
+			return errors.New("bad catalog page")
+		}
+		size := binary.LittleEndian.Uint16(node.data[2:])
+		data = append(data, node.data[CATALOG_HEADER:CATALOG_HEADER+int(size)]...)
+		kv.catalog.pages = append(kv.catalog.pages, curr)
+		curr = binary.LittleEndian.Uint64(node.data[4:])
+	}
+	if kv.catalog.head == 0 {
+		return nil
+	}
+	return kv.catalog.decode(data)
+}
+
+// rewrite the catalog into new pages, called once per commit
+func (tx *KVTX) catalogFlush() {
+	c := &tx.catalog
+	if !c.dirty {
+		return
+	}
+	for _, ptr := range c.pages {
+		tx.pageDel(ptr)
+	}
+	c.pages = nil
+	c.head = 0
+
+	data := c.encode()
+	var chunks [][]byte
+	for len(data) > 0 {
+		size := min(len(data), CATALOG_CAP)
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	// from tail to head
+	for i := len(chunks) - 1; i >= 0; i-- {
+		node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		binary.LittleEndian.PutUint16(node.data[0:], BNODE_CATALOG)
+		binary.LittleEndian.PutUint16(node.data[2:], uint16(len(chunks[i])))
+		binary.LittleEndian.PutUint64(node.data[4:], c.head)
+		copy(node.data[CATALOG_HEADER:], chunks[i])
+		c.head = tx.pageNew(node)
+		c.pages = append(c.pages, c.head)
+	}
+	c.dirty = false
+}
+
+// drop one reference to the tree under `ptr`, freeing the pages
+// that are no longer referenced from anywhere
+func (tx *KVTX) treeRelease(ptr uint64) {
+	if ptr == 0 {
+		return
+	}
+	if tx.catalog.refs[ptr] > 0 {
+		tx.catalog.decref(ptr)
+		return
+	}
+	node := tx.pageGet(ptr)
+	if node.bNodeType() == BNODE_INODE {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			tx.treeRelease(node.getPtr(i))
+		}
+	}
+	tx.pageDel(ptr)
+}
+
+// the root of a branch, the caller holds `kv.mu` or `kv.writer`
+func (kv *KV) rootOf(branch string) uint64 {
+	if branch == "" {
+		return kv.tree.root
+	}
+	return kv.catalog.branches[branch]
+}
+
+func checkCatalogName(c *Catalog, name string) error {
+	if !catalogNameRe.MatchString(name) || name == MAIN_BRANCH {
+		return fmt.Errorf("invalid name '%s'", name)
+	}
+	if _, ok := c.snapshots[name]; ok {
+		return fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	}
+	if _, ok := c.branches[name]; ok {
+		return fmt.Errorf("%w: %s", ErrBranchExists, name)
+	}
+	return nil
+}
+
+// SnapshotCreate pins the tree as seen by the transaction under `name`.
+func (tx *KVTX) SnapshotCreate(name string) error {
+	if err := checkCatalogName(&tx.catalog, name); err != nil {
+		return err
+	}
+	tx.catalog.incref(tx.Tree.root)
+	tx.catalog.own()
+	tx.catalog.snapshots[name] = Snapshot{
+		Name:    name,
+		Root:    tx.Tree.root,
+		Version: tx.version,
+		Time:    time.Now(),
+	}
+	return nil
+}
+
+// SnapshotDrop releases a snapshot, pages only it referenced are freed.
+func (tx *KVTX) SnapshotDrop(name string) error {
+	snap, ok := tx.catalog.snapshots[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	tx.catalog.own()
+	delete(tx.catalog.snapshots, name)
+	tx.treeRelease(snap.Root)
+	return nil
+}
+
+// BranchCreate creates a writable branch sharing the pages of a snapshot.
+func (tx *KVTX) BranchCreate(name string, from string) error {
+	snap, ok := tx.catalog.snapshots[from]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, from)
+	}
+	if err := checkCatalogName(&tx.catalog, name); err != nil {
+		return err
+	}
+	tx.catalog.incref(snap.Root)
+	tx.catalog.own()
+	tx.catalog.branches[name] = snap.Root
+	return nil
+}
+
+// BranchDrop removes a branch and frees the pages only it referenced.
+func (tx *KVTX) BranchDrop(name string) error {
+	root, ok := tx.catalog.branches[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, name)
+	}
+	tx.kv.mu.Lock()
+	current := tx.kv.branch
+	tx.kv.mu.Unlock()
+	if name == tx.branch || name == current {
+		return fmt.Errorf("%w: %s", ErrBranchInUse, name)
+	}
+	tx.catalog.own()
+	delete(tx.catalog.branches, name)
+	tx.treeRelease(root)
+	return nil
+}
+
+// Snapshots returns the committed snapshots sorted by name.
+func (kv *KV) Snapshots() []Snapshot {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	snaps := []Snapshot{}
+	for _, name := range sortedKeys(kv.catalog.snapshots) {
+		snaps = append(snaps, kv.catalog.snapshots[name])
+	}
+	return snaps
+}
+
+// Branches returns the committed branches sorted by name, main first,
+// and the branch new transactions start on.
+func (kv *KV) Branches() ([]string, string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	current := kv.branch
+	if current == "" {
+		current = MAIN_BRANCH
+	}
+	return append([]string{MAIN_BRANCH}, sortedKeys(kv.catalog.branches)...), current
+}
+
+// UseBranch makes new transactions and readers start on `name`.
+func (kv *KV) UseBranch(name string) error {
+	kv.writer.Lock()
+	defer kv.writer.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if name == MAIN_BRANCH {
+		kv.branch = ""
+		return nil
+	}
+	if _, ok := kv.catalog.branches[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, name)
+	}
+	kv.branch = name
+	return nil
+}
+
+// initialising the reader from a snapshot
+func (kv *KV) BeginReadSnapshot(tx *KVReader, name string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	snap, ok := kv.catalog.snapshots[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	// pages freed from now on are protected by the current version
+	kv.beginReadLocked(tx, CommitInfo{Version: kv.version, Root: snap.Root})
+	return nil
+}
+
+// UseBranch switches the branch used by new transactions and reads.
+func (db *DB) UseBranch(name string) error {
+	if err := db.kv.UseBranch(name); err != nil {
+		return err
+	}
+	// the cached table definitions belong to the previous branch
+	db.tablesMu.Lock()
+	db.tables = map[string]*TableDef{}
+	db.tablesMu.Unlock()
+	// and so do the cached sequence ranges
+	db.seqMu.Lock()
+	db.seqs = nil
+	db.seqMu.Unlock()
+	return nil
+}
+
+// run a catalog change in the current transaction, or in its own.
+// the private tree of a transaction can't be snapshotted, so the change
+// is only made, and checked, when the transaction commits.
+func (db *DB) catalogOp(tx *DBTX, op func(*KVTX) error) error {
+	if tx != nil {
+		return tx.exec(func() error {
+			tx.log = append(tx.log, op)
+			return nil
+		})
+	}
+	var writer KVTX
+	db.kv.Begin(&writer)
+	if err := op(&writer); err != nil {
+		db.kv.Abort(&writer)
+		return err
+	}
+	return db.kv.Commit(&writer)
+}
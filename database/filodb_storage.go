@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"sync"
+	"time"
 )
 
 const DB_SIG = "FiloDB\x00\x00"
@@ -41,8 +43,28 @@ type KV struct {
 
 	version uint64
 	readers ReaderList // heap, for tranking the minimum reader version
+
+	// recently committed versions, oldest first, kept readable
+	// for time-travel queries. their pages are not reused.
+	history     []CommitInfo
+	historySize int
+
+	// snapshots, branches & shared page references
+	catalog Catalog
+	// the branch new transactions start on, empty for main
+	branch string
 }
 
+// a committed version of the tree
+type CommitInfo struct {
+	Version uint64
+	Root    uint64
+	Time    time.Time
+}
+
+// number of committed versions retained by default
+const DEFAULT_HISTORY = 32
+
 // implements heap.Interface
 type ReaderList []*KVReader
 
@@ -54,15 +76,19 @@ func (rl ReaderList) Less(i int, j int) bool {
 	if rl[i] == nil || rl[j] == nil {
 		return false
 	}
-	return rl[i].index < rl[j].index
+	return versionBefore(rl[i].version, rl[j].version)
 }
 
 func (rl ReaderList) Swap(i, j int) {
 	rl[i], rl[j] = rl[j], rl[i]
+	rl[i].index = i
+	rl[j].index = j
 }
 
 func (rl *ReaderList) Push(item interface{}) {
-	*rl = append(*rl, item.(*KVReader))
+	reader := item.(*KVReader)
+	reader.index = len(*rl)
+	*rl = append(*rl, reader)
 }
 
 func (rl *ReaderList) Pop() interface{} {
@@ -75,10 +101,24 @@ func (rl *ReaderList) Pop() interface{} {
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used | free_list | version |
-// |  8B | 	   8B 	  | 	 8B	  |		8B	  |   8B    |
+// | sig | btree_root | page_used | free_list | version | nhistory | checksum | catalog |
+// |  8B | 	   8B 	  | 	 8B	  |		8B	  |   8B    |    4B    |    4B    |   8B    |
+// followed by `nhistory` entries of | version | root | unix nano |, each 8B.
+// the checksum covers the history entries.
+
+const (
+	MASTER_HEADER = 56
+	MAX_HISTORY   = (BTREE_PAGE_SIZE - MASTER_HEADER) / 24
+)
 
 func (db *KV) Open() error {
+	// finish a commit across files that was interrupted
+	if err := recoverCommitLog(db.Path); err != nil {
+		return fmt.Errorf("KV Open: %w", err)
+	}
+	if err := recoverPrepared(db.Path); err != nil {
+		return fmt.Errorf("KV Open: %w", err)
+	}
 	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
 		return fmt.Errorf("OpenFile: %w", err)
@@ -100,6 +140,10 @@ func (db *KV) Open() error {
 	if err != nil {
 		goto fail
 	}
+	err = catalogLoad(db)
+	if err != nil {
+		goto fail
+	}
 	return nil
 
 fail:
@@ -121,42 +165,43 @@ func (db *KVTX) Get(key []byte) ([]byte, bool, error) {
 	return db.Tree.Get(key)
 }
 
+// the pages stay in `page.updates` until the transaction commits
 func (db *KVTX) Set(key, val []byte) error {
 	db.Tree.Insert(key, val)
-	return flushPages(db)
+	return nil
 }
 
 func (db *KVTX) Delete(req *DeleteReq) (bool, error) {
-	val, _, err := db.Get(req.Key)
+	val, exists, err := db.Get(req.Key)
 	if err != nil {
 		return false, err
-	} else if len(val) == 0 {
+	} else if !exists {
+		// index entries have an empty value, test for the key itself
 		return false, errors.New("record not found")
 	}
 	deleted := db.Tree.Delete(req.Key)
 	if deleted {
 		req.Old = val
 	}
-	return deleted, flushPages(db)
+	return deleted, nil
 }
 
-// persist the newly allocated pages after updates
-func flushPages(db *KVTX) error {
-	if err := writePages(db); err != nil {
-		return err
-	}
-	return syncPages(db)
-}
-
-func writePages(db *KVTX) error {
-	freed := []uint64{}
-
+// move the deallocated pages to the free list, along with
+// the pages allocated by the transaction but no longer used
+func releasePages(db *KVTX) {
+	freed := db.page.spare
+	db.page.spare = nil
 	for ptr, page := range db.page.updates {
 		if page == nil {
 			freed = append(freed, ptr)
+			delete(db.page.updates, ptr)
 		}
 	}
 	db.free.Add(freed)
+}
+
+func writePages(db *KVTX) error {
+	releasePages(db)
 	npages := int(db.page.nappend) + int(db.kv.page.flushed)
 
 	// extends mmap & file if needed
@@ -166,6 +211,7 @@ func writePages(db *KVTX) error {
 	if err := extendMmap(db.kv, npages); err != nil {
 		return err
 	}
+	db.mmap.chunks = db.kv.mmap.chunks
 
 	for ptr, page := range db.page.updates {
 		if page != nil {
@@ -175,25 +221,11 @@ func writePages(db *KVTX) error {
 	return nil
 }
 
-func syncPages(db *KVTX) error {
-	if err := db.kv.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
-	}
-	db.kv.page.flushed += uint64(db.page.nappend)
-	db.page.updates = map[uint64][]byte{}
-
-	if err := masterStore(db.kv); err != nil {
-		return err
-	}
-	if err := db.kv.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
-	}
-	return nil
-}
-
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created
+		db.tree.root = 0
+		db.catalog = Catalog{}
 		db.page.flushed = 1 // reserved for the first page
 		return nil
 	}
@@ -216,17 +248,84 @@ func masterLoad(db *KV) error {
 	db.tree.root = root
 	db.page.flushed = pagesUsed
 	db.free.head = freeListPtr
+	db.version = binary.LittleEndian.Uint64(data[32:])
+	db.catalog = Catalog{head: binary.LittleEndian.Uint64(data[48:])}
+	db.history = loadHistory(data, pagesUsed)
 	return nil
 }
 
-func masterStore(db *KV) error {
-	var data [32]byte
+// a damaged history is dropped, it's not needed to open the database
+func loadHistory(data []byte, pagesUsed uint64) []CommitInfo {
+	n := int(binary.LittleEndian.Uint32(data[40:]))
+	if n == 0 || n > MAX_HISTORY {
+		return nil
+	}
+	entries := data[MASTER_HEADER : MASTER_HEADER+n*24]
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(data[44:]) {
+		return nil
+	}
+	history := make([]CommitInfo, n)
+	for i := range history {
+		entry := entries[i*24:]
+		history[i] = CommitInfo{
+			Version: binary.LittleEndian.Uint64(entry[0:]),
+			Root:    binary.LittleEndian.Uint64(entry[8:]),
+			Time:    time.Unix(0, int64(binary.LittleEndian.Uint64(entry[16:]))),
+		}
+		if history[i].Root >= pagesUsed {
+			return nil
+		}
+	}
+	return history
+}
+
+// the fields of the master page
+type masterPage struct {
+	root    uint64
+	used    uint64
+	free    uint64
+	version uint64
+	catalog uint64
+	history []CommitInfo
+}
+
+// the master page of the committed state, the caller holds `kv.mu` or `kv.writer`
+func (db *KV) master() masterPage {
+	return masterPage{
+		root:    db.tree.root,
+		used:    db.page.flushed,
+		free:    db.free.head,
+		version: db.version,
+		catalog: db.catalog.head,
+		history: db.history,
+	}
+}
+
+func (m masterPage) encode() []byte {
+	data := make([]byte, MASTER_HEADER+len(m.history)*24)
 	copy(data[:8], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[8:16], db.tree.root)
-	binary.LittleEndian.PutUint64(data[16:24], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[24:32], db.free.head)
+	binary.LittleEndian.PutUint64(data[8:16], m.root)
+	binary.LittleEndian.PutUint64(data[16:24], m.used)
+	binary.LittleEndian.PutUint64(data[24:32], m.free)
+	binary.LittleEndian.PutUint64(data[32:40], m.version)
+	binary.LittleEndian.PutUint32(data[40:44], uint32(len(m.history)))
+	binary.LittleEndian.PutUint64(data[48:56], m.catalog)
+	for i, commit := range m.history {
+		entry := data[MASTER_HEADER+i*24:]
+		binary.LittleEndian.PutUint64(entry[0:], commit.Version)
+		binary.LittleEndian.PutUint64(entry[8:], commit.Root)
+		binary.LittleEndian.PutUint64(entry[16:], uint64(commit.Time.UnixNano()))
+	}
+	binary.LittleEndian.PutUint32(data[44:48], crc32.ChecksumIEEE(data[MASTER_HEADER:]))
+	return data
+}
+
+func masterStore(db *KV) error {
+	db.mu.Lock()
+	data := db.master().encode()
+	db.mu.Unlock()
 	// Pwrite ensures that updating the page is atomic
-	_, err := pwriteFile(db.fp.Fd(), data[:], 0)
+	_, err := pwriteFile(db.fp.Fd(), data, 0)
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
@@ -309,18 +408,70 @@ func (db *KVTX) pageGet(ptr uint64) BNode {
 // callback for BTree, allocate a new page
 func (db *KVTX) pageNew(node BNode) uint64 {
 	assert(len(node.data) <= BTREE_PAGE_SIZE)
-	ptr := db.free.Pop()
-	if ptr == 0 {
+	var ptr uint64
+	if n := len(db.page.spare); n > 0 {
+		ptr, db.page.spare = db.page.spare[n-1], db.page.spare[:n-1]
+	} else if ptr = db.free.Pop(); ptr == 0 {
 		ptr = db.free.new(node)
 	}
+	db.page.fresh[ptr] = true
 	db.page.updates[ptr] = node.data
 	return ptr
 }
 
+// callback for BTree, deallocate a page
 func (db *KVTX) pageDel(ptr uint64) {
+	if db.catalog.refs[ptr] > 0 {
+		// shared with another root, so it stays. the copy replacing
+		// it in this tree is one more reference to its children.
+		node := db.pageGet(ptr)
+		db.catalog.decref(ptr)
+		if node.bNodeType() == BNODE_INODE {
+			for i := uint16(0); i < node.nKeys(); i++ {
+				db.catalog.incref(node.getPtr(i))
+			}
+		}
+		return
+	}
+	if db.page.fresh[ptr] {
+		// an intermediate version that was never written,
+		// its page is taken by the next allocation instead
+		delete(db.page.updates, ptr)
+		db.page.spare = append(db.page.spare, ptr)
+		return
+	}
 	db.page.updates[ptr] = nil
 }
 
+// callbacks for a scratch tree, its pages live in memory only
+// and are numbered past any page on disk.
+func (db *KVTX) pageScratch(node BNode) uint64 {
+	assert(len(node.data) <= BTREE_PAGE_SIZE)
+	ptr := SCRATCH_PAGE_MIN + uint64(db.page.nappend)
+	db.page.nappend++
+	db.page.updates[ptr] = node.data
+	return ptr
+}
+
+func (db *KVTX) pageScratchDel(ptr uint64) {
+	// the pages on disk belong to the committed tree
+	delete(db.page.updates, ptr)
+}
+
+// release a subtree of a scratch tree, stopping at the pages on disk
+func (db *KVTX) scratchRelease(ptr uint64) {
+	if ptr < SCRATCH_PAGE_MIN {
+		return
+	}
+	node := db.pageGet(ptr)
+	if node.bNodeType() == BNODE_INODE {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			db.scratchRelease(node.getPtr(i))
+		}
+	}
+	db.pageScratchDel(ptr)
+}
+
 func (db *KVReader) pageGetMapped(ptr uint64) BNode {
 	start := uint64(0)
 	for _, chunk := range db.mmap.chunks {
@@ -343,6 +494,7 @@ func (db *KVTX) pageAppend(node BNode) uint64 {
 	return ptr
 }
 
+// callback for Freelist, reuse a free page
 func (db *KVTX) pageUse(ptr uint64, node BNode) {
 	db.page.updates[ptr] = node.data
 }
@@ -2,13 +2,38 @@ package database
 
 import (
 	"container/heap"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// DB transaction
+// DB transaction. its writes, the DDL included, are made in a private
+// tree and are visible to others once the transaction commits.
 type DBTX struct {
 	kv KVTX
 	db *DB
+	// held while a statement, commit or abort runs
+	mu sync.Mutex
+	// set once the transaction has ended, guarded by `mu`
+	err error
+	// bookkeeping for the reaper, guarded by `db.txMu`
+	started time.Time
+	active  time.Time // end of the last statement
+	stmt    time.Time // start of the running statement, zero when idle
+	kill    error     // reason to abort once the running statement returns
+	// set with `kill`, read without the lock by the running statement
+	killed atomic.Bool
+	// the changes applied to the private tree `kv`, replayed against
+	// the latest tree on commit
+	log []func(*KVTX) error
+	// row locks held and the request being waited on, guarded by `db.locks.mu`
+	locks   map[string]LockMode
+	waiting *lockRequest
+	// the parts of the transaction on attached databases, by alias.
+	// they run their statements under `mu` of this transaction.
+	attached map[string]*DBTX
 }
 
 type KVReader struct {
@@ -19,6 +44,9 @@ type KVReader struct {
 		chunks [][]byte // copied from sttruct KV, read-only
 	}
 	index int
+	// for reporting long-lived readers
+	started  time.Time
+	reported bool
 }
 
 // KV Transaction
@@ -31,17 +59,34 @@ type KVTX struct {
 		// newly allocated or deallocated pages keyed by the pointer.
 		// nil value denotes a deallocated page.
 		updates map[uint64][]byte
+		// pages allocated by the transaction, and the ones among them
+		// that were deallocated again and can be reused before commit
+		fresh map[uint64]bool
+		spare []uint64
 	}
+	// table definitions used or changed by this transaction,
+	// a nil value denotes a dropped table.
+	tables map[string]*TableDef
+	// run after a successful commit
+	onCommit []func()
+	// copied from the KV, the branch being written, empty for main
+	catalog Catalog
+	branch  string
+	// a private tree that is never committed, see `BeginScratch`
+	scratch bool
+	// the depth of the triggers writing, see `triggerWrite`
+	triggers int
+	// locks the row a trigger is about to write, set by the DBTX owning
+	// the private tree
+	lock func(tdef *TableDef, rec Record) error
+	// the master page once committed, set by `prepare`
+	master masterPage
 }
 
 // initialising the reader from the kv
 func (kv *KV) BeginRead(tx *KVReader) {
 	kv.mu.Lock()
-	tx.mmap.chunks = kv.mmap.chunks
-	tx.Tree.root = kv.tree.root
-	tx.Tree.get = tx.pageGetMapped
-	tx.version = kv.version
-	heap.Push(&kv.readers, tx)
+	kv.beginReadLocked(tx, CommitInfo{Version: kv.version, Root: kv.rootOf(kv.branch)})
 	kv.mu.Unlock()
 }
 
@@ -55,103 +100,610 @@ func (tx *KVReader) Seek(key []byte, cmp int) *BIter {
 	return tx.Tree.Seek(key, cmp)
 }
 
+// Begin starts an interactive transaction. Its statements run on a
+// private copy of the tree, so transactions don't block each other
+// until they touch the same rows, and are replayed by the single
+// writer on commit.
 func (db *DB) Begin(tx *DBTX) {
 	tx.db = db
-	db.kv.Begin(&tx.kv)
+	tx.err = nil
+	tx.log = nil
+	db.kv.BeginScratch(&tx.kv)
+	tx.kv.Tree.interrupt = tx.interrupted
+	tx.kv.lock = tx.lockWrite
+	db.txRegister(tx)
 }
 
 func (db *DB) Commit(tx *DBTX) error {
-	return db.kv.Commit(&tx.kv)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.err != nil {
+		return tx.err
+	}
+	err := db.commitParts(tx)
+	// the locks are held until the changes are visible
+	tx.end(fmt.Errorf("%w: committed", ErrTxDone))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTxAborted, err)
+	}
+	return nil
+}
+
+// run a single statement in its own transaction, so it takes the same
+// row locks as the interactive ones. it is rolled back unless it
+// succeeds and reports a change.
+func (db *DB) autocommit(stmt func(tx *DBTX) (bool, error)) (bool, error) {
+	var tx DBTX
+	db.Begin(&tx)
+	ok, err := stmt(&tx)
+	if err != nil || !ok {
+		db.Abort(&tx)
+		return ok, err
+	}
+	return ok, db.Commit(&tx)
+}
+
+// apply the changes of a transaction to the latest tree, the writer
+// is left locked on success. returns false if nothing has changed.
+func (db *DB) replay(tx *DBTX, writer *KVTX) (bool, error) {
+	db.kv.Begin(writer)
+	for _, op := range tx.log {
+		if err := op(writer); err != nil {
+			db.kv.Abort(writer)
+			return false, err
+		}
+	}
+	changed, err := db.kv.prepare(writer)
+	if err != nil || !changed {
+		db.kv.Abort(writer)
+	}
+	return changed, err
 }
 
+// Abort is a no-op for a transaction that has already ended,
+// e.g. one that was aborted by the reaper.
 func (db *DB) Abort(tx *DBTX) {
-	db.kv.Abort(&tx.kv)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.err == nil {
+		tx.end(fmt.Errorf("%w: aborted", ErrTxDone))
+	}
+}
+
+// end the transaction along with its parts on attached databases,
+// dropping their private trees and locks. the caller holds `tx.mu`.
+func (tx *DBTX) end(reason error) {
+	tx.err = reason
+	tx.log = nil
+	tx.db.txUnregister(tx)
+	tx.db.kv.EndRead(&tx.kv.KVReader)
+	tx.db.locks.releaseAll(tx)
+	for _, part := range tx.attached {
+		part.end(reason)
+	}
+	tx.attached = nil
+}
+
+// Err returns the reason the transaction has ended, or nil if it is still open.
+func (tx *DBTX) Err() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.err
+}
+
+// the reason the reaper flagged the running statement, its scans and
+// writes stop with it rather than run to the end
+func (tx *DBTX) interrupted() error {
+	if !tx.killed.Load() {
+		return nil
+	}
+	tx.db.txMu.Lock()
+	defer tx.db.txMu.Unlock()
+	return tx.kill
+}
+
+// run a statement, refusing it if the transaction has already ended
+// and aborting the transaction if the reaper flagged the statement.
+func (tx *DBTX) exec(stmt func() error) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.err != nil {
+		return tx.err
+	}
+	tx.db.txMu.Lock()
+	tx.stmt = time.Now()
+	tx.db.txMu.Unlock()
+
+	err := stmt()
+
+	tx.db.txMu.Lock()
+	tx.stmt = time.Time{}
+	tx.active = time.Now()
+	kill := tx.kill
+	tx.db.txMu.Unlock()
+	if kill == nil && (errors.Is(err, ErrDeadlock) || errors.Is(err, ErrLockTimeout)) {
+		kill = err
+	}
+	if kill != nil {
+		tx.end(fmt.Errorf("%w: %w", ErrTxAborted, kill))
+		return tx.err
+	}
+	return err
 }
 
 func (tx *DBTX) TableNew(tdef *TableDef) error {
-	return tx.db.TableNew(tdef, &tx.kv)
+	return tx.exec(func() error {
+		tx, name := tx.route(tdef.Name)
+		tdef.Name = name
+		if err := tx.lockTableDef(tdef.Name); err != nil {
+			return err
+		}
+		// their definitions record the new table
+		for _, fk := range tdef.ForeignKeys {
+			if err := tx.lockTableDef(fk.Table); err != nil {
+				return err
+			}
+		}
+		// the prefixes are assigned again by the replay
+		def := *tdef
+		if err := tx.db.TableNew(tdef, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			def := def
+			return tx.db.TableNew(&def, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) AlterTable(table string, alter TableAlter) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.AlterTable(name, alter, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.AlterTable(name, alter, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TableDrop(table string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		// their definitions stop recording the table
+		if tdef := getTableDefTX(tx.db, name, &tx.kv); tdef != nil {
+			for _, fk := range tdef.ForeignKeys {
+				if err := tx.lockTableDef(fk.Table); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.db.TableDrop(name, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TableDrop(name, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TableRename(table, newName string, alias bool) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		for _, n := range []string{name, inSchemaOf(name, newName)} {
+			if err := tx.lockTableDef(n); err != nil {
+				return err
+			}
+		}
+		// their definitions record the name
+		if tdef := getTableDefTX(tx.db, name, &tx.kv); tdef != nil {
+			related := append([]string(nil), tdef.ReferencedBy...)
+			for _, fk := range tdef.ForeignKeys {
+				related = append(related, fk.Table)
+			}
+			for _, n := range related {
+				if err := tx.lockTableDef(n); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.db.TableRename(name, newName, alias, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TableRename(name, newName, alias, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TableAliasDrop(alias string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(alias)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.TableAliasDrop(name, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TableAliasDrop(name, writer)
+		})
+		return nil
+	})
+}
+
+// the view and the table it reads are locked, a rename of that table
+// waits for the view.
+func (tx *DBTX) ViewCreate(view, query string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(view)
+		def, err := parseViewQuery(name, query)
+		if err != nil {
+			return err
+		}
+		for _, lock := range []string{name, def.Table} {
+			if err := tx.lockTableDef(lock); err != nil {
+				return err
+			}
+		}
+		if err := tx.db.ViewCreate(name, query, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.ViewCreate(name, query, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) ViewDrop(view string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(view)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.ViewDrop(name, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.ViewDrop(name, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TriggerCreate(table string, trig Trigger) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		// it isn't dropped while the trigger is checked against it
+		if trig.Table != "" {
+			if err := tx.lockTableDef(trig.Table); err != nil {
+				return err
+			}
+		}
+		if err := tx.db.TriggerCreate(name, trig, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TriggerCreate(name, trig, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TriggerDrop(table, trigger string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.TriggerDrop(name, trigger, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TriggerDrop(name, trigger, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) TableSetTTL(table string, ttl *TTL) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.TableSetTTL(name, ttl, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.TableSetTTL(name, ttl, writer)
+		})
+		return nil
+	})
+}
+
+func (tx *DBTX) IndexDrop(table string, cols []string) error {
+	return tx.exec(func() error {
+		tx, name := tx.route(table)
+		if err := tx.lockTableDef(name); err != nil {
+			return err
+		}
+		if err := tx.db.IndexDrop(name, cols, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			return tx.db.IndexDrop(name, cols, writer)
+		})
+		return nil
+	})
 }
 
 func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
-	return tx.db.Set(table, rec, mode, &tx.kv)
+	var ok bool
+	err := tx.exec(func() (err error) {
+		tx, table := tx.route(table)
+		if err = tx.shareTableDef(table); err != nil {
+			return err
+		}
+		tdef := getTableDefTX(tx.db, table, &tx.kv)
+		if tdef == nil {
+			return fmt.Errorf("table not found: %s", table)
+		}
+		// the defaults are evaluated once, the replay writes the same row
+		rec, err := applyDefaults(tx.db, tdef, copyRecord(rec), nil)
+		if errors.Is(err, ErrSequenceNotFound) {
+			// a table created by the transaction has its sequence in the
+			// private tree only, the replay moves the real one past the id
+			rec, err = applyDefaults(tx.db, tdef, copyRecord(rec), &tx.kv)
+		}
+		if err != nil {
+			return err
+		}
+		if err = tx.lockWrite(tdef, rec); err != nil {
+			return err
+		}
+		if ok, err = tx.db.Set(table, copyRecord(rec), mode, &tx.kv); err != nil {
+			return err
+		}
+		want := ok
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			got, err := tx.db.Set(table, rec, mode, writer)
+			return replayed(table, got, want, err)
+		})
+		return nil
+	})
+	return ok, err
 }
 
 func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
-	return tx.db.Delete(table, rec, &tx.kv)
+	var ok bool
+	err := tx.exec(func() (err error) {
+		tx, table := tx.route(table)
+		if err = tx.shareTableDef(table); err != nil {
+			return err
+		}
+		if err = tx.lockRow(table, rec, LOCK_EXCLUSIVE); err != nil {
+			return err
+		}
+		if tdef := getTableDefTX(tx.db, table, &tx.kv); tdef != nil && isReferenced(tdef) {
+			values, err := checkRecord(tdef, rec, tdef.PKeys)
+			if err != nil {
+				return err
+			}
+			if err = tx.lockReferences(tdef, values[:tdef.PKeys], map[string]bool{}); err != nil {
+				return err
+			}
+		}
+		rec := copyRecord(rec)
+		if ok, err = tx.db.Delete(table, copyRecord(rec), &tx.kv); err != nil {
+			return err
+		}
+		want := ok
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			got, err := tx.db.Delete(table, rec, writer)
+			return replayed(table, got, want, err)
+		})
+		return nil
+	})
+	return ok, err
+}
+
+// Get reads a row as seen by the transaction, without locking it.
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+	var ok bool
+	err := tx.exec(func() (err error) {
+		tx, table := tx.route(table)
+		ok, err = tx.db.Get(table, rec, &tx.kv.KVReader)
+		return err
+	})
+	return ok, err
+}
+
+// GetForUpdate reads a row and locks it exclusively until the
+// transaction ends, i.e. SELECT ... FOR UPDATE.
+func (tx *DBTX) GetForUpdate(table string, rec *Record) (bool, error) {
+	return tx.getLocked(table, rec, LOCK_EXCLUSIVE)
+}
+
+// GetForShare reads a row and keeps other transactions from changing
+// it until the transaction ends, i.e. SELECT ... FOR SHARE.
+func (tx *DBTX) GetForShare(table string, rec *Record) (bool, error) {
+	return tx.getLocked(table, rec, LOCK_SHARED)
 }
 
 func (tx *DBTX) Scan(table string, req *Scanner) error {
-	return tx.db.Scan(table, req, &tx.kv.Tree)
+	return tx.exec(func() error {
+		tx, table := tx.route(table)
+		return tx.db.Scan(table, req, &tx.kv.Tree)
+	})
 }
 
 func (kv *KV) Begin(tx *KVTX) {
 	tx.kv = kv
+	tx.scratch = false
+	tx.page.nappend = 0
 	tx.page.updates = map[uint64][]byte{}
+	tx.page.fresh = map[uint64]bool{}
+	tx.page.spare = nil
+	tx.tables = map[string]*TableDef{}
+	tx.onCommit = nil
 	tx.mmap.chunks = kv.mmap.chunks
 
 	kv.writer.Lock()
 	tx.version = kv.version
+	kv.mu.Lock()
+	tx.branch = kv.branch
+	tx.catalog = kv.catalog
+	tx.catalog.owned = false
 	// btree
-	tx.Tree.root = kv.tree.root
+	tx.Tree.root = kv.rootOf(kv.branch)
+	kv.mu.Unlock()
 	tx.Tree.get = tx.pageGet
 	tx.Tree.new = tx.pageNew
 	tx.Tree.del = tx.pageDel
+	tx.Tree.free = tx.treeRelease
 
 	// freelist
 	tx.free.FreeListData = kv.free
-	tx.free.version = kv.version
+	// the slices are shared with `kv.free`, appending must copy them
+	tx.free.items = kv.free.items[:len(kv.free.items):len(kv.free.items)]
+	tx.free.version = kv.version + 1
 	tx.free.get = tx.pageGet
 	tx.free.new = tx.pageAppend
 	tx.free.use = tx.pageUse
 
-	tx.free.minReader = kv.version
 	kv.mu.Lock()
+	tx.free.minReader = kv.minReader()
+	kv.mu.Unlock()
+}
 
-	if len(kv.readers) > 0 {
-		tx.free.minReader = kv.readers[0].version
-	}
+// the first page number of a scratch tree
+const SCRATCH_PAGE_MIN = 1 << 62
+
+// BeginScratch starts a transaction on a private copy of the latest
+// tree. It holds no writer lock and can't be committed; end it with
+// EndRead. The pages it reads are pinned like a reader's.
+func (kv *KV) BeginScratch(tx *KVTX) {
+	tx.kv = kv
+	tx.scratch = true
+	tx.page.nappend = 0
+	tx.page.updates = map[uint64][]byte{}
+	tx.tables = map[string]*TableDef{}
+	tx.onCommit = nil
+
+	kv.mu.Lock()
+	tx.branch = kv.branch
+	tx.catalog = kv.catalog
+	tx.catalog.owned = false
+	kv.beginReadLocked(&tx.KVReader, CommitInfo{Version: kv.version, Root: kv.rootOf(kv.branch)})
 	kv.mu.Unlock()
+	tx.Tree.get = tx.pageGet
+	tx.Tree.new = tx.pageScratch
+	tx.Tree.del = tx.pageScratchDel
+	tx.Tree.free = tx.scratchRelease
 }
 
 // end a transaction: commit updates
 func (kv *KV) Commit(tx *KVTX) error {
 	defer kv.writer.Unlock()
-	if kv.tree.root == tx.Tree.root {
-		return nil // no updates
+	if changed, err := kv.prepare(tx); !changed || err != nil {
+		return err
 	}
+	kv.publish(tx)
+	return kv.storeMaster()
+}
 
-	// phase 1: persist the page data to disk
+// phase 1: persist the page data to disk and compute the master page,
+// returns false if there is nothing to commit. the pages are discarded
+// on error. the caller holds `kv.writer`.
+func (kv *KV) prepare(tx *KVTX) (bool, error) {
+	if tx.branch != "" && kv.rootOf(tx.branch) != tx.Tree.root {
+		tx.catalog.own()
+		tx.catalog.branches[tx.branch] = tx.Tree.root
+	}
+	if kv.rootOf(tx.branch) == tx.Tree.root && !tx.catalog.dirty {
+		return false, nil // no updates
+	}
+
+	tx.catalogFlush()
+	releasePages(tx)
+	tx.free.Flush()
 	if err := writePages(tx); err != nil {
 		rollbackTX(tx)
-		return err
+		return false, err
 	}
 
 	// the page data must reach disk before master page.
 	// the `fsync` serves as a barrier here
 	if err := kv.fp.Sync(); err != nil {
 		rollbackTX(tx)
-		return fmt.Errorf("fsync: %w", err)
+		return false, fmt.Errorf("fsync: %w", err)
 	}
 
-	// transaction is visible
-	kv.page.flushed += uint64(tx.page.nappend)
+	kv.mu.Lock()
+	tx.master = kv.master()
+	kv.mu.Unlock()
+	tx.master.used += uint64(tx.page.nappend)
+	tx.master.free = tx.free.head
+	tx.master.catalog = tx.catalog.head
+	tx.master.version++
+	if tx.branch == "" && tx.master.root != tx.Tree.root {
+		tx.master.root = tx.Tree.root
+		kv.mu.Lock()
+		tx.master.history = kv.remember(CommitInfo{Version: tx.master.version, Root: tx.master.root, Time: time.Now()})
+		kv.mu.Unlock()
+	}
+	return true, nil
+}
+
+// make a prepared transaction visible
+func (kv *KV) publish(tx *KVTX) {
+	kv.page.flushed = tx.master.used
 	kv.free = tx.free.FreeListData
 	kv.mu.Lock()
-	kv.tree.root = tx.Tree.root
-	kv.version++
+	kv.catalog = tx.catalog
+	kv.version = tx.master.version
+	kv.tree.root = tx.master.root
+	kv.history = tx.master.history
 	kv.mu.Unlock()
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+}
 
-	// phase 2: update the master page to point to new tree
+// phase 2: update the master page to point to new tree
+func (kv *KV) storeMaster() error {
 	if err := masterStore(kv); err != nil {
 		return err
 	}
-
 	if err := kv.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
 	return nil
 }
 
+// whether `root` is the root of the latest committed tree
+func (kv *KV) isLatest(root uint64) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.rootOf(kv.branch) == root
+}
+
 // end a transaction: rollback
 func (kv *KV) Abort(tx *KVTX) {
 	kv.writer.Unlock()
@@ -170,10 +722,11 @@ func (tx *KVTX) Del(req *DeleteReq) bool {
 	return tx.Tree.DeleteEx(req)
 }
 
-// rollbackTX the tree & other in-memmory data structures
+// rollbackTX discards the pages of a failed commit,
+// the committed tree & free list are left untouched.
 func rollbackTX(tx *KVTX) {
-	tx.kv.tree.root = tx.Tree.root
-	tx.kv.free = tx.free.FreeListData
 	tx.page.nappend = 0
 	tx.page.updates = make(map[uint64][]byte)
+	tx.page.fresh = make(map[uint64]bool)
+	tx.page.spare = nil
 }
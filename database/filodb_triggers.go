@@ -0,0 +1,423 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrTriggerExists   = errors.New("trigger already exists")
+	ErrTriggerNotFound = errors.New("trigger not found")
+	ErrTriggerRejected = errors.New("rejected by trigger")
+	ErrTriggerTarget   = errors.New("table written by a trigger")
+)
+
+// when a trigger runs, and on which writes
+const (
+	TRIGGER_BEFORE = "BEFORE"
+	TRIGGER_AFTER  = "AFTER"
+	TRIGGER_INSERT = "INSERT"
+	TRIGGER_UPDATE = "UPDATE"
+	TRIGGER_DELETE = "DELETE"
+)
+
+// what a trigger does
+const (
+	ACTION_INSERT = "INSERT" // insert a row into a table
+	ACTION_UPSERT = "UPSERT" // insert or replace a row of a table
+	ACTION_REJECT = "REJECT" // fail the write with a message
+	ACTION_SET    = "SET"    // change columns of the row being written, BEFORE only
+)
+
+// the triggers writing to tables with triggers nest up to this depth
+const TRIGGER_MAX_DEPTH = 16
+
+// A trigger runs in the transaction of the write that fires it. Its
+// expressions read the row written by column name, and the rows before
+// and after the write as old.col and new.col.
+type Trigger struct {
+	Name   string
+	Timing string // TRIGGER_BEFORE or TRIGGER_AFTER
+	Event  string // TRIGGER_INSERT, TRIGGER_UPDATE or TRIGGER_DELETE
+	When   string // a condition on the rows, "" to run on every write
+	Action string
+	// ACTION_INSERT and ACTION_UPSERT: the table written
+	Table string
+	// the columns written to `Table`, or set by ACTION_SET, and their
+	// values
+	Cols  []string
+	Exprs []string
+	// ACTION_REJECT
+	Message string
+}
+
+// TriggerCreate adds a trigger to a table.
+func (db *DB) TriggerCreate(table string, trig Trigger, kvtx *KVTX) error {
+	current := getTableDefTX(db, table, kvtx)
+	if current == nil || strings.HasPrefix(table, "@") {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	for _, other := range current.Triggers {
+		if other.Name == trig.Name {
+			return fmt.Errorf("%w: %s on %s", ErrTriggerExists, trig.Name, current.Name)
+		}
+	}
+	if err := checkTrigger(db, current, &trig, kvtx); err != nil {
+		return fmt.Errorf("trigger %s: %w", trig.Name, err)
+	}
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	tdef.Triggers = append(tdef.Triggers, trig)
+	return tableDefUpdate(db, tdef, kvtx)
+}
+
+// TriggerDrop removes a trigger of a table.
+func (db *DB) TriggerDrop(table, name string, kvtx *KVTX) error {
+	current := getTableDefTX(db, table, kvtx)
+	if current == nil || strings.HasPrefix(table, "@") {
+		return fmt.Errorf("table not found: %s", table)
+	}
+	for i, trig := range current.Triggers {
+		if trig.Name != name {
+			continue
+		}
+		tdef, err := copyTableDef(current)
+		if err != nil {
+			return err
+		}
+		tdef.Triggers = append(tdef.Triggers[:i], tdef.Triggers[i+1:]...)
+		if len(tdef.Triggers) == 0 {
+			tdef.Triggers = nil
+		}
+		return tableDefUpdate(db, tdef, kvtx)
+	}
+	return fmt.Errorf("%w: %s on %s", ErrTriggerNotFound, name, current.Name)
+}
+
+// normalize a trigger and check it against its table and the table it
+// writes to
+func checkTrigger(db *DB, tdef *TableDef, trig *Trigger, kvtx *KVTX) error {
+	if !isValidTableName(trig.Name) {
+		return fmt.Errorf("invalid trigger name: %q", trig.Name)
+	}
+	trig.Timing = strings.ToUpper(trig.Timing)
+	trig.Event = strings.ToUpper(trig.Event)
+	trig.Action = strings.ToUpper(trig.Action)
+	if trig.Timing != TRIGGER_BEFORE && trig.Timing != TRIGGER_AFTER {
+		return fmt.Errorf("expected BEFORE or AFTER, got %q", trig.Timing)
+	}
+	switch trig.Event {
+	case TRIGGER_INSERT, TRIGGER_UPDATE, TRIGGER_DELETE:
+	default:
+		return fmt.Errorf("expected INSERT, UPDATE or DELETE, got %q", trig.Event)
+	}
+	if len(trig.Cols) != len(trig.Exprs) {
+		return errors.New("length of columns & values do not match")
+	}
+	exprs := append([]string(nil), trig.Exprs...)
+	if trig.When != "" {
+		exprs = append(exprs, trig.When)
+	}
+	for _, src := range exprs {
+		e, err := parseExpr(src)
+		if err != nil {
+			return err
+		}
+		for _, col := range e.columns() {
+			if err := checkTriggerColumn(tdef, trig.Event, col); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch trig.Action {
+	case ACTION_INSERT, ACTION_UPSERT:
+		target := getTableDefTX(db, trig.Table, kvtx)
+		if target == nil || strings.HasPrefix(trig.Table, "@") {
+			return fmt.Errorf("table not found: %s", trig.Table)
+		}
+		if err := checkTriggerCols(target, trig.Cols); err != nil {
+			return err
+		}
+		trig.Table = target.Name // not an alias
+	case ACTION_REJECT:
+		if len(trig.Cols) > 0 {
+			return errors.New("REJECT sets no columns")
+		}
+	case ACTION_SET:
+		if trig.Timing != TRIGGER_BEFORE || trig.Event == TRIGGER_DELETE {
+			return errors.New("SET runs BEFORE an INSERT or an UPDATE")
+		}
+		if len(trig.Cols) == 0 {
+			return errors.New("SET without columns")
+		}
+		if err := checkTriggerCols(tdef, trig.Cols); err != nil {
+			return err
+		}
+		for _, col := range trig.Cols {
+			if ColIndex(tdef, col) < tdef.PKeys {
+				return fmt.Errorf("SET of the primary key column %s", col)
+			}
+		}
+	default:
+		return fmt.Errorf("expected INSERT, UPSERT, REJECT or SET, got %q", trig.Action)
+	}
+	return nil
+}
+
+// a column read by a trigger, the old row is absent on INSERT and the
+// new one on DELETE
+func checkTriggerColumn(tdef *TableDef, event, name string) error {
+	row, col, ok := strings.Cut(name, ".")
+	if !ok {
+		row, col = "", name
+	}
+	switch {
+	case row == "old" && event == TRIGGER_INSERT:
+		return fmt.Errorf("%s: no old row on INSERT", name)
+	case row == "new" && event == TRIGGER_DELETE:
+		return fmt.Errorf("%s: no new row on DELETE", name)
+	case row != "" && row != "old" && row != "new":
+		return fmt.Errorf("unknown column %s", name)
+	}
+	if ColIndex(tdef, col) < 0 {
+		return fmt.Errorf("unknown column %s", name)
+	}
+	return nil
+}
+
+func checkTriggerCols(tdef *TableDef, cols []string) error {
+	for i, col := range cols {
+		if ColIndex(tdef, col) < 0 {
+			return fmt.Errorf("unknown column %s in %s", col, tdef.Name)
+		}
+		if contains(cols[:i], col) {
+			return fmt.Errorf("duplicate column %s", col)
+		}
+	}
+	return nil
+}
+
+// the columns of a table read by its triggers, or set by them
+func triggerColumns(trig Trigger) []string {
+	var cols []string
+	if trig.Action == ACTION_SET {
+		cols = append(cols, trig.Cols...)
+	}
+	for _, src := range append([]string{trig.When}, trig.Exprs...) {
+		if e, err := parseExpr(src); err == nil {
+			for _, name := range e.columns() {
+				_, col, ok := strings.Cut(name, ".")
+				if !ok {
+					col = name
+				}
+				cols = append(cols, col)
+			}
+		}
+	}
+	return cols
+}
+
+// the write a row is about to be, and the row it replaces. "" for a write
+// that fails anyway, i.e. the insert of a row that exists or the update
+// of one that doesn't.
+func triggerEvent(tdef *TableDef, values []Value, mode int, kvtx *KVTX) (string, []Value) {
+	old, exists := currentRow(tdef, values, kvtx)
+	switch {
+	case exists && mode != MODE_INSERT_ONLY:
+		return TRIGGER_UPDATE, old
+	case !exists && mode != MODE_UPDATE_ONLY:
+		return TRIGGER_INSERT, nil
+	}
+	return "", nil
+}
+
+// the stored row with the primary key of `values`
+func currentRow(tdef *TableDef, values []Value, kvtx *KVTX) ([]Value, bool) {
+	val, exists, err := kvtx.Get(encodeKey(nil, tdef.Prefix, values[:tdef.PKeys]))
+	if err != nil || !exists {
+		return nil, false
+	}
+	row := make([]Value, len(tdef.Cols))
+	copy(row, values[:tdef.PKeys])
+	for i := tdef.PKeys; i < len(row); i++ {
+		row[i] = Value{Type: tdef.Types[i]}
+	}
+	decodeRow(tdef, val, row[tdef.PKeys:])
+	return row, true
+}
+
+// run the triggers of a write, `old` is nil on INSERT and `new` on DELETE.
+// returns the row to write, changed by the BEFORE triggers with SET.
+func fireTriggers(db *DB, tdef *TableDef, timing, event string, old, new []Value, kvtx *KVTX) ([]Value, error) {
+	for _, trig := range tdef.Triggers {
+		if trig.Timing != timing || trig.Event != event {
+			continue
+		}
+		env := triggerEnv(tdef, old, new)
+		if trig.When != "" {
+			pe := tdef.parsed(trig.When)
+			if pe.err != nil {
+				return nil, pe.err
+			}
+			v, err := evalBool(env, pe.e)
+			if err != nil {
+				return nil, fmt.Errorf("trigger %s: %w", trig.Name, err)
+			}
+			if v.Null || !v.Bool {
+				continue
+			}
+		}
+		vals := make([]Value, len(trig.Exprs))
+		for i, src := range trig.Exprs {
+			pe := tdef.parsed(src)
+			err := pe.err
+			if err == nil {
+				vals[i], err = pe.e.eval(env)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("trigger %s: %w", trig.Name, err)
+			}
+		}
+
+		switch trig.Action {
+		case ACTION_REJECT:
+			return nil, fmt.Errorf("%w %s: %s", ErrTriggerRejected, trig.Name, trig.Message)
+		case ACTION_SET:
+			new = append([]Value(nil), new...)
+			for i, col := range trig.Cols {
+				j := ColIndex(tdef, col)
+				v, err := convertValue(vals[i], tdef.Types[j])
+				if err != nil {
+					return nil, fmt.Errorf("trigger %s: %s: %w", trig.Name, col, err)
+				}
+				new[j] = v
+			}
+		case ACTION_INSERT, ACTION_UPSERT:
+			if err := triggerWrite(db, trig, vals, kvtx); err != nil {
+				return nil, fmt.Errorf("trigger %s: %w", trig.Name, err)
+			}
+		}
+	}
+	return new, nil
+}
+
+// the columns of the row written, and the rows as old.col and new.col
+func triggerEnv(tdef *TableDef, old, new []Value) *exprEnv {
+	row := Record{}
+	for i, col := range tdef.Cols {
+		switch {
+		case new != nil:
+			row.Cols = append(row.Cols, col)
+			row.Vals = append(row.Vals, new[i])
+		case old != nil:
+			row.Cols = append(row.Cols, col)
+			row.Vals = append(row.Vals, old[i])
+		}
+		if new != nil {
+			row.Cols = append(row.Cols, "new."+col)
+			row.Vals = append(row.Vals, new[i])
+		}
+		if old != nil {
+			row.Cols = append(row.Cols, "old."+col)
+			row.Vals = append(row.Vals, old[i])
+		}
+	}
+	return &exprEnv{row: row}
+}
+
+// the row of ACTION_INSERT or ACTION_UPSERT, checked like any other write
+func triggerWrite(db *DB, trig Trigger, vals []Value, kvtx *KVTX) error {
+	if kvtx.triggers >= TRIGGER_MAX_DEPTH {
+		return errors.New("triggers nested too deep")
+	}
+	target := getTableDefTX(db, trig.Table, kvtx)
+	if target == nil {
+		return fmt.Errorf("table not found: %s", trig.Table)
+	}
+	rec := Record{}
+	for i, col := range trig.Cols {
+		v, err := convertValue(vals[i], target.Types[ColIndex(target, col)])
+		if err != nil {
+			return fmt.Errorf("%s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	mode := MODE_INSERT_ONLY
+	if trig.Action == ACTION_UPSERT {
+		mode = MODE_UPSERT
+	}
+	if kvtx.lock != nil {
+		// in a transaction, the row is locked like the rows it writes
+		// itself, once the defaults give its primary key
+		var err error
+		if rec, err = applyDefaults(db, target, rec, kvtx); err != nil {
+			return err
+		}
+		if err = kvtx.lock(target, rec); err != nil {
+			return err
+		}
+	}
+	kvtx.triggers++
+	defer func() { kvtx.triggers-- }()
+	_, err := dbUpdate(db, target, rec, mode, kvtx)
+	return err
+}
+
+// the triggers of other tables writing to a table, as "trigger on table"
+func triggersWriting(db *DB, name string, kvtx *KVTX) ([]string, error) {
+	names, err := db.TableNames(&kvtx.Tree)
+	if err != nil {
+		return nil, err
+	}
+	var writers []string
+	for _, table := range names {
+		tdef := getTableDefTX(db, table, kvtx)
+		if tdef == nil || table == name || strings.HasPrefix(table, "@") {
+			continue
+		}
+		for _, trig := range tdef.Triggers {
+			if trig.Table == name && (trig.Action == ACTION_INSERT || trig.Action == ACTION_UPSERT) {
+				writers = append(writers, trig.Name+" on "+table)
+			}
+		}
+	}
+	return writers, nil
+}
+
+// point the triggers writing to a renamed table at its new name
+func renameInTriggers(db *DB, name, newName string, kvtx *KVTX) error {
+	names, err := db.TableNames(&kvtx.Tree)
+	if err != nil {
+		return err
+	}
+	for _, table := range names {
+		tdef := getTableDefTX(db, table, kvtx)
+		if tdef == nil || strings.HasPrefix(table, "@") {
+			continue
+		}
+		var updated *TableDef
+		for i, trig := range tdef.Triggers {
+			if trig.Table != name || (trig.Action != ACTION_INSERT && trig.Action != ACTION_UPSERT) {
+				continue
+			}
+			if updated == nil {
+				var err error
+				if updated, err = copyTableDef(tdef); err != nil {
+					return err
+				}
+			}
+			updated.Triggers[i].Table = newName
+		}
+		if updated != nil {
+			if err := tableDefUpdate(db, updated, kvtx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// the rows of a table with a TTL expire once the DATETIME column `Col`,
+// plus `Seconds`, is in the past. a fixed TTL counts from a column set
+// when the row is written, e.g. with the default now(). a NULL never
+// expires.
+type TTL struct {
+	Col     string
+	Seconds int64
+}
+
+// how often the expired rows are purged
+var expiryInterval time.Duration = time.Minute
+
+// the expired rows are invisible right away, and deleted by the purge
+func rowExpired(tdef *TableDef, values []Value, now time.Time) bool {
+	if tdef.TTL == nil {
+		return false
+	}
+	i := ColIndex(tdef, tdef.TTL.Col)
+	if i < 0 || i >= len(values) {
+		return false
+	}
+	return tdef.TTL.passed(values[i], now)
+}
+
+// rowExpired for a record of some of the columns, the TTL one among them
+func recordExpired(tdef *TableDef, rec *Record, now time.Time) bool {
+	if tdef.TTL == nil {
+		return false
+	}
+	v := rec.Get(tdef.TTL.Col)
+	return v != nil && tdef.TTL.passed(*v, now)
+}
+
+// whether the lifetime of a row from the time `v` is over
+func (ttl *TTL) passed(v Value, now time.Time) bool {
+	return !v.Null && !v.Time.Add(time.Duration(ttl.Seconds)*time.Second).After(now)
+}
+
+// drop the expired rows from the rows read
+func unexpired(tdef *TableDef, rows []*Record) []*Record {
+	if tdef.TTL == nil {
+		return rows
+	}
+	now := time.Now()
+	out := rows[:0]
+	for _, row := range rows {
+		if !rowExpired(tdef, row.Vals, now) {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+func checkTTL(tdef *TableDef) error {
+	if tdef.TTL == nil {
+		return nil
+	}
+	i := ColIndex(tdef, tdef.TTL.Col)
+	if i < 0 {
+		return fmt.Errorf("TTL: unknown column %s", tdef.TTL.Col)
+	}
+	if tdef.Types[i] != TYPE_DATETIME {
+		return fmt.Errorf("TTL: %s is not a DATETIME column", tdef.TTL.Col)
+	}
+	if tdef.TTL.Seconds < 0 {
+		return fmt.Errorf("TTL: negative duration %ds", tdef.TTL.Seconds)
+	}
+	return nil
+}
+
+// ParseTTL parses `col` or `col+duration`, e.g. created_at+24h.
+func ParseTTL(input string) (*TTL, error) {
+	col, after, found := strings.Cut(input, "+")
+	ttl := &TTL{Col: strings.TrimSpace(col)}
+	if found {
+		d, err := time.ParseDuration(strings.TrimSpace(after))
+		if err != nil {
+			return nil, fmt.Errorf("TTL: %w", err)
+		}
+		ttl.Seconds = int64(d / time.Second)
+	}
+	return ttl, nil
+}
+
+func (ttl *TTL) String() string {
+	if ttl.Seconds == 0 {
+		return ttl.Col
+	}
+	return fmt.Sprintf("%s+%v", ttl.Col, time.Duration(ttl.Seconds)*time.Second)
+}
+
+// TableSetTTL sets the TTL of a table, nil to keep its rows.
+func (db *DB) TableSetTTL(name string, ttl *TTL, kvtx *KVTX) error {
+	current := getTableDefTX(db, name, kvtx)
+	if current == nil || strings.HasPrefix(name, "@") {
+		return fmt.Errorf("table not found: %s", name)
+	}
+	tdef, err := copyTableDef(current)
+	if err != nil {
+		return err
+	}
+	tdef.TTL = ttl
+	if err := checkTTL(tdef); err != nil {
+		return err
+	}
+	return tableDefUpdate(db, tdef, kvtx)
+}
+
+// a write to the key of an expired row writes to a free key, the row is
+// deleted first. the rows referencing it keep referencing the key.
+func dropExpired(db *DB, tdef *TableDef, values []Value, kvtx *KVTX) error {
+	old, exists := currentRow(tdef, values, kvtx)
+	if !exists || !rowExpired(tdef, old, time.Now()) {
+		return nil
+	}
+	_, err := dbRemove(db, tdef, old, kvtx)
+	return err
+}
+
+// start the background goroutine that submits the purge to the pool
+func (db *DB) startExpiry() {
+	db.expiry = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a pass still running skips this one
+				if !db.purging.CompareAndSwap(false, true) {
+					continue
+				}
+				db.pool.Submit(func() {
+					defer db.purging.Store(false)
+					if _, err := db.PurgeExpired(); err != nil {
+						log.Printf("purge: %v", err)
+					}
+				})
+			}
+		}
+	}(db.expiry)
+}
+
+func (db *DB) stopExpiry() {
+	if db.expiry != nil {
+		close(db.expiry)
+		db.expiry = nil
+	}
+}
+
+// PurgeExpired deletes the expired rows of every table with a TTL,
+// returns the number of rows deleted.
+func (db *DB) PurgeExpired() (int, error) {
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	names, err := db.TableNames(&reader.Tree)
+	var tables []string
+	for _, name := range names {
+		if tdef := GetTableDef(db, name, &reader.Tree); tdef != nil && tdef.TTL != nil {
+			tables = append(tables, name)
+		}
+	}
+	db.kv.EndRead(&reader)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, name := range tables {
+		n, err := db.purgeTable(name)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return total, nil
+}
+
+// the expired rows of a snapshot are deleted a batch per write
+// transaction, each row read again as it is now: it may have been
+// written since.
+func (db *DB) purgeTable(name string) (int, error) {
+	var reader KVReader
+	db.kv.BeginRead(&reader)
+	defer db.kv.EndRead(&reader)
+	tdef := GetTableDef(db, name, &reader.Tree)
+	if tdef == nil || tdef.TTL == nil {
+		return 0, nil
+	}
+
+	total := 0
+	values := make([]Value, len(tdef.Cols))
+	start, end := prefixRange(tdef.Prefix)
+	iter := reader.Tree.Seek(start, CMP_GE)
+	for {
+		now := time.Now()
+		var keys [][]byte
+		done := true
+		for ; iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			if bytes.Compare(key, end) >= 0 {
+				break
+			}
+			if len(keys) == MIGRATE_BATCH {
+				done = false
+				break
+			}
+			for i := range values {
+				values[i] = Value{Type: tdef.Types[i]}
+			}
+			decodeValues(key[4:], values[:tdef.PKeys])
+			decodeRow(tdef, val, values[tdef.PKeys:])
+			if rowExpired(tdef, values, now) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+		}
+		if len(keys) > 0 {
+			var tx DBTX
+			db.Begin(&tx)
+			n, err := tx.purgeBatch(name, keys, now)
+			if err != nil {
+				db.Abort(&tx)
+				return total, err
+			}
+			if err := db.Commit(&tx); err != nil {
+				return total, err
+			}
+			total += n
+		}
+		if done {
+			return total, nil
+		}
+	}
+}
+
+// purgeBatch in a transaction, the rows and the rows the deletes reach
+// are locked like for `DBTX.Delete`, a row in use is waited for
+func (tx *DBTX) purgeBatch(name string, keys [][]byte, now time.Time) (int, error) {
+	var n int
+	err := tx.exec(func() (err error) {
+		tdef := getTableDefTX(tx.db, name, &tx.kv)
+		if tdef == nil {
+			return nil // dropped
+		}
+		for _, key := range keys {
+			pk := make([]Value, tdef.PKeys)
+			for i := range pk {
+				pk[i] = Value{Type: tdef.Types[i]}
+			}
+			decodeValues(key[4:], pk)
+			if err := tx.lockKey(tdef, pk, LOCK_EXCLUSIVE); err != nil {
+				return err
+			}
+			if isReferenced(tdef) {
+				if err := tx.lockReferences(tdef, pk, map[string]bool{}); err != nil {
+					return err
+				}
+			}
+		}
+		if n, err = purgeBatch(tx.db, name, keys, now, &tx.kv); err != nil {
+			return err
+		}
+		tx.log = append(tx.log, func(writer *KVTX) error {
+			_, err := purgeBatch(tx.db, name, keys, now, writer)
+			return err
+		})
+		return nil
+	})
+	return n, err
+}
+
+// delete the rows with the keys `keys` that are still expired, along
+// with their index entries and the rows referencing them
+func purgeBatch(db *DB, name string, keys [][]byte, now time.Time, kvtx *KVTX) (int, error) {
+	tdef := getTableDefTX(db, name, kvtx)
+	if tdef == nil {
+		return 0, nil // dropped
+	}
+	n := 0
+	pk := make([]Value, tdef.PKeys)
+	for _, key := range keys {
+		for i := range pk {
+			pk[i] = Value{Type: tdef.Types[i]}
+		}
+		decodeValues(key[4:], pk)
+		row, exists := currentRow(tdef, pk, kvtx)
+		if !exists || !rowExpired(tdef, row, now) {
+			continue
+		}
+		if isReferenced(tdef) {
+			if err := deleteReferences(db, tdef, pk, kvtx); err != nil {
+				return n, err
+			}
+		}
+		if _, err := dbRemove(db, tdef, row, kvtx); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
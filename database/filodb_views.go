@@ -0,0 +1,328 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrViewExists   = errors.New("view already exists")
+	ErrViewNotFound = errors.New("view not found")
+)
+
+// the views are in @meta, keyed `view:<name>`, holding the JSON of the
+// query. they hold no rows, the query runs each time the view is read.
+const VIEW_KEY = "view:"
+
+// views on views are expanded up to this depth, which also stops a cycle
+// made by dropping and creating views again
+const VIEW_MAX_DEPTH = 16
+
+// SELECT <cols> FROM <table or view> [WHERE <expr>]
+type ViewDef struct {
+	Name  string
+	Table string
+	Cols  []string // nil for every column
+	Where string   // "" for every row
+}
+
+var viewQueryRe = regexp.MustCompile(`(?is)^\s*SELECT\s+(.+?)\s+FROM\s+([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)?)\s*(?:WHERE\s+(.+?))?\s*;?\s*$`)
+
+// parse the query of CREATE VIEW
+func parseViewQuery(name, query string) (*ViewDef, error) {
+	m := viewQueryRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("invalid view query, expected SELECT <cols> FROM <table> [WHERE <expr>]: %s", query)
+	}
+	view := &ViewDef{Name: name, Table: m[2], Where: strings.TrimSpace(m[3])}
+	if cols := strings.TrimSpace(m[1]); cols != "*" {
+		for _, col := range strings.Split(cols, ",") {
+			view.Cols = append(view.Cols, strings.TrimSpace(col))
+		}
+	}
+	return view, nil
+}
+
+// Query is the view as the text it's created from.
+func (view *ViewDef) Query() string {
+	cols := "*"
+	if view.Cols != nil {
+		cols = strings.Join(view.Cols, ", ")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", cols, view.Table)
+	if view.Where != "" {
+		query += " WHERE " + view.Where
+	}
+	return query
+}
+
+func viewRecord(name string) *Record {
+	return (&Record{}).AddStr("key", []byte(VIEW_KEY+name))
+}
+
+// the view named `name`, nil if there's none
+func getView(db *DB, name string, tree *BTree) *ViewDef {
+	rec := viewRecord(name)
+	if ok, err := dbGet(db, TDEF_META, rec, tree); err != nil || !ok {
+		return nil
+	}
+	view := &ViewDef{}
+	if err := json.Unmarshal(rec.Get("val").Str, view); err != nil {
+		return nil
+	}
+	return view
+}
+
+// the columns of a view, as a definition without rows
+func viewTableDef(db *DB, view *ViewDef, tree *BTree, depth int) (*TableDef, error) {
+	if depth > VIEW_MAX_DEPTH {
+		return nil, fmt.Errorf("view %s: views nested too deep", view.Name)
+	}
+	base, err := queryTableDef(db, view.Table, tree, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", view.Name, err)
+	}
+	if view.Where != "" {
+		e, err := parseExpr(view.Where)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", view.Name, err)
+		}
+		for _, col := range e.columns() {
+			if ColIndex(base, col) < 0 {
+				return nil, fmt.Errorf("view %s: unknown column %s", view.Name, col)
+			}
+		}
+	}
+	cols := view.Cols
+	if cols == nil {
+		cols = base.Cols
+	}
+	tdef := &TableDef{Name: view.Name}
+	for _, col := range cols {
+		i := ColIndex(base, col)
+		if i < 0 {
+			return nil, fmt.Errorf("view %s: unknown column %s", view.Name, col)
+		}
+		if ColIndex(tdef, col) >= 0 {
+			return nil, fmt.Errorf("view %s: duplicate column %s", view.Name, col)
+		}
+		tdef.Cols = append(tdef.Cols, col)
+		tdef.Types = append(tdef.Types, base.Types[i])
+		tdef.NotNull = append(tdef.NotNull, !isNullable(base, i))
+	}
+	return tdef, nil
+}
+
+// the definition of a table, or the columns of a view
+func queryTableDef(db *DB, name string, tree *BTree, depth int) (*TableDef, error) {
+	if tdef := GetTableDef(db, name, tree); tdef != nil {
+		return tdef, nil
+	}
+	if view := getView(db, name, tree); view != nil {
+		return viewTableDef(db, view, tree, depth)
+	}
+	return nil, fmt.Errorf("table not found: %s", name)
+}
+
+// QueryDef returns the definition of a table, or the columns of a view.
+func (db *DB) QueryDef(name string, tree *BTree) (*TableDef, error) {
+	return queryTableDef(db, name, tree, 0)
+}
+
+// QueryRows returns the rows of a table, or runs the query of a view.
+func (db *DB) QueryRows(name string, reader *KVReader) ([]*Record, error) {
+	return queryRows(db, name, reader, 0)
+}
+
+func queryRows(db *DB, name string, reader *KVReader, depth int) ([]*Record, error) {
+	if tdef := GetTableDef(db, name, &reader.Tree); tdef != nil {
+		return fullTableScan(db, name, tdef, reader)
+	}
+	view := getView(db, name, &reader.Tree)
+	if view == nil {
+		return nil, fmt.Errorf("table not found: %s", name)
+	}
+	tdef, err := viewTableDef(db, view, &reader.Tree, depth)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := queryRows(db, view.Table, reader, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var where *expr
+	if view.Where != "" {
+		if where, err = parseExpr(view.Where); err != nil {
+			return nil, err
+		}
+	}
+	out := rows[:0]
+	for _, row := range rows {
+		if where != nil {
+			v, err := evalBool(&exprEnv{row: *row}, where)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", view.Name, err)
+			}
+			if v.Null || !v.Bool {
+				continue
+			}
+		}
+		if view.Cols != nil {
+			projected := &Record{Cols: tdef.Cols}
+			for _, col := range view.Cols {
+				projected.Vals = append(projected.Vals, *row.Get(col))
+			}
+			row = projected
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+// ViewCreate stores a view, its query is checked against the tables it
+// reads.
+func (db *DB) ViewCreate(name, query string, kvtx *KVTX) error {
+	if schema, _ := splitSchema(name); schema == "" && !isValidTableName(name) {
+		return fmt.Errorf("invalid view name: %q", name)
+	}
+	if err := checkSchemaName(db, name, &kvtx.Tree); err != nil {
+		return err
+	}
+	if getView(db, name, &kvtx.Tree) != nil {
+		return fmt.Errorf("%w: %s", ErrViewExists, name)
+	}
+	if getTableDefTX(db, name, kvtx) != nil {
+		return fmt.Errorf("%w: %s", ErrTableAlreadyExists, name)
+	}
+	view, err := parseViewQuery(name, query)
+	if err != nil {
+		return err
+	}
+	if _, err := viewTableDef(db, view, &kvtx.Tree, 0); err != nil {
+		return err
+	}
+	return viewStore(db, view, kvtx)
+}
+
+func viewStore(db *DB, view *ViewDef, kvtx *KVTX) error {
+	val, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	rec := viewRecord(view.Name).AddStr("val", val)
+	_, err = dbUpdate(db, TDEF_META, *rec, MODE_UPSERT, kvtx)
+	return err
+}
+
+// ViewDrop removes a view, the views reading it fail from then on.
+func (db *DB) ViewDrop(name string, kvtx *KVTX) error {
+	if getView(db, name, &kvtx.Tree) == nil {
+		return fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	_, err := dbDelete(db, TDEF_META, *viewRecord(name), kvtx)
+	return err
+}
+
+// Views returns every view.
+func (db *DB) Views(tree *BTree) ([]*ViewDef, error) {
+	start := (&Record{}).AddStr("key", []byte(VIEW_KEY))
+	end := (&Record{}).AddStr("key", []byte("view;")) // after every `view:` key
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LT, Key1: *start, Key2: *end}
+	if err := dbScan(db, TDEF_META, &sc, tree); err != nil {
+		return nil, err
+	}
+	var views []*ViewDef
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec, tree)
+		view := &ViewDef{}
+		if err := json.Unmarshal(rec.Get("val").Str, view); err != nil {
+			return nil, fmt.Errorf("view %s: %w", rec.Get("key").Str, err)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// point the views reading a renamed table, or view, at its new name
+func renameInViews(db *DB, name, newName string, kvtx *KVTX) error {
+	views, err := db.Views(&kvtx.Tree)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		if view.Table == name {
+			view.Table = newName
+			if err := viewStore(db, view, kvtx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// QueryView runs the query of a view and keeps the rows a GET asks for.
+// a view has no index, the rows are filtered in memory.
+func (db *DB) QueryView(name string, queryType QueryType, start, end *Record, reader *KVReader) ([]*Record, error) {
+	rows, err := db.QueryRows(name, reader)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Record
+	for _, row := range rows {
+		ok, err := viewRowMatches(row, queryType, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, row)
+		}
+	}
+	return out, nil
+}
+
+func viewRowMatches(row *Record, queryType QueryType, start, end *Record) (bool, error) {
+	switch queryType {
+	case SingleRecord:
+		// every column given
+		for i, col := range start.Cols {
+			if !compareValues(*row.Get(col), start.Vals[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case TableScan:
+		// any of the values given
+		for i, col := range start.Cols {
+			if compareValues(*row.Get(col), start.Vals[i]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	lo, err := compareTuple(row, start)
+	if err != nil || lo < 0 {
+		return false, err
+	}
+	hi, err := compareTuple(row, end)
+	return hi <= 0, err
+}
+
+// compare the columns of `key` in a row, in order, like an index does
+func compareTuple(row, key *Record) (int, error) {
+	for i, col := range key.Cols {
+		v := *row.Get(col)
+		if v.Null {
+			return -1, nil // NULL sorts first, out of every range
+		}
+		c, err := exprCompare(v, key.Vals[i])
+		if c != 0 || err != nil {
+			return c, err
+		}
+	}
+	return 0, nil
+}
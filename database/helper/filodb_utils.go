@@ -7,10 +7,70 @@ import (
 )
 
 type TableInput struct {
-	Name    string
-	Types   []uint32
-	Cols    []string
-	Indexes [][]string
+	Name          string
+	Types         []uint32
+	Cols          []string
+	PrimaryKey    []string
+	AutoIncrement bool
+	NotNull       []string
+	Defaults      map[string]string
+	Checks        []string
+	Indexes       [][]string
+	Unique        [][]string
+	Foreign       []ForeignKeyInput
+	TTL           string
+}
+
+type ForeignKeyInput struct {
+	Cols     []string
+	Table    string
+	OnDelete string
+}
+
+// parse `col1+col2->table [ON DELETE CASCADE|RESTRICT|SET NULL]`
+func parseForeignKey(input string) (ForeignKeyInput, error) {
+	cols, rest, ok := strings.Cut(input, "->")
+	if !ok {
+		return ForeignKeyInput{}, fmt.Errorf("missing '->' in foreign key: %s", input)
+	}
+	fk := ForeignKeyInput{}
+	for _, col := range strings.Split(cols, "+") {
+		fk.Cols = append(fk.Cols, strings.TrimSpace(col))
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return ForeignKeyInput{}, fmt.Errorf("missing table in foreign key: %s", input)
+	}
+	fk.Table = fields[0]
+	if len(fields) > 1 {
+		if len(fields) < 3 || !strings.EqualFold(fields[1], "ON") || !strings.EqualFold(fields[2], "DELETE") {
+			return ForeignKeyInput{}, fmt.Errorf("expected ON DELETE in foreign key: %s", input)
+		}
+		fk.OnDelete = strings.ToUpper(strings.Join(fields[3:], " "))
+	}
+	return fk, nil
+}
+
+// split `;` separated expressions, dropping the empty ones
+func splitExprs(input string) []string {
+	var out []string
+	for _, e := range strings.Split(input, ";") {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// ParseAssignments parses `col=expression; ...`, keeping the order
+func ParseAssignments(input string) ([]string, []string) {
+	var cols, exprs []string
+	for _, def := range splitExprs(input) {
+		col, expr, _ := strings.Cut(def, "=")
+		cols = append(cols, strings.TrimSpace(col))
+		exprs = append(exprs, strings.TrimSpace(expr))
+	}
+	return cols, exprs
 }
 
 func GetTableInput(scanner *bufio.Reader) TableInput {
@@ -32,6 +92,43 @@ func GetTableInput(scanner *bufio.Reader) TableInput {
 		types[i] = typeValue
 	}
 
+	fmt.Print("Enter primary key column(s) (comma-separated, leave empty for the first column): ")
+	pkInput, _ := scanner.ReadString('\n')
+	pkInput = strings.TrimSpace(pkInput)
+	var pk []string
+	if pkInput != "" {
+		for _, col := range strings.Split(pkInput, ",") {
+			pk = append(pk, strings.TrimSpace(col))
+		}
+	}
+
+	fmt.Print("AUTO_INCREMENT primary key? (y/N): ")
+	autoInput, _ := scanner.ReadString('\n')
+	autoInput = strings.ToLower(strings.TrimSpace(autoInput))
+	autoIncrement := autoInput == "y" || autoInput == "yes"
+
+	fmt.Print("Enter NOT NULL column(s) (comma-separated, leave empty for none): ")
+	notNullInput, _ := scanner.ReadString('\n')
+	notNullInput = strings.TrimSpace(notNullInput)
+	var notNull []string
+	if notNullInput != "" {
+		for _, col := range strings.Split(notNullInput, ",") {
+			notNull = append(notNull, strings.TrimSpace(col))
+		}
+	}
+
+	fmt.Print("Enter defaults (format: col=expression; ... or leave empty): ")
+	defaultsInput, _ := scanner.ReadString('\n')
+	defaults := map[string]string{}
+	for _, def := range splitExprs(defaultsInput) {
+		col, expr, _ := strings.Cut(def, "=")
+		defaults[strings.TrimSpace(col)] = strings.TrimSpace(expr)
+	}
+
+	fmt.Print("Enter CHECK constraints (format: price >= 0; ... or leave empty): ")
+	checksInput, _ := scanner.ReadString('\n')
+	checks := splitExprs(checksInput)
+
 	fmt.Print("Enter indexes (format: col1+col2,col3, ... or leave empty): ")
 	indexInput, _ := scanner.ReadString('\n')
 	indexInput = strings.TrimSpace(indexInput)
@@ -43,11 +140,44 @@ func GetTableInput(scanner *bufio.Reader) TableInput {
 			indexes = append(indexes, strings.Split(indexCols, "+"))
 		}
 	}
+	fmt.Print("Enter UNIQUE indexes (format: col1+col2,col3, ... or leave empty): ")
+	uniqueInput, _ := scanner.ReadString('\n')
+	uniqueInput = strings.TrimSpace(uniqueInput)
+
+	unique := [][]string{}
+	if uniqueInput != "" {
+		for _, indexCols := range strings.Split(uniqueInput, ",") {
+			unique = append(unique, strings.Split(indexCols, "+"))
+		}
+	}
+
+	fmt.Print("Enter foreign keys (format: col1+col2->table [ON DELETE CASCADE|RESTRICT|SET NULL]; ... or leave empty): ")
+	foreignInput, _ := scanner.ReadString('\n')
+	var foreign []ForeignKeyInput
+	for _, input := range splitExprs(foreignInput) {
+		fk, err := parseForeignKey(input)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		foreign = append(foreign, fk)
+	}
+
+	fmt.Print("Enter TTL (format: col or col+duration, e.g. created_at+24h, or leave empty): ")
+	ttl, _ := scanner.ReadString('\n')
 	tdef := TableInput{
-		Name:    name,
-		Cols:    cols,
-		Types:   types,
-		Indexes: indexes,
+		Name:          name,
+		Cols:          cols,
+		Types:         types,
+		PrimaryKey:    pk,
+		AutoIncrement: autoIncrement,
+		NotNull:       notNull,
+		Defaults:      defaults,
+		Checks:        checks,
+		Indexes:       indexes,
+		Unique:        unique,
+		Foreign:       foreign,
+		TTL:           strings.TrimSpace(ttl),
 	}
 	return tdef
 }
@@ -65,19 +195,39 @@ func PrintWelcomeMessage(isWelcome bool) {
 	}
 	fmt.Println("Available Commands You can use:")
 	fmt.Println("  CREATE       - Create a new table")
+	fmt.Println("  ALTER        - Add, drop or rename a column of a table")
+	fmt.Println("  DROP         - Drop a table with its rows and indexes")
+	fmt.Println("  INDEX        - Create or drop an index of an existing table")
+	fmt.Println("  RENAME       - Rename a table, optionally keeping the old name as an alias")
+	fmt.Println("  ALIAS        - List or drop the old table names kept by RENAME")
+	fmt.Println("  VIEW         - Create, drop or list views, read by GET, SCAN and the aggregates")
+	fmt.Println("  TRIGGER      - Create, drop or list the triggers of a table")
+	fmt.Println("  TTL          - Set, drop or show the row TTL of a table, or purge")
 	fmt.Println("  INSERT       - Add a record to a table")
 	fmt.Println("  DELETE       - Delete a record from a table")
-	fmt.Println("  GET          - Retrieve a record from a table")
+	fmt.Println("  GET          - Retrieve a record, optionally locking it in a transaction")
 	fmt.Println("  UPDATE       - Update a record in a table")
 	fmt.Println("  BEGIN        - Begin new transaction")
 	fmt.Println("  COMMIT       - Commit transaction")
 	fmt.Println("  ABORT        - Rollback transaction")
 	fmt.Println("  STATS        - Show database statistics")
+	fmt.Println("  TABLES       - List the tables with approximate row and page counts")
+	fmt.Println("  DESCRIBE     - Show the columns, types and constraints of a table")
+	fmt.Println("  INDEXES      - Show the indexes of a table with their prefixes and sizes")
+	fmt.Println("  TIMEOUT      - Show or change transaction timeouts")
+	fmt.Println("  HISTORY      - List versions readable with GET ... AS OF")
+	fmt.Println("  SNAPSHOT     - Create, drop or list named snapshots")
+	fmt.Println("  BRANCH       - Create, drop, list or switch branches")
+	fmt.Println("  ATTACH       - Attach another database file under an alias")
+	fmt.Println("  DETACH       - Detach a database file")
+	fmt.Println("  DATABASES    - List the main and attached database files")
+	fmt.Println("  SEQUENCE     - Create, drop or list sequences, or take a NEXTVAL")
+	fmt.Println("  SCHEMA       - Create, drop (CASCADE) or list schemas, named schema.table")
 	fmt.Println("  HELP         - List all commands")
 	fmt.Println("  EXIT         - Exit the program")
 	fmt.Println()
 	fmt.Println("AGGREGATE FUNCTIONS:")
-	fmt.Println("  COUNT        - Count records in a table")
+	fmt.Println("  COUNT        - Count records, or the non-NULL values of a column")
 	fmt.Println("  SUM          - Sum numeric values")
 	fmt.Println("  AVG          - Calculate averages")
 	fmt.Println("  MIN          - Find minimum values")